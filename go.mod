@@ -2,9 +2,13 @@ module orchid
 
 go 1.21.5
 
+require (
+	github.com/gofrs/flock v0.12.1
+	golang.org/x/net v0.30.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/gofrs/flock v0.12.1 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/cobra v1.8.1 // indirect
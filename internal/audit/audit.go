@@ -0,0 +1,127 @@
+// Package audit keeps an append-only JSON-lines record of orchestration runs.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"time"
+
+	"orchid/internal/ci"
+
+	"github.com/gofrs/flock"
+)
+
+// Record describes a single orchestration run
+type Record struct {
+	Timestamp   time.Time `json:"timestamp"`
+	User        string    `json:"user"`
+	Environment string    `json:"environment"`
+	Action      string    `json:"action"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+
+	PipelineID string `json:"pipeline_id,omitempty"`
+	CommitSHA  string `json:"commit_sha,omitempty"`
+	Project    string `json:"project,omitempty"`
+}
+
+// Writer appends records to an audit file. It is safe for use by multiple
+// processes at once.
+type Writer struct {
+	path string
+}
+
+func NewWriter(path string) *Writer {
+	return &Writer{path: path}
+}
+
+// Append writes rec as a single JSON line, filling in the timestamp, user
+// and CI metadata when they are not already set
+func (w *Writer) Append(rec Record) error {
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now().UTC()
+	}
+	if rec.User == "" {
+		rec.User = currentUser()
+	}
+	if rec.PipelineID == "" && rec.CommitSHA == "" && rec.Project == "" {
+		md := ci.Detect()
+		rec.PipelineID = md.PipelineID
+		rec.CommitSHA = md.CommitSHA
+		rec.Project = md.Project
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	// Lock a separate file, since Windows locks block writes to the locked
+	// file through other handles
+	lock := flock.New(w.path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("failed to lock audit file '%s': %w", w.path, err)
+	}
+	defer lock.Unlock()
+
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file '%s': %w", w.path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit file '%s': %w", w.path, err)
+	}
+
+	return nil
+}
+
+// Read returns the records in the audit file at path with a timestamp at or
+// after since. A zero since returns every record.
+func Read(path string, since time.Time) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	// Read whole lines rather than scanning, as records carry command output
+	// and can be far longer than a scanner's maximum token size
+	var records []Record
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read audit file '%s': %w", path, err)
+		}
+		eof := err != nil
+
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			var rec Record
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return nil, fmt.Errorf("failed to parse audit file '%s' line %d: %w", path, line, err)
+			}
+			if !rec.Timestamp.Before(since) {
+				records = append(records, rec)
+			}
+		}
+		if eof {
+			return records, nil
+		}
+	}
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gitlabPipeline makes ci.Detect report a GitLab pipeline for the rest of
+// the test
+func gitlabPipeline(t *testing.T) {
+	t.Helper()
+	t.Setenv("GITHUB_ACTIONS", "")
+	t.Setenv("JENKINS_URL", "")
+	t.Setenv("GITLAB_CI", "true")
+	t.Setenv("CI_PIPELINE_ID", "1234")
+	t.Setenv("CI_COMMIT_SHA", "abc123")
+	t.Setenv("CI_PROJECT_PATH", "ops/orchid")
+}
+
+func TestAppendFillsInRecord(t *testing.T) {
+	gitlabPipeline(t)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	w := NewWriter(path)
+
+	if err := w.Append(Record{Environment: "prod", Action: "up", Result: "failure", Error: "step web failed"}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	records, err := Read(path, time.Time{})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("records = %+v, want one", records)
+	}
+
+	rec := records[0]
+	if rec.Environment != "prod" || rec.Action != "up" || rec.Result != "failure" || rec.Error != "step web failed" {
+		t.Errorf("record = %+v, want the appended run", rec)
+	}
+	if rec.Timestamp.IsZero() || rec.User == "" {
+		t.Errorf("record = %+v, want the timestamp and user filled in", rec)
+	}
+	if rec.PipelineID != "1234" || rec.CommitSHA != "abc123" || rec.Project != "ops/orchid" {
+		t.Errorf("record = %+v, want the pipeline's CI metadata", rec)
+	}
+}
+
+func TestAppendConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Separate writers, as separate processes would have
+			if err := NewWriter(path).Append(Record{Environment: "prod", Action: "up", Result: "success"}); err != nil {
+				t.Errorf("Append: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	records, err := Read(path, time.Time{})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(records) != n {
+		t.Errorf("read %d records, want %d", len(records), n)
+	}
+}
+
+func TestReadSince(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	w := NewWriter(path)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, rec := range []Record{
+		{Timestamp: now.Add(-48 * time.Hour), Environment: "prod", Action: "up"},
+		{Timestamp: now.Add(-2 * time.Hour), Environment: "prod", Action: "down"},
+		{Timestamp: now.Add(-time.Hour), Environment: "staging", Action: "up"},
+		// Longer than a bufio.Scanner's default maximum token size
+		{Timestamp: now.Add(-time.Minute), Environment: "prod", Action: "up", Error: strings.Repeat("x", 128*1024)},
+	} {
+		if err := w.Append(rec); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		since time.Time
+		want  []string
+	}{
+		{name: "everything", want: []string{"prod up", "prod down", "staging up", "prod up"}},
+		{name: "last day", since: now.Add(-24 * time.Hour), want: []string{"prod down", "staging up", "prod up"}},
+		{name: "inclusive", since: now.Add(-time.Hour), want: []string{"staging up", "prod up"}},
+		{name: "nothing newer", since: now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := Read(path, tt.since)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			var got []string
+			for _, rec := range records {
+				got = append(got, rec.Environment+" "+rec.Action)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("records = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
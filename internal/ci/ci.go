@@ -0,0 +1,61 @@
+// Package ci detects the CI system orchid is running under, reads the
+// pipeline metadata it exposes and writes its log section markers.
+package ci
+
+import "os"
+
+// Metadata identifies the pipeline run that invoked orchid. Fields are empty
+// when not running under CI.
+type Metadata struct {
+	Provider   string `json:"provider,omitempty"`
+	PipelineID string `json:"pipeline_id,omitempty"`
+	CommitSHA  string `json:"commit_sha,omitempty"`
+	Project    string `json:"project,omitempty"`
+}
+
+// provider maps a CI system's environment variables onto Metadata
+type provider struct {
+	name     string
+	detect   string // set to a non-empty value when running under the provider
+	pipeline string
+	commit   string
+	project  string
+}
+
+var providers = []provider{
+	{name: "github", detect: "GITHUB_ACTIONS", pipeline: "GITHUB_RUN_ID", commit: "GITHUB_SHA", project: "GITHUB_REPOSITORY"},
+	{name: "jenkins", detect: "JENKINS_URL", pipeline: "BUILD_TAG", commit: "GIT_COMMIT", project: "JOB_NAME"},
+	{name: "gitlab", detect: "GITLAB_CI", pipeline: "CI_PIPELINE_ID", commit: "CI_COMMIT_SHA", project: "CI_PROJECT_PATH"},
+}
+
+// gitlab is also used when no provider is detected, since its variable
+// names are the ones orchid originally read
+var gitlab = providers[len(providers)-1]
+
+// Detect returns the metadata of the current CI run
+func Detect() Metadata {
+	return detect(os.Getenv)
+}
+
+func detect(getenv func(string) string) Metadata {
+	for _, p := range providers {
+		if getenv(p.detect) != "" {
+			return p.read(getenv)
+		}
+	}
+
+	md := gitlab.read(getenv)
+	if md.PipelineID == "" && md.CommitSHA == "" && md.Project == "" {
+		return Metadata{}
+	}
+	return md
+}
+
+func (p provider) read(getenv func(string) string) Metadata {
+	return Metadata{
+		Provider:   p.name,
+		PipelineID: getenv(p.pipeline),
+		CommitSHA:  getenv(p.commit),
+		Project:    getenv(p.project),
+	}
+}
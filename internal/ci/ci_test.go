@@ -0,0 +1,48 @@
+package ci
+
+import "testing"
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want Metadata
+	}{
+		{
+			name: "github actions",
+			env:  map[string]string{"GITHUB_ACTIONS": "true", "GITHUB_RUN_ID": "987", "GITHUB_SHA": "abc123", "GITHUB_REPOSITORY": "ops/orchid"},
+			want: Metadata{Provider: "github", PipelineID: "987", CommitSHA: "abc123", Project: "ops/orchid"},
+		},
+		{
+			name: "jenkins",
+			env:  map[string]string{"JENKINS_URL": "https://ci.example.com", "BUILD_TAG": "jenkins-deploy-12", "GIT_COMMIT": "def456", "JOB_NAME": "deploy"},
+			want: Metadata{Provider: "jenkins", PipelineID: "jenkins-deploy-12", CommitSHA: "def456", Project: "deploy"},
+		},
+		{
+			name: "gitlab",
+			env:  map[string]string{"GITLAB_CI": "true", "CI_PIPELINE_ID": "42", "CI_COMMIT_SHA": "0a1b2c", "CI_PROJECT_PATH": "ops/orchid"},
+			want: Metadata{Provider: "gitlab", PipelineID: "42", CommitSHA: "0a1b2c", Project: "ops/orchid"},
+		},
+		{
+			name: "detected provider wins over gitlab names",
+			env:  map[string]string{"GITHUB_ACTIONS": "true", "GITHUB_RUN_ID": "987", "CI_PIPELINE_ID": "42"},
+			want: Metadata{Provider: "github", PipelineID: "987"},
+		},
+		{
+			name: "gitlab names without a provider",
+			env:  map[string]string{"CI_PIPELINE_ID": "42"},
+			want: Metadata{Provider: "gitlab", PipelineID: "42"},
+		},
+		{
+			name: "not under ci",
+			env:  map[string]string{"HOME": "/root"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detect(func(key string) string { return tt.env[key] }); got != tt.want {
+				t.Errorf("detect = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package ci
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// Section formats accepted by NewSections
+const (
+	FormatGitLab = "gitlab"
+	FormatGitHub = "github"
+)
+
+// Sections writes the markers a CI system uses to fold a run's log into
+// collapsible sections. The markers must go to the same stream as the logs
+// they bracket.
+type Sections struct {
+	w      io.Writer
+	format string
+	now    func() time.Time
+}
+
+// NewSections returns Sections writing markers in format to w. An empty
+// format returns nil, which writes nothing.
+func NewSections(w io.Writer, format string) (*Sections, error) {
+	switch format {
+	case "":
+		return nil, nil
+	case FormatGitLab, FormatGitHub:
+		return &Sections{w: w, format: format, now: time.Now}, nil
+	default:
+		return nil, fmt.Errorf("invalid CI format %q: expected %q or %q", format, FormatGitLab, FormatGitHub)
+	}
+}
+
+// invalidSectionChars matches what GitLab does not allow in section names
+var invalidSectionChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// Start opens a section identified by name and shown as title
+func (s *Sections) Start(name, title string) {
+	if s == nil {
+		return
+	}
+	switch s.format {
+	case FormatGitLab:
+		fmt.Fprintf(s.w, "\x1b[0Ksection_start:%d:%s[collapsed=true]\r\x1b[0K%s\n",
+			s.now().Unix(), invalidSectionChars.ReplaceAllString(name, "_"), title)
+	case FormatGitHub:
+		fmt.Fprintf(s.w, "::group::%s\n", title)
+	}
+}
+
+// End closes the section opened by Start with the same name
+func (s *Sections) End(name string) {
+	if s == nil {
+		return
+	}
+	switch s.format {
+	case FormatGitLab:
+		fmt.Fprintf(s.w, "\x1b[0Ksection_end:%d:%s\r\x1b[0K\n",
+			s.now().Unix(), invalidSectionChars.ReplaceAllString(name, "_"))
+	case FormatGitHub:
+		fmt.Fprintln(s.w, "::endgroup::")
+	}
+}
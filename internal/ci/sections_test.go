@@ -0,0 +1,53 @@
+package ci
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSections(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: FormatGitLab,
+			want: "\x1b[0Ksection_start:1700000000:step_1_auth_service[collapsed=true]\r\x1b[0KStep 1: auth service\n" +
+				"\x1b[0Ksection_end:1700000000:step_1_auth_service\r\x1b[0K\n",
+		},
+		{
+			format: FormatGitHub,
+			want:   "::group::Step 1: auth service\n::endgroup::\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			s, err := NewSections(&buf, tt.format)
+			if err != nil {
+				t.Fatalf("NewSections: %v", err)
+			}
+			s.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+			s.Start("step_1_auth service", "Step 1: auth service")
+			s.End("step_1_auth service")
+			if buf.String() != tt.want {
+				t.Errorf("markers = %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSections(t *testing.T) {
+	s, err := NewSections(&bytes.Buffer{}, "")
+	if s != nil || err != nil {
+		t.Errorf("NewSections with no format = %v, %v, want nil", s, err)
+	}
+	s.Start("step", "Step") // A nil Sections writes nothing
+	s.End("step")
+
+	if _, err := NewSections(&bytes.Buffer{}, "jenkins"); err == nil {
+		t.Error("NewSections accepted an unknown format")
+	}
+}
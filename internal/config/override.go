@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Override replaces one step command in the named environment, given as a
+// step.field=command assignment such as web.start="/opt/web/start.sh --debug".
+// Only the commands the step's type runs may be replaced: start, stop and
+// check for services and run for command and smoke steps. It returns the
+// command that was replaced.
+func (c *Config) Override(envName, assignment string) (string, error) {
+	target, command, ok := strings.Cut(assignment, "=")
+	if !ok {
+		return "", fmt.Errorf("invalid override %q: expected step.field=command", assignment)
+	}
+	stepName, field, ok := strings.Cut(target, ".")
+	if !ok || stepName == "" || field == "" {
+		return "", fmt.Errorf("invalid override %q: expected step.field=command", assignment)
+	}
+	if command == "" {
+		return "", fmt.Errorf("invalid override %q: the command is empty", assignment)
+	}
+
+	env, ok := c.Environments[envName]
+	if !ok {
+		return "", fmt.Errorf("environment %s not found", envName)
+	}
+
+	for i := range env.Sequence {
+		step := &env.Sequence[i]
+		if step.Name != stepName {
+			continue
+		}
+
+		var cmd *string
+		switch step.Type {
+		case "application", "dependency":
+			switch field {
+			case "start":
+				cmd = &step.Start
+			case "stop":
+				cmd = &step.Stop
+			case "check":
+				cmd = &step.Check
+			}
+		case "command", "smoke":
+			if field == "run" {
+				cmd = &step.Run
+			}
+		}
+		if cmd == nil {
+			return "", fmt.Errorf("invalid override %q: %s steps have no %s command to override", assignment, step.Type, field)
+		}
+
+		previous := *cmd
+		*cmd = command
+		return previous, nil
+	}
+	return "", fmt.Errorf("invalid override %q: step %s not found in environment %s", assignment, stepName, envName)
+}
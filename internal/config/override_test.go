@@ -0,0 +1,75 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOverride(t *testing.T) {
+	const data = `
+environments:
+  prod:
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - {name: web, type: application, start: systemctl start web, stop: systemctl stop web, check: curl -f localhost}
+      - {name: migrate, type: command, run: ./migrate.sh}
+`
+	tests := []struct {
+		name       string
+		env        string
+		assignment string
+		want       func(Environment) string
+		wantValue  string
+		previous   string
+		wantErr    string
+	}{
+		{
+			name:       "service command",
+			env:        "prod",
+			assignment: `web.start=/opt/web/start.sh --debug --level=2`,
+			want:       func(e Environment) string { return e.Sequence[0].Start },
+			wantValue:  "/opt/web/start.sh --debug --level=2",
+			previous:   "systemctl start web",
+		},
+		{
+			name:       "command step",
+			env:        "prod",
+			assignment: "migrate.run=./migrate.sh --dry-run",
+			want:       func(e Environment) string { return e.Sequence[1].Run },
+			wantValue:  "./migrate.sh --dry-run",
+			previous:   "./migrate.sh",
+		},
+		{name: "unknown step", env: "prod", assignment: "api.start=x", wantErr: "step api not found in environment prod"},
+		{name: "field of another type", env: "prod", assignment: "web.run=x", wantErr: "application steps have no run command"},
+		{name: "unknown field", env: "prod", assignment: "migrate.start=x", wantErr: "command steps have no start command"},
+		{name: "no field", env: "prod", assignment: "web=x", wantErr: "expected step.field=command"},
+		{name: "no command", env: "prod", assignment: "web.start", wantErr: "expected step.field=command"},
+		{name: "empty command", env: "prod", assignment: "web.start=", wantErr: "the command is empty"},
+		{name: "unknown environment", env: "qa", assignment: "web.start=x", wantErr: "environment qa not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadYAML(t, data)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			previous, err := cfg.Override(tt.env, tt.assignment)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Override: %v", err)
+			}
+			if previous != tt.previous {
+				t.Errorf("previous = %q, want %q", previous, tt.previous)
+			}
+			if got := tt.want(cfg.Environments["prod"]); got != tt.wantValue {
+				t.Errorf("command = %q, want %q", got, tt.wantValue)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// resolve normalises a freshly parsed configuration so the rest of orchid
+// only ever sees concrete host names in each step
+func (c *Config) resolve() error {
+	names := make([]string, 0, len(c.Environments))
+	for name := range c.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		env := c.Environments[name]
+		env.applyDefaults()
+		if err := env.checkStepFields(); err != nil {
+			return fmt.Errorf("environment %s: %w", name, err)
+		}
+		if err := env.expandGroups(); err != nil {
+			return fmt.Errorf("environment %s: %w", name, err)
+		}
+		c.Environments[name] = env
+	}
+	return nil
+}
+
+// applyDefaults fills in commands a step leaves empty from the environment
+// defaults. Services only inherit start/stop/check and commands only run, so
+// a default for one kind of step never leaks into another. Every step
+// inherits the environment's shell.
+func (e *Environment) applyDefaults() {
+	inherit := func(field *string, def string) {
+		if *field == "" {
+			*field = def
+		}
+	}
+
+	for i := range e.Sequence {
+		step := &e.Sequence[i]
+		inherit(&step.Shell, e.Shell)
+		switch step.Type {
+		case "application", "dependency":
+			inherit(&step.Start, e.Defaults.Start)
+			inherit(&step.Check, e.Defaults.Check)
+			inherit(&step.Stop, e.Defaults.Stop)
+		case "command", "smoke":
+			inherit(&step.Run, e.Defaults.Run)
+		}
+	}
+}
+
+// checkStepFields reports every step that sets commands its type doesn't
+// use or lacks ones it needs, which usually means the wrong type was given.
+// It runs after applyDefaults so inherited commands count.
+func (e *Environment) checkStepFields() error {
+	var errs []error
+	for _, step := range e.Sequence {
+		var forbidden, missing []string
+		switch step.Type {
+		case "application", "dependency":
+			if step.Start == "" {
+				missing = append(missing, "start")
+			}
+			if step.Stop == "" {
+				missing = append(missing, "stop")
+			}
+			if step.Check == "" {
+				missing = append(missing, "check")
+			}
+			if step.Run != "" {
+				forbidden = append(forbidden, "run")
+			}
+			if step.PreRun != "" {
+				forbidden = append(forbidden, "pre_run")
+			}
+			if step.PostRun != "" {
+				forbidden = append(forbidden, "post_run")
+			}
+		case "command", "smoke":
+			if step.Run == "" {
+				missing = append(missing, "run")
+			}
+			if step.Start != "" {
+				forbidden = append(forbidden, "start")
+			}
+			if step.Stop != "" {
+				forbidden = append(forbidden, "stop")
+			}
+			if step.Check != "" {
+				forbidden = append(forbidden, "check")
+			}
+			if step.StoppedCheck != "" {
+				forbidden = append(forbidden, "stopped_check")
+			}
+			if step.Background {
+				forbidden = append(forbidden, "background")
+			}
+			if step.RollbackCommand != "" {
+				forbidden = append(forbidden, "rollback_command")
+			}
+		}
+		if step.FailFast && step.MaxFailures != "" {
+			errs = append(errs, fmt.Errorf("step %s sets both fail_fast and max_failures", step.Name))
+		}
+		if len(missing) > 0 {
+			errs = append(errs, fmt.Errorf("%s step %s is missing %s", step.Type, step.Name, strings.Join(missing, ", ")))
+		}
+		if len(forbidden) > 0 {
+			errs = append(errs, fmt.Errorf("%s step %s sets %s, used only by %s steps",
+				step.Type, step.Name, strings.Join(forbidden, ", "), otherKind(step.Type)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// otherKind names the step types that use the commands a step of typ may not
+func otherKind(typ string) string {
+	if typ == "command" || typ == "smoke" {
+		return "application and dependency"
+	}
+	return "command and smoke"
+}
+
+// expandGroups replaces group references in each step's hosts with the
+// group's members, dropping duplicates while keeping first-seen order. A step
+// that omits hosts runs on every host in the environment.
+func (e *Environment) expandGroups() error {
+	for group, members := range e.Groups {
+		if _, ok := e.Hosts[group]; ok {
+			return fmt.Errorf("group %s has the same name as a host", group)
+		}
+		for _, member := range members {
+			if _, ok := e.Hosts[member]; !ok {
+				return fmt.Errorf("group %s references unknown host %s", group, member)
+			}
+		}
+	}
+
+	for i, step := range e.Sequence {
+		if step.Hosts == nil {
+			e.Sequence[i].Hosts = e.hostNames()
+			continue
+		}
+		if len(step.Hosts) == 0 {
+			return fmt.Errorf("step %s has an empty hosts list; omit hosts to use every host", step.Name)
+		}
+
+		var hosts []string
+		seen := make(map[string]bool)
+		add := func(host string) {
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+
+		for _, ref := range step.Hosts {
+			if members, ok := e.Groups[ref]; ok {
+				for _, member := range members {
+					add(member)
+				}
+				continue
+			}
+			if _, ok := e.Hosts[ref]; !ok {
+				return fmt.Errorf("step %s references unknown host or group %s", step.Name, ref)
+			}
+			add(ref)
+		}
+
+		e.Sequence[i].Hosts = hosts
+	}
+	return nil
+}
+
+// hostNames returns the names of every host in the environment, sorted
+func (e *Environment) hostNames() []string {
+	names := make([]string, 0, len(e.Hosts))
+	for name := range e.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// loadYAML loads data as a config file
+func loadYAML(t *testing.T, data string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "orchid.yml")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return LoadConfig(path)
+}
+
+func TestExpandGroups(t *testing.T) {
+	const hosts = `
+environments:
+  prod:
+    hosts:
+      web1: {hostname: web1.example.com}
+      web2: {hostname: web2.example.com}
+      db1: {hostname: db1.example.com}
+    groups:
+      web: [web1, web2]
+      all: [db1, web1, web2]
+`
+	tests := []struct {
+		name    string
+		hosts   string
+		want    []string
+		wantErr string
+	}{
+		{name: "group", hosts: "[web]", want: []string{"web1", "web2"}},
+		{name: "mixed", hosts: "[db1, web]", want: []string{"db1", "web1", "web2"}},
+		{name: "duplicates dropped", hosts: "[web1, web, all]", want: []string{"web1", "web2", "db1"}},
+		{name: "unknown group", hosts: "[cache]", wantErr: "unknown host or group cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadYAML(t, hosts+`    sequence:
+      - {name: app, type: command, run: deploy, hosts: `+tt.hosts+`}
+`)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if got := cfg.Environments["prod"].Sequence[0].Hosts; !slices.Equal(got, tt.want) {
+				t.Errorf("hosts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		groups  string
+		wantErr string
+	}{
+		{name: "unknown member", groups: "web: [web1, web9]", wantErr: "group web references unknown host web9"},
+		{name: "shadows host", groups: "web1: [web1]", wantErr: "group web1 has the same name as a host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadYAML(t, `
+environments:
+  prod:
+    hosts:
+      web1: {hostname: web1.example.com}
+    groups:
+      `+tt.groups+`
+    sequence:
+      - {name: app, type: command, run: deploy, hosts: [web1]}
+`)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStepDefaults(t *testing.T) {
+	cfg, err := loadYAML(t, `
+environments:
+  prod:
+    hosts:
+      app1: {hostname: app1.example.com}
+    defaults:
+      start: systemctl start {{.Name}}
+      stop: systemctl stop {{.Name}}
+      check: systemctl is-active {{.Name}}
+      run: make {{.Name}}
+    sequence:
+      - {name: api, type: application}
+      - {name: web, type: application, start: "web-start --host {{.Host}}", check: curl -f localhost}
+      - {name: migrate, type: command}
+      - {name: seed, type: command, run: ./seed.sh}
+`)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	tests := []struct {
+		step               string
+		start, stop, check string
+		run                string
+	}{
+		{step: "api", start: "systemctl start {{.Name}}", stop: "systemctl stop {{.Name}}", check: "systemctl is-active {{.Name}}"},
+		{step: "web", start: "web-start --host {{.Host}}", stop: "systemctl stop {{.Name}}", check: "curl -f localhost"},
+		{step: "migrate", run: "make {{.Name}}"},
+		{step: "seed", run: "./seed.sh"},
+	}
+	sequence := cfg.Environments["prod"].Sequence
+	for i, tt := range tests {
+		got := sequence[i]
+		if got.Name != tt.step {
+			t.Fatalf("step %d = %s, want %s", i, got.Name, tt.step)
+		}
+		if got.Start != tt.start || got.Stop != tt.stop || got.Check != tt.check || got.Run != tt.run {
+			t.Errorf("%s: start=%q stop=%q check=%q run=%q, want start=%q stop=%q check=%q run=%q",
+				tt.step, got.Start, got.Stop, got.Check, got.Run, tt.start, tt.stop, tt.check, tt.run)
+		}
+	}
+}
+
+func TestOmittedHosts(t *testing.T) {
+	const hosts = `
+environments:
+  prod:
+    hosts:
+      web2: {hostname: web2.example.com}
+      db1: {hostname: db1.example.com}
+      web1: {hostname: web1.example.com}
+    sequence:
+`
+	t.Run("omitted means every host", func(t *testing.T) {
+		cfg, err := loadYAML(t, hosts+"      - {name: app, type: command, run: deploy}\n")
+		if err != nil {
+			t.Fatalf("LoadConfig: %v", err)
+		}
+		got := slices.Clone(cfg.Environments["prod"].Sequence[0].Hosts)
+		slices.Sort(got)
+		if want := []string{"db1", "web1", "web2"}; !slices.Equal(got, want) {
+			t.Errorf("hosts = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("explicit empty list", func(t *testing.T) {
+		_, err := loadYAML(t, hosts+"      - {name: app, type: command, run: deploy, hosts: []}\n")
+		if err == nil || !strings.Contains(err.Error(), "omit hosts to use every host") {
+			t.Errorf("err = %v, want an empty hosts error", err)
+		}
+	})
+}
+
+func TestStepFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    string
+		wantErr []string
+	}{
+		{name: "application", step: `{name: api, type: application, start: a, stop: b, check: c}`},
+		{name: "command", step: `{name: api, type: command, run: a}`},
+		{name: "application missing start", step: `{name: api, type: application, stop: b, check: c}`, wantErr: []string{"application step api is missing start"}},
+		{name: "dependency missing everything", step: `{name: api, type: dependency}`, wantErr: []string{"dependency step api is missing start, stop, check"}},
+		{name: "application with run", step: `{name: api, type: application, start: a, stop: b, check: c, run: d}`, wantErr: []string{"application step api sets run, used only by command and smoke steps"}},
+		{name: "command missing run", step: `{name: api, type: command}`, wantErr: []string{"command step api is missing run"}},
+		{name: "command with service commands", step: `{name: api, type: command, run: a, start: b, stop: c, check: d}`, wantErr: []string{"command step api sets start, stop, check, used only by application and dependency steps"}},
+		{name: "command with stopped_check", step: `{name: api, type: command, run: a, stopped_check: b}`, wantErr: []string{"command step api sets stopped_check"}},
+		{name: "command with background", step: `{name: api, type: command, run: a, background: true}`, wantErr: []string{"command step api sets background"}},
+		{name: "command with rollback_command", step: `{name: api, type: command, run: a, rollback_command: b}`, wantErr: []string{"command step api sets rollback_command"}},
+		{name: "fail_fast with max_failures", step: `{name: api, type: command, run: a, fail_fast: true, max_failures: 1}`, wantErr: []string{"step api sets both fail_fast and max_failures"}},
+		{
+			name:    "smoke missing and setting",
+			step:    `{name: api, type: smoke, check: d}`,
+			wantErr: []string{"smoke step api is missing run", "smoke step api sets check"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadYAML(t, `
+environments:
+  prod:
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - `+tt.step+`
+`)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("LoadConfig succeeded, want %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("err = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestShellDefault(t *testing.T) {
+	cfg, err := loadYAML(t, `
+environments:
+  prod:
+    shell: bash -l
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - {name: api, type: application, start: a, stop: b, check: c}
+      - {name: legacy, type: application, start: a, stop: b, check: c, shell: sh}
+  staging:
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - {name: api, type: application, start: a, stop: b, check: c}
+`)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	tests := []struct {
+		env  string
+		step int
+		want string
+	}{
+		{env: "prod", step: 0, want: "bash -l"},
+		{env: "prod", step: 1, want: "sh"},
+		{env: "staging", step: 0, want: ""},
+	}
+	for _, tt := range tests {
+		step := cfg.Environments[tt.env].Sequence[tt.step]
+		if step.Shell != tt.want {
+			t.Errorf("%s step %s shell = %q, want %q", tt.env, step.Name, step.Shell, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// StepTypes lists the valid values of Step.Type
+var StepTypes = []string{"dependency", "application", "command", "smoke"}
+
+// requiredFields lists the YAML keys that must be present, per struct type
+var requiredFields = map[reflect.Type][]string{
+	reflect.TypeOf(Host{}):  {"hostname"},
+	reflect.TypeOf(WinRM{}): {"user", "password_env"},
+	reflect.TypeOf(Step{}):  {"name", "type"},
+}
+
+// enumFields constrains individual YAML keys to a fixed set of values
+var enumFields = map[reflect.Type]map[string][]string{
+	reflect.TypeOf(Step{}): {"type": StepTypes},
+	reflect.TypeOf(Host{}): {"transport": Transports},
+}
+
+// Schema returns a JSON Schema describing the configuration file. It is
+// derived from the yaml tags of the config structs so it cannot drift from
+// what LoadConfig accepts.
+func Schema() map[string]any {
+	schema := schemaFor(reflect.TypeOf(Config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "orchid configuration"
+	return schema
+}
+
+func schemaFor(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return map[string]any{
+			"description": "duration such as 30s or 5m",
+			"type":        []string{"string", "integer"},
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		// YAML keys left empty, such as a sequence still to be written, are
+		// null and load as empty lists and maps
+		return map[string]any{"type": []string{"array", "null"}, "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": []string{"object", "null"}, "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return map[string]any{}
+	}
+}
+
+func structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+
+		prop := schemaFor(field.Type)
+		if values, ok := enumFields[t][name]; ok {
+			prop["enum"] = values
+		}
+		properties[name] = prop
+	}
+
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if required, ok := requiredFields[t]; ok {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validateSchema checks value, as decoded from YAML, against the subset of
+// JSON Schema that Schema emits, returning a description of each violation
+func validateSchema(schema map[string]any, value any, path string) []string {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := schema["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []string:
+			types = t
+		}
+		if !slices.Contains(types, jsonType(value)) {
+			fail("got %s, want %s", jsonType(value), strings.Join(types, " or "))
+			return problems
+		}
+	}
+	if enum, ok := schema["enum"].([]string); ok && !slices.Contains(enum, fmt.Sprint(value)) {
+		fail("%v is not one of %q", value, enum)
+	}
+
+	switch value := value.(type) {
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range value {
+				problems = append(problems, validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]string)
+		for _, key := range required {
+			if _, ok := value[key]; !ok {
+				fail("missing required %s", key)
+			}
+		}
+		for key, v := range value {
+			if prop, ok := properties[key].(map[string]any); ok {
+				problems = append(problems, validateSchema(prop, v, path+"."+key)...)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					fail("unknown key %s", key)
+				}
+			case map[string]any:
+				problems = append(problems, validateSchema(extra, v, path+"."+key)...)
+			}
+		}
+	}
+	return problems
+}
+
+func jsonType(value any) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int64, uint64:
+		return "integer"
+	case float64:
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return "null"
+	}
+}
+
+func TestSchemaValidatesConfigs(t *testing.T) {
+	examplePath := filepath.Join("..", "..", "orchid.yml")
+	example, err := os.ReadFile(examplePath)
+	if err != nil {
+		t.Fatalf("failed to read the example config: %v", err)
+	}
+	// The known-good config must be one orchid itself accepts
+	if _, err := LoadConfig(examplePath); err != nil {
+		t.Fatalf("LoadConfig rejected the example config: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		yaml string
+		want []string // Fragments of the expected problems, none for a valid config
+	}{
+		{name: "example config", yaml: string(example)},
+		{
+			name: "unknown step type",
+			yaml: `
+environments:
+  prod:
+    hosts:
+      web1: {hostname: web1.example.com}
+    sequence:
+      - {name: web, type: service, hosts: [web1], start: "systemctl start web"}
+`,
+			want: []string{"service is not one of"},
+		},
+		{
+			name: "missing hostname and misspelt key",
+			yaml: `
+environments:
+  prod:
+    hosts:
+      web1: {host: web1.example.com}
+`,
+			want: []string{"missing required hostname", "unknown key host"},
+		},
+		{
+			name: "wrong type",
+			yaml: `
+environments:
+  prod:
+    sequence:
+      - {name: web, type: application, hosts: web1}
+`,
+			want: []string{"got string, want array"},
+		},
+	}
+	schema := roundTrip(t, Schema())
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc any
+			if err := yaml.Unmarshal([]byte(tt.yaml), &doc); err != nil {
+				t.Fatalf("invalid YAML: %v", err)
+			}
+			problems := validateSchema(schema, doc, "$")
+			if len(tt.want) == 0 && len(problems) > 0 {
+				t.Fatalf("schema rejected a valid config:\n%s", strings.Join(problems, "\n"))
+			}
+			for _, want := range tt.want {
+				if !slices.ContainsFunc(problems, func(p string) bool { return strings.Contains(p, want) }) {
+					t.Errorf("problems = %q, want one mentioning %q", problems, want)
+				}
+			}
+		})
+	}
+}
+
+// roundTrip encodes schema as the schema command does and decodes it
+// again, normalising the types validateSchema sees to those of JSON
+func roundTrip(t *testing.T, schema map[string]any) map[string]any {
+	t.Helper()
+	data, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatalf("failed to encode the schema: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to decode the schema: %v", err)
+	}
+	return normalise(decoded).(map[string]any)
+}
+
+// normalise turns the []any of decoded string lists back into []string
+func normalise(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			v[key] = normalise(value)
+		}
+		return v
+	case []any:
+		strs := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return v
+			}
+			strs = append(strs, s)
+		}
+		return strs
+	default:
+		return v
+	}
+}
+
+// TestSchemaCoversConfigFields guards against config fields the schema
+// would reject: every field LoadConfig reads must be a schema property
+func TestSchemaCoversConfigFields(t *testing.T) {
+	for _, typ := range []reflect.Type{
+		reflect.TypeOf(Config{}),
+		reflect.TypeOf(Environment{}),
+		reflect.TypeOf(SSHDefaults{}),
+		reflect.TypeOf(Timeouts{}),
+		reflect.TypeOf(Host{}),
+		reflect.TypeOf(Step{}),
+		reflect.TypeOf(RunHook{}),
+	} {
+		properties := structSchema(typ)["properties"].(map[string]any)
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				t.Errorf("%s.%s has no yaml name, so the schema leaves it out", typ.Name(), field.Name)
+				continue
+			}
+			if _, ok := properties[name]; !ok {
+				t.Errorf("%s.%s (%s) is missing from the schema", typ.Name(), field.Name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CheckScriptCommand is the check of steps with a check_script. It saves the
+// script, which is sent on its stdin, to a temporary file, runs it and
+// removes the file whatever the outcome. The script runs directly, so it
+// should start with a #! line.
+//
+// The script is streamed to mktemp over the check's own session rather than
+// uploaded with SFTP. That needs no SFTP client or subsystem on the host,
+// keeps upload, run and cleanup in one command run as check_user, and lets
+// the trap remove the file even if the connection drops mid-check. mktemp
+// creates the file in $TMPDIR, or /tmp when that is unset, so on hosts that
+// mount /tmp noexec the check user's TMPDIR must name a directory scripts
+// can run from.
+const CheckScriptCommand = `trap 'rm -f "$f"' EXIT; f=$(mktemp) && cat > "$f" && chmod 700 "$f" && "$f"`
+
+// loadCheckScripts reads the check_script of every step in cfg, resolving
+// relative paths against dir, the directory of the file that defined them
+func (cfg *Config) loadCheckScripts(dir string) error {
+	var errs []error
+	for name, env := range cfg.Environments {
+		for i := range env.Sequence {
+			step := &env.Sequence[i]
+			if step.CheckScript == "" {
+				continue
+			}
+			if step.Check != "" {
+				errs = append(errs, fmt.Errorf("environment %s: step %s sets both check and check_script", name, step.Name))
+				continue
+			}
+			if step.RequestPTY {
+				// A terminal never delivers the end of the script to cat
+				errs = append(errs, fmt.Errorf("environment %s: step %s sets check_script, which can't be used with request_pty", name, step.Name))
+				continue
+			}
+
+			path := step.CheckScript
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			body, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("environment %s: step %s: failed to read check_script: %w", name, step.Name, err))
+				continue
+			}
+			step.CheckScript = path
+			step.CheckScriptBody = string(body)
+			step.Check = CheckScriptCommand
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCheckScripts(t *testing.T) {
+	const script = "#!/bin/sh\ncurl -fs localhost:8080/health\n"
+	tests := []struct {
+		name    string
+		step    string
+		wantErr string
+	}{
+		{name: "relative path", step: `{name: api, type: application, start: a, stop: b, check_script: checks/health.sh}`},
+		{name: "with check", step: `{name: api, type: application, start: a, stop: b, check: c, check_script: checks/health.sh}`, wantErr: "step api sets both check and check_script"},
+		{name: "with request_pty", step: `{name: api, type: application, start: a, stop: b, request_pty: true, check_script: checks/health.sh}`, wantErr: "step api sets check_script, which can't be used with request_pty"},
+		{name: "missing script", step: `{name: api, type: application, start: a, stop: b, check_script: checks/missing.sh}`, wantErr: "step api: failed to read check_script"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "checks"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "checks", "health.sh"), []byte(script), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "orchid.yml")
+			data := `
+environments:
+  prod:
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - ` + tt.step + `
+`
+			if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			step := cfg.Environments["prod"].Sequence[0]
+			if step.CheckScript != filepath.Join(dir, "checks", "health.sh") || step.CheckScriptBody != script || step.Check != CheckScriptCommand {
+				t.Errorf("step = %+v, want the script resolved against the config's directory and loaded", step)
+			}
+		})
+	}
+}
+
+func TestCheckScriptCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the command")
+	}
+	tests := []struct {
+		name       string
+		script     string
+		wantStatus int
+		wantOutput string
+	}{
+		{name: "healthy", script: "#!/bin/sh\necho healthy\n", wantOutput: "healthy\n"},
+		{name: "unhealthy", script: "#!/bin/sh\necho down\nexit 3\n", wantStatus: 3, wantOutput: "down\n"},
+		{name: "not a script", script: "plain text\n", wantStatus: 126},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The check runs the script as it would on a host, with the
+			// temporary file created in a directory the test can inspect
+			tmp := t.TempDir()
+			cmd := exec.Command("sh", "-c", CheckScriptCommand)
+			cmd.Env = append(os.Environ(), "TMPDIR="+tmp)
+			cmd.Stdin = strings.NewReader(tt.script)
+			out, err := cmd.Output()
+
+			status := 0
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				status = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if status != tt.wantStatus && !(tt.wantStatus == 126 && status != 0) {
+				t.Errorf("exit status = %d, want %d", status, tt.wantStatus)
+			}
+			if tt.wantOutput != "" && string(out) != tt.wantOutput {
+				t.Errorf("output = %q, want %q", out, tt.wantOutput)
+			}
+
+			// The temporary copy is removed whatever the outcome
+			entries, err := os.ReadDir(tmp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				t.Errorf("left %s behind", e.Name())
+			}
+		})
+	}
+}
@@ -3,57 +3,378 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type SSHDefaults struct {
-	User    string        `yaml:"user"`
-	Key     string        `yaml:"key"`
+	User string `yaml:"user"`
+	Key  string `yaml:"key"`
+
+	// ConnectTimeout bounds the TCP dial and SSH handshake. When unset it
+	// falls back to Timeout, which is what older configs used for dialing.
+	ConnectTimeout time.Duration `yaml:"connect_timeout,omitempty"`
+
+	// Timeout bounds the execution of each remote command
 	Timeout time.Duration `yaml:"timeout"`
+
+	// KnownHostsPath is the known_hosts file used when host keys are
+	// verified. Defaults to ~/.ssh/known_hosts.
+	KnownHostsPath string `yaml:"known_hosts,omitempty"`
+
+	// Proxy is a socks5:// URL to dial hosts through. When unset a socks5
+	// ALL_PROXY is used; "none" always dials directly.
+	Proxy string `yaml:"proxy,omitempty"`
+}
+
+// Timeouts overrides the orchestrator's default timeouts for an environment.
+// Timeouts given explicitly on the command line still take precedence.
+type Timeouts struct {
+	Operation           time.Duration `yaml:"operation,omitempty"`
+	HealthCheck         time.Duration `yaml:"health_check,omitempty"`
+	HealthCheckInterval time.Duration `yaml:"health_check_interval,omitempty"`
+
+	// StopVerifyDelay is how long down waits after stopping a service before
+	// checking that it stopped, for services that take a moment to exit
+	StopVerifyDelay time.Duration `yaml:"stop_verify_delay,omitempty"`
+
+	// StartWait is how long up waits after starting a service before its
+	// first health check, 5s by default
+	StartWait time.Duration `yaml:"start_wait,omitempty"`
+}
+
+// TransportSSH is the default Host.Transport
+const TransportSSH = "ssh"
+
+// TransportWinRM runs commands with PowerShell over WinRM, for Windows hosts
+const TransportWinRM = "winrm"
+
+// Transports lists the valid values of Host.Transport
+var Transports = []string{TransportSSH, TransportWinRM}
+
+// WinRM configures how hosts with transport winrm are connected to. Only
+// basic authentication is supported, so HTTPS should be used outside
+// trusted networks.
+type WinRM struct {
+	User        string `yaml:"user"`
+	PasswordEnv string `yaml:"password_env"` // Environment variable holding the password
+
+	// HTTPS connects on port 5986 instead of 5985. Insecure skips
+	// verifying the host's certificate.
+	HTTPS    bool `yaml:"https,omitempty"`
+	Insecure bool `yaml:"insecure,omitempty"`
 }
 
 type Host struct {
-	Hostname string `yaml:"hostname"`
-	SSHUser  string `yaml:"ssh_user,omitempty"`
-	SSHKey   string `yaml:"ssh_key,omitempty"`
+	Hostname  string `yaml:"hostname"` // May include a port, as host:2222
+	SSHUser   string `yaml:"ssh_user,omitempty"`
+	SSHKey    string `yaml:"ssh_key,omitempty"`
+	Transport string `yaml:"transport,omitempty"` // Defaults to "ssh"
+
+	// Port is the SSH port when it isn't 22, or the WinRM port when it isn't
+	// the default for winrm.https, as an alternative to giving it in
+	// hostname. Setting both is an error.
+	Port int `yaml:"port,omitempty"`
+
+	// WinRM is required by hosts with transport winrm
+	WinRM *WinRM `yaml:"winrm,omitempty"`
+
+	// Priority orders the hosts of a step: higher priorities start first,
+	// and finish starting before lower ones begin, and stop last. Hosts of
+	// equal priority keep their config order.
+	Priority int `yaml:"priority,omitempty"`
+}
+
+// StepDefaults holds commands inherited by steps that don't set their own
+type StepDefaults struct {
+	Start string `yaml:"start,omitempty"`
+	Check string `yaml:"check,omitempty"`
+	Stop  string `yaml:"stop,omitempty"`
+	Run   string `yaml:"run,omitempty"`
 }
 
 type Step struct {
 	Name  string   `yaml:"name"`
-	Type  string   `yaml:"type"` // "dependency", "application", or "command"
-	Hosts []string `yaml:"hosts"`
+	Type  string   `yaml:"type"`  // "dependency", "application", "command", or "smoke"
+	Hosts []string `yaml:"hosts"` // Omitted means every host in the environment
+	Tags  []string `yaml:"tags,omitempty"`
 
 	Start string `yaml:"start,omitempty"`
 	Check string `yaml:"check,omitempty"`
 	Stop  string `yaml:"stop,omitempty"`
 	Run   string `yaml:"run,omitempty"`
+
+	// When is run before up handles the step, which is skipped unless it
+	// exits 0 on every host, such as a migration that only runs below a
+	// given schema version
+	When string `yaml:"when,omitempty"`
+
+	// PreRun and PostRun surround a command step's run on each host. The
+	// three run in order over the host's connection and the first to fail
+	// stops the rest, so post_run only runs after run succeeds.
+	PreRun  string `yaml:"pre_run,omitempty"`
+	PostRun string `yaml:"post_run,omitempty"`
+
+	// CheckScript is a local script, relative to the config file, used as
+	// the check: it is copied to a temporary file on each host, run there
+	// and removed again, as CheckScriptCommand describes. Hosts with a
+	// noexec /tmp need TMPDIR set for the check user. CheckScriptBody holds
+	// its contents once loaded.
+	CheckScript     string `yaml:"check_script,omitempty"`
+	CheckScriptBody string `yaml:"-"`
+
+	// HostChecks replaces check on the hosts it names, for hosts where the
+	// service runs differently, such as under another supervisor
+	HostChecks map[string]string `yaml:"host_checks,omitempty"`
+
+	// Per-command SSH users, overriding the host and environment user
+	StartUser string `yaml:"start_user,omitempty"`
+	CheckUser string `yaml:"check_user,omitempty"`
+	StopUser  string `yaml:"stop_user,omitempty"`
+
+	// RequestPTY allocates a pseudo-terminal for the step's commands, for
+	// tools like sudo that refuse to run without one
+	RequestPTY bool `yaml:"request_pty,omitempty"`
+
+	// Background runs start detached with nohup and returns once it has been
+	// launched, for start commands that stay in the foreground and would
+	// otherwise hold the SSH session open. Other commands are unaffected.
+	Background bool `yaml:"background,omitempty"`
+
+	// Shell runs the step's commands as `<shell> -c '<command>'`, such as
+	// "bash -l", overriding the environment's shell. Unset runs them through
+	// the remote user's login shell.
+	Shell string `yaml:"shell,omitempty"`
+
+	// Canary starts hosts in batches of this size, either a count ("1") or
+	// a percentage of the step's hosts ("10%"), health checking each batch
+	// before moving on
+	Canary string `yaml:"canary,omitempty"`
+
+	// Serial starts and stops the step's hosts one at a time instead of all
+	// at once, waiting HostInterval between hosts
+	Serial       bool          `yaml:"serial,omitempty"`
+	HostInterval time.Duration `yaml:"host_interval,omitempty"`
+
+	// FailFast cancels the commands still running on the step's other hosts
+	// as soon as start or run fails on one, and starts no further hosts,
+	// instead of waiting for every host before failing the step
+	FailFast bool `yaml:"fail_fast,omitempty"`
+
+	// MaxFailures lets a command step succeed despite failing on up to this
+	// many hosts, either a count ("2") or a percentage of its hosts ("10%")
+	MaxFailures string `yaml:"max_failures,omitempty"`
+
+	// RollbackOnFailure set to false makes a failing command step abort the
+	// run without rolling back the services started before it. Only
+	// informational commands should opt out; unset means true.
+	RollbackOnFailure *bool `yaml:"rollback_on_failure,omitempty"`
+
+	// Drain is polled on each host before down stops the service until it
+	// succeeds, for services that must leave a load balancer and finish
+	// their connections first. After DrainTimeout, which defaults to the
+	// health check timeout, the service is stopped regardless.
+	Drain        string        `yaml:"drain,omitempty"`
+	DrainTimeout time.Duration `yaml:"drain_timeout,omitempty"`
+
+	// StopVerifyDelay overrides the environment's timeouts.stop_verify_delay
+	// for this step
+	StopVerifyDelay time.Duration `yaml:"stop_verify_delay,omitempty"`
+
+	// StartWait overrides the environment's timeouts.start_wait for this
+	// step
+	StartWait time.Duration `yaml:"start_wait,omitempty"`
+
+	// RollbackCommand replaces stop when a failed up rolls the service back,
+	// such as to redeploy the previous version instead of leaving the
+	// service down. It runs as stop_user.
+	RollbackCommand string `yaml:"rollback_command,omitempty"`
+
+	// StoppedCheck succeeds once the service is gone, and is used to verify
+	// a stop instead of expecting check to fail, for services whose check
+	// keeps passing briefly after they exit, such as on a lingering socket
+	StoppedCheck string `yaml:"stopped_check,omitempty"`
+
+	// DepReady is polled after a dependency's check passes when dependencies
+	// are only being verified, for readiness beyond liveness
+	DepReady string `yaml:"dep_ready,omitempty"`
+
+	// CheckExpect is a regular expression the check's output must match for
+	// the service to count as healthy, even when the check exits 0
+	CheckExpect string `yaml:"check_expect,omitempty"`
+
+	// HealthyExitCodes lists non-zero exit codes of check and dep_ready that
+	// still count as healthy, for scripts signalling "degraded but acceptable"
+	HealthyExitCodes []int `yaml:"healthy_exit_codes,omitempty"`
+
+	// Settle keeps re-running the check for this long after the health
+	// check first passes, failing the step if the service stops being
+	// healthy, for services that crash shortly after starting
+	Settle time.Duration `yaml:"settle,omitempty"`
+
+	// Grace ignores failed checks during the settle window until this long
+	// after the service was started, for services that briefly report
+	// unhealthy while they finish starting up
+	Grace time.Duration `yaml:"grace,omitempty"`
+
+	// DependsOn names earlier steps whose services must pass their check
+	// before up runs this step. A failing soft dependency in SoftDependsOn
+	// only logs a warning.
+	DependsOn     []string `yaml:"depends_on,omitempty"`
+	SoftDependsOn []string `yaml:"soft_depends_on,omitempty"`
+
+	// Diagnostics is run on the step's hosts when the step fails, before
+	// anything is rolled back, such as to capture recent logs and the process
+	// list. Its output is saved in the run report.
+	Diagnostics string `yaml:"diagnostics,omitempty"`
+
+	// LogCommand prints the service's logs, such as "tail -f" of its log
+	// file, for orchid logs to follow on each of the step's hosts
+	LogCommand string `yaml:"log_command,omitempty"`
+
+	// Checkpoint marks a stable boundary; rollback leaves this step and
+	// everything before it running
+	Checkpoint bool `yaml:"checkpoint,omitempty"`
+}
+
+// RunHook is a command run once before or after a whole up or down
+type RunHook struct {
+	Run  string `yaml:"run"`
+	Host string `yaml:"host,omitempty"` // Omitted runs the command locally with sh
 }
 
 type Environment struct {
 	SSHDefaults SSHDefaults     `yaml:"ssh_defaults"`
 	Hosts       map[string]Host `yaml:"hosts"`
 	Sequence    []Step          `yaml:"sequence"`
+	Rollback    *bool           `yaml:"rollback,omitempty"` // Defaults to true when unset
+	Timeouts    Timeouts        `yaml:"timeouts,omitempty"`
+
+	// Defaults supplies start/stop/check to service steps and run to command
+	// steps that leave them empty. Commands may use {{.Name}}, {{.Host}} and
+	// {{.Vars.name}}.
+	Defaults StepDefaults `yaml:"defaults,omitempty"`
+
+	// Groups names sets of hosts that steps can reference in place of
+	// listing each host
+	Groups map[string][]string `yaml:"groups,omitempty"`
+
+	// AllowedCommands restricts start/stop/check/run to commands fully
+	// matching one of these regular expressions. Empty allows everything.
+	AllowedCommands []string `yaml:"allowed_commands,omitempty"`
+
+	// Shell is the default for steps that don't set their own, and is used
+	// for ad-hoc commands run with exec
+	Shell string `yaml:"shell,omitempty"`
+
+	// Redact lists regular expressions matching secrets, such as
+	// "token=\S+", that are masked in logs, streamed output and transcripts
+	Redact []string `yaml:"redact,omitempty"`
+
+	// Vars are environment-wide values available to every command template
+	// as {{.Vars.name}}
+	Vars map[string]string `yaml:"vars,omitempty"`
+
+	// Run hooks surround a whole up or down. A failing pre hook stops the
+	// run before anything is touched. Post hooks run whether the run
+	// succeeded or failed, including by its pre hook, with the outcome in
+	// $ORCHID_RESULT and $ORCHID_ERROR.
+	PreUp    *RunHook `yaml:"pre_up,omitempty"`
+	PostUp   *RunHook `yaml:"post_up,omitempty"`
+	PreDown  *RunHook `yaml:"pre_down,omitempty"`
+	PostDown *RunHook `yaml:"post_down,omitempty"`
 }
 
 type Config struct {
 	Environments map[string]Environment `yaml:"environments"`
 }
 
+// LoadConfig reads the configuration from filePath. When filePath is a
+// directory, every .yml, .yaml and .json file in it is read in name order and
+// their environments merged; an environment may only be defined once.
 func LoadConfig(filePath string) (*Config, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file '%s': %w", filePath, err)
+	}
+
+	var cfg *Config
+	if info.IsDir() {
+		cfg, err = loadDir(filePath)
+	} else {
+		cfg, err = loadFile(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.resolve(); err != nil {
+		return nil, fmt.Errorf("invalid config file '%s': %w", filePath, err)
+	}
+
+	return cfg, nil
+}
+
+func loadFile(filePath string) (*Config, error) {
 	// Read the YAML configuration file
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file '%s': %w", filePath, err)
 	}
 
-	// Unmarshal the YAML into the Config struct
+	// Unmarshal the YAML into the Config struct. JSON is valid YAML, so
+	// .json files are parsed the same way.
 	var cfg Config
 	err = yaml.Unmarshal(data, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse config file '%s': %w", filePath, err)
 	}
 
+	if err := cfg.loadCheckScripts(filepath.Dir(filePath)); err != nil {
+		return nil, fmt.Errorf("invalid config file '%s': %w", filePath, err)
+	}
+
 	return &cfg, nil
 }
+
+// loadDir merges the config files in dir, rejecting environments defined in
+// more than one of them
+func loadDir(dir string) (*Config, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config directory '%s': %w", dir, err)
+	}
+
+	merged := &Config{Environments: make(map[string]Environment)}
+	definedIn := make(map[string]string)
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".yml", ".yaml", ".json":
+		default:
+			continue
+		}
+		if entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		cfg, err := loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, env := range cfg.Environments {
+			if other, ok := definedIn[name]; ok {
+				return nil, fmt.Errorf("environment %s is defined in both '%s' and '%s'", name, other, path)
+			}
+			definedIn[name] = path
+			merged.Environments[name] = env
+		}
+	}
+
+	if len(definedIn) == 0 {
+		return nil, fmt.Errorf("config directory '%s' has no .yml, .yaml or .json files defining environments", dir)
+	}
+	return merged, nil
+}
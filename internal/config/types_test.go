@@ -0,0 +1,96 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, by name, to a new directory and returns it
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	const staging = `
+environments:
+  staging:
+    hosts:
+      app1: {hostname: app1.staging}
+    sequence:
+      - {name: api, type: application, start: start api, stop: stop api, check: check api}
+`
+	const prod = `{"environments": {"prod": {"hosts": {"app1": {"hostname": "app1.prod"}}, "sequence": [{"name": "migrate", "type": "command", "run": "migrate"}]}}}`
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "merged",
+			files: map[string]string{
+				"staging.yml":         staging,
+				"prod.json":           prod,
+				"README.md":           "not config",
+				"archive.yml/old.yml": staging, // Directories are skipped
+			},
+			want: []string{"prod", "staging"},
+		},
+		{
+			name:    "duplicate environment",
+			files:   map[string]string{"a.yaml": staging, "b.yml": staging},
+			wantErr: "environment staging is defined in both",
+		},
+		{
+			name:    "no config files",
+			files:   map[string]string{"README.md": "not config"},
+			wantErr: "has no .yml, .yaml or .json files",
+		},
+		{
+			name:    "invalid fragment",
+			files:   map[string]string{"staging.yml": staging, "broken.yml": "environments: ["},
+			wantErr: "broken.yml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeFiles(t, tt.files))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			var names []string
+			for name := range cfg.Environments {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("environments = %q, want %q", names, tt.want)
+			}
+			if got := cfg.Environments["prod"].Hosts["app1"].Hostname; got != "app1.prod" {
+				t.Errorf("prod app1 = %q, want the JSON fragment's host", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Validate reports problems LoadConfig tolerates but that would make a run
+// fail part way through, such as unknown step types or bad allowed_commands
+// patterns. All problems are returned together.
+func (c *Config) Validate() error {
+	names := make([]string, 0, len(c.Environments))
+	for name := range c.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		env := c.Environments[name]
+		for _, err := range env.validate() {
+			errs = append(errs, fmt.Errorf("environment %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *Environment) validate() []error {
+	var errs []error
+
+	for _, name := range e.hostNames() {
+		if transport := e.Hosts[name].Transport; transport != "" && !slices.Contains(Transports, transport) {
+			errs = append(errs, fmt.Errorf("host %s has unsupported transport %q: supported transports are %s", name, transport, strings.Join(Transports, ", ")))
+		}
+		if err := e.Hosts[name].validateWinRM(); err != nil {
+			errs = append(errs, fmt.Errorf("host %s %w", name, err))
+		}
+		if err := e.Hosts[name].validatePort(); err != nil {
+			errs = append(errs, fmt.Errorf("host %s %w", name, err))
+		}
+	}
+
+	for _, hook := range []struct {
+		key  string
+		hook *RunHook
+	}{
+		{"pre_up", e.PreUp},
+		{"post_up", e.PostUp},
+		{"pre_down", e.PreDown},
+		{"post_down", e.PostDown},
+	} {
+		if hook.hook == nil {
+			continue
+		}
+		if hook.hook.Run == "" {
+			errs = append(errs, fmt.Errorf("%s has no run command", hook.key))
+		}
+		if _, ok := e.Hosts[hook.hook.Host]; hook.hook.Host != "" && !ok {
+			errs = append(errs, fmt.Errorf("%s references unknown host %s", hook.key, hook.hook.Host))
+		}
+	}
+
+	for _, pattern := range e.Redact {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("invalid redact pattern %q: %w", pattern, err))
+		}
+	}
+
+	seen := make(map[string]bool)
+	earlier := make(map[string]Step)
+	for i, step := range e.Sequence {
+		if step.Name == "" {
+			errs = append(errs, fmt.Errorf("step %d has no name", i+1))
+		} else if seen[step.Name] {
+			errs = append(errs, fmt.Errorf("step %s is defined more than once", step.Name))
+		}
+		seen[step.Name] = true
+
+		if !slices.Contains(StepTypes, step.Type) {
+			errs = append(errs, fmt.Errorf("step %s has unknown type %q", step.Name, step.Type))
+		}
+		if step.CheckExpect != "" {
+			if _, err := regexp.Compile(step.CheckExpect); err != nil {
+				errs = append(errs, fmt.Errorf("step %s has invalid check_expect %q: %w", step.Name, step.CheckExpect, err))
+			}
+		}
+		for _, field := range []struct {
+			key   string
+			names []string
+		}{{"depends_on", step.DependsOn}, {"soft_depends_on", step.SoftDependsOn}} {
+			for _, name := range field.names {
+				dep, ok := earlier[name]
+				switch {
+				case !ok:
+					errs = append(errs, fmt.Errorf("step %s %s %s, which is not an earlier step", step.Name, field.key, name))
+				case dep.Check == "" || (dep.Type != "application" && dep.Type != "dependency"):
+					errs = append(errs, fmt.Errorf("step %s %s %s, which is not a service with a check", step.Name, field.key, name))
+				}
+			}
+		}
+		for host := range step.HostChecks {
+			if !slices.Contains(step.Hosts, host) {
+				errs = append(errs, fmt.Errorf("step %s has a host_checks entry for %s, which is not one of its hosts", step.Name, host))
+			}
+		}
+		if step.RollbackOnFailure != nil && step.Type != "command" {
+			errs = append(errs, fmt.Errorf("step %s sets rollback_on_failure, which only applies to command steps", step.Name))
+		}
+		earlier[step.Name] = step
+	}
+
+	for _, pattern := range e.AllowedCommands {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("invalid allowed_commands pattern %q: %w", pattern, err))
+		}
+	}
+
+	return errs
+}
+
+// Warnings reports suspicious but valid settings, such as a check that
+// repeats the start command, which usually means a copy-paste mistake
+func (c *Config) Warnings() []string {
+	names := make([]string, 0, len(c.Environments))
+	for name := range c.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var warnings []string
+	for _, name := range names {
+		env := c.Environments[name]
+		for _, w := range env.warnings() {
+			warnings = append(warnings, fmt.Sprintf("environment %s: %s", name, w))
+		}
+	}
+	return warnings
+}
+
+func (e *Environment) warnings() []string {
+	var warnings []string
+	for _, step := range e.Sequence {
+		// Missing commands are rejected when the config is loaded
+		if step.Type != "application" && step.Type != "dependency" {
+			continue
+		}
+		switch step.Check {
+		case step.Start:
+			warnings = append(warnings, fmt.Sprintf("step %s uses the same command for check and start", step.Name))
+		case step.Stop:
+			warnings = append(warnings, fmt.Sprintf("step %s uses the same command for check and stop", step.Name))
+		}
+	}
+	return warnings
+}
+
+// validateWinRM checks that hosts have winrm settings exactly when they use
+// the winrm transport
+func (h Host) validateWinRM() error {
+	switch {
+	case h.Transport != TransportWinRM && h.WinRM != nil:
+		return errors.New("has winrm settings but does not use transport winrm")
+	case h.Transport != TransportWinRM:
+		return nil
+	case h.WinRM == nil:
+		return errors.New("uses transport winrm but has no winrm settings")
+	case h.WinRM.User == "" || h.WinRM.PasswordEnv == "":
+		return errors.New("needs winrm user and password_env")
+	}
+	return nil
+}
+
+func (h Host) validatePort() error {
+	if h.Port == 0 {
+		return nil
+	}
+	if h.Port < 0 || h.Port > 65535 {
+		return fmt.Errorf("has invalid port %d", h.Port)
+	}
+	if _, _, err := net.SplitHostPort(h.Hostname); err == nil {
+		return fmt.Errorf("sets port but its hostname %s already includes one", h.Hostname)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWarnings(t *testing.T) {
+	cfg, err := loadYAML(t, `
+environments:
+  prod:
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - {name: api, type: application, start: systemctl start api, stop: systemctl stop api, check: systemctl start api}
+      - {name: web, type: application, start: systemctl start web, stop: systemctl stop web, check: systemctl stop web}
+      - {name: db, type: dependency, start: systemctl start db, stop: systemctl stop db, check: systemctl is-active db}
+      - {name: migrate, type: command, run: systemctl start api}
+  staging:
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - {name: api, type: application, start: run-api, stop: stop-api, check: run-api}
+`)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	want := []string{
+		"environment prod: step api uses the same command for check and start",
+		"environment prod: step web uses the same command for check and stop",
+		"environment staging: step api uses the same command for check and start",
+	}
+	if got := cfg.Warnings(); !slices.Equal(got, want) {
+		t.Errorf("Warnings() = %q, want %q", got, want)
+	}
+}
+
+func TestMissingCheck(t *testing.T) {
+	_, err := loadYAML(t, `
+environments:
+  prod:
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - {name: api, type: application, start: systemctl start api, stop: systemctl stop api}
+`)
+	if err == nil || !strings.Contains(err.Error(), "check") {
+		t.Errorf("err = %v, want the missing check reported", err)
+	}
+}
+
+func TestValidateWinRM(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		wantErr string
+	}{
+		{name: "configured", host: `{hostname: win1, transport: winrm, winrm: {user: admin, password_env: WIN_PASSWORD, https: true}}`},
+		{name: "settings missing", host: `{hostname: win1, transport: winrm}`, wantErr: "host win1 uses transport winrm but has no winrm settings"},
+		{name: "password missing", host: `{hostname: win1, transport: winrm, winrm: {user: admin}}`, wantErr: "host win1 needs winrm user and password_env"},
+		{name: "settings without the transport", host: `{hostname: win1, winrm: {user: admin, password_env: WIN_PASSWORD}}`, wantErr: "host win1 has winrm settings but does not use transport winrm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadYAML(t, `
+environments:
+  prod:
+    hosts:
+      win1: `+tt.host+`
+    sequence:
+      - {name: iis, type: command, run: iisreset}
+`)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			err = cfg.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDependsOn(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    string
+		wantErr string
+	}{
+		{name: "earlier service", step: `{name: api, type: application, start: a, stop: b, check: c, depends_on: [db], soft_depends_on: [cache]}`},
+		{name: "later step", step: `{name: api, type: application, start: a, stop: b, check: c, depends_on: [web]}`, wantErr: "step api depends_on web, which is not an earlier step"},
+		{name: "unknown step", step: `{name: api, type: application, start: a, stop: b, check: c, soft_depends_on: [queue]}`, wantErr: "step api soft_depends_on queue, which is not an earlier step"},
+		{name: "command step", step: `{name: api, type: application, start: a, stop: b, check: c, depends_on: [migrate]}`, wantErr: "step api depends_on migrate, which is not a service with a check"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadYAML(t, `
+environments:
+  prod:
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - {name: db, type: dependency, start: a, stop: b, check: c}
+      - {name: cache, type: application, start: a, stop: b, check: c}
+      - {name: migrate, type: command, run: migrate}
+      - `+tt.step+`
+      - {name: web, type: application, start: a, stop: b, check: c}
+`)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			err = cfg.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateHostChecks(t *testing.T) {
+	cfg, err := loadYAML(t, `
+environments:
+  prod:
+    hosts:
+      app1: {hostname: app1.example.com}
+      app2: {hostname: app2.example.com}
+    sequence:
+      - {name: api, type: application, hosts: [app1], start: a, stop: b, check: c, host_checks: {app2: d}}
+`)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	err = cfg.Validate()
+	if want := "step api has a host_checks entry for app2, which is not one of its hosts"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+}
+
+func TestValidatePort(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		wantErr string
+	}{
+		{name: "default", host: `{hostname: app1.example.com}`},
+		{name: "custom", host: `{hostname: app1.example.com, port: 2222}`},
+		{name: "in hostname", host: `{hostname: "app1.example.com:2222"}`},
+		{name: "out of range", host: `{hostname: app1.example.com, port: 70000}`, wantErr: "host app1 has invalid port 70000"},
+		{name: "set twice", host: `{hostname: "app1.example.com:2222", port: 2200}`, wantErr: "host app1 sets port but its hostname app1.example.com:2222 already includes one"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadYAML(t, `
+environments:
+  prod:
+    hosts:
+      app1: `+tt.host+`
+    sequence:
+      - {name: migrate, type: command, hosts: [app1], run: migrate}
+`)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			err = cfg.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
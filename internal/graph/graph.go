@@ -0,0 +1,127 @@
+// Package graph renders an environment's step ordering as a diagram.
+package graph
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"orchid/internal/config"
+)
+
+// Edge kinds
+const (
+	EdgeSequence      = "sequence"        // To runs after From
+	EdgeDependsOn     = "depends_on"      // To requires From to be healthy
+	EdgeSoftDependsOn = "soft_depends_on" // To prefers From to be healthy
+)
+
+// Edge is a constraint between steps From and To
+type Edge struct {
+	From, To string
+	Kind     string
+}
+
+// Edges returns the constraints between the environment's steps. Steps run
+// in sequence order, so each step follows the one before it; depends_on and
+// soft_depends_on add edges from each dependency.
+func Edges(env config.Environment) []Edge {
+	var edges []Edge
+	for i, step := range env.Sequence {
+		if i > 0 {
+			edges = append(edges, Edge{From: env.Sequence[i-1].Name, To: step.Name, Kind: EdgeSequence})
+		}
+		for _, dep := range step.DependsOn {
+			edges = append(edges, Edge{From: dep, To: step.Name, Kind: EdgeDependsOn})
+		}
+		for _, dep := range step.SoftDependsOn {
+			edges = append(edges, Edge{From: dep, To: step.Name, Kind: EdgeSoftDependsOn})
+		}
+	}
+	return edges
+}
+
+// dotEdgeStyles and mermaidArrows draw each kind of edge
+var (
+	dotEdgeStyles = map[string]string{
+		EdgeDependsOn:     " [style=bold]",
+		EdgeSoftDependsOn: " [style=dashed]",
+	}
+	mermaidArrows = map[string]string{
+		EdgeSequence:      "-->",
+		EdgeDependsOn:     "==>",
+		EdgeSoftDependsOn: "-.->",
+	}
+)
+
+// dotShapes styles each step type in DOT output
+var dotShapes = map[string]string{
+	"dependency":  `shape=cylinder, style=filled, fillcolor="#dbe9f6"`,
+	"application": `shape=box, style="rounded,filled", fillcolor="#dff0d8"`,
+	"command":     `shape=parallelogram`,
+	"smoke":       `shape=hexagon, style=filled, fillcolor="#fcf8e3"`,
+}
+
+// DOT writes the environment's graph in Graphviz DOT format
+func DOT(w io.Writer, name string, env config.Environment) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", name)
+	b.WriteString("  rankdir=LR;\n")
+	known := make(map[string]bool, len(env.Sequence))
+	for _, step := range env.Sequence {
+		known[step.Name] = true
+		attrs := []string{fmt.Sprintf("label=%q", step.Name+"\n"+step.Type)}
+		if shape, ok := dotShapes[step.Type]; ok {
+			attrs = append(attrs, shape)
+		}
+		if step.Checkpoint {
+			attrs = append(attrs, "peripheries=2")
+		}
+		fmt.Fprintf(&b, "  %q [%s];\n", step.Name, strings.Join(attrs, ", "))
+	}
+	for _, e := range Edges(env) {
+		if !known[e.From] {
+			continue
+		}
+		fmt.Fprintf(&b, "  %q -> %q%s;\n", e.From, e.To, dotEdgeStyles[e.Kind])
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidShapes wraps a node label in the Mermaid syntax for each step type
+var mermaidShapes = map[string][2]string{
+	"dependency":  {"[(", ")]"},
+	"application": {"(", ")"},
+	"command":     {"[/", "/]"},
+	"smoke":       {"{{", "}}"},
+}
+
+// Mermaid writes the environment's graph as a Mermaid flowchart
+func Mermaid(w io.Writer, env config.Environment) error {
+	ids := make(map[string]string, len(env.Sequence))
+
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for i, step := range env.Sequence {
+		id := fmt.Sprintf("s%d", i+1)
+		ids[step.Name] = id
+
+		shape, ok := mermaidShapes[step.Type]
+		if !ok {
+			shape = [2]string{"[", "]"}
+		}
+		fmt.Fprintf(&b, "  %s%s\"%s<br/>%s\"%s\n", id, shape[0], step.Name, step.Type, shape[1])
+	}
+	for _, e := range Edges(env) {
+		if _, ok := ids[e.From]; !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "  %s %s %s\n", ids[e.From], mermaidArrows[e.Kind], ids[e.To])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,87 @@
+package graph
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+// sampleEnvironment has a dependency, two applications depending on it, a
+// command and a smoke test
+var sampleEnvironment = config.Environment{Sequence: []config.Step{
+	{Name: "db", Type: "dependency", Checkpoint: true},
+	{Name: "api", Type: "application", DependsOn: []string{"db"}},
+	{Name: "web", Type: "application", SoftDependsOn: []string{"api"}},
+	{Name: "migrate", Type: "command", DependsOn: []string{"missing"}},
+	{Name: "smoke", Type: "smoke"},
+}}
+
+func TestEdges(t *testing.T) {
+	want := []Edge{
+		{From: "db", To: "api", Kind: EdgeSequence},
+		{From: "db", To: "api", Kind: EdgeDependsOn},
+		{From: "api", To: "web", Kind: EdgeSequence},
+		{From: "api", To: "web", Kind: EdgeSoftDependsOn},
+		{From: "web", To: "migrate", Kind: EdgeSequence},
+		{From: "missing", To: "migrate", Kind: EdgeDependsOn},
+		{From: "migrate", To: "smoke", Kind: EdgeSequence},
+	}
+	if got := Edges(sampleEnvironment); !slices.Equal(got, want) {
+		t.Errorf("Edges = %v, want %v", got, want)
+	}
+}
+
+func TestDOT(t *testing.T) {
+	var b strings.Builder
+	if err := DOT(&b, "prod", sampleEnvironment); err != nil {
+		t.Fatalf("DOT: %v", err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		`digraph "prod" {`,
+		`"db" [label="db\ndependency", shape=cylinder, style=filled, fillcolor="#dbe9f6", peripheries=2];`,
+		`"api" [label="api\napplication", shape=box`,
+		`"migrate" [label="migrate\ncommand", shape=parallelogram];`,
+		`"smoke" [label="smoke\nsmoke", shape=hexagon`,
+		`"db" -> "api";`,
+		`"db" -> "api" [style=bold];`,
+		`"api" -> "web" [style=dashed];`,
+		`"migrate" -> "smoke";`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("DOT output is missing %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "missing") {
+		t.Errorf("DOT output has an edge from an unknown step:\n%s", out)
+	}
+}
+
+func TestMermaid(t *testing.T) {
+	var b strings.Builder
+	if err := Mermaid(&b, sampleEnvironment); err != nil {
+		t.Fatalf("Mermaid: %v", err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		"flowchart LR\n",
+		`s1[("db<br/>dependency")]`,
+		`s2("api<br/>application")`,
+		`s4[/"migrate<br/>command"/]`,
+		`s5{{"smoke<br/>smoke"}}`,
+		"s1 --> s2\n",
+		"s1 ==> s2\n",
+		"s2 -.-> s3\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Mermaid output is missing %s:\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "-->")+strings.Count(out, "==>")+strings.Count(out, "-.->") != 6 {
+		t.Errorf("Mermaid output should have 6 edges, skipping the unknown step's:\n%s", out)
+	}
+}
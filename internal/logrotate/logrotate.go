@@ -0,0 +1,111 @@
+// Package logrotate provides an io.Writer that rotates its file by size.
+package logrotate
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Writer appends to a file, rotating it to path.1, path.2, ... once it
+// reaches MaxSize bytes and keeping at most MaxBackups old files
+type Writer struct {
+	Path       string
+	MaxSize    int64 // Rotate once the file reaches this size; 0 disables rotation
+	MaxBackups int   // Number of rotated files to keep
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func New(path string, maxSize int64, maxBackups int) *Writer {
+	return &Writer{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.MaxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the current log file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file '%s': %w", w.Path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file '%s': %w", w.Path, err)
+	}
+
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// rotate shifts existing backups up by one, drops the oldest and starts a
+// fresh file
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file '%s': %w", w.Path, err)
+	}
+	w.file = nil
+
+	if w.MaxBackups <= 0 {
+		if err := os.Remove(w.Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove log file '%s': %w", w.Path, err)
+		}
+		return w.open()
+	}
+
+	os.Remove(w.backup(w.MaxBackups))
+	for i := w.MaxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(w.backup(i), w.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate log file '%s': %w", w.backup(i), err)
+		}
+	}
+	if err := os.Rename(w.Path, w.backup(1)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate log file '%s': %w", w.Path, err)
+	}
+
+	return w.open()
+}
+
+func (w *Writer) backup(n int) string {
+	return fmt.Sprintf("%s.%d", w.Path, n)
+}
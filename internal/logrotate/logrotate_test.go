@@ -0,0 +1,107 @@
+package logrotate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readFile returns the contents of path, or "" if it doesn't exist
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   string
+		maxSize    int64
+		maxBackups int
+		writes     []string
+		want       []string // The log file followed by its backups
+	}{
+		{
+			name:   "no rotation",
+			writes: []string{"one\n", "two\n"},
+			want:   []string{"one\ntwo\n"},
+		},
+		{
+			name:     "appends to an existing file",
+			existing: "old\n",
+			writes:   []string{"new\n"},
+			want:     []string{"old\nnew\n"},
+		},
+		{
+			name:       "rotates at max size",
+			maxSize:    8,
+			maxBackups: 2,
+			writes:     []string{"one\n", "two\n", "three\n"},
+			want:       []string{"three\n", "one\ntwo\n", ""},
+		},
+		{
+			name:       "drops the oldest backup",
+			maxSize:    4,
+			maxBackups: 2,
+			writes:     []string{"one\n", "two\n", "six\n", "ten\n"},
+			want:       []string{"ten\n", "six\n", "two\n", ""},
+		},
+		{
+			name:       "counts an existing file towards max size",
+			existing:   "old\n",
+			maxSize:    6,
+			maxBackups: 1,
+			writes:     []string{"new\n"},
+			want:       []string{"new\n", "old\n"},
+		},
+		{
+			name:    "no backups truncates",
+			maxSize: 4,
+			writes:  []string{"one\n", "two\n"},
+			want:    []string{"two\n", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "orchid.log")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := New(path, tt.maxSize, tt.maxBackups)
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+					t.Fatalf("Write(%q) = %d, %v", s, n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			for i, want := range tt.want {
+				name := path
+				if i > 0 {
+					name = w.backup(i)
+				}
+				if got := readFile(t, name); got != want {
+					t.Errorf("%s = %q, want %q", filepath.Base(name), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterOpenError(t *testing.T) {
+	w := New(filepath.Join(t.TempDir(), "missing", "orchid.log"), 0, 0)
+	_, err := w.Write([]byte("line\n"))
+	if err == nil || !strings.Contains(err.Error(), "failed to open log file") {
+		t.Errorf("err = %v, want an open error", err)
+	}
+}
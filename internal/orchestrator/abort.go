@@ -0,0 +1,232 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrAborted is returned when a run stops because of an abort request
+	ErrAborted = errors.New("run aborted")
+
+	// ErrNoRun is returned by Abort when no run is in progress
+	ErrNoRun = errors.New("no run in progress")
+
+	// ErrRunInProgress is returned by Up and Down when another run against
+	// the environment is still going
+	ErrRunInProgress = errors.New("another run is in progress")
+)
+
+// RunInfo describes an in-progress up or down, so other invocations can see
+// what they would be aborting
+type RunInfo struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host,omitempty"` // Machine the run is on
+	Action    string    `json:"action"`
+	User      string    `json:"user,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// AbortRequest is the control file Abort leaves for the running process
+type AbortRequest struct {
+	Reason      string    `json:"reason,omitempty"`
+	User        string    `json:"user,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+func runPath(stateDir, env string) string {
+	return filepath.Join(stateDir, env+".run")
+}
+
+func abortPath(stateDir, env string) string {
+	return filepath.Join(stateDir, env+".abort")
+}
+
+// Abort asks the run in progress against env to stop. The run checks for
+// the request between steps and rolls back as if the next step had failed.
+// It only reaches runs sharing the same state directory.
+func Abort(stateDir, env, reason string) (*RunInfo, error) {
+	info, err := readJSON[RunInfo](runPath(stateDir, env))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run marker: %w", err)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoRun, env)
+	}
+	if !info.running() {
+		return nil, fmt.Errorf("%w: %s (the %s run with pid %d exited without cleaning up)", ErrNoRun, env, info.Action, info.PID)
+	}
+
+	req := AbortRequest{
+		Reason:      reason,
+		User:        currentUsername(),
+		RequestedAt: time.Now().UTC(),
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode abort request: %w", err)
+	}
+	if err := os.WriteFile(abortPath(stateDir, env), data, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write abort request: %w", err)
+	}
+	return info, nil
+}
+
+// registerRun records this process as running action against the
+// environment and clears any stale abort request. The returned function
+// removes both markers.
+//
+// Only one run may hold the marker at a time: registerRun fails with
+// ErrRunInProgress while another run's marker is there, and replaces
+// markers left by runs on this machine whose process has exited.
+func (o *Orchestrator) registerRun(action string) (func(), error) {
+	stateDir := o.options.StateDir
+	if stateDir == "" || o.dryRun {
+		return func() {}, nil
+	}
+
+	hostname, _ := os.Hostname()
+	info := RunInfo{
+		PID:       os.Getpid(),
+		Host:      hostname,
+		Action:    action,
+		User:      currentUsername(),
+		StartedAt: time.Now().UTC(),
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode run marker: %w", err)
+	}
+
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory '%s': %w", stateDir, err)
+	}
+	path := runPath(stateDir, o.env)
+	for {
+		err := writeExclusive(path, data)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to write run marker: %w", err)
+		}
+
+		other, err := readJSON[RunInfo](path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read run marker: %w", err)
+		}
+		if other != nil && other.running() {
+			return nil, fmt.Errorf("%w against environment %s: %s by %s since %s (pid %d on %s)", ErrRunInProgress, o.env,
+				other.Action, other.User, other.StartedAt.Format(time.RFC3339), other.PID, other.Host)
+		}
+		if other != nil {
+			o.logger.Warn("removing run marker left by a run that exited",
+				slog.String("action", other.Action),
+				slog.Int("pid", other.PID))
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale run marker: %w", err)
+		}
+	}
+	os.Remove(abortPath(stateDir, o.env))
+
+	return func() {
+		os.Remove(runPath(stateDir, o.env))
+		os.Remove(abortPath(stateDir, o.env))
+	}, nil
+}
+
+// writeExclusive creates the file at path holding data, failing with an
+// error wrapping os.ErrExist if it is already there
+func writeExclusive(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// running reports whether the run could still be going. Only runs on this
+// machine can be checked, so runs elsewhere sharing the state directory
+// are assumed to be running. Markers without a host predate it being
+// recorded and are taken to be from this machine.
+func (info *RunInfo) running() bool {
+	if hostname, _ := os.Hostname(); info.Host != "" && info.Host != hostname {
+		return true
+	}
+	if info.PID <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(info.PID)
+	if err != nil {
+		return false
+	}
+	// Signal 0 only checks the process exists. Errors other than it having
+	// exited, such as not being allowed to signal it, mean it is running.
+	return !errors.Is(p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// checkAbort returns an error wrapping ErrAborted if an abort has been
+// requested for this run or interrupt is done
+func (o *Orchestrator) checkAbort(interrupt context.Context) error {
+	if err := interrupt.Err(); err != nil {
+		o.logger.Warn("run interrupted")
+		return fmt.Errorf("%w: %w", ErrAborted, err)
+	}
+	if o.options.StateDir == "" || o.dryRun {
+		return nil
+	}
+
+	req, err := readJSON[AbortRequest](abortPath(o.options.StateDir, o.env))
+	if err != nil {
+		o.logger.Warn("failed to read abort request", slog.String("error", err.Error()))
+		return nil
+	}
+	if req == nil {
+		return nil
+	}
+
+	o.logger.Warn("abort requested",
+		slog.String("requested_by", req.User),
+		slog.String("reason", req.Reason))
+	return fmt.Errorf("%w by %s: %s", ErrAborted, req.User, req.Reason)
+}
+
+// readJSON decodes the file at path, returning nil if it does not exist
+func readJSON[T any](path string) (*T, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
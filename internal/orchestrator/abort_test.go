@@ -0,0 +1,149 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+func TestUpStopsWhenInterrupted(t *testing.T) {
+	mock := &mockTransport{}
+	transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+		return mock, nil
+	}
+	t.Cleanup(func() { delete(transports, "mock") })
+
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Hosts:    map[string]config.Host{"app": {Hostname: "app.example.com", Transport: "mock"}},
+			Sequence: []config.Step{{Name: "migrate", Type: "command", Hosts: []string{"app"}, Run: "migrate"}},
+		},
+	}}
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := o.Up(ctx)
+	if !errors.Is(err, ErrAborted) {
+		t.Fatalf("err = %v, want %v", err, ErrAborted)
+	}
+	if len(mock.commands) > 0 {
+		t.Errorf("commands = %q, want none run after the interrupt", mock.commands)
+	}
+}
+
+func TestAbortRequestMidRun(t *testing.T) {
+	hosts := newFakeHosts(t)
+	dir := t.TempDir()
+	cfg := fakeEnvironment(service("api", "api1"), service("web", "web1"))
+
+	// Another terminal aborts the run while api is starting
+	open := transports["mock"]
+	transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+		tr, err := open(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		mock := tr.(*mockTransport)
+		run := mock.run
+		mock.run = func(cmd string) (string, error) {
+			if cmd == "start api" {
+				if _, err := Abort(dir, "test", "bad release"); err != nil {
+					return "", err
+				}
+			}
+			return run(cmd)
+		}
+		return mock, nil
+	}
+
+	o := newTestOrchestrator(t, cfg, Options{StateDir: dir})
+	err := o.Up(context.Background())
+	if !errors.Is(err, ErrAborted) || !strings.Contains(err.Error(), "bad release") {
+		t.Fatalf("err = %v, want an abort with the reason", err)
+	}
+	if hosts.ranCommand("start web") {
+		t.Error("web was started after the abort request")
+	}
+	if hosts.isRunning("api1", "api") {
+		t.Error("api was not rolled back after the abort")
+	}
+	for _, name := range []string{"test.run", "test.abort"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind after the run: %v", name, err)
+		}
+	}
+}
+
+// exitedPID returns the PID of a process that has exited
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("failed to run a short-lived process: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestRunMarker(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		name    string
+		marker  RunInfo
+		wantErr error
+	}{
+		{name: "live run", marker: RunInfo{PID: os.Getpid(), Host: hostname, Action: "up"}, wantErr: ErrRunInProgress},
+		{name: "run on another machine", marker: RunInfo{PID: 1, Host: "elsewhere.example.com", Action: "up"}, wantErr: ErrRunInProgress},
+		{name: "crashed run", marker: RunInfo{PID: exitedPID(t), Host: hostname, Action: "up"}},
+		{name: "crashed run without a host", marker: RunInfo{PID: exitedPID(t), Action: "down"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			dir := t.TempDir()
+			data, _ := json.Marshal(tt.marker)
+			marker := filepath.Join(dir, "test.run")
+			if err := os.WriteFile(marker, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			o := newTestOrchestrator(t, fakeEnvironment(service("api", "api1")), Options{StateDir: dir})
+			err := o.Up(context.Background())
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			_, statErr := os.Stat(marker)
+			if tt.wantErr != nil {
+				if ran := hosts.commands(); len(ran) > 0 {
+					t.Errorf("ran %q alongside another run", ran)
+				}
+				if statErr != nil {
+					t.Errorf("the other run's marker was removed: %v", statErr)
+				}
+				return
+			}
+			if !errors.Is(statErr, os.ErrNotExist) {
+				t.Errorf("stale marker left behind: %v", statErr)
+			}
+		})
+	}
+}
+
+func TestAbortStaleRun(t *testing.T) {
+	dir := t.TempDir()
+	data, _ := json.Marshal(RunInfo{PID: exitedPID(t), Action: "up"})
+	if err := os.WriteFile(filepath.Join(dir, "test.run"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Abort(dir, "test", "stuck"); !errors.Is(err, ErrNoRun) {
+		t.Errorf("err = %v, want %v", err, ErrNoRun)
+	}
+}
@@ -0,0 +1,104 @@
+package orchestrator
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"orchid/internal/config"
+)
+
+// startCanary starts the step's hosts batch by batch, health checking each
+// batch before starting the next. If a batch fails, every host started by
+// this step so far is stopped again.
+func (o *Orchestrator) startCanary(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	// Batch hosts in start order so the highest priorities go first
+	hosts := slices.Clone(step.Hosts)
+	slices.SortStableFunc(hosts, func(a, b string) int {
+		return cmp.Compare(env.Hosts[b].Priority, env.Hosts[a].Priority)
+	})
+	batches, err := canaryBatches(hosts, step.Canary)
+	if err != nil {
+		return fmt.Errorf("step %s: %w", step.Name, err)
+	}
+
+	var started []string
+	for n, batch := range batches {
+		batchStep := step
+		batchStep.Hosts = batch
+		batchLogger := logger.With(slog.Int("batch", n+1), slog.Int("batches", len(batches)))
+
+		batchLogger.Info("starting canary batch", slog.Any("hosts", batch))
+		started = append(started, batch...)
+
+		err := o.startHosts(ctx, batchStep, env, batchLogger)
+		if err == nil && n < len(batches)-1 {
+			// The final batch is health checked with the whole step
+			err = o.checkCanaryBatch(ctx, batchStep, env, batchLogger)
+		}
+		if err != nil {
+			o.abortCanary(ctx, step, env, started, batchLogger)
+			return fmt.Errorf("canary batch %d of %d failed: %w", n+1, len(batches), err)
+		}
+	}
+
+	return nil
+}
+
+func (o *Orchestrator) checkCanaryBatch(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	if err := o.waitForStart(ctx, step, "waiting before canary health check", logger); err != nil {
+		return err
+	}
+	return o.performHealthCheck(ctx, step, env, logger)
+}
+
+// abortCanary stops the hosts a failed canary rollout had already started
+func (o *Orchestrator) abortCanary(ctx context.Context, step config.Step, env config.Environment, started []string, logger *slog.Logger) {
+	startedStep := step
+	startedStep.Hosts = started
+
+	logger.Warn("canary failed; stopping hosts started so far", slog.Any("hosts", started))
+	if err := o.stopService(ctx, startedStep, env, logger); err != nil {
+		logger.Error("failed to stop canary hosts", slog.String("error", err.Error()))
+	}
+}
+
+// canaryBatches splits hosts into batches of the size given by spec, either
+// a host count or a percentage of the hosts. Every batch has at least one
+// host.
+func canaryBatches(hosts []string, spec string) ([][]string, error) {
+	size, err := canaryBatchSize(len(hosts), spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var batches [][]string
+	for start := 0; start < len(hosts); start += size {
+		end := min(start+size, len(hosts))
+		batches = append(batches, hosts[start:end])
+	}
+	return batches, nil
+}
+
+func canaryBatchSize(hosts int, spec string) (int, error) {
+	if pct, ok := strings.CutSuffix(spec, "%"); ok {
+		n, err := strconv.ParseFloat(pct, 64)
+		if err != nil || n <= 0 || n > 100 {
+			return 0, fmt.Errorf("invalid canary percentage %q", spec)
+		}
+		// Round up so small fleets still get a batch of at least one host
+		size := int(math.Ceil(float64(hosts) * n / 100))
+		return max(size, 1), nil
+	}
+
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid canary batch size %q: expected a count or percentage", spec)
+	}
+	return n, nil
+}
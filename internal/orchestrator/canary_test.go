@@ -0,0 +1,74 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCanaryBatches(t *testing.T) {
+	hosts := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "1", want: "[[a] [b] [c] [d] [e]]"},
+		{spec: "2", want: "[[a b] [c d] [e]]"},
+		{spec: "10", want: "[[a b c d e]]"},
+		{spec: "20%", want: "[[a] [b] [c] [d] [e]]"},
+		{spec: "50%", want: "[[a b c] [d e]]"},
+		{spec: "1%", want: "[[a] [b] [c] [d] [e]]"},
+		{spec: "0", wantErr: true},
+		{spec: "0%", wantErr: true},
+		{spec: "150%", wantErr: true},
+		{spec: "half", wantErr: true},
+	}
+	for _, tt := range tests {
+		batches, err := canaryBatches(hosts, tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("canaryBatches(%q) = %v, want an error", tt.spec, batches)
+			}
+			continue
+		}
+		if got := fmt.Sprint(batches); err != nil || got != tt.want {
+			t.Errorf("canaryBatches(%q) = %s, %v, want %s", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestCanaryRollout(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.fail("app2: check web")
+
+	web := service("web", "app1", "app2", "app3", "app4")
+	web.Canary = "1"
+	cfg := fakeEnvironment(web)
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	err := o.Up(context.Background())
+	if !errors.Is(err, ErrHealthCheckFailed) || !strings.Contains(err.Error(), "canary batch 2 of 4") {
+		t.Fatalf("err = %v, want the second canary batch to fail its health check", err)
+	}
+
+	// The second batch only starts once the first passed its health check,
+	// and the batches after the failed one never start
+	ran := hosts.commands()
+	firstStarted := slices.Index(ran, "app1: start web")
+	secondStarted := slices.Index(ran, "app2: start web")
+	if firstStarted < 0 || secondStarted < firstStarted || !slices.Contains(ran[firstStarted:secondStarted], "app1: check web") {
+		t.Errorf("commands = %q, want the first batch checked before the second starts", ran)
+	}
+	if slices.Contains(ran, "app3: start web") || slices.Contains(ran, "app4: start web") {
+		t.Errorf("commands = %q, want no batch started after the failed one", ran)
+	}
+	for _, host := range web.Hosts {
+		if hosts.isRunning(host, "web") {
+			t.Errorf("web still running on %s after the canary failed", host)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"orchid/internal/config"
+)
+
+// CheckResult is the outcome of a service's check command on one host
+type CheckResult struct {
+	Step    string `json:"step"`
+	Type    string `json:"type"`
+	Host    string `json:"host"`
+	Healthy bool   `json:"healthy"`
+	Output  string `json:"output,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Check runs every service step's check command on each of its hosts and
+// reports the results. It never issues start, stop or run commands, and takes
+// no host locks and writes no run state, so monitoring can poll it while a
+// deploy is in progress.
+func (o *Orchestrator) Check() ([]CheckResult, error) {
+	env, err := LookupEnvironment(o.cfg, o.env)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.options.OperationTimeout)
+	defer cancel()
+
+	var results []CheckResult
+	var steps []config.Step
+	for _, step := range env.Sequence {
+		if step.Check == "" || (step.Type != "application" && step.Type != "dependency") {
+			continue
+		}
+		for _, hostName := range step.Hosts {
+			results = append(results, CheckResult{Step: step.Name, Type: step.Type, Host: hostName})
+			steps = append(steps, step)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(res *CheckResult, step config.Step) {
+			defer wg.Done()
+			res.Output, res.Healthy, res.Error = o.checkHost(ctx, step, env, res.Host)
+			res.Output = o.redactor.String(res.Output)
+			res.Error = o.redactor.String(res.Error)
+		}(&results[i], steps[i])
+	}
+
+	wg.Wait()
+	return results, nil
+}
+
+// checkHost runs the step's check on a single host
+func (o *Orchestrator) checkHost(ctx context.Context, step config.Step, env config.Environment, hostName string) (output string, healthy bool, errMsg string) {
+	host, ok := env.Hosts[hostName]
+	if !ok {
+		return "", false, fmt.Sprintf("host %s not found in environment", hostName)
+	}
+
+	check, err := o.hostCommand(env, step, host, hostCheck(step, hostName))
+	if err != nil {
+		return "", false, err.Error()
+	}
+
+	client, err := o.connect(ctx, asUser(host, step.CheckUser), env.SSHDefaults)
+	if err != nil {
+		return "", false, fmt.Sprintf("failed to get SSH client for host %s: %v", hostName, err)
+	}
+
+	output, err = o.executeInput(ctx, client, step, host.Hostname, "check", check, checkScript(step, hostName))
+	logger := o.logger.With(slog.String("step", step.Name), slog.String("host", hostName))
+	if err := checkFailure(step, step.CheckExpect, output, err, logger); err != nil {
+		return output, false, err.Error()
+	}
+	return output, true, ""
+}
@@ -0,0 +1,224 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+func TestCheck(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.start("api1", "api")
+	hosts.start("web1", "web")
+	hosts.unreachable("db1")
+
+	db := service("db", "db1")
+	db.Type = "dependency"
+	migrate := config.Step{Name: "migrate", Type: "command", Hosts: []string{"api1"}, Run: "migrate"}
+	cfg := fakeEnvironment(db, service("api", "api1", "api2"), migrate, service("web", "web1"))
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	results, err := o.Check()
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	want := []struct {
+		step, host string
+		healthy    bool
+		err        string
+	}{
+		{"db", "db1", false, "failed to get SSH client for host db1"},
+		{"api", "api1", true, ""},
+		{"api", "api2", false, "status 1"},
+		{"web", "web1", true, ""},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("results = %+v, want %d", results, len(want))
+	}
+	for i, w := range want {
+		got := results[i]
+		if got.Step != w.step || got.Host != w.host || got.Healthy != w.healthy || !strings.Contains(got.Error, w.err) {
+			t.Errorf("result %d = %+v, want %s on %s healthy %t with error %q", i, got, w.step, w.host, w.healthy, w.err)
+		}
+	}
+
+	for _, cmd := range hosts.commands() {
+		if _, c, _ := strings.Cut(cmd, ": "); !strings.HasPrefix(c, "check ") {
+			t.Errorf("Check ran %q, want only check commands", cmd)
+		}
+	}
+}
+
+func TestReadOnlyCommandsTakeNoLocks(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.start("api1", "api")
+	cfg := fakeEnvironment(service("api", "api1"))
+	stateDir, lockDir := t.TempDir(), t.TempDir()
+
+	// A deploy holds the host locks while monitoring polls
+	deploy := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(lockDir)})
+	release, err := deploy.lockHosts(context.Background(), context.Background(), cfg.Environments["test"])
+	if err != nil {
+		t.Fatalf("lockHosts: %v", err)
+	}
+	defer release()
+
+	o := newTestOrchestrator(t, cfg, Options{StateDir: stateDir, HostLock: HostLockFail, LockBackend: NewFileLockBackend(lockDir)})
+	if results, err := o.Check(); err != nil || len(results) != 1 || !results[0].Healthy {
+		t.Errorf("Check = %+v, %v, want api healthy while the hosts are locked", results, err)
+	}
+	if _, err := o.Plan(); err != nil {
+		t.Errorf("Plan: %v", err)
+	}
+
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("read-only commands wrote %s to the state directory", e.Name())
+	}
+}
+
+func TestHostChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     []string
+		wantErr  bool
+		wantRuns []string // Checks run, as "<hostname>: <command>"
+	}{
+		{
+			// The default check would fail on app2, where the override is used instead
+			name:     "override passes",
+			fail:     []string{"app2: check api"},
+			wantRuns: []string{"app1: check api", "app2: supervisorctl status api"},
+		},
+		{
+			name:    "override fails",
+			fail:    []string{"supervisorctl status api"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.fail(tt.fail...)
+			step := service("api", "app1", "app2")
+			step.HostChecks = map[string]string{"app2": "supervisorctl status api"}
+			o := newTestOrchestrator(t, fakeEnvironment(step), Options{})
+
+			err := o.Up(context.Background())
+			if got := errors.Is(err, ErrHealthCheckFailed); got != tt.wantErr {
+				t.Fatalf("err = %v, want health check failure %t", err, tt.wantErr)
+			}
+			for _, cmd := range tt.wantRuns {
+				if !slices.Contains(hosts.commands(), cmd) {
+					t.Errorf("commands = %q, want %q", hosts.commands(), cmd)
+				}
+			}
+			if slices.Contains(hosts.commands(), "app2: check api") {
+				t.Errorf("commands = %q, want the default check never run on app2", hosts.commands())
+			}
+		})
+	}
+
+	t.Run("check command", func(t *testing.T) {
+		hosts := newFakeHosts(t)
+		hosts.start("app1", "api")
+		step := service("api", "app1", "app2")
+		step.HostChecks = map[string]string{"app2": "supervisorctl status api"}
+		o := newTestOrchestrator(t, fakeEnvironment(step), Options{})
+
+		results, err := o.Check()
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		for _, r := range results {
+			if !r.Healthy {
+				t.Errorf("%s unhealthy: %s", r.Host, r.Error)
+			}
+		}
+		if !slices.Contains(hosts.commands(), "app2: supervisorctl status api") {
+			t.Errorf("commands = %q, want the override run on app2", hosts.commands())
+		}
+	})
+}
+
+func TestCheckScript(t *testing.T) {
+	const body = "#!/bin/sh\ncurl -fs localhost:8080/health\n"
+	var (
+		mu     sync.Mutex
+		opened = make(map[string]*mockTransport)
+	)
+	transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if m, ok := opened[host.Hostname]; ok {
+			return m, nil
+		}
+		started := false
+		m := &mockTransport{host: host.Hostname, run: func(cmd string) (string, error) {
+			switch cmd {
+			case "start api":
+				started = true
+			case config.CheckScriptCommand, "supervisorctl status api":
+				if !started {
+					return "not running", exitError(1)
+				}
+			}
+			return "ok", nil
+		}}
+		opened[host.Hostname] = m
+		return m, nil
+	}
+	t.Cleanup(func() { delete(transports, "mock") })
+
+	step := service("api", "app1", "app2")
+	step.Check = config.CheckScriptCommand
+	step.CheckScript = "/etc/orchid/checks/api.sh"
+	step.CheckScriptBody = body
+	step.HostChecks = map[string]string{"app2": "supervisorctl status api"}
+	o := newTestOrchestrator(t, fakeEnvironment(step), Options{})
+
+	if err := o.Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+
+	// Only the script check is given the script, on every run, and the
+	// host_checks override and the other commands run without input
+	for hostname, m := range opened {
+		m.mu.Lock()
+		for i, cmd := range m.commands {
+			var input string
+			if stdin := m.opts[i].Stdin; stdin != nil {
+				data, err := io.ReadAll(stdin)
+				if err != nil {
+					t.Fatal(err)
+				}
+				input = string(data)
+			}
+			want := ""
+			if hostname == "app1" && cmd == config.CheckScriptCommand {
+				want = body
+			}
+			if input != want {
+				t.Errorf("%s: %q ran with input %q, want %q", hostname, cmd, input, want)
+			}
+		}
+		m.mu.Unlock()
+	}
+	if !slices.Contains(opened["app1"].ran(), config.CheckScriptCommand) {
+		t.Errorf("app1 ran %q, want the script check", opened["app1"].ran())
+	}
+	if slices.Contains(opened["app2"].ran(), config.CheckScriptCommand) {
+		t.Errorf("app2 ran %q, want its host_checks override instead of the script", opened["app2"].ran())
+	}
+}
@@ -0,0 +1,61 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"orchid/internal/config"
+)
+
+// collectDiagnostics runs the failed step's diagnostics command on each of
+// its hosts, before anything is rolled back, and records the output in the
+// run report and the log. A diagnostics command that fails is only warned
+// about; it never changes the outcome of the run.
+func (o *Orchestrator) collectDiagnostics(ctx context.Context, step config.Step, env config.Environment) {
+	if step.Diagnostics == "" || o.dryRun {
+		return
+	}
+
+	logger := o.logger.With(slog.String("step", step.Name))
+	logger.Info("collecting diagnostics", slog.Any("hosts", step.Hosts))
+
+	var wg sync.WaitGroup
+	for _, hostName := range step.Hosts {
+		wg.Add(1)
+		go func(hostName string) {
+			defer wg.Done()
+
+			output, err := o.runDiagnostics(ctx, step, env, hostName)
+			o.report.addDiagnostics(step.Name, Diagnostics{Host: hostName, Output: output, Error: errString(err)})
+			if err != nil {
+				o.warn(logger, Warning{Step: step.Name, Host: hostName, Message: "failed to collect diagnostics", Error: err.Error()},
+					slog.String("host", hostName),
+					slog.String("error", err.Error()),
+					slog.String("output", output))
+				return
+			}
+			logger.Info("diagnostics", slog.String("host", hostName), slog.String("output", output))
+		}(hostName)
+	}
+	wg.Wait()
+}
+
+func (o *Orchestrator) runDiagnostics(ctx context.Context, step config.Step, env config.Environment, hostName string) (string, error) {
+	host, ok := env.Hosts[hostName]
+	if !ok {
+		return "", fmt.Errorf("host %s not found in environment", hostName)
+	}
+
+	client, err := o.connect(ctx, asUser(host, step.CheckUser), env.SSHDefaults)
+	if err != nil {
+		return "", fmt.Errorf("failed to get SSH client for host %s: %w", host.Hostname, err)
+	}
+
+	cmd, err := o.hostCommand(env, step, host, step.Diagnostics)
+	if err != nil {
+		return "", err
+	}
+	return o.execute(ctx, client, step, host.Hostname, "diagnostics", cmd)
+}
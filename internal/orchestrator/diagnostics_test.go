@@ -0,0 +1,89 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     []string
+		wantErr  error
+		want     []Diagnostics
+		wantWarn bool
+	}{
+		{name: "success"},
+		{
+			name:    "failed step",
+			fail:    []string{"check web"},
+			wantErr: ErrHealthCheckFailed,
+			want:    []Diagnostics{{Host: "web1", Output: "ok"}, {Host: "web2", Output: "ok"}},
+		},
+		{
+			name:     "diagnostics fail",
+			fail:     []string{"check web", "web2: diag web"},
+			wantErr:  ErrHealthCheckFailed,
+			want:     []Diagnostics{{Host: "web1", Output: "ok"}, {Host: "web2", Output: "failed", Error: "command exited with status 1"}},
+			wantWarn: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.fail(tt.fail...)
+			web := service("web", "web1", "web2")
+			web.Diagnostics = "diag web"
+			o := newTestOrchestrator(t, fakeEnvironment(service("api", "api1"), web), Options{})
+
+			err := o.Up(context.Background())
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr == nil && hosts.ranCommand("diag web") {
+				t.Error("ran diagnostics for a run that succeeded")
+			}
+
+			var got []Diagnostics
+			for _, s := range o.Report().Steps {
+				if s.Name == "web" {
+					got = s.Diagnostics
+				}
+			}
+			slices.SortFunc(got, func(a, b Diagnostics) int { return strings.Compare(a.Host, b.Host) })
+			if len(got) != len(tt.want) {
+				t.Fatalf("diagnostics = %+v, want %+v", got, tt.want)
+			}
+			for i, want := range tt.want {
+				if got[i].Host != want.Host || got[i].Output != want.Output || !strings.Contains(got[i].Error, want.Error) {
+					t.Errorf("diagnostics on %s = %+v, want %+v", want.Host, got[i], want)
+				}
+			}
+
+			// Diagnostics run while the failed service is still in the state
+			// that failed, and failing to collect them doesn't stop the rollback
+			if tt.wantErr != nil {
+				ran := hosts.commands()
+				diag, rollback := slices.Index(ran, "web1: diag web"), slices.Index(ran, "api1: stop api")
+				if diag < 0 || rollback < diag {
+					t.Errorf("commands = %q, want diagnostics collected before rollback", ran)
+				}
+				if hosts.isRunning("api1", "api") {
+					t.Error("api still running, want it rolled back")
+				}
+			}
+
+			var warned bool
+			for _, w := range o.Report().Warnings {
+				warned = warned || w.Message == "failed to collect diagnostics"
+			}
+			if warned != tt.wantWarn {
+				t.Errorf("warned %t, want %t: %+v", warned, tt.wantWarn, o.Report().Warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"orchid/internal/config"
+	"orchid/internal/retry"
+)
+
+// drain polls the step's drain command on every host until it succeeds,
+// meaning the service has taken itself out of rotation and finished its
+// active connections. If drain_timeout passes first the service is stopped
+// anyway, since down must still make progress; any other failure to run the
+// command is returned.
+func (o *Orchestrator) drain(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	if step.Drain == "" {
+		return nil
+	}
+	if err := o.validateCommand(env, step, step.Drain); err != nil {
+		return err
+	}
+
+	timeout := firstDuration(step.DrainTimeout, o.options.HealthCheckTimeout)
+	if o.dryRun {
+		logger.Info("dry run - would drain before stopping",
+			slog.String("drain", step.Drain),
+			slog.Duration("timeout", timeout))
+		return nil
+	}
+
+	drainCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logger.Info("draining service", slog.Duration("timeout", timeout))
+	err := retry.Do(drainCtx, o.healthCheckPolicy(), func(ctx context.Context) error {
+		done, err := o.succeedsOnAllHosts(ctx, step.Drain, step, env, logger)
+		if err != nil {
+			return retry.Permanent(fmt.Errorf("failed to run drain command: %w", err))
+		}
+		if !done {
+			logger.Info("waiting for service to drain", slog.String("service", step.Name))
+			return fmt.Errorf("service %s has not drained", step.Name)
+		}
+		return nil
+	})
+
+	switch {
+	case err == nil:
+		logger.Info("service drained", slog.String("service", step.Name))
+		return nil
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+		o.warn(logger, Warning{Step: step.Name, Message: "drain timed out; stopping anyway"},
+			slog.String("service", step.Name),
+			slog.Duration("timeout", timeout))
+		return nil
+	default:
+		return fmt.Errorf("failed to drain %s: %w", step.Name, err)
+	}
+}
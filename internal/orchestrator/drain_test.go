@@ -0,0 +1,75 @@
+package orchestrator
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int // Runs of the drain command that report active connections, -1 for all
+		dryRun      bool
+		wantDrains  int // -1 for at least one
+		wantWarning bool
+	}{
+		{name: "drained at once", wantDrains: 1},
+		{name: "drained after polling", failures: 2, wantDrains: 3},
+		{name: "timed out", failures: -1, wantDrains: -1, wantWarning: true},
+		{name: "dry run", failures: -1, dryRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.start("api1", "api")
+			if tt.failures != 0 {
+				hosts.failTimes(tt.failures, "drain api")
+			}
+			step := service("api", "api1")
+			step.Drain = "drain api"
+			step.DrainTimeout = 100 * time.Millisecond
+			o := newTestOrchestrator(t, fakeEnvironment(step), Options{DryRun: tt.dryRun})
+
+			start := time.Now()
+			if err := o.Down(context.Background()); err != nil {
+				t.Fatalf("Down: %v", err)
+			}
+			if tt.wantWarning && time.Since(start) < step.DrainTimeout {
+				t.Errorf("Down returned after %v, before drain_timeout", time.Since(start))
+			}
+
+			cmds := hosts.commands()
+			drains := 0
+			for _, cmd := range cmds {
+				if cmd == "api1: drain api" {
+					drains++
+				}
+			}
+			if tt.wantDrains == -1 && drains == 0 || tt.wantDrains >= 0 && drains != tt.wantDrains {
+				t.Errorf("drained %d times, want %d: %q", drains, tt.wantDrains, cmds)
+			}
+			if tt.dryRun {
+				return
+			}
+
+			// The service is stopped after draining, even when draining times out
+			drained := slices.Index(cmds, "api1: drain api")
+			if stop := slices.Index(cmds, "api1: stop api"); stop < drained {
+				t.Errorf("commands = %q, want stop after drain", cmds)
+			}
+			if hosts.isRunning("api1", "api") {
+				t.Error("service still running after down")
+			}
+
+			var warned bool
+			for _, w := range o.Report().Warnings {
+				warned = warned || w.Message == "drain timed out; stopping anyway"
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("warned %t, want %t: %+v", warned, tt.wantWarning, o.Report().Warnings)
+			}
+		})
+	}
+}
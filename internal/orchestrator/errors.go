@@ -0,0 +1,76 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"orchid/internal/config"
+)
+
+// ErrEnvironmentNotFound is returned when the requested environment is not
+// defined in the configuration
+var ErrEnvironmentNotFound = errors.New("environment not found")
+
+// LookupEnvironment returns the named environment of cfg. When there is no
+// such environment the error lists the ones that are defined, sorted, so a
+// mistyped name is easy to correct.
+func LookupEnvironment(cfg *config.Config, name string) (config.Environment, error) {
+	env, ok := cfg.Environments[name]
+	if ok {
+		return env, nil
+	}
+
+	names := make([]string, 0, len(cfg.Environments))
+	for n := range cfg.Environments {
+		names = append(names, n)
+	}
+	if len(names) == 0 {
+		return env, fmt.Errorf("%w: %s (the config defines no environments)", ErrEnvironmentNotFound, name)
+	}
+	sort.Strings(names)
+	return env, fmt.Errorf("%w: %s (available: %s)", ErrEnvironmentNotFound, name, strings.Join(names, ", "))
+}
+
+// ErrHealthCheckFailed is wrapped by errors from a service that never passed
+// its health check after starting
+var ErrHealthCheckFailed = errors.New("health check failed")
+
+// StepError reports the step at which an orchestration failed
+type StepError struct {
+	Environment string
+	Step        string
+	StepNumber  int // 1-based position in the sequence
+	RolledBack  bool
+	RollbackErr error // Services that failed to stop during rollback
+	Err         error
+
+	// RollbackSkipped says why the services started before the step were
+	// left in place, when RolledBack is false
+	RollbackSkipped string
+}
+
+// Reasons for StepError.RollbackSkipped
+const (
+	RollbackSkippedDisabled = "rollback disabled"
+	RollbackSkippedOptedOut = "step opted out of rollback"
+)
+
+func (e *StepError) Error() string {
+	msg := fmt.Sprintf("orchestration failed at step %d", e.StepNumber)
+	if !e.RolledBack && e.RollbackSkipped != "" {
+		msg += " (" + e.RollbackSkipped + ")"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if e.RollbackErr != nil {
+		msg += "; rollback incomplete: " + e.RollbackErr.Error()
+	}
+	return msg
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
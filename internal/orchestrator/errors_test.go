@@ -0,0 +1,86 @@
+package orchestrator
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+func TestStepErrorMessage(t *testing.T) {
+	cause := errors.New("health check failed")
+	tests := []struct {
+		name string
+		err  StepError
+		want string
+	}{
+		{
+			name: "rolled back",
+			err:  StepError{StepNumber: 2, RolledBack: true, Err: cause},
+			want: "orchestration failed at step 2: health check failed",
+		},
+		{
+			name: "rollback disabled",
+			err:  StepError{StepNumber: 2, RollbackSkipped: RollbackSkippedDisabled, Err: cause},
+			want: "orchestration failed at step 2 (rollback disabled): health check failed",
+		},
+		{
+			name: "step opted out",
+			err:  StepError{StepNumber: 3, RollbackSkipped: RollbackSkippedOptedOut, Err: cause},
+			want: "orchestration failed at step 3 (step opted out of rollback): health check failed",
+		},
+		{
+			name: "rollback incomplete",
+			err:  StepError{StepNumber: 2, RolledBack: true, Err: cause, RollbackErr: errors.New("db: still running")},
+			want: "orchestration failed at step 2: health check failed; rollback incomplete: db: still running",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.want {
+				t.Errorf("Error() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupEnvironment(t *testing.T) {
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"staging": {}, "prod": {}, "dev": {},
+	}}
+	tests := []struct {
+		name    string
+		cfg     *config.Config
+		env     string
+		wantErr string
+	}{
+		{name: "found", cfg: cfg, env: "prod"},
+		{name: "typo", cfg: cfg, env: "prd", wantErr: "environment not found: prd (available: dev, prod, staging)"},
+		{name: "no environments", cfg: &config.Config{}, env: "prod", wantErr: "environment not found: prod (the config defines no environments)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LookupEnvironment(tt.cfg, tt.env)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("LookupEnvironment: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr || !errors.Is(err, ErrEnvironmentNotFound) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("New", func(t *testing.T) {
+		_, err := New(Options{Config: cfg, Environment: "prd", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+		if want := "(available: dev, prod, staging)"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	})
+}
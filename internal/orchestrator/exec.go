@@ -0,0 +1,106 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh"
+)
+
+// HostResult is the outcome of running a command on a single host
+type HostResult struct {
+	Host   string
+	Output string
+	Err    error
+}
+
+// Exec runs an ad-hoc command on the hosts of the named step, or on every
+// host in the environment when allHosts is set. Results are returned in host
+// order; a failure on one host does not stop the others.
+func (o *Orchestrator) Exec(stepName string, allHosts bool, command string) ([]HostResult, error) {
+	env, err := LookupEnvironment(o.cfg, o.env)
+	if err != nil {
+		return nil, err
+	}
+
+	hostNames, err := execHosts(env, stepName, allHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkAllowed(env, command); err != nil {
+		return nil, err
+	}
+
+	if o.dryRun {
+		o.logger.Info("dry run - would execute command",
+			slog.Any("hosts", hostNames),
+			slog.String("command", command))
+		return nil, nil
+	}
+
+	// Run through the step's shell, or the environment's for --all-hosts
+	opts := ssh.ExecOptions{Shell: env.Shell}
+	for _, step := range env.Sequence {
+		if step.Name == stepName && !allHosts {
+			opts.Shell = step.Shell
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.options.OperationTimeout)
+	defer cancel()
+
+	results := make([]HostResult, len(hostNames))
+	var wg sync.WaitGroup
+
+	for i, hostName := range hostNames {
+		results[i].Host = hostName
+
+		host, ok := env.Hosts[hostName]
+		if !ok {
+			results[i].Err = fmt.Errorf("host %s not found in environment", hostName)
+			continue
+		}
+
+		wg.Add(1)
+		go func(res *HostResult, h config.Host) {
+			defer wg.Done()
+
+			client, err := o.connect(ctx, h, env.SSHDefaults)
+			if err != nil {
+				res.Err = fmt.Errorf("failed to get SSH client for host %s: %w", h.Hostname, err)
+				return
+			}
+
+			res.Output, res.Err = client.ExecuteWith(ctx, command, opts)
+			res.Output = o.redactor.String(res.Output)
+			res.Err = o.redactor.Error(res.Err)
+		}(&results[i], host)
+	}
+
+	wg.Wait()
+	return results, nil
+}
+
+// execHosts resolves the hosts an ad-hoc command should run on
+func execHosts(env config.Environment, stepName string, allHosts bool) ([]string, error) {
+	if allHosts {
+		names := make([]string, 0, len(env.Hosts))
+		for name := range env.Hosts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+
+	for _, step := range env.Sequence {
+		if step.Name == stepName {
+			return step.Hosts, nil
+		}
+	}
+	return nil, fmt.Errorf("step %s not found in environment", stepName)
+}
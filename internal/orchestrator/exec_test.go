@@ -0,0 +1,127 @@
+package orchestrator
+
+import (
+	"context"
+	"maps"
+	"testing"
+)
+
+func TestExec(t *testing.T) {
+	cfg := fakeEnvironment(service("db", "db1"), service("web", "web1", "web2"))
+
+	tests := []struct {
+		name      string
+		step      string
+		allHosts  bool
+		wantHosts []string
+	}{
+		{name: "step hosts", step: "web", wantHosts: []string{"web1", "web2"}},
+		{name: "all hosts", allHosts: true, wantHosts: []string{"db1", "web1", "web2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.fail("web2: uptime")
+			o := newTestOrchestrator(t, cfg, Options{})
+
+			results, err := o.Exec(tt.step, tt.allHosts, "uptime")
+			if err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+			if len(results) != len(tt.wantHosts) {
+				t.Fatalf("results = %+v, want one per host of %q", results, tt.wantHosts)
+			}
+			for i, res := range results {
+				if res.Host != tt.wantHosts[i] {
+					t.Errorf("result %d is for %s, want %s", i, res.Host, tt.wantHosts[i])
+				}
+				wantErr := res.Host == "web2"
+				if (res.Err != nil) != wantErr {
+					t.Errorf("%s: err = %v, want error %t", res.Host, res.Err, wantErr)
+				}
+				if !wantErr && res.Output != "ok" {
+					t.Errorf("%s: output = %q, want the command's output", res.Host, res.Output)
+				}
+			}
+			if len(hosts.commands()) != len(tt.wantHosts) {
+				t.Errorf("commands = %q, want the command once on each host", hosts.commands())
+			}
+		})
+	}
+}
+
+func TestExecRefusesBlockedCommand(t *testing.T) {
+	hosts := newFakeHosts(t)
+	cfg := fakeEnvironment(service("web", "web1"))
+	env := cfg.Environments["test"]
+	env.AllowedCommands = []string{"uptime"}
+	cfg.Environments["test"] = env
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	if _, err := o.Exec("web", false, "reboot"); err == nil {
+		t.Fatal("Exec ran a command the allow-list blocks")
+	}
+	if _, err := o.Exec("nope", false, "uptime"); err == nil {
+		t.Error("Exec accepted an unknown step")
+	}
+	if len(hosts.commands()) > 0 {
+		t.Errorf("commands = %q, want none", hosts.commands())
+	}
+}
+
+func TestStepShell(t *testing.T) {
+	newOrchestrator := func(t *testing.T) (*Orchestrator, *mockTransport) {
+		mock := &mockTransport{}
+		useMockTransport(t, mock)
+		api := service("api", "api1")
+		api.Shell = "bash -l"
+		cfg := fakeEnvironment(api, service("web", "web1"))
+		env := cfg.Environments["test"]
+		env.Shell = "sh"
+		cfg.Environments["test"] = env
+		return newTestOrchestrator(t, cfg, Options{}), mock
+	}
+	shells := func(mock *mockTransport) map[string]string {
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		got := make(map[string]string)
+		for i, cmd := range mock.commands {
+			got[cmd] = mock.opts[i].Shell
+		}
+		return got
+	}
+
+	t.Run("down", func(t *testing.T) {
+		o, mock := newOrchestrator(t)
+		if err := o.Down(context.Background()); err != nil {
+			t.Fatalf("Down: %v", err)
+		}
+		// Steps inherit the environment's shell when the config is loaded,
+		// so here web runs its commands directly
+		want := map[string]string{"stop api": "bash -l", "check api": "bash -l", "stop web": "", "check web": ""}
+		if got := shells(mock); !maps.Equal(got, want) {
+			t.Errorf("shells = %q, want %q", got, want)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		step     string
+		allHosts bool
+		want     string
+	}{
+		{name: "exec on a step", step: "api", want: "bash -l"},
+		{name: "exec on all hosts", allHosts: true, want: "sh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, mock := newOrchestrator(t)
+			if _, err := o.Exec(tt.step, tt.allHosts, "uptime"); err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+			if got := shells(mock); got["uptime"] != tt.want {
+				t.Errorf("uptime ran with shell %q, want %q", got["uptime"], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package orchestrator
+
+import (
+	"log/slog"
+
+	"orchid/internal/config"
+)
+
+// Reasons recorded for what Up and Down did with each step
+const (
+	ReasonStarted               = "started"
+	ReasonRestarted             = "restarted"
+	ReasonSkippedRunning        = "skipped-already-running"
+	ReasonSkippedByTag          = "skipped-by-tag"
+	ReasonSkippedNotFailed      = "skipped-not-failed"
+	ReasonSkippedByCondition    = "skipped-by-condition"
+	ReasonVerifiedDependency    = "verified-dependency"
+	ReasonDependencyNotRunning  = "dependency-not-running-lenient"
+	ReasonRanCommand            = "ran-command"
+	ReasonSkippedCommand        = "skipped-command"
+	ReasonStopped               = "stopped"
+	ReasonSkippedDependencyStop = "skipped-dependency-stop"
+)
+
+// explain records why a step was run or skipped in the run report and, with
+// Options.Explain set, logs it as one line on the step's logger, so the
+// decisions made across the step handlers can be read in one place
+func (o *Orchestrator) explain(logger *slog.Logger, step config.Step, reason string) {
+	o.report.setReason(step.Name, reason)
+	if o.options.Explain {
+		logger.Info("explain: "+reason, slog.String("reason", reason))
+	}
+}
@@ -0,0 +1,99 @@
+package orchestrator
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+func TestExplain(t *testing.T) {
+	dependency := func(name, host string) config.Step {
+		step := service(name, host)
+		step.Type = "dependency"
+		return step
+	}
+	tagged := service("web", "web1")
+	tagged.Tags = []string{"frontend"}
+	conditional := service("api", "api1")
+	conditional.When = "when api"
+
+	tests := []struct {
+		name    string
+		steps   []config.Step
+		running bool // api is running on api1 before the run
+		fail    []string
+		down    bool
+		lastRun *RunState
+		opts    Options
+		want    string // api's reason
+	}{
+		{name: "started", steps: []config.Step{service("api", "api1")}, want: ReasonStarted},
+		{name: "already running", steps: []config.Step{service("api", "api1")}, running: true, opts: Options{Ensure: true}, want: ReasonSkippedRunning},
+		{name: "tag filter", steps: []config.Step{service("api", "api1"), tagged}, opts: Options{Tags: []string{"frontend"}}, want: ReasonSkippedByTag},
+		{name: "not failed last run", steps: []config.Step{service("api", "api1"), service("web", "web1")}, lastRun: &RunState{Result: "failure", FailedSteps: []string{"web"}}, opts: Options{OnlyFailed: true}, want: ReasonSkippedNotFailed},
+		{name: "condition", steps: []config.Step{conditional}, fail: []string{"when api"}, want: ReasonSkippedByCondition},
+		{name: "dependency verified", steps: []config.Step{dependency("api", "api1")}, running: true, want: ReasonVerifiedDependency},
+		{name: "dependency not running", steps: []config.Step{dependency("api", "api1")}, opts: Options{LenientDeps: true}, want: ReasonDependencyNotRunning},
+		{name: "dependency restarted", steps: []config.Step{dependency("api", "api1")}, running: true, opts: Options{HandleDeps: true}, want: ReasonRestarted},
+		{name: "command run", steps: []config.Step{{Name: "api", Type: "command", Hosts: []string{"api1"}, Run: "migrate"}}, want: ReasonRanCommand},
+		{name: "command on down", steps: []config.Step{{Name: "api", Type: "command", Hosts: []string{"api1"}, Run: "migrate"}}, down: true, want: ReasonSkippedCommand},
+		{name: "stopped", steps: []config.Step{service("api", "api1")}, running: true, down: true, want: ReasonStopped},
+		{name: "dependency left up", steps: []config.Step{dependency("api", "api1")}, running: true, down: true, want: ReasonSkippedDependencyStop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			if tt.running {
+				hosts.start("api1", "api")
+			}
+			hosts.fail(tt.fail...)
+			if tt.lastRun != nil {
+				tt.opts.StateDir = t.TempDir()
+				seedRunState(t, tt.opts.StateDir, *tt.lastRun)
+			}
+			var logs lockedBuffer
+			tt.opts.Explain = true
+			tt.opts.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			o := newTestOrchestrator(t, fakeEnvironment(tt.steps...), tt.opts)
+
+			run := o.Up
+			if tt.down {
+				run = o.Down
+			}
+			if err := run(context.Background()); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+
+			var reason string
+			for _, s := range o.Report().Steps {
+				if s.Name == "api" {
+					reason = s.Reason
+				}
+			}
+			if reason != tt.want {
+				t.Errorf("reported reason = %q, want %q", reason, tt.want)
+			}
+			if line := `msg="explain: ` + tt.want + `" step=api`; !strings.Contains(logs.String(), line) {
+				t.Errorf("logs = %s\nwant a line containing %s", logs.String(), line)
+			}
+		})
+	}
+
+	t.Run("logged only with explain", func(t *testing.T) {
+		newFakeHosts(t)
+		var logs lockedBuffer
+		o := newTestOrchestrator(t, fakeEnvironment(service("api", "api1")), Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+		if err := o.Up(context.Background()); err != nil {
+			t.Fatalf("Up: %v", err)
+		}
+		if strings.Contains(logs.String(), "explain:") {
+			t.Errorf("logs = %s, want no explanations", logs.String())
+		}
+		if got := o.Report().Steps[0].Reason; got != ReasonStarted {
+			t.Errorf("reported reason = %q, want %q", got, ReasonStarted)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package orchestrator
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"orchid/internal/config"
+)
+
+// Hooks are optional callbacks for following a run programmatically, for
+// example from a UI embedding orchid. Callbacks are delivered in order on a
+// single goroutine, so they need not be safe for concurrent use, and a slow
+// callback never holds up the run; Up and Down wait for outstanding
+// callbacks before returning.
+type Hooks struct {
+	OnStepStart    func(StepEvent)
+	OnStepComplete func(StepEvent)
+	OnHealthCheck  func(HealthCheckEvent)
+	OnRollback     func(StepEvent)
+}
+
+// StepEvent describes a step starting, completing or being rolled back
+type StepEvent struct {
+	Environment string
+	Step        string
+	Type        string
+	StepNumber  int           // 1-based position in the sequence
+	Status      string        // Set on completion and rollback
+	Duration    time.Duration // Set on completion
+	Err         error
+}
+
+// HealthCheckEvent reports one health check attempt on one host
+type HealthCheckEvent struct {
+	Environment string
+	Step        string
+	Host        string
+	Healthy     bool
+	Err         error
+}
+
+func (h Hooks) empty() bool {
+	return h.OnStepStart == nil && h.OnStepComplete == nil && h.OnHealthCheck == nil && h.OnRollback == nil
+}
+
+// hookQueue delivers callbacks on its own goroutine without ever blocking
+// the caller
+type hookQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func newHookQueue() *hookQueue {
+	q := &hookQueue{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *hookQueue) enqueue(fn func()) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.pending = append(q.pending, fn)
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *hookQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *hookQueue) run() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		batch, closed := q.pending, q.closed
+		q.pending = nil
+		q.mu.Unlock()
+
+		for _, fn := range batch {
+			fn()
+		}
+		if len(batch) > 0 {
+			continue
+		}
+		if closed {
+			return
+		}
+		<-q.wake
+	}
+}
+
+// close waits for every queued callback to be delivered
+func (q *hookQueue) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+	<-q.done
+}
+
+// startHooks begins delivering the configured hooks for a run and returns
+// the function that waits for them to drain
+func (o *Orchestrator) startHooks() func() {
+	if o.options.Hooks.empty() {
+		return func() {}
+	}
+	o.hooks = newHookQueue()
+	return o.hooks.close
+}
+
+func (o *Orchestrator) stepEvent(step config.Step, index int) StepEvent {
+	return StepEvent{
+		Environment: o.env,
+		Step:        step.Name,
+		Type:        step.Type,
+		StepNumber:  index + 1,
+	}
+}
+
+// sectionName identifies a step's CI log section
+func sectionName(step config.Step, index int) string {
+	return fmt.Sprintf("step_%d_%s", index+1, step.Name)
+}
+
+// hookStepStart also opens the step's CI log section, which unlike the hooks
+// must be written before the step logs anything
+func (o *Orchestrator) hookStepStart(step config.Step, index int) {
+	o.options.Sections.Start(sectionName(step, index), fmt.Sprintf("Step %d: %s (%s)", index+1, step.Name, step.Type))
+	if fn := o.options.Hooks.OnStepStart; fn != nil {
+		ev := o.stepEvent(step, index)
+		o.hooks.enqueue(func() { fn(ev) })
+	}
+}
+
+func (o *Orchestrator) hookStepComplete(step config.Step, index int, status string, err error) {
+	o.options.Sections.End(sectionName(step, index))
+	if fn := o.options.Hooks.OnStepComplete; fn != nil {
+		ev := o.stepEvent(step, index)
+		ev.Status, ev.Duration, ev.Err = status, o.stepDuration(step.Name), o.redactor.Error(err)
+		o.hooks.enqueue(func() { fn(ev) })
+	}
+}
+
+func (o *Orchestrator) hookRollback(step config.Step, index int, err error) {
+	if fn := o.options.Hooks.OnRollback; fn != nil {
+		ev := o.stepEvent(step, index)
+		ev.Status, ev.Err = StepRolledBack, o.redactor.Error(err)
+		if err != nil {
+			ev.Status = StepFailed
+		}
+		o.hooks.enqueue(func() { fn(ev) })
+	}
+}
+
+func (o *Orchestrator) hookHealthCheck(step config.Step, host string, err error) {
+	if fn := o.options.Hooks.OnHealthCheck; fn != nil {
+		ev := HealthCheckEvent{
+			Environment: o.env,
+			Step:        step.Name,
+			Host:        host,
+			Healthy:     err == nil,
+			Err:         o.redactor.Error(err),
+		}
+		o.hooks.enqueue(func() { fn(ev) })
+	}
+}
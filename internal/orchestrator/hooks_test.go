@@ -0,0 +1,191 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"orchid/internal/ci"
+)
+
+func TestHooks(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.fail("start web")
+	cfg := fakeEnvironment(service("api", "app1", "app2"), service("web", "app3"))
+
+	var (
+		mu       sync.Mutex
+		steps    []string
+		checks   []string
+		inFlight atomic.Int32
+		overlap  atomic.Bool
+	)
+	record := func(list *[]string, event string) {
+		if inFlight.Add(1) > 1 {
+			overlap.Store(true)
+		}
+		defer inFlight.Add(-1)
+		time.Sleep(time.Millisecond) // Long enough for concurrent calls to overlap
+		mu.Lock()
+		defer mu.Unlock()
+		*list = append(*list, event)
+	}
+	o := newTestOrchestrator(t, cfg, Options{Hooks: Hooks{
+		OnStepStart: func(ev StepEvent) {
+			record(&steps, fmt.Sprintf("start %s %s %d", ev.Step, ev.Type, ev.StepNumber))
+		},
+		OnStepComplete: func(ev StepEvent) {
+			record(&steps, fmt.Sprintf("complete %s %s error=%t", ev.Step, ev.Status, ev.Err != nil))
+		},
+		OnRollback: func(ev StepEvent) {
+			record(&steps, fmt.Sprintf("rollback %s %s", ev.Step, ev.Status))
+		},
+		OnHealthCheck: func(ev HealthCheckEvent) {
+			if ev.Environment != "test" || ev.Healthy != (ev.Err == nil) {
+				t.Errorf("health check event %+v", ev)
+			}
+			record(&checks, fmt.Sprintf("%s %s healthy=%t", ev.Step, ev.Host, ev.Healthy))
+		},
+	}})
+
+	if err := o.Up(context.Background()); err == nil {
+		t.Fatal("Up succeeded although web failed to start")
+	}
+
+	// Up waits for the callbacks, so everything has been delivered
+	mu.Lock()
+	defer mu.Unlock()
+	wantSteps := []string{
+		"start api application 1",
+		"complete api succeeded error=false",
+		"start web application 2",
+		"complete web failed error=true",
+		"rollback api rolled_back",
+	}
+	if !slices.Equal(steps, wantSteps) {
+		t.Errorf("step events = %q, want %q", steps, wantSteps)
+	}
+	slices.Sort(checks)
+	if !slices.Contains(checks, "api app1 healthy=true") || !slices.Contains(checks, "api app2 healthy=true") {
+		t.Errorf("health check events = %q, want api healthy on app1 and app2", checks)
+	}
+	if overlap.Load() {
+		t.Error("callbacks ran concurrently")
+	}
+}
+
+func TestSlowHooksDoNotBlockTheRun(t *testing.T) {
+	hosts := newFakeHosts(t)
+	cfg := fakeEnvironment(service("api", "app1"), service("web", "app2"))
+
+	var sawWebRunning atomic.Bool
+	o := newTestOrchestrator(t, cfg, Options{Hooks: Hooks{
+		OnStepStart: func(ev StepEvent) {
+			if ev.Step != "api" {
+				return
+			}
+			// Hold up delivery until the run has moved on to later steps
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) && !hosts.isRunning("app2", "web") {
+				time.Sleep(5 * time.Millisecond)
+			}
+			sawWebRunning.Store(hosts.isRunning("app2", "web"))
+		},
+	}})
+
+	if err := o.Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	if !sawWebRunning.Load() {
+		t.Error("the run waited for a slow callback")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writes
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCISections(t *testing.T) {
+	tests := []struct {
+		format     string
+		start, end string
+	}{
+		{format: ci.FormatGitLab, start: "section_start:", end: "section_end:"},
+		{format: ci.FormatGitHub, start: "::group::", end: "::endgroup::"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			newFakeHosts(t)
+			var out lockedBuffer
+			sections, err := ci.NewSections(&out, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := fakeEnvironment(service("api", "app1", "app2"), service("web", "app3"))
+			o := newTestOrchestrator(t, cfg, Options{
+				Logger:   slog.New(slog.NewTextHandler(&out, nil)),
+				Sections: sections,
+			})
+			if err := o.Up(context.Background()); err != nil {
+				t.Fatalf("Up: %v", err)
+			}
+
+			// Every log line naming a step falls inside that step's section
+			open := ""
+			sectionsSeen := 0
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				switch {
+				case strings.Contains(line, tt.start):
+					if open != "" {
+						t.Fatalf("section opened inside %s: %q", open, line)
+					}
+					for _, step := range []string{"api", "web"} {
+						if strings.Contains(line, fmt.Sprintf(": %s (application)", step)) {
+							open = step
+						}
+					}
+					if open == "" {
+						t.Fatalf("section start names no step: %q", line)
+					}
+					sectionsSeen++
+				case strings.Contains(line, tt.end):
+					if open == "" {
+						t.Fatalf("section closed with none open: %q", line)
+					}
+					if tt.format == ci.FormatGitLab && !strings.Contains(line, "_"+open) {
+						t.Errorf("section end %q does not match %s", line, open)
+					}
+					open = ""
+				case strings.Contains(line, " step_number="):
+					if !strings.Contains(line, "step="+open) || open == "" {
+						t.Errorf("log line outside its step's section (open %q): %q", open, line)
+					}
+				}
+			}
+			if open != "" || sectionsSeen != 2 {
+				t.Errorf("saw %d sections, %q left open, want one per step all closed", sectionsSeen, open)
+			}
+		})
+	}
+}
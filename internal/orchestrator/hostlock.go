@@ -0,0 +1,148 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"orchid/internal/audit"
+	"orchid/internal/ci"
+	"orchid/internal/config"
+	"orchid/internal/retry"
+)
+
+// Host lock modes for Options.HostLock
+const (
+	HostLockOff  = ""
+	HostLockFail = "fail"
+	HostLockWait = "wait"
+)
+
+// ErrHostLocked is returned when another run is acting on a host
+var ErrHostLocked = errors.New("host is locked by another run")
+
+// lockHosts takes an exclusive lock on every host used by the sequence so
+// that runs against different environments sharing a host don't overlap.
+// Locks are taken in hostname order to avoid deadlocks between runs. In
+// wait mode it gives up after Options.LockWait, if set, or when interrupt
+// is done.
+//
+// A lock held by an earlier job of the same CI pipeline is re-entered rather
+// than contended, so a retried job doesn't wait on its own locks. A forced
+// down goes ahead without locks it can't take; up never does.
+func (o *Orchestrator) lockHosts(ctx, interrupt context.Context, env config.Environment) (func(), error) {
+	if o.options.HostLock == HostLockOff || o.dryRun {
+		return func() {}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(interrupt, cancel)()
+	if o.options.LockWait > 0 {
+		ctx, cancel = context.WithTimeout(ctx, o.options.LockWait)
+		defer cancel()
+	}
+
+	var held []string
+	release := func() {
+		for _, key := range held {
+			if err := o.locks.Release(key); err != nil {
+				o.warn(o.logger, Warning{Host: key, Message: "failed to release host lock", Error: err.Error()},
+					slog.String("host", key),
+					slog.String("error", err.Error()))
+			}
+		}
+	}
+
+	holder := LockHolder{Environment: o.env, PipelineID: ci.Detect().PipelineID, PID: os.Getpid()}
+	for _, hostname := range sequenceHostnames(env) {
+		if err := o.lockHost(ctx, hostname, holder); err != nil {
+			release()
+			if interrupt.Err() != nil {
+				return nil, fmt.Errorf("%w while waiting for host locks: %w", ErrAborted, err)
+			}
+			return nil, err
+		}
+		held = append(held, hostname)
+	}
+
+	return release, nil
+}
+
+// lockPollInterval is how often a held host lock is first retried in wait
+// mode, backing off to five times as long
+var lockPollInterval = time.Second
+
+func (o *Orchestrator) lockHost(ctx context.Context, hostname string, holder LockHolder) error {
+	policy := retry.Policy{Attempts: 1}
+	if o.options.HostLock == HostLockWait {
+		policy = retry.Policy{BaseInterval: lockPollInterval, MaxInterval: 5 * lockPollInterval}
+	}
+
+	waitStart := time.Now()
+	return retry.Do(ctx, policy, func(ctx context.Context) error {
+		err := o.locks.Acquire(ctx, hostname, holder)
+		if !errors.Is(err, ErrLockHeld) {
+			return err
+		}
+
+		current := o.lockHolder(hostname)
+		if o.options.HostLock == HostLockWait {
+			o.logger.Info("waiting for host lock",
+				slog.String("host", hostname),
+				slog.String("held_by", current),
+				slog.Duration("waited", time.Since(waitStart).Round(time.Second)))
+		}
+		return fmt.Errorf("%w: %s (held by %s)", ErrHostLocked, hostname, current)
+	})
+}
+
+// overrideHostLock lets a forced down proceed without the host locks it
+// could not take, logging and auditing the override since another run may
+// be acting on the same hosts
+func (o *Orchestrator) overrideHostLock(lockErr error) {
+	o.warn(o.logger, Warning{Message: "proceeding without host locks because of --force; another run may be acting on these hosts", Error: lockErr.Error()},
+		slog.String("error", lockErr.Error()))
+	if o.options.Audit != nil {
+		err := o.options.Audit.Append(audit.Record{
+			Environment: o.env,
+			Action:      "down",
+			Result:      "lock override",
+			Error:       "forced despite host lock: " + lockErr.Error(),
+		})
+		if err != nil {
+			o.logger.Error("failed to write audit record", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (o *Orchestrator) lockHolder(hostname string) string {
+	holder, err := o.locks.Read(hostname)
+	if err != nil || holder == nil {
+		return "unknown"
+	}
+	return holder.String()
+}
+
+// sequenceHostnames returns the sorted, distinct hostnames used by the
+// environment's sequence
+func sequenceHostnames(env config.Environment) []string {
+	seen := make(map[string]bool)
+	var hostnames []string
+	for _, step := range env.Sequence {
+		for _, name := range step.Hosts {
+			host, ok := env.Hosts[name]
+			if !ok || seen[host.Hostname] {
+				continue
+			}
+			seen[host.Hostname] = true
+			hostnames = append(hostnames, host.Hostname)
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
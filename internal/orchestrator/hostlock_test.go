@@ -0,0 +1,309 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"orchid/internal/audit"
+	"orchid/internal/config"
+)
+
+// newTestOrchestrator returns an orchestrator for the "test" environment of
+// cfg, or the one opts names, discarding its logs. Unless opts says otherwise it waits only
+// briefly for services to start and gives up on health checks quickly.
+func newTestOrchestrator(t *testing.T, cfg *config.Config, opts Options) *Orchestrator {
+	t.Helper()
+
+	opts.Config = cfg
+	if opts.Environment == "" {
+		opts.Environment = "test"
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	opts.StartWait = firstDuration(opts.StartWait, time.Millisecond)
+	opts.HealthCheckInterval = firstDuration(opts.HealthCheckInterval, 10*time.Millisecond)
+	opts.HealthCheckTimeout = firstDuration(opts.HealthCheckTimeout, 200*time.Millisecond)
+	if opts.StateDir == "" {
+		opts.StateDir = t.TempDir()
+	}
+	o, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(o.Close)
+	return o
+}
+
+// inPipeline makes runs started by the rest of the test belong to CI
+// pipeline id, or to no pipeline when id is empty
+func inPipeline(t *testing.T, id string) {
+	t.Helper()
+	t.Setenv("GITHUB_ACTIONS", "")
+	t.Setenv("JENKINS_URL", "")
+	t.Setenv("GITLAB_CI", "true")
+	t.Setenv("CI_PIPELINE_ID", id)
+}
+
+func TestLockHostsSamePipelineReenters(t *testing.T) {
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Hosts:    map[string]config.Host{"app": {Hostname: "app.example.com"}},
+			Sequence: []config.Step{{Name: "app", Hosts: []string{"app"}}},
+		},
+	}}
+	env := cfg.Environments["test"]
+	dir := t.TempDir()
+
+	// Each orchestrator gets its own backend, as separate runs would
+	inPipeline(t, "42")
+	first := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(dir)})
+	release, err := first.lockHosts(context.Background(), context.Background(), env)
+	if err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	defer release()
+
+	retried := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(dir)})
+	releaseRetry, err := retried.lockHosts(context.Background(), context.Background(), env)
+	if err != nil {
+		t.Fatalf("retry of the same pipeline: %v", err)
+	}
+	releaseRetry()
+
+	// The retry's release left the lock with the first run
+	inPipeline(t, "43")
+	other := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(dir)})
+	if _, err := other.lockHosts(context.Background(), context.Background(), env); !errors.Is(err, ErrHostLocked) {
+		t.Errorf("err = %v, want %v while the first run holds the lock", err, ErrHostLocked)
+	}
+}
+
+func TestLockHostsDifferentPipelineContends(t *testing.T) {
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Hosts:    map[string]config.Host{"app": {Hostname: "app.example.com"}},
+			Sequence: []config.Step{{Name: "app", Hosts: []string{"app"}}},
+		},
+	}}
+	env := cfg.Environments["test"]
+	dir := t.TempDir()
+
+	inPipeline(t, "42")
+	first := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(dir)})
+	release, err := first.lockHosts(context.Background(), context.Background(), env)
+	if err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+
+	for _, pipeline := range []string{"43", ""} {
+		inPipeline(t, pipeline)
+		second := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(dir)})
+		_, err := second.lockHosts(context.Background(), context.Background(), env)
+		if !errors.Is(err, ErrHostLocked) {
+			t.Fatalf("pipeline %q: err = %v, want %v while the first run holds the lock", pipeline, err, ErrHostLocked)
+		}
+		if !strings.Contains(err.Error(), "pipeline 42") {
+			t.Errorf("pipeline %q: err = %v, want it to name the holding pipeline", pipeline, err)
+		}
+	}
+
+	release()
+	second := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(dir)})
+	release, err = second.lockHosts(context.Background(), context.Background(), env)
+	if err != nil {
+		t.Fatalf("after the first run released its locks: %v", err)
+	}
+	release()
+}
+
+func TestLockHostsSharedAcrossEnvironments(t *testing.T) {
+	inPipeline(t, "")
+	hosts := newFakeHosts(t)
+	shared := config.Host{Hostname: "shared.example.com", Transport: "mock"}
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Hosts:    map[string]config.Host{"app": shared},
+			Sequence: []config.Step{service("api", "app")},
+		},
+		"staging": {
+			Hosts:    map[string]config.Host{"box": shared, "other": {Hostname: "other.example.com", Transport: "mock"}},
+			Sequence: []config.Step{service("web", "box", "other")},
+		},
+	}}
+	dir := t.TempDir()
+
+	first := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(dir)})
+	release, err := first.lockHosts(context.Background(), context.Background(), cfg.Environments["test"])
+	if err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+
+	second := newTestOrchestrator(t, cfg, Options{Environment: "staging", HostLock: HostLockFail, LockBackend: NewFileLockBackend(dir)})
+	err = second.Up(context.Background())
+	if !errors.Is(err, ErrHostLocked) {
+		t.Fatalf("err = %v, want %v", err, ErrHostLocked)
+	}
+	if !strings.Contains(err.Error(), "shared.example.com") || !strings.Contains(err.Error(), "environment test") {
+		t.Errorf("err = %v, want it to name the shared host and the environment holding it", err)
+	}
+	if ran := hosts.commands(); len(ran) > 0 {
+		t.Errorf("blocked run ran %q", ran)
+	}
+
+	release()
+	if err := second.Up(context.Background()); err != nil {
+		t.Fatalf("after the first run released its locks: %v", err)
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	inPipeline(t, "")
+	lockPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { lockPollInterval = time.Second })
+
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Hosts:    map[string]config.Host{"app": {Hostname: "app.example.com"}},
+			Sequence: []config.Step{{Name: "app", Hosts: []string{"app"}}},
+		},
+	}}
+	env := cfg.Environments["test"]
+
+	tests := []struct {
+		name      string
+		releaseIn time.Duration // 0 never releases the first run's lock
+		interrupt bool
+		wantErr   error
+	}{
+		{name: "released mid-wait", releaseIn: 100 * time.Millisecond},
+		{name: "timed out", wantErr: ErrHostLocked},
+		{name: "interrupted", interrupt: true, wantErr: ErrAborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			first := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(dir)})
+			release, err := first.lockHosts(context.Background(), context.Background(), env)
+			if err != nil {
+				t.Fatalf("first run: %v", err)
+			}
+			t.Cleanup(release)
+			if tt.releaseIn > 0 {
+				time.AfterFunc(tt.releaseIn, release)
+			}
+
+			interrupt, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.interrupt {
+				time.AfterFunc(100*time.Millisecond, cancel)
+			}
+
+			var logs bytes.Buffer
+			second := newTestOrchestrator(t, cfg, Options{
+				LockWait:    time.Second,
+				LockBackend: NewFileLockBackend(dir),
+				Logger:      slog.New(slog.NewTextHandler(&logs, nil)),
+			})
+			release2, err := second.lockHosts(context.Background(), interrupt, env)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				release2()
+			}
+			if !strings.Contains(logs.String(), "waiting for host lock") || !strings.Contains(logs.String(), "held_by=\"environment test") {
+				t.Errorf("logs do not say who holds the lock:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestLockWaitNeedsWaitMode(t *testing.T) {
+	_, err := New(Options{HostLock: HostLockFail, LockWait: time.Minute})
+	if err == nil {
+		t.Error("New accepted a lock wait with host lock mode fail")
+	}
+}
+
+func TestForceOverridesHostLocks(t *testing.T) {
+	tests := []struct {
+		name         string
+		action       string
+		force        bool
+		wantErr      bool
+		wantOverride bool
+	}{
+		{name: "down", action: ActionDown, wantErr: true},
+		{name: "forced down", action: ActionDown, force: true, wantOverride: true},
+		{name: "up", action: ActionUp, wantErr: true},
+		{name: "forced up", action: ActionUp, force: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.start("api1", "api")
+			cfg := fakeEnvironment(service("api", "api1"))
+			lockDir := t.TempDir()
+
+			// A stuck run from another pipeline holds the host lock
+			inPipeline(t, "42")
+			stuck := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: NewFileLockBackend(lockDir)})
+			release, err := stuck.lockHosts(context.Background(), context.Background(), cfg.Environments["test"])
+			if err != nil {
+				t.Fatalf("lockHosts: %v", err)
+			}
+			defer release()
+
+			inPipeline(t, "43")
+			auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+			o := newTestOrchestrator(t, cfg, Options{
+				HostLock:    HostLockFail,
+				LockBackend: NewFileLockBackend(lockDir),
+				Force:       tt.force,
+				Audit:       audit.NewWriter(auditPath),
+			})
+			run := o.Up
+			if tt.action == ActionDown {
+				run = o.Down
+			}
+
+			err = run(context.Background())
+			if tt.wantErr {
+				if !errors.Is(err, ErrHostLocked) {
+					t.Errorf("err = %v, want %v", err, ErrHostLocked)
+				}
+			} else if err != nil {
+				t.Fatalf("%s: %v", tt.action, err)
+			}
+			if stopped := !hosts.isRunning("api1", "api"); stopped != tt.wantOverride {
+				t.Errorf("api stopped %t, want %t", stopped, tt.wantOverride)
+			}
+
+			records, err := audit.Read(auditPath, time.Time{})
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.Fatal(err)
+			}
+			var overridden bool
+			for _, r := range records {
+				if r.Result == "lock override" {
+					overridden = true
+					if !strings.Contains(r.Error, "pipeline 42") {
+						t.Errorf("audit error = %q, want the lock holder named", r.Error)
+					}
+				}
+			}
+			if overridden != tt.wantOverride {
+				t.Errorf("audited a lock override %t, want %t: %+v", overridden, tt.wantOverride, records)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gofrs/flock"
+)
+
+// ErrLockHeld is returned by LockBackend.Acquire when another holder has the
+// lock
+var ErrLockHeld = errors.New("lock is held by another holder")
+
+// LockHolder identifies the run holding a lock. Backends store it as JSON.
+type LockHolder struct {
+	Environment string `json:"environment"`
+	PipelineID  string `json:"pipeline_id,omitempty"` // CI pipeline of the run, if any
+	PID         int    `json:"pid"`
+}
+
+func (h LockHolder) String() string {
+	if h.PipelineID != "" {
+		return fmt.Sprintf("environment %s, pipeline %s, pid %d", h.Environment, h.PipelineID, h.PID)
+	}
+	return fmt.Sprintf("environment %s, pid %d", h.Environment, h.PID)
+}
+
+// SamePipeline reports whether h and other are runs of the same CI pipeline,
+// such as a job and its retry
+func (h LockHolder) SamePipeline(other LockHolder) bool {
+	return h.PipelineID != "" && h.PipelineID == other.PipelineID
+}
+
+// LockBackend stores the locks orchid takes on shared resources. The default
+// is FileLockBackend, which only coordinates runs on the same machine; runs
+// from ephemeral containers across machines need a shared backend such as
+// Redis or Consul.
+//
+// Implementations must be safe for concurrent use.
+type LockBackend interface {
+	// Acquire takes the lock named key for holder without blocking, returning
+	// an error wrapping ErrLockHeld if someone else has it. A lock whose
+	// holder is of the same CI pipeline is re-entered instead, so a retried
+	// job doesn't deadlock on locks its earlier attempt left behind: Acquire
+	// succeeds and the matching Release leaves the lock with its holder.
+	Acquire(ctx context.Context, key string, holder LockHolder) error
+
+	// Release gives up a lock previously taken with Acquire
+	Release(key string) error
+
+	// Read returns the holder recorded for key, or nil if it isn't known
+	Read(key string) (*LockHolder, error)
+}
+
+// FileLockBackend implements LockBackend with flock-ed files in Dir. Each
+// lock's holder is recorded in a file beside it, as Windows locks stop
+// other processes reading the locked file.
+type FileLockBackend struct {
+	Dir string
+
+	mu        sync.Mutex
+	locks     map[string]*flock.Flock
+	reentered map[string]int // Re-entries not yet released, by key
+}
+
+// NewFileLockBackend returns a FileLockBackend storing lock files in dir
+func NewFileLockBackend(dir string) *FileLockBackend {
+	return &FileLockBackend{Dir: dir, locks: make(map[string]*flock.Flock), reentered: make(map[string]int)}
+}
+
+func (b *FileLockBackend) path(key string) string {
+	return filepath.Join(b.Dir, key+".lock")
+}
+
+func (b *FileLockBackend) holderPath(key string) string {
+	return filepath.Join(b.Dir, key+".holder")
+}
+
+func (b *FileLockBackend) Acquire(ctx context.Context, key string, holder LockHolder) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.locks[key]; !ok {
+		locked, err := b.lock(key, holder)
+		if err != nil || locked {
+			return err
+		}
+	}
+
+	if current, err := b.Read(key); err == nil && current != nil && holder.SamePipeline(*current) {
+		b.reentered[key]++
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrLockHeld, key)
+}
+
+// lock takes the file lock for key and records holder beside it, reporting
+// false if another process has it
+func (b *FileLockBackend) lock(key string, holder LockHolder) (bool, error) {
+	if err := os.MkdirAll(b.Dir, 0o755); err != nil {
+		return false, fmt.Errorf("failed to create lock directory '%s': %w", b.Dir, err)
+	}
+
+	path := b.path(key)
+	lock := flock.New(path, flock.SetPermissions(0o644))
+	locked, err := lock.TryLock()
+	if err != nil {
+		return false, fmt.Errorf("failed to lock '%s': %w", path, err)
+	}
+	if !locked {
+		return false, nil
+	}
+
+	// Record the holder so contending runs can say who they are waiting on
+	data, err := json.Marshal(holder)
+	if err == nil {
+		err = os.WriteFile(b.holderPath(key), data, 0o644)
+	}
+	if err != nil {
+		lock.Unlock()
+		return false, fmt.Errorf("failed to record lock holder: %w", err)
+	}
+
+	b.locks[key] = lock
+	return true, nil
+}
+
+func (b *FileLockBackend) Release(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.reentered[key] > 0 {
+		b.reentered[key]--
+		return nil
+	}
+	lock, ok := b.locks[key]
+	if !ok {
+		return nil
+	}
+	delete(b.locks, key)
+
+	err := os.Remove(b.holderPath(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("failed to remove lock holder: %w", err)
+	} else {
+		err = nil
+	}
+	// Unlock also closes the lock file
+	return errors.Join(err, lock.Unlock())
+}
+
+func (b *FileLockBackend) Read(key string) (*LockHolder, error) {
+	f, err := os.Open(b.holderPath(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, 1024))
+	if err != nil {
+		return nil, err
+	}
+	var holder LockHolder
+	if err := json.Unmarshal(data, &holder); err != nil {
+		return nil, fmt.Errorf("failed to parse lock holder '%s': %w", b.holderPath(key), err)
+	}
+	return &holder, nil
+}
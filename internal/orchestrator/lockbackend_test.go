@@ -0,0 +1,246 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+// memLockBackend is a LockBackend kept in memory, standing in for a shared
+// backend such as Redis that several orchestrators point at
+type memLockBackend struct {
+	mu        sync.Mutex
+	holders   map[string]LockHolder
+	reentered map[string]int
+}
+
+func newMemLockBackend() *memLockBackend {
+	return &memLockBackend{holders: make(map[string]LockHolder), reentered: make(map[string]int)}
+}
+
+func (b *memLockBackend) Acquire(ctx context.Context, key string, holder LockHolder) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current, ok := b.holders[key]
+	switch {
+	case !ok:
+		b.holders[key] = holder
+		return nil
+	case holder.SamePipeline(current):
+		b.reentered[key]++
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrLockHeld, key)
+	}
+}
+
+func (b *memLockBackend) Release(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reentered[key] > 0 {
+		b.reentered[key]--
+		return nil
+	}
+	delete(b.holders, key)
+	return nil
+}
+
+func (b *memLockBackend) Read(key string) (*LockHolder, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if holder, ok := b.holders[key]; ok {
+		return &holder, nil
+	}
+	return nil, nil
+}
+
+func (b *memLockBackend) keys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for key := range b.holders {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// testLockBackend checks the LockBackend contract against backend
+func testLockBackend(t *testing.T, backend LockBackend) {
+	t.Helper()
+	ctx := context.Background()
+	first := LockHolder{Environment: "prod", PID: 100}
+	second := LockHolder{Environment: "staging", PID: 200}
+
+	if err := backend.Acquire(ctx, "app.example.com", first); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := backend.Acquire(ctx, "app.example.com", second); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("second Acquire err = %v, want %v", err, ErrLockHeld)
+	}
+	if holder, err := backend.Read("app.example.com"); err != nil || holder == nil || *holder != first {
+		t.Errorf("Read = %v, %v, want the first run", holder, err)
+	}
+	if err := backend.Acquire(ctx, "db.example.com", second); err != nil {
+		t.Errorf("Acquire of another key: %v", err)
+	}
+
+	if err := backend.Release("app.example.com"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if holder, err := backend.Read("app.example.com"); err != nil || holder != nil {
+		t.Errorf("Read after Release = %v, %v, want no holder", holder, err)
+	}
+	if err := backend.Acquire(ctx, "app.example.com", second); err != nil {
+		t.Errorf("Acquire after Release: %v", err)
+	}
+	if err := backend.Release("unknown.example.com"); err != nil {
+		t.Errorf("Release of a lock never taken: %v", err)
+	}
+}
+
+// testLockBackendPipelines checks that first and second, which may be the
+// same backend, let a run re-enter a lock held by its own CI pipeline and
+// only that
+func testLockBackendPipelines(t *testing.T, first, second LockBackend) {
+	t.Helper()
+	ctx := context.Background()
+	job := LockHolder{Environment: "prod", PipelineID: "42", PID: 100}
+
+	if err := first.Acquire(ctx, "app.example.com", job); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	for _, other := range []LockHolder{
+		{Environment: "prod", PipelineID: "43", PID: 200},
+		{Environment: "prod", PID: 200},
+	} {
+		if err := second.Acquire(ctx, "app.example.com", other); !errors.Is(err, ErrLockHeld) {
+			t.Errorf("Acquire by %s: err = %v, want %v", other, err, ErrLockHeld)
+		}
+	}
+
+	retry := LockHolder{Environment: "prod", PipelineID: "42", PID: 300}
+	if err := second.Acquire(ctx, "app.example.com", retry); err != nil {
+		t.Fatalf("Acquire by the same pipeline: %v", err)
+	}
+	if err := second.Release("app.example.com"); err != nil {
+		t.Fatalf("Release of the re-entered lock: %v", err)
+	}
+
+	// Releasing the re-entered lock left it with the job that took it
+	if holder, err := second.Read("app.example.com"); err != nil || holder == nil || *holder != job {
+		t.Errorf("Read after releasing the re-entry = %v, %v, want %s", holder, err, job)
+	}
+	if err := second.Acquire(ctx, "app.example.com", LockHolder{Environment: "prod", PID: 200}); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("err = %v, want the lock still held", err)
+	}
+
+	if err := first.Release("app.example.com"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if holder, err := second.Read("app.example.com"); err != nil || holder != nil {
+		t.Errorf("Read after Release = %v, %v, want no holder", holder, err)
+	}
+}
+
+func TestLockBackends(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testLockBackend(t, newMemLockBackend())
+		backend := newMemLockBackend()
+		testLockBackendPipelines(t, backend, backend)
+	})
+	t.Run("file", func(t *testing.T) {
+		testLockBackend(t, NewFileLockBackend(t.TempDir()))
+		backend := NewFileLockBackend(t.TempDir())
+		testLockBackendPipelines(t, backend, backend)
+	})
+	t.Run("file across backends", func(t *testing.T) {
+		// Separate backends on one directory contend like separate runs
+		dir := t.TempDir()
+		testLockBackendPipelines(t, NewFileLockBackend(dir), NewFileLockBackend(dir))
+	})
+}
+
+func TestFileLockBackendHolder(t *testing.T) {
+	dir := t.TempDir()
+	backend := NewFileLockBackend(dir)
+	holder := LockHolder{Environment: "prod", PipelineID: "42", PID: 100}
+	if err := backend.Acquire(context.Background(), "app.example.com", holder); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer backend.Release("app.example.com")
+
+	data, err := os.ReadFile(filepath.Join(dir, "app.example.com.holder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"environment":"prod","pipeline_id":"42","pid":100}`; string(data) != want {
+		t.Errorf("holder file = %s, want %s", data, want)
+	}
+}
+
+func TestFileLockBackendHolderErrors(t *testing.T) {
+	dir := t.TempDir()
+	backend := NewFileLockBackend(dir)
+
+	// A directory in the way of the holder file makes recording it fail
+	blocked := filepath.Join(dir, "app.example.com.holder")
+	if err := os.Mkdir(blocked, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := backend.Acquire(context.Background(), "app.example.com", LockHolder{Environment: "prod", PID: 100})
+	if err == nil || errors.Is(err, ErrLockHeld) || !strings.Contains(err.Error(), "failed to record lock holder") {
+		t.Fatalf("err = %v, want a failure to record the holder", err)
+	}
+
+	// The lock was given back, so it can be taken once the holder can be
+	// recorded
+	if err := os.Remove(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFileLockBackend(dir).Acquire(context.Background(), "app.example.com", LockHolder{Environment: "prod", PID: 200}); err != nil {
+		t.Fatalf("Acquire after a failed Acquire: %v", err)
+	}
+}
+
+func TestLockHostsUsesBackend(t *testing.T) {
+	inPipeline(t, "")
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Hosts: map[string]config.Host{
+				"web": {Hostname: "web.example.com"},
+				"db":  {Hostname: "db.example.com"},
+			},
+			Sequence: []config.Step{{Name: "db", Hosts: []string{"db"}}, {Name: "web", Hosts: []string{"web"}}},
+		},
+	}}
+	env := cfg.Environments["test"]
+	backend := newMemLockBackend()
+
+	first := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: backend})
+	release, err := first.lockHosts(context.Background(), context.Background(), env)
+	if err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	if got, want := backend.keys(), []string{"db.example.com", "web.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("locked %q, want %q", got, want)
+	}
+
+	second := newTestOrchestrator(t, cfg, Options{HostLock: HostLockFail, LockBackend: backend})
+	if _, err := second.lockHosts(context.Background(), context.Background(), env); !errors.Is(err, ErrHostLocked) {
+		t.Fatalf("second run err = %v, want %v", err, ErrHostLocked)
+	}
+
+	release()
+	if keys := backend.keys(); len(keys) > 0 {
+		t.Errorf("locks %q still held after release", keys)
+	}
+}
@@ -0,0 +1,144 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"orchid/internal/config"
+	"orchid/internal/redact"
+	"orchid/internal/ssh"
+)
+
+// Logs runs the named step's log_command on each of its hosts and copies
+// their output to w as it arrives, each line prefixed with the host name,
+// until every command exits or ctx is cancelled. Cancelling ctx is the normal
+// way to stop following logs and is not reported as an error.
+func (o *Orchestrator) Logs(ctx context.Context, stepName string, w io.Writer) error {
+	env, err := LookupEnvironment(o.cfg, o.env)
+	if err != nil {
+		return err
+	}
+
+	var step config.Step
+	found := false
+	for _, s := range env.Sequence {
+		if s.Name == stepName {
+			step, found = s, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("step %s not found in environment", stepName)
+	}
+	if step.LogCommand == "" {
+		return fmt.Errorf("step %s has no log_command", stepName)
+	}
+
+	// Render every host's command first so a template or allow-list error
+	// doesn't leave some hosts streaming
+	cmds := make(map[string]string, len(step.Hosts))
+	for _, hostName := range step.Hosts {
+		host, ok := env.Hosts[hostName]
+		if !ok {
+			return fmt.Errorf("host %s not found in environment", hostName)
+		}
+		cmd, err := o.hostCommand(env, step, host, step.LogCommand)
+		if err != nil {
+			return fmt.Errorf("host %s: %w", hostName, err)
+		}
+		cmds[hostName] = cmd
+	}
+
+	if o.dryRun {
+		o.logger.Info("dry run - would follow logs",
+			slog.String("step", step.Name),
+			slog.Any("hosts", step.Hosts),
+			slog.String("command", step.LogCommand))
+		return nil
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make([]error, len(step.Hosts))
+	)
+	for i, hostName := range step.Hosts {
+		wg.Add(1)
+		go func(i int, hostName string) {
+			defer wg.Done()
+
+			out := &prefixWriter{w: w, mu: &mu, prefix: hostName + " | ", redactor: o.redactor}
+			defer out.Flush()
+
+			client, err := o.connect(ctx, asUser(env.Hosts[hostName], step.CheckUser), env.SSHDefaults)
+			if err != nil {
+				errs[i] = fmt.Errorf("host %s: %w", hostName, err)
+				return
+			}
+
+			// A pseudo-terminal makes the remote side hang up the command
+			// when the stream is closed, rather than leaving tail -f running
+			err = client.Stream(ctx, cmds[hostName], ssh.ExecOptions{RequestPTY: true, Shell: step.Shell}, out)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				errs[i] = fmt.Errorf("host %s: %w", hostName, err)
+			}
+		}(i, hostName)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// prefixWriter writes each complete line it receives to w with prefix in
+// front and secrets redacted, holding back a trailing partial line until it
+// is completed or flushed. Writers sharing mu never interleave within a line.
+type prefixWriter struct {
+	w        io.Writer
+	mu       *sync.Mutex
+	prefix   string
+	redactor *redact.Redactor
+	buf      []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:i]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes any partial line still buffered
+func (p *prefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLine(p.buf)
+	p.buf = nil
+	return err
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	// Output through a pseudo-terminal ends lines with \r\n
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.redactor.String(string(line)))
+	return err
+}
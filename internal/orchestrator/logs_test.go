@@ -0,0 +1,123 @@
+package orchestrator
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh"
+)
+
+// streamingTransport streams output to Stream's writer in small chunks that
+// split lines, then returns err or, when follow is set, waits for ctx
+type streamingTransport struct {
+	mockTransport
+	output string
+	follow bool
+	err    error
+}
+
+func (s *streamingTransport) Stream(ctx context.Context, cmd string, opts ssh.ExecOptions, w io.Writer) error {
+	s.ExecuteWith(ctx, cmd, opts)
+	for out := s.output; out != ""; {
+		n := min(len(out), 5)
+		if _, err := w.Write([]byte(out[:n])); err != nil {
+			return err
+		}
+		out = out[n:]
+	}
+	if s.follow {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.err
+}
+
+func TestLogs(t *testing.T) {
+	tests := []struct {
+		name    string
+		web2Err error
+		follow  bool
+		wantErr string
+	}{
+		{name: "commands exit"},
+		{name: "followed until cancelled", follow: true},
+		{name: "one host fails", web2Err: exitError(1), wantErr: "host web2: command exited with status 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streams := map[string]*streamingTransport{
+				"web1": {output: "starting\r\nlistening token=abc\r\n", follow: tt.follow},
+				"web2": {output: "starting\nready", follow: tt.follow, err: tt.web2Err},
+			}
+			transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+				return streams[host.Hostname], nil
+			}
+			t.Cleanup(func() { delete(transports, "mock") })
+
+			step := service("web", "web1", "web2")
+			step.LogCommand = "tail -F /var/log/{{.Name}}.log"
+			cfg := fakeEnvironment(step)
+			env := cfg.Environments["test"]
+			env.Redact = []string{`token=\S+`}
+			cfg.Environments["test"] = env
+			o := newTestOrchestrator(t, cfg, Options{})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.follow {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+			var out lockedBuffer
+			done := make(chan error)
+			go func() { done <- o.Logs(ctx, "web", &out) }()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Logs did not return")
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+
+			// Each host's lines arrive whole, prefixed, redacted and in order,
+			// with a trailing partial line flushed at the end
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			var web1, web2 []string
+			for _, line := range lines {
+				switch {
+				case strings.HasPrefix(line, "web1 | "):
+					web1 = append(web1, line)
+				case strings.HasPrefix(line, "web2 | "):
+					web2 = append(web2, line)
+				default:
+					t.Errorf("line %q has no host prefix", line)
+				}
+			}
+			if want := []string{"web1 | starting", "web1 | listening [REDACTED]"}; !slices.Equal(web1, want) {
+				t.Errorf("web1 lines = %q, want %q", web1, want)
+			}
+			if want := []string{"web2 | starting", "web2 | ready"}; !slices.Equal(web2, want) {
+				t.Errorf("web2 lines = %q, want %q", web2, want)
+			}
+
+			if ran := streams["web1"].ran(); !slices.Equal(ran, []string{"tail -F /var/log/web.log"}) {
+				t.Errorf("web1 ran %q, want the rendered log_command", ran)
+			}
+		})
+	}
+}
+
+func TestLogsWithoutLogCommand(t *testing.T) {
+	o := newTestOrchestrator(t, fakeEnvironment(service("web", "web1")), Options{})
+	err := o.Logs(context.Background(), "web", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "step web has no log_command") {
+		t.Errorf("err = %v, want the missing log_command reported", err)
+	}
+}
@@ -0,0 +1,75 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrFrozen is returned when an environment is in maintenance mode
+var ErrFrozen = errors.New("environment is frozen for maintenance")
+
+// Maintenance describes why and by whom an environment was frozen
+type Maintenance struct {
+	Reason   string    `json:"reason,omitempty"`
+	User     string    `json:"user,omitempty"`
+	FrozenAt time.Time `json:"frozen_at"`
+}
+
+func maintenancePath(stateDir, env string) string {
+	return filepath.Join(stateDir, env+".maintenance")
+}
+
+// Freeze puts the environment into maintenance mode, blocking up and down
+// until Unfreeze is called
+func Freeze(stateDir, env, reason string) error {
+	m := Maintenance{
+		Reason:   reason,
+		User:     currentUsername(),
+		FrozenAt: time.Now().UTC(),
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode maintenance marker: %w", err)
+	}
+
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory '%s': %w", stateDir, err)
+	}
+	if err := os.WriteFile(maintenancePath(stateDir, env), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write maintenance marker: %w", err)
+	}
+	return nil
+}
+
+// Unfreeze takes the environment out of maintenance mode. It is not an
+// error if the environment was not frozen.
+func Unfreeze(stateDir, env string) error {
+	err := os.Remove(maintenancePath(stateDir, env))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove maintenance marker: %w", err)
+	}
+	return nil
+}
+
+// Frozen returns the maintenance marker for the environment, or nil if it
+// is not frozen
+func Frozen(stateDir, env string) (*Maintenance, error) {
+	data, err := os.ReadFile(maintenancePath(stateDir, env))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance marker: %w", err)
+	}
+
+	var m Maintenance
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse maintenance marker: %w", err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,90 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"orchid/internal/audit"
+)
+
+func TestFrozenEnvironment(t *testing.T) {
+	tests := []struct {
+		name    string
+		force   bool
+		wantErr error
+	}{
+		{name: "blocked", wantErr: ErrFrozen},
+		{name: "forced", force: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			stateDir := t.TempDir()
+			if err := Freeze(stateDir, "test", "incident 42"); err != nil {
+				t.Fatalf("Freeze: %v", err)
+			}
+
+			auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+			o := newTestOrchestrator(t, fakeEnvironment(service("web", "web1")), Options{
+				StateDir: stateDir,
+				Force:    tt.force,
+				Audit:    audit.NewWriter(auditPath),
+			})
+
+			for _, run := range []struct {
+				action string
+				fn     func(context.Context) error
+			}{{"up", o.Up}, {"down", o.Down}} {
+				err := run.fn(context.Background())
+				if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+					t.Errorf("%s: err = %v, want %v", run.action, err, tt.wantErr)
+				}
+			}
+			if ran := len(hosts.commands()) > 0; ran != tt.force {
+				t.Errorf("commands = %q, want commands run only when forced", hosts.commands())
+			}
+
+			records, err := audit.Read(auditPath, time.Time{})
+			if err != nil {
+				t.Fatalf("failed to read the audit log: %v", err)
+			}
+			var overrides int
+			for _, rec := range records {
+				if rec.Result == "maintenance override" {
+					overrides++
+				}
+			}
+			if tt.force && overrides != 2 {
+				t.Errorf("audit records = %+v, want both forced runs audited as overrides", records)
+			}
+		})
+	}
+}
+
+func TestUnfreeze(t *testing.T) {
+	stateDir := t.TempDir()
+	if err := Unfreeze(stateDir, "test"); err != nil {
+		t.Errorf("Unfreeze of an environment that isn't frozen: %v", err)
+	}
+	if err := Freeze(stateDir, "test", "release freeze"); err != nil {
+		t.Fatalf("Freeze: %v", err)
+	}
+
+	m, err := Frozen(stateDir, "test")
+	if err != nil || m == nil {
+		t.Fatalf("Frozen = %v, %v, want the maintenance marker", m, err)
+	}
+	if m.Reason != "release freeze" || m.FrozenAt.IsZero() {
+		t.Errorf("marker = %+v, want the reason and time recorded", m)
+	}
+
+	if err := Unfreeze(stateDir, "test"); err != nil {
+		t.Fatalf("Unfreeze: %v", err)
+	}
+	if m, err := Frozen(stateDir, "test"); err != nil || m != nil {
+		t.Errorf("Frozen after Unfreeze = %v, %v, want nil", m, err)
+	}
+}
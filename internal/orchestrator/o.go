@@ -2,21 +2,35 @@
 package orchestrator
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"orchid/internal/audit"
+	"orchid/internal/ci"
 	"orchid/internal/config"
+	"orchid/internal/redact"
+	"orchid/internal/retry"
 	"orchid/internal/ssh"
+	"orchid/internal/trace"
 )
 
 const (
 	defaultHealthCheckTimeout  = 60 * time.Second
 	defaultHealthCheckInterval = 2 * time.Second
 	defaultOperationTimeout    = 5 * time.Minute
-	startWaitDuration          = 5 * time.Second
+	defaultStartWait           = 5 * time.Second
 )
 
 type Options struct {
@@ -28,8 +42,74 @@ type Options struct {
 	HealthCheckTimeout  time.Duration
 	HealthCheckInterval time.Duration
 	OperationTimeout    time.Duration
+	StartWait           time.Duration // Wait after starting a service before health checking it
 	HandleDeps          bool
 	StopDeps            bool
+	NoRollback          bool
+	Audit               *audit.Writer
+	StateDir            string
+	LenientDeps         bool          // Warn instead of failing when a verified dependency is down
+	HostLock            string        // HostLockOff, HostLockFail or HostLockWait
+	LockWait            time.Duration // Longest to wait for host locks; implies HostLockWait
+	HostKeyChecking     string        // ssh.HostKeyIgnore, ssh.HostKeyStrict or ssh.HostKeyAcceptNew
+	RollbackConcurrency int           // Services stopped at once during rollback; 0 or 1 is sequential
+	RollbackScope       string        // RollbackScopeAll or RollbackScopeApps
+	ConnectAttempts     int           // Tries per host connection on transient failures; 0 uses the default
+	MaxOutput           int           // Bytes of output kept per command; 0 uses the default, negative is unlimited
+
+	// Trace records every remote command, with its output, exit status and
+	// timing, to a JSON-lines transcript
+	Trace *trace.Writer
+
+	// ReportOut writes a JSON RunSummary of every Up or Down run to this
+	// path, whether it succeeds or fails
+	ReportOut string
+
+	// FailOnWarn fails an otherwise successful Up or Down that raised
+	// warnings, such as a service that didn't stop, with ErrWarnings
+	FailOnWarn bool
+
+	// PlanOut writes the steps up would run to a file for review. PlanIn
+	// runs the steps of a previously written plan instead of selecting them,
+	// refusing to if any has changed since.
+	PlanOut string
+	PlanIn  string
+
+	// Ensure only starts services that are not running, leaving running
+	// services and command steps alone, so up can be re-run to reconcile
+	Ensure bool
+
+	// ValidateRemote makes a dry run connect to each host and check that the
+	// programs the step commands run exist there
+	ValidateRemote bool
+
+	// Explain logs a one-line reason for what was done with each step, such
+	// as skipped-by-tag or verified-dependency
+	Explain bool
+
+	// KeepRunningDeps leaves dependencies that are already running alone
+	// with HandleDeps, instead of stopping and restarting them
+	KeepRunningDeps bool
+
+	// Hooks receive progress callbacks during Up and Down
+	Hooks Hooks
+
+	// Sections folds each step's logs into a collapsible CI log section
+	Sections *ci.Sections
+
+	// LockBackend stores host locks. Defaults to lock files under StateDir,
+	// which only coordinates runs on the same machine.
+	LockBackend LockBackend
+
+	// Tags selects the steps to run. A step is selected when it carries any
+	// of the tags, or all of them when MatchAllTags is set. Dependency steps
+	// are always kept since the selected steps may rely on them.
+	Tags         []string
+	MatchAllTags bool
+
+	// OnlyFailed has up run just the steps that failed in the last up
+	// recorded under StateDir, along with the steps they depend on
+	OnlyFailed bool
 }
 
 type Orchestrator struct {
@@ -40,20 +120,71 @@ type Orchestrator struct {
 	logger     *slog.Logger
 	sshManager *ssh.Manager
 	options    Options
+	report     *RunReport
+	hooks      *hookQueue
+	locks      LockBackend
+	redactor   *redact.Redactor
+
+	transportsMu sync.Mutex
+	transports   []Transport // Opened by connect other than SSH clients
 }
 
 func New(opts Options) (*Orchestrator, error) {
-	if opts.HealthCheckTimeout == 0 {
-		opts.HealthCheckTimeout = defaultHealthCheckTimeout
+	switch opts.HostLock {
+	case HostLockOff, HostLockFail, HostLockWait:
+	default:
+		return nil, fmt.Errorf("invalid host lock mode %q: expected %q or %q", opts.HostLock, HostLockFail, HostLockWait)
+	}
+	if opts.LockWait > 0 {
+		if opts.HostLock == HostLockFail {
+			return nil, fmt.Errorf("a host lock wait needs host lock mode %q, not %q", HostLockWait, HostLockFail)
+		}
+		opts.HostLock = HostLockWait
 	}
-	if opts.HealthCheckInterval == 0 {
-		opts.HealthCheckInterval = defaultHealthCheckInterval
+	switch opts.RollbackScope {
+	case "", RollbackScopeAll, RollbackScopeApps:
+	default:
+		return nil, fmt.Errorf("invalid rollback scope %q: expected %q or %q", opts.RollbackScope, RollbackScopeAll, RollbackScopeApps)
+	}
+	if opts.PlanIn != "" && (len(opts.Tags) > 0 || opts.OnlyFailed) {
+		return nil, errors.New("a plan already selects the steps to run: tags and only-failed can't be used with one")
 	}
-	if opts.OperationTimeout == 0 {
-		opts.OperationTimeout = defaultOperationTimeout
+	if !ssh.ValidHostKeyChecking(opts.HostKeyChecking) {
+		return nil, fmt.Errorf("invalid host key checking mode %q: expected %q or %q", opts.HostKeyChecking, ssh.HostKeyStrict, ssh.HostKeyAcceptNew)
+	}
+
+	// Timeouts set in Options win over the environment's, which win over the
+	// package defaults
+	var timeouts config.Timeouts
+	var redactor *redact.Redactor
+	if opts.Config != nil {
+		env, err := LookupEnvironment(opts.Config, opts.Environment)
+		if err != nil {
+			return nil, err
+		}
+		timeouts = env.Timeouts
+
+		if redactor, err = redact.New(env.Redact); err != nil {
+			return nil, err
+		}
+		if opts.Logger != nil {
+			opts.Logger = slog.New(redactor.Handler(opts.Logger.Handler()))
+		}
+	}
+	opts.HealthCheckTimeout = firstDuration(opts.HealthCheckTimeout, timeouts.HealthCheck, defaultHealthCheckTimeout)
+	opts.HealthCheckInterval = firstDuration(opts.HealthCheckInterval, timeouts.HealthCheckInterval, defaultHealthCheckInterval)
+	opts.OperationTimeout = firstDuration(opts.OperationTimeout, timeouts.Operation, defaultOperationTimeout)
+	opts.StartWait = firstDuration(opts.StartWait, timeouts.StartWait, defaultStartWait)
+
+	if opts.LockBackend == nil {
+		opts.LockBackend = NewFileLockBackend(filepath.Join(opts.StateDir, "hosts"))
 	}
 
-	sshManager := ssh.NewManager(opts.Logger)
+	sshManager := ssh.NewManager(opts.Logger, ssh.ManagerOptions{
+		HostKeyChecking: opts.HostKeyChecking,
+		ConnectAttempts: opts.ConnectAttempts,
+		MaxOutput:       opts.MaxOutput,
+	})
 
 	return &Orchestrator{
 		cfg:        opts.Config,
@@ -63,13 +194,109 @@ func New(opts Options) (*Orchestrator, error) {
 		logger:     opts.Logger,
 		sshManager: sshManager,
 		options:    opts,
+		locks:      opts.LockBackend,
+		redactor:   redactor,
 	}, nil
 }
 
-func (o *Orchestrator) Up() error {
-	env, ok := o.cfg.Environments[o.env]
-	if !ok {
-		return fmt.Errorf("environment %s not found", o.env)
+// firstDuration returns the first non-zero duration
+func firstDuration(durations ...time.Duration) time.Duration {
+	for _, d := range durations {
+		if d != 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Up starts the environment's sequence, recording the outcome in the audit
+// log. Cancelling ctx stops the run before its next step as if it had been
+// aborted; commands already running are left to finish.
+func (o *Orchestrator) Up(ctx context.Context) error {
+	o.report = newRunReport(o.env, "up", o.redactor)
+	defer o.startHooks()()
+	err := o.checkMaintenance("up")
+	if err == nil {
+		err = o.withRunHooks(ctx, "up", func() error { return o.up(ctx) })
+	}
+	// Errors carry command output, so mask secrets before the error reaches
+	// the audit log, the summary or the caller
+	err = o.redactor.Error(o.checkWarnings(err))
+	o.report.finish()
+	o.report.log(o.logger)
+	o.recordAudit("up", err)
+	o.writeSummary(err)
+	o.saveRunState(err)
+	return err
+}
+
+// Down stops the environment's sequence, recording the outcome in the audit
+// log. Cancelling ctx stops it before its next step, like Up.
+func (o *Orchestrator) Down(ctx context.Context) error {
+	o.report = newRunReport(o.env, "down", o.redactor)
+	defer o.startHooks()()
+	err := o.checkMaintenance("down")
+	if err == nil {
+		err = o.withRunHooks(ctx, "down", func() error { return o.down(ctx) })
+	}
+	err = o.redactor.Error(o.checkWarnings(err))
+	o.report.finish()
+	o.report.log(o.logger)
+	o.recordAudit("down", err)
+	o.writeSummary(err)
+	return err
+}
+
+// Close releases the orchestrator's host connections
+func (o *Orchestrator) Close() {
+	o.sshManager.CloseAll()
+	o.closeTransports()
+}
+
+// Report returns the report of the most recent Up or Down run, or nil if
+// neither has run
+func (o *Orchestrator) Report() *RunReport {
+	return o.report
+}
+
+// checkMaintenance refuses to run while the environment is frozen, unless
+// forced, in which case the override is logged and audited
+func (o *Orchestrator) checkMaintenance(action string) error {
+	if o.options.StateDir == "" {
+		return nil
+	}
+
+	m, err := Frozen(o.options.StateDir, o.env)
+	if err != nil || m == nil {
+		return err
+	}
+
+	if !o.force {
+		return fmt.Errorf("%w: %s (frozen by %s at %s: %s)", ErrFrozen, o.env,
+			m.User, m.FrozenAt.Format(time.RFC3339), m.Reason)
+	}
+
+	o.warn(o.logger, Warning{Message: "environment is frozen for maintenance; proceeding because of --force"},
+		slog.String("frozen_by", m.User),
+		slog.String("reason", m.Reason))
+	if o.options.Audit != nil {
+		err := o.options.Audit.Append(audit.Record{
+			Environment: o.env,
+			Action:      action,
+			Result:      "maintenance override",
+			Error:       "forced while frozen: " + m.Reason,
+		})
+		if err != nil {
+			o.logger.Error("failed to write audit record", slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+func (o *Orchestrator) up(interrupt context.Context) error {
+	env, err := LookupEnvironment(o.cfg, o.env)
+	if err != nil {
+		return err
 	}
 
 	o.logger.Info("starting orchestration UP",
@@ -77,56 +304,108 @@ func (o *Orchestrator) Up() error {
 		slog.Bool("force", o.force),
 		slog.Bool("dry_run", o.dryRun),
 		slog.Bool("handle_deps", o.options.HandleDeps),
+		slog.Bool("rollback", o.rollbackEnabled(env)),
 	)
 
+	if o.options.PlanIn != "" {
+		if env.Sequence, err = o.plannedSequence("up", env); err != nil {
+			return err
+		}
+	} else {
+		sequence, err := o.selectFailed(env.Sequence)
+		if err != nil {
+			return err
+		}
+		// Smoke tests only make sense once everything else is up
+		env.Sequence = smokeLast(o.selectSteps(sequence))
+	}
+
+	if err := o.writePlan("up", env); err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), o.options.OperationTimeout)
 	defer cancel()
 
+	if err := o.checkKeys(env); err != nil {
+		return err
+	}
+
+	if err := o.probeCommands(ctx, env, upCommands); err != nil {
+		return err
+	}
+
+	unlock, err := o.lockHosts(ctx, interrupt, env)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	done, err := o.registerRun("up")
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	started := time.Now()
 	for i, step := range env.Sequence {
 		stepLogger := o.logger.With(
 			slog.String("step", step.Name),
 			slog.Int("step_number", i+1),
 			slog.String("type", step.Type),
 		)
+		if err := o.checkAbort(interrupt); err != nil {
+			return o.handleFailure(ctx, env, i, err)
+		}
+		o.report.startStep(step)
+		o.hookStepStart(step, i)
 
-		var err error
-
-		switch step.Type {
-		case "dependency", "application":
-			err = o.handleUp(ctx, step, env, stepLogger)
-		case "command":
-			err = o.handleCommand(ctx, step, env, stepLogger)
-		default:
-			err = fmt.Errorf("unknown step type: %s", step.Type)
+		if o.options.Ensure {
+			inSync, err := o.inDesiredState(ctx, step, env, stepLogger)
+			if err != nil {
+				stepLogger.Error("step failed", slog.String("error", err.Error()))
+				o.report.finishStep(step.Name, err)
+				o.hookStepComplete(step, i, StepFailed, err)
+				return o.handleFailure(ctx, env, i, err)
+			}
+			if inSync {
+				o.report.finishStep(step.Name, nil)
+				o.report.setStatus(step.Name, StepSkipped)
+				o.hookStepComplete(step, i, StepSkipped, nil)
+				o.logProgress(i+1, len(env.Sequence), started)
+				continue
+			}
 		}
 
+		skipped, err := o.upStep(ctx, step, env, stepLogger)
 		if err != nil {
 			stepLogger.Error("step failed", slog.String("error", err.Error()))
-			return o.handleFailure(ctx, env, i)
+			o.report.finishStep(step.Name, err)
+			o.hookStepComplete(step, i, StepFailed, err)
+			return o.handleFailure(ctx, env, i, err)
 		}
-
-		if step.Type == "application" || (step.Type == "dependency" && o.options.HandleDeps) {
-			stepLogger.Info("waiting before health check", slog.Duration("duration", startWaitDuration))
-			if !o.dryRun {
-				time.Sleep(startWaitDuration)
-				stepLogger.Info("performing health check")
-
-				if err := o.performHealthCheck(ctx, step, env, stepLogger); err != nil {
-					stepLogger.Error("health check failed", slog.String("error", err.Error()))
-					return o.handleFailure(ctx, env, i)
-				}
-			}
+		if skipped {
+			o.report.finishStep(step.Name, nil)
+			o.report.setStatus(step.Name, StepSkipped)
+			o.hookStepComplete(step, i, StepSkipped, nil)
+			o.logProgress(i+1, len(env.Sequence), started)
+			continue
 		}
+
+		o.report.finishStep(step.Name, nil)
+		stepLogger.Info("step completed", slog.Duration("duration", o.stepDuration(step.Name)))
+		o.hookStepComplete(step, i, StepSucceeded, nil)
+		o.logProgress(i+1, len(env.Sequence), started)
 	}
 
 	o.logger.Info("orchestration UP completed successfully")
 	return nil
 }
 
-func (o *Orchestrator) Down() error {
-	env, ok := o.cfg.Environments[o.env]
-	if !ok {
-		return fmt.Errorf("environment %s not found", o.env)
+func (o *Orchestrator) down(interrupt context.Context) error {
+	env, err := LookupEnvironment(o.cfg, o.env)
+	if err != nil {
+		return err
 	}
 
 	o.logger.Info("starting orchestration DOWN",
@@ -136,10 +415,38 @@ func (o *Orchestrator) Down() error {
 		slog.Bool("stop_deps", o.options.StopDeps),
 	)
 
+	env.Sequence = o.selectSteps(env.Sequence)
+
 	ctx, cancel := context.WithTimeout(context.Background(), o.options.OperationTimeout)
 	defer cancel()
 
+	if err := o.checkKeys(env); err != nil {
+		return err
+	}
+
+	if err := o.probeCommands(ctx, env, downCommands); err != nil {
+		return err
+	}
+
+	unlock, err := o.lockHosts(ctx, interrupt, env)
+	if err != nil {
+		if !o.force || !errors.Is(err, ErrHostLocked) || errors.Is(err, ErrAborted) {
+			return err
+		}
+		// Tearing down in an emergency matters more than the lock
+		o.overrideHostLock(err)
+		unlock = func() {}
+	}
+	defer unlock()
+
+	done, err := o.registerRun("down")
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	// Stop services in reverse order
+	started := time.Now()
 	for i := len(env.Sequence) - 1; i >= 0; i-- {
 		step := env.Sequence[i]
 		stepLogger := o.logger.With(
@@ -147,33 +454,176 @@ func (o *Orchestrator) Down() error {
 			slog.Int("step_number", i+1),
 			slog.String("type", step.Type),
 		)
-
-		var err error
-
-		switch step.Type {
-		case "dependency", "application":
-			// For dependencies, respect the StopDeps flag
-			if step.Type == "dependency" && !o.options.StopDeps {
-				stepLogger.Info("skipping dependency stop", slog.String("dependency", step.Name))
-				continue
-			}
-			err = o.handleDown(ctx, step, env, stepLogger)
-		case "command":
-			stepLogger.Info("skipping command in down")
-		default:
-			err = fmt.Errorf("unknown step type: %s", step.Type)
+		if err := o.checkAbort(interrupt); err != nil {
+			return err
 		}
+		o.report.startStep(step)
+		o.hookStepStart(step, i)
 
+		skipped, err := o.downStep(ctx, step, env, stepLogger)
 		if err != nil {
 			stepLogger.Error("step failed", slog.String("error", err.Error()))
 			// Continue stopping other services despite the error
 		}
+
+		o.report.finishStep(step.Name, err)
+		status := StepSucceeded
+		switch {
+		case err != nil:
+			status = StepFailed
+		case skipped:
+			status = StepSkipped
+			o.report.setStatus(step.Name, StepSkipped)
+		}
+		o.hookStepComplete(step, i, status, err)
+		o.logProgress(len(env.Sequence)-i, len(env.Sequence), started)
 	}
 
 	o.logger.Info("orchestration DOWN completed")
 	return nil
 }
 
+// recordAudit appends the outcome of an action to the audit log, if configured
+func (o *Orchestrator) recordAudit(action string, runErr error) {
+	if o.options.Audit == nil {
+		return
+	}
+
+	rec := audit.Record{
+		Environment: o.env,
+		Action:      action,
+		Result:      "success",
+	}
+	if o.dryRun {
+		rec.Action += " (dry run)"
+	}
+	if runErr != nil {
+		rec.Result = "failure"
+		rec.Error = runErr.Error()
+	}
+
+	if err := o.options.Audit.Append(rec); err != nil {
+		o.logger.Error("failed to write audit record", slog.String("error", err.Error()))
+	}
+}
+
+// selectSteps filters the sequence down to the steps matching the tag
+// selector, logging each step that is skipped
+func (o *Orchestrator) selectSteps(sequence []config.Step) []config.Step {
+	if len(o.options.Tags) == 0 {
+		return sequence
+	}
+
+	selected := make([]config.Step, 0, len(sequence))
+	for _, step := range sequence {
+		if step.Type == "dependency" || o.matchesTags(step) {
+			selected = append(selected, step)
+			continue
+		}
+		o.report.skipStep(step)
+		logger := o.logger.With(slog.String("step", step.Name))
+		logger.Info("skipping step not matching tag selector",
+			slog.Any("tags", step.Tags),
+			slog.Any("selector", o.options.Tags))
+		o.explain(logger, step, ReasonSkippedByTag)
+	}
+	return selected
+}
+
+func (o *Orchestrator) matchesTags(step config.Step) bool {
+	for _, want := range o.options.Tags {
+		found := slices.Contains(step.Tags, want)
+		if found && !o.options.MatchAllTags {
+			return true
+		}
+		if !found && o.options.MatchAllTags {
+			return false
+		}
+	}
+	return o.options.MatchAllTags
+}
+
+// smokeLast returns the sequence with smoke steps moved to the end, keeping
+// the relative order of all other steps
+func smokeLast(sequence []config.Step) []config.Step {
+	ordered := make([]config.Step, 0, len(sequence))
+	var smoke []config.Step
+	for _, step := range sequence {
+		if step.Type == "smoke" {
+			smoke = append(smoke, step)
+			continue
+		}
+		ordered = append(ordered, step)
+	}
+	return append(ordered, smoke...)
+}
+
+// stepDuration returns how long the named step took according to the report
+func (o *Orchestrator) stepDuration(name string) time.Duration {
+	if o.report == nil {
+		return 0
+	}
+	o.report.mu.Lock()
+	defer o.report.mu.Unlock()
+
+	if s := o.report.step(name); s != nil {
+		return s.Duration.Round(time.Millisecond)
+	}
+	return 0
+}
+
+// inDesiredState reports whether --ensure can leave the step alone: running
+// services that up would otherwise stop or restart, and command steps, which
+// only run on a full up. Dependencies that are only verified and smoke tests
+// always run.
+func (o *Orchestrator) inDesiredState(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) (bool, error) {
+	switch {
+	case step.Type == "command":
+		logger.Info("skipping command step in ensure mode")
+		o.explain(logger, step, ReasonSkippedCommand)
+		return true, nil
+	case step.Type == "application" || (step.Type == "dependency" && o.options.HandleDeps):
+		if o.dryRun {
+			return false, nil
+		}
+		running, err := o.isServiceRunning(ctx, step, env, logger)
+		if err != nil {
+			return false, fmt.Errorf("failed to check running state: %w", err)
+		}
+		if running {
+			logger.Info("service is running; leaving it alone in ensure mode")
+			o.explain(logger, step, ReasonSkippedRunning)
+		}
+		return running, nil
+	default:
+		return false, nil
+	}
+}
+
+// logProgress reports how many steps of the sequence have completed so far
+func (o *Orchestrator) logProgress(completed, total int, started time.Time) {
+	percent := 100
+	if total > 0 {
+		percent = completed * 100 / total
+	}
+	o.logger.Info(fmt.Sprintf("progress: step %d/%d (%d%%)", completed, total, percent),
+		slog.Int("completed", completed),
+		slog.Int("total", total),
+		slog.Duration("elapsed", time.Since(started).Round(time.Millisecond)))
+}
+
+// logHostProgress logs how many of a concurrent step's hosts have finished,
+// for steps with more than one host
+func (o *Orchestrator) logHostProgress(step config.Step, completed, total int) {
+	if total < 2 {
+		return
+	}
+	o.logger.Info(fmt.Sprintf("progress: %s host %d/%d", step.Name, completed, total),
+		slog.String("step", step.Name),
+		slog.Int("hosts_completed", completed),
+		slog.Int("hosts_total", total))
+}
+
 // handleUp manages the UP operation for both dependencies and applications
 func (o *Orchestrator) handleUp(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
 	switch step.Type {
@@ -217,6 +667,7 @@ func (o *Orchestrator) handleApplicationUp(ctx context.Context, step config.Step
 
 	if running {
 		logger.Info("application is already running; skipping start")
+		o.explain(logger, step, ReasonSkippedRunning)
 		if err := o.stopService(ctx, step, env, logger); err != nil {
 			return fmt.Errorf("failed to stop application: %w", err)
 		}
@@ -230,6 +681,7 @@ func (o *Orchestrator) handleApplicationUp(ctx context.Context, step config.Step
 		return fmt.Errorf("failed to start application: %w", err)
 	}
 
+	o.explain(logger, step, ReasonStarted)
 	return nil
 }
 
@@ -240,6 +692,12 @@ func (o *Orchestrator) handleDependencyUp(ctx context.Context, step config.Step,
 		return fmt.Errorf("failed to check dependency running state: %w", err)
 	}
 
+	if running && o.options.KeepRunningDeps {
+		logger.Info("dependency is already running; leaving it as is", slog.String("service", step.Name))
+		o.explain(logger, step, ReasonSkippedRunning)
+		return nil
+	}
+
 	if running {
 		logger.Info("dependency is already running; restarting", slog.String("service", step.Name))
 		// Stop the dependency
@@ -253,6 +711,11 @@ func (o *Orchestrator) handleDependencyUp(ctx context.Context, step config.Step,
 		return fmt.Errorf("failed to start dependency: %w", err)
 	}
 
+	if running {
+		o.explain(logger, step, ReasonRestarted)
+	} else {
+		o.explain(logger, step, ReasonStarted)
+	}
 	return nil
 }
 
@@ -264,115 +727,432 @@ func (o *Orchestrator) verifyDependencyRunning(ctx context.Context, step config.
 	}
 
 	if !running {
+		if o.options.LenientDeps {
+			o.warn(logger, Warning{Step: step.Name, Message: "dependency is not running; continuing because of lenient deps"},
+				slog.String("service", step.Name))
+			o.explain(logger, step, ReasonDependencyNotRunning)
+			return nil
+		}
 		logger.Error("dependency is not running and HandleDeps is false", slog.String("service", step.Name))
 		return fmt.Errorf("dependency %s is not running", step.Name)
 	}
 
 	logger.Info("dependency is running", slog.String("service", step.Name))
+
+	if step.DepReady != "" {
+		if err := o.waitDependencyReady(ctx, step, env, logger); err != nil {
+			return err
+		}
+	}
+
+	o.explain(logger, step, ReasonVerifiedDependency)
 	return nil
 }
 
+// waitDependencyReady polls the dependency's dep_ready command until it
+// passes on every host or the health check timeout expires
+func (o *Orchestrator) waitDependencyReady(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	if err := o.validateCommand(env, step, step.DepReady); err != nil {
+		return err
+	}
+
+	if o.dryRun {
+		logger.Info("dry run - would wait for dependency readiness",
+			slog.String("dep_ready", step.DepReady))
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.options.HealthCheckTimeout)
+	defer cancel()
+
+	err := retry.Do(ctx, o.healthCheckPolicy(), func(ctx context.Context) error {
+		ready, err := o.succeedsOnAllHosts(ctx, step.DepReady, step, env, logger)
+		if err != nil {
+			return retry.Permanent(fmt.Errorf("failed to check dependency readiness: %w", err))
+		}
+		if !ready {
+			logger.Info("waiting for dependency to become ready", slog.String("service", step.Name))
+			return fmt.Errorf("dependency %s is not ready", step.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("dependency %s did not become ready: %w", step.Name, err)
+	}
+
+	logger.Info("dependency is ready", slog.String("service", step.Name))
+	return nil
+}
+
+// healthCheckPolicy is the backoff used when polling checks until they pass
+func (o *Orchestrator) healthCheckPolicy() retry.Policy {
+	return retry.Policy{
+		BaseInterval: o.options.HealthCheckInterval,
+		MaxInterval:  4 * o.options.HealthCheckInterval,
+		Jitter:       0.1,
+	}
+}
+
 // handleApplicationDown manages the DOWN operation for applications
 func (o *Orchestrator) handleApplicationDown(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	if err := o.drain(ctx, step, env, logger); err != nil {
+		return err
+	}
+
 	// Stop the application
 	if err := o.stopService(ctx, step, env, logger); err != nil {
 		return fmt.Errorf("failed to stop application: %w", err)
 	}
 
+	o.verifyStopped(ctx, step, env, logger)
+	o.explain(logger, step, ReasonStopped)
 	return nil
 }
 
 // handleDependencyDown manages the DOWN operation for dependencies when StopDeps is true
 func (o *Orchestrator) handleDependencyDown(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	if err := o.drain(ctx, step, env, logger); err != nil {
+		return err
+	}
+
 	// Stop the dependency
 	if err := o.stopService(ctx, step, env, logger); err != nil {
 		return fmt.Errorf("failed to stop dependency: %w", err)
 	}
 
+	o.verifyStopped(ctx, step, env, logger)
+	o.explain(logger, step, ReasonStopped)
 	return nil
 }
 
-func (o *Orchestrator) performHealthCheck(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+// verifyStopped runs the step's check on each host after a stop and warns
+// where the service still appears to be running, or where its stopped_check
+// fails when it has one. It first waits for the step's stop_verify_delay, or
+// the environment's, since some services take a moment to exit after their
+// stop command returns.
+func (o *Orchestrator) verifyStopped(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) {
+	if step.Check == "" && step.StoppedCheck == "" {
+		return
+	}
+
+	delay := firstDuration(step.StopVerifyDelay, env.Timeouts.StopVerifyDelay)
 	if o.dryRun {
-		logger.Info("dry run - skipping health check")
-		return nil
+		logger.Info("dry run - skipping stop verification", slog.Duration("delay", delay))
+		return
 	}
 
-	for _, hostName := range step.Hosts {
-		host, ok := env.Hosts[hostName]
-		if !ok {
-			return fmt.Errorf("host %s not found in environment", hostName)
+	if delay > 0 {
+		logger.Info("waiting before verifying stop", slog.Duration("delay", delay))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
 		}
+	}
 
-		client, err := o.sshManager.GetClient(host, env.SSHDefaults)
-		if err != nil {
-			return fmt.Errorf("failed to get SSH client for host %s: %w", hostName, err)
-		}
+	for _, hostName := range step.Hosts {
+		one := step
+		one.Hosts = []string{hostName}
 
-		output, err := client.Execute(ctx, step.Check)
-		if err != nil {
-			logger.Warn("health check failed",
-				slog.String("host", hostName),
-				slog.String("error", err.Error()),
-				slog.String("output", output))
-			return fmt.Errorf("health check command failed on host %s: %w", hostName, err)
+		var running bool
+		var err error
+		if step.StoppedCheck != "" {
+			var stopped bool
+			stopped, err = o.succeedsOnAllHosts(ctx, step.StoppedCheck, one, env, logger)
+			running = !stopped
+		} else {
+			running, err = o.checkPassesOnAllHosts(ctx, one, env, logger)
 		}
+		switch {
+		case err != nil:
+			o.warn(logger, Warning{Step: step.Name, Host: hostName, Message: "could not verify service stopped", Error: err.Error()},
+				slog.String("host", hostName), slog.String("error", err.Error()))
+		case running:
+			o.warn(logger, Warning{Step: step.Name, Host: hostName, Message: "service still appears to be running after stop"},
+				slog.String("host", hostName))
+		}
+	}
+}
 
-		logger.Info("health check passed", slog.String("host", hostName))
+func (o *Orchestrator) performHealthCheck(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	if err := o.validateCheck(env, step); err != nil {
+		return err
 	}
 
+	if o.dryRun {
+		logger.Info("dry run - skipping health check")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.options.HealthCheckTimeout)
+	defer cancel()
+
+	// Retry until every host has passed, without re-checking hosts that
+	// already have
+	passed := make(map[string]bool)
+	err := retry.Do(ctx, o.healthCheckPolicy(), func(ctx context.Context) error {
+		for _, hostName := range step.Hosts {
+			if passed[hostName] {
+				continue
+			}
+
+			host, ok := env.Hosts[hostName]
+			if !ok {
+				return retry.Permanent(fmt.Errorf("host %s not found in environment", hostName))
+			}
+
+			client, err := o.connect(ctx, asUser(host, step.CheckUser), env.SSHDefaults)
+			if err != nil {
+				return fmt.Errorf("failed to get SSH client for host %s: %w", hostName, err)
+			}
+
+			check, err := o.hostCommand(env, step, host, hostCheck(step, hostName))
+			if err != nil {
+				return retry.Permanent(err)
+			}
+
+			output, err := o.executeInput(ctx, client, step, host.Hostname, "check", check, checkScript(step, hostName))
+			err = checkFailure(step, step.CheckExpect, output, err, logger)
+			o.hookHealthCheck(step, hostName, err)
+			if err != nil {
+				logger.Warn("health check failed",
+					slog.String("host", hostName),
+					slog.String("error", err.Error()),
+					slog.String("output", output))
+				return fmt.Errorf("health check command failed on host %s: %w", hostName, err)
+			}
+
+			passed[hostName] = true
+			logger.Info("health check passed", slog.String("host", hostName))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrHealthCheckFailed, err)
+	}
 	return nil
 }
 
-func (o *Orchestrator) handleFailure(ctx context.Context, env config.Environment, failedStepIndex int) error {
-	o.logger.Info("initiating rollback due to failure")
+// rollbackEnabled reports whether a failed UP should stop the services it started
+func (o *Orchestrator) rollbackEnabled(env config.Environment) bool {
+	if o.options.NoRollback {
+		return false
+	}
+	return env.Rollback == nil || *env.Rollback
+}
+
+func (o *Orchestrator) handleFailure(ctx context.Context, env config.Environment, failedStepIndex int, cause error) error {
+	stepErr := &StepError{
+		Environment: o.env,
+		Step:        env.Sequence[failedStepIndex].Name,
+		StepNumber:  failedStepIndex + 1,
+		Err:         cause,
+	}
+
+	// Collect diagnostics while the failed service is still in the state
+	// that failed, unless the run was aborted rather than failing
+	if !errors.Is(cause, ErrAborted) {
+		o.collectDiagnostics(ctx, env.Sequence[failedStepIndex], env)
+	}
+
+	if !o.rollbackEnabled(env) {
+		var left []string
+		for i := 0; i < failedStepIndex; i++ {
+			if step := env.Sequence[i]; step.Type == "application" || step.Type == "dependency" {
+				left = append(left, step.Name)
+			}
+		}
+		o.warn(o.logger, Warning{Step: env.Sequence[failedStepIndex].Name, Message: "rollback disabled; leaving started services in place"},
+			slog.String("failed_step", env.Sequence[failedStepIndex].Name),
+			slog.Any("services", left))
+		stepErr.RollbackSkipped = RollbackSkippedDisabled
+		return stepErr
+	}
+
+	if failed := env.Sequence[failedStepIndex]; !rollsBackOnFailure(failed) && !errors.Is(cause, ErrAborted) {
+		o.warn(o.logger, Warning{Step: failed.Name, Message: "command step opted out of rollback; leaving started services in place"},
+			slog.String("failed_step", failed.Name))
+		stepErr.RollbackSkipped = RollbackSkippedOptedOut
+		return stepErr
+	}
 
-	// Roll back services in reverse order up to the failed step
+	o.logger.Info("initiating rollback due to failure",
+		slog.Int("concurrency", max(o.options.RollbackConcurrency, 1)))
+
+	// Roll back services in reverse order up to the failed step, stopping at
+	// the most recent checkpoint so the stable base stays running
+	var services []int
 	for i := failedStepIndex - 1; i >= 0; i-- {
 		step := env.Sequence[i]
-		if step.Type != "command" {
-			stepLogger := o.logger.With(
-				slog.String("step", step.Name),
-				slog.Int("step_number", i+1),
-				slog.String("type", step.Type),
-			)
-			stepLogger.Info("rolling back service",
-				slog.String("service", step.Name),
+		if step.Checkpoint {
+			o.logger.Info("reached checkpoint; leaving earlier steps running",
+				slog.String("checkpoint", step.Name),
 				slog.Int("step_number", i+1))
-
-			if err := o.stopService(ctx, step, env, stepLogger); err != nil {
-				stepLogger.Error("failed to stop service during rollback",
+			break
+		}
+		if step.Type == "dependency" && o.options.RollbackScope == RollbackScopeApps {
+			if o.report.status(step.Name) != StepSkipped {
+				o.logger.Info("leaving dependency running; rollback scope is apps",
 					slog.String("service", step.Name),
-					slog.String("error", err.Error()))
-				// Continue rolling back other services despite the error
+					slog.Int("step_number", i+1))
 			}
+			continue
 		}
+		// Services left alone by --ensure were running before this run
+		if (step.Type == "application" || step.Type == "dependency") && o.report.status(step.Name) != StepSkipped {
+			services = append(services, i)
+		}
+	}
+
+	var errs []error
+	for _, wave := range rollbackWaves(env, services) {
+		errs = append(errs, o.rollbackWave(ctx, env, wave)...)
+	}
+
+	stepErr.RolledBack = true
+	stepErr.RollbackErr = errors.Join(errs...)
+	return stepErr
+}
+
+// Rollback scopes for Options.RollbackScope
+const (
+	RollbackScopeAll  = "all"  // Roll back applications and dependencies; the default
+	RollbackScopeApps = "apps" // Leave dependencies running for the next attempt
+)
+
+// rollsBackOnFailure reports whether a failure of step should roll back the
+// services started before it
+func rollsBackOnFailure(step config.Step) bool {
+	return step.Type != "command" || step.RollbackOnFailure == nil || *step.RollbackOnFailure
+}
+
+// rollbackWaves splits the services to roll back, already in reverse order,
+// into runs of the same step type. Services within a wave are independent and
+// may stop in parallel; applications are always stopped before the
+// dependencies started ahead of them.
+func rollbackWaves(env config.Environment, services []int) [][]int {
+	var waves [][]int
+	for _, i := range services {
+		last := len(waves) - 1
+		if last >= 0 && env.Sequence[waves[last][0]].Type == env.Sequence[i].Type {
+			waves[last] = append(waves[last], i)
+			continue
+		}
+		waves = append(waves, []int{i})
+	}
+	return waves
+}
+
+// rollbackWave stops the wave's services, up to RollbackConcurrency at a
+// time, and returns the failures
+func (o *Orchestrator) rollbackWave(ctx context.Context, env config.Environment, wave []int) []error {
+	sem := make(chan struct{}, max(o.options.RollbackConcurrency, 1))
+	errs := make([]error, len(wave))
+
+	var wg sync.WaitGroup
+	for j, i := range wave {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(j, i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[j] = o.rollbackService(ctx, env, i)
+		}(j, i)
 	}
+	wg.Wait()
 
-	return fmt.Errorf("orchestration failed at step %d", failedStepIndex+1)
+	return slices.DeleteFunc(errs, func(err error) bool { return err == nil })
+}
+
+func (o *Orchestrator) rollbackService(ctx context.Context, env config.Environment, i int) error {
+	step := env.Sequence[i]
+	stepLogger := o.logger.With(
+		slog.String("step", step.Name),
+		slog.Int("step_number", i+1),
+		slog.String("type", step.Type),
+	)
+	stepLogger.Info("rolling back service",
+		slog.String("service", step.Name),
+		slog.Int("step_number", i+1))
+
+	rollback := o.stopService
+	if step.RollbackCommand != "" {
+		rollback = o.runRollbackCommand
+	}
+	if err := rollback(ctx, step, env, stepLogger); err != nil {
+		stepLogger.Error("failed to roll back service",
+			slog.String("service", step.Name),
+			slog.String("error", err.Error()))
+		o.hookRollback(step, i, err)
+		return fmt.Errorf("%s: %w", step.Name, err)
+	}
+	o.report.setStatus(step.Name, StepRolledBack)
+	o.hookRollback(step, i, nil)
+	return nil
 }
 
 func (o *Orchestrator) isServiceRunning(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) (bool, error) {
+	if err := o.validateCheck(env, step); err != nil {
+		return false, err
+	}
+
 	if o.dryRun {
 		logger.Info("dry run - setting service running check to true")
 		return true, nil
 	}
 
+	return o.checkPassesOnAllHosts(ctx, step, env, logger)
+}
+
+// succeedsOnAllHosts runs cmd on each of the step's hosts in turn and
+// reports whether it exited successfully everywhere. Connection problems
+// and commands that never report an exit status are errors; a non-zero exit
+// is not.
+func (o *Orchestrator) succeedsOnAllHosts(ctx context.Context, cmd string, step config.Step, env config.Environment, logger *slog.Logger) (bool, error) {
+	return o.passesOnAllHosts(ctx, step, env, "", logger, func(string) (string, io.Reader) {
+		return cmd, nil
+	})
+}
+
+// checkPassesOnAllHosts is succeedsOnAllHosts for the step's check, taking
+// per-host overrides, check_expect and check_script into account
+func (o *Orchestrator) checkPassesOnAllHosts(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) (bool, error) {
+	return o.passesOnAllHosts(ctx, step, env, step.CheckExpect, logger, func(hostName string) (string, io.Reader) {
+		return hostCheck(step, hostName), checkScript(step, hostName)
+	})
+}
+
+// passesOnAllHosts runs the command hostCmd gives for each of the step's
+// hosts, with the input it gives, and reports whether it exited
+// successfully, with output matching expect if set, everywhere
+func (o *Orchestrator) passesOnAllHosts(ctx context.Context, step config.Step, env config.Environment, expect string, logger *slog.Logger, hostCmd func(hostName string) (string, io.Reader)) (bool, error) {
 	for _, hostName := range step.Hosts {
 		host, ok := env.Hosts[hostName]
 		if !ok {
 			return false, fmt.Errorf("host %s not found in environment", hostName)
 		}
 
-		client, err := o.sshManager.GetClient(host, env.SSHDefaults)
+		client, err := o.connect(ctx, asUser(host, step.CheckUser), env.SSHDefaults)
 		if err != nil {
 			return false, fmt.Errorf("failed to get SSH client for host %s: %w", hostName, err)
 		}
 
-		output, err := client.Execute(ctx, step.Check)
+		cmd, stdin := hostCmd(hostName)
+		rendered, err := o.hostCommand(env, step, host, cmd)
 		if err != nil {
+			return false, err
+		}
+
+		output, err := o.executeInput(ctx, client, step, host.Hostname, "check", rendered, stdin)
+		if _, exited := ssh.ExitStatus(err); err != nil && !exited {
+			// The command never reported an exit status, so this says nothing
+			// about whether the service is running
+			return false, fmt.Errorf("check on host %s did not complete: %w", hostName, err)
+		}
+		if err := checkFailure(step, expect, output, err, logger); err != nil {
 			logger.Debug("service check failed",
 				slog.String("host", hostName),
+				slog.String("command", rendered),
 				slog.String("error", err.Error()),
 				slog.String("output", output))
 			return false, nil
@@ -382,60 +1162,180 @@ func (o *Orchestrator) isServiceRunning(ctx context.Context, step config.Step, e
 	return true, nil
 }
 
+// checkFailure returns why a check that printed output and returned err is
+// unhealthy, or nil if it passed. The step's healthy_exit_codes count as
+// success, and when expect is set the output must also match it.
+func checkFailure(step config.Step, expect, output string, err error, logger *slog.Logger) error {
+	if err != nil {
+		status, ok := ssh.ExitStatus(err)
+		if !ok || !slices.Contains(step.HealthyExitCodes, status) {
+			return err
+		}
+		logger.Info("check exited with a status listed as healthy", slog.Int("exit_status", status))
+	}
+
+	if expect != "" {
+		matched, err := regexp.MatchString(expect, output)
+		if err != nil {
+			return fmt.Errorf("invalid check_expect pattern %q: %w", expect, err)
+		}
+		if !matched {
+			return fmt.Errorf("output does not match check_expect %q", expect)
+		}
+	}
+	return nil
+}
+
 func (o *Orchestrator) startService(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	if err := o.validateCommand(env, step, step.Start); err != nil {
+		return err
+	}
+
 	if o.dryRun {
 		logger.Info("dry run - would start service",
 			slog.Any("hosts", step.Hosts),
-			slog.String("start_command", step.Start))
+			slog.String("start_command", step.Start),
+			slog.String("canary", step.Canary))
 		return nil
 	}
 
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(step.Hosts))
+	if step.Canary != "" {
+		return o.startCanary(ctx, step, env, logger)
+	}
+	return o.startHosts(ctx, step, env, logger)
+}
 
+// startHosts runs the start command on all of the step's hosts concurrently
+func (o *Orchestrator) startHosts(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	hosts := make([]config.Host, 0, len(step.Hosts))
 	for _, hostName := range step.Hosts {
 		host, ok := env.Hosts[hostName]
 		if !ok {
 			return fmt.Errorf("host %s not found in environment", hostName)
 		}
+		hosts = append(hosts, host)
+	}
+	byPriority(hosts)
 
-		wg.Add(1)
-		go func(h config.Host) {
-			defer wg.Done()
+	errs := o.eachHost(ctx, step, hosts, step.FailFast, func(ctx context.Context, h config.Host) error {
+		client, err := o.connect(ctx, asUser(h, step.StartUser), env.SSHDefaults)
+		if err != nil {
+			return fmt.Errorf("failed to get SSH client for host %s: %w", h.Hostname, err)
+		}
+
+		cmd, err := o.hostCommand(env, step, h, step.Start)
+		if err != nil {
+			return err
+		}
+		if step.Background {
+			cmd = backgroundCommand(cmd, step.Shell)
+		}
+
+		output, err := o.execute(ctx, client, step, h.Hostname, "start", cmd)
+		if err != nil {
+			return fmt.Errorf("failed to start service on host %s: %w. Output: %s", h.Hostname, err, output)
+		}
+
+		logger.Info("service start initiated",
+			slog.String("host", h.Hostname),
+			slog.String("service", step.Name))
+		return nil
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to start service on some hosts: %v", errs)
+	}
+
+	return nil
+}
+
+// byPriority sorts hosts into the order they are started in, highest
+// priority first and otherwise in config order
+func byPriority(hosts []config.Host) {
+	slices.SortStableFunc(hosts, func(a, b config.Host) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+}
 
-			client, err := o.sshManager.GetClient(h, env.SSHDefaults)
+// eachHost calls fn for every host, in the order given, and returns the
+// failures. Hosts are handled concurrently unless the step is serial, in
+// which case they go one at a time with host_interval between them.
+// Concurrent hosts are handled in runs of equal priority, each run finishing
+// before the next starts. With failFast the first failure cancels the
+// context of hosts still running and no further hosts are started.
+func (o *Orchestrator) eachHost(ctx context.Context, step config.Step, hosts []config.Host, failFast bool, fn func(context.Context, config.Host) error) []error {
+	if failFast {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		run := fn
+		fn = func(ctx context.Context, h config.Host) error {
+			err := run(ctx, h)
 			if err != nil {
-				errCh <- fmt.Errorf("failed to get SSH client for host %s: %w", h.Hostname, err)
-				return
+				cancel()
 			}
+			return err
+		}
+	}
 
-			output, err := client.Execute(ctx, step.Start)
-			if err != nil {
-				errCh <- fmt.Errorf("failed to start service on host %s: %w. Output: %s", h.Hostname, err, output)
-				return
+	if !step.Serial {
+		errs := make([]error, len(hosts))
+		var mu sync.Mutex
+		completed := 0
+		for start := 0; start < len(hosts); {
+			if failFast && ctx.Err() != nil {
+				break
+			}
+			end := start + 1
+			for end < len(hosts) && hosts[end].Priority == hosts[start].Priority {
+				end++
 			}
 
-			logger.Info("service start initiated",
-				slog.String("host", h.Hostname),
-				slog.String("service", step.Name))
-		}(host)
+			var wg sync.WaitGroup
+			for i := start; i < end; i++ {
+				wg.Add(1)
+				go func(i int, h config.Host) {
+					defer wg.Done()
+					errs[i] = fn(ctx, h)
+
+					mu.Lock()
+					defer mu.Unlock()
+					completed++
+					o.logHostProgress(step, completed, len(hosts))
+				}(i, hosts[i])
+			}
+			wg.Wait()
+			start = end
+		}
+		return slices.DeleteFunc(errs, func(err error) bool { return err == nil })
 	}
 
-	wg.Wait()
-	close(errCh)
-
 	var errs []error
-	for err := range errCh {
-		errs = append(errs, err)
-	}
-	if len(errs) > 0 {
-		return fmt.Errorf("failed to start service on some hosts: %v", errs)
+	for i, host := range hosts {
+		if failFast && ctx.Err() != nil {
+			break
+		}
+		if i > 0 && step.HostInterval > 0 {
+			timer := time.NewTimer(step.HostInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return append(errs, fmt.Errorf("interrupted before host %s: %w", host.Hostname, ctx.Err()))
+			case <-timer.C:
+			}
+		}
+		if err := fn(ctx, host); err != nil {
+			errs = append(errs, err)
+		}
 	}
-
-	return nil
+	return errs
 }
 
 func (o *Orchestrator) stopService(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	if err := o.validateCommand(env, step, step.Stop); err != nil {
+		return err
+	}
+
 	if o.dryRun {
 		logger.Info("dry run - would stop service",
 			slog.Any("hosts", step.Hosts),
@@ -443,100 +1343,375 @@ func (o *Orchestrator) stopService(ctx context.Context, step config.Step, env co
 		return nil
 	}
 
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(step.Hosts))
+	var errs []error
+	hosts := make([]config.Host, 0, len(step.Hosts))
 
+	// Attempt every host even if some are missing or unreachable, so a
+	// single bad host doesn't leave the rest of the service running
 	for _, hostName := range step.Hosts {
 		host, ok := env.Hosts[hostName]
 		if !ok {
-			return fmt.Errorf("host %s not found in environment", hostName)
+			errs = append(errs, fmt.Errorf("host %s not found in environment", hostName))
+			continue
 		}
+		hosts = append(hosts, host)
+	}
 
-		wg.Add(1)
-		go func(h config.Host) {
-			defer wg.Done()
+	// The reverse of the start order, so the hosts others rely on stop last
+	byPriority(hosts)
+	slices.Reverse(hosts)
 
-			client, err := o.sshManager.GetClient(h, env.SSHDefaults)
-			if err != nil {
-				errCh <- fmt.Errorf("failed to get SSH client for host %s: %w", h.Hostname, err)
-				return
-			}
+	errs = append(errs, o.eachHost(ctx, step, hosts, false, func(ctx context.Context, h config.Host) error {
+		client, err := o.connect(ctx, asUser(h, step.StopUser), env.SSHDefaults)
+		if err != nil {
+			return fmt.Errorf("failed to get SSH client for host %s: %w", h.Hostname, err)
+		}
 
-			output, err := client.Execute(ctx, step.Stop)
-			if err != nil {
-				errCh <- fmt.Errorf("failed to stop service on host %s: %w. Output: %s", h.Hostname, err, output)
-				return
-			}
+		cmd, err := o.hostCommand(env, step, h, step.Stop)
+		if err != nil {
+			return err
+		}
 
-			logger.Info("service stopped",
-				slog.String("host", h.Hostname),
-				slog.String("service", step.Name))
-		}(host)
+		output, err := o.execute(ctx, client, step, h.Hostname, "stop", cmd)
+		if err != nil {
+			return fmt.Errorf("failed to stop service on host %s: %w. Output: %s", h.Hostname, err, output)
+		}
+
+		logger.Info("service stopped",
+			slog.String("host", h.Hostname),
+			slog.String("service", step.Name))
+		return nil
+	})...)
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to stop service on some hosts: %v", errs)
 	}
 
-	wg.Wait()
-	close(errCh)
+	return nil
+}
+
+// runRollbackCommand runs the step's rollback_command on its hosts in place
+// of stopping the service, in the order the hosts are started
+func (o *Orchestrator) runRollbackCommand(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	if err := o.validateCommand(env, step, step.RollbackCommand); err != nil {
+		return err
+	}
+
+	if o.dryRun {
+		logger.Info("dry run - would run rollback command",
+			slog.Any("hosts", step.Hosts),
+			slog.String("rollback_command", step.RollbackCommand))
+		return nil
+	}
 
 	var errs []error
-	for err := range errCh {
-		errs = append(errs, err)
+	hosts := make([]config.Host, 0, len(step.Hosts))
+	for _, hostName := range step.Hosts {
+		host, ok := env.Hosts[hostName]
+		if !ok {
+			errs = append(errs, fmt.Errorf("host %s not found in environment", hostName))
+			continue
+		}
+		hosts = append(hosts, host)
 	}
+	byPriority(hosts)
+
+	errs = append(errs, o.eachHost(ctx, step, hosts, false, func(ctx context.Context, h config.Host) error {
+		client, err := o.connect(ctx, asUser(h, step.StopUser), env.SSHDefaults)
+		if err != nil {
+			return fmt.Errorf("failed to get SSH client for host %s: %w", h.Hostname, err)
+		}
+
+		cmd, err := o.hostCommand(env, step, h, step.RollbackCommand)
+		if err != nil {
+			return err
+		}
+
+		output, err := o.execute(ctx, client, step, h.Hostname, "rollback", cmd)
+		if err != nil {
+			return fmt.Errorf("failed to run rollback command on host %s: %w. Output: %s", h.Hostname, err, output)
+		}
+
+		logger.Info("rollback command completed",
+			slog.String("host", h.Hostname),
+			slog.String("service", step.Name))
+		return nil
+	})...)
 	if len(errs) > 0 {
-		return fmt.Errorf("failed to stop service on some hosts: %v", errs)
+		return fmt.Errorf("failed to run rollback command on some hosts: %v", errs)
 	}
 
 	return nil
 }
 
 func (o *Orchestrator) handleCommand(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	// The step's commands in the order they run on each host
+	var commands []string
+	for _, cmd := range []string{step.PreRun, step.Run, step.PostRun} {
+		if cmd == "" {
+			continue
+		}
+		if err := o.validateCommand(env, step, cmd); err != nil {
+			return err
+		}
+		commands = append(commands, cmd)
+	}
+
 	if o.dryRun {
 		logger.Info("dry run - would execute command",
 			slog.Any("hosts", step.Hosts),
-			slog.String("command", step.Run))
+			slog.String("command", step.Run),
+			slog.String("pre_run", step.PreRun),
+			slog.String("post_run", step.PostRun))
 		return nil
 	}
 
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(step.Hosts))
-
+	hosts := make([]config.Host, 0, len(step.Hosts))
 	for _, hostName := range step.Hosts {
 		host, ok := env.Hosts[hostName]
 		if !ok {
 			return fmt.Errorf("host %s not found in environment", hostName)
 		}
+		hosts = append(hosts, host)
+	}
+	byPriority(hosts)
 
-		wg.Add(1)
-		go func(h config.Host) {
-			defer wg.Done()
+	limit, err := maxFailures(step.MaxFailures, len(hosts))
+	if err != nil {
+		return err
+	}
 
-			client, err := o.sshManager.GetClient(h, env.SSHDefaults)
+	var mu sync.Mutex
+	var failed []string
+	errs := o.eachHost(ctx, step, hosts, step.FailFast, func(ctx context.Context, h config.Host) (err error) {
+		defer func() {
 			if err != nil {
-				errCh <- fmt.Errorf("failed to get SSH client for host %s: %w", h.Hostname, err)
-				return
+				mu.Lock()
+				failed = append(failed, h.Hostname)
+				mu.Unlock()
 			}
+		}()
 
-			output, err := client.Execute(ctx, step.Run)
-			if err != nil {
-				errCh <- fmt.Errorf("failed to execute command on host %s: %w. Output: %s", h.Hostname, err, output)
-				return
+		client, err := o.connect(ctx, h, env.SSHDefaults)
+		if err != nil {
+			return fmt.Errorf("failed to get SSH client for host %s: %w", h.Hostname, err)
+		}
+
+		cmds := make([]string, len(commands))
+		for i, cmd := range commands {
+			if cmds[i], err = o.hostCommand(env, step, h, cmd); err != nil {
+				return err
 			}
+		}
 
-			logger.Info("command executed",
-				slog.String("host", h.Hostname),
-				slog.String("command", step.Run))
-		}(host)
+		output, err := o.executeBatch(ctx, client, step, h.Hostname, "run", cmds)
+		if err != nil {
+			return fmt.Errorf("failed to execute command on host %s: %w. Output: %s", h.Hostname, err, output)
+		}
+
+		logger.Info("command executed",
+			slog.String("host", h.Hostname),
+			slog.String("command", step.Run))
+		return nil
+	})
+	if len(errs) == 0 {
+		return nil
 	}
 
-	wg.Wait()
-	close(errCh)
+	slices.Sort(failed)
+	o.report.setFailedHosts(step.Name, failed)
 
-	var errs []error
-	for err := range errCh {
-		errs = append(errs, err)
+	if len(errs) <= limit {
+		o.warn(logger, Warning{Step: step.Name, Message: "command failed on some hosts; continuing within max_failures", Error: strings.Join(failed, ", ")},
+			slog.Any("failed_hosts", failed),
+			slog.Int("max_failures", limit))
+		return nil
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf("failed to execute command on some hosts: %v", errs)
+	return fmt.Errorf("failed to execute command on %d of %d hosts: %v", len(errs), len(hosts), errs)
+}
+
+// maxFailures resolves a command step's max_failures, either a count ("2")
+// or a percentage of its hosts ("10%", rounded down), into a host count
+func maxFailures(spec string, hosts int) (int, error) {
+	if spec == "" {
+		return 0, nil
+	}
+
+	if pct, ok := strings.CutSuffix(spec, "%"); ok {
+		n, err := strconv.ParseFloat(pct, 64)
+		if err != nil || n < 0 || n > 100 {
+			return 0, fmt.Errorf("invalid max_failures percentage %q", spec)
+		}
+		return int(math.Floor(float64(hosts) * n / 100)), nil
+	}
+
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid max_failures %q: expected a count or percentage", spec)
+	}
+	return n, nil
+}
+
+// execute runs one of a step's commands on a host, recording how long it
+// took in the run report
+func (o *Orchestrator) execute(ctx context.Context, client Transport, step config.Step, hostname, action, cmd string) (string, error) {
+	return o.executeInput(ctx, client, step, hostname, action, cmd, nil)
+}
+
+// executeInput is execute with stdin sent to the command's standard input
+func (o *Orchestrator) executeInput(ctx context.Context, client Transport, step config.Step, hostname, action, cmd string, stdin io.Reader) (string, error) {
+	opts := ssh.ExecOptions{RequestPTY: step.RequestPTY, Shell: step.Shell, Stdin: stdin}
+
+	start := time.Now()
+	output, err := client.ExecuteWith(ctx, cmd, opts)
+	o.report.recordCommand(step.Name, CommandTiming{
+		Host:     hostname,
+		Action:   action,
+		Start:    start,
+		Duration: time.Since(start),
+		Err:      errString(err),
+	})
+	return output, err
+}
+
+// batchTransport is implemented by transports that can run several
+// commands in order over one connection, such as ssh.Client
+type batchTransport interface {
+	ExecuteBatch(ctx context.Context, cmds []string, opts ssh.ExecOptions) ([]ssh.BatchResult, error)
+}
+
+// executeBatch runs a step's commands on a host in order, stopping at the
+// first failure, and returns the output of the last one that ran. The batch
+// is recorded in the run report as a single action. Transports that can't
+// batch, including traced ones that record each command, run them one by
+// one through execute.
+func (o *Orchestrator) executeBatch(ctx context.Context, client Transport, step config.Step, hostname, action string, cmds []string) (string, error) {
+	batch, ok := client.(batchTransport)
+	if !ok || len(cmds) == 1 {
+		var output string
+		for _, cmd := range cmds {
+			var err error
+			if output, err = o.execute(ctx, client, step, hostname, action, cmd); err != nil {
+				return output, err
+			}
+		}
+		return output, nil
+	}
+
+	start := time.Now()
+	results, err := batch.ExecuteBatch(ctx, cmds, ssh.ExecOptions{RequestPTY: step.RequestPTY, Shell: step.Shell})
+	o.report.recordCommand(step.Name, CommandTiming{
+		Host:     hostname,
+		Action:   action,
+		Start:    start,
+		Duration: time.Since(start),
+		Err:      errString(err),
+	})
+	var output string
+	if len(results) > 0 {
+		output = results[len(results)-1].Output
+	}
+	return output, err
+}
+
+// asUser returns host with its SSH user replaced by user, if one is given
+func asUser(host config.Host, user string) config.Host {
+	if user != "" {
+		host.SSHUser = user
+	}
+	return host
+}
+
+// hostCommand renders cmd for a single host and checks the result against
+// the environment's allow-list
+func (o *Orchestrator) hostCommand(env config.Environment, step config.Step, host config.Host, cmd string) (string, error) {
+	rendered, err := renderCommand(cmd, step, host, env.Vars)
+	if err != nil {
+		return "", err
 	}
+	if err := checkAllowed(env, rendered); err != nil {
+		return "", err
+	}
+	return rendered, nil
+}
 
+// backgroundCommand wraps a start command so that it keeps running detached
+// from the SSH session, which then ends as soon as the process is launched.
+// Output is discarded; services that need logs should write their own.
+func backgroundCommand(cmd, shell string) string {
+	if shell == "" {
+		shell = "sh"
+	}
+	return fmt.Sprintf("nohup %s -c %s </dev/null >/dev/null 2>&1 &", shell, ssh.ShellQuote(cmd))
+}
+
+// hostCheck returns the check command the step runs on a host
+func hostCheck(step config.Step, hostName string) string {
+	if check, ok := step.HostChecks[hostName]; ok {
+		return check
+	}
+	return step.Check
+}
+
+// checkScript returns the check_script sent to the step's check on a host,
+// or nil where the step has no check_script or the host overrides its check.
+// The check is config.CheckScriptCommand, which saves what it is sent to a
+// temporary file and runs it.
+func checkScript(step config.Step, hostName string) io.Reader {
+	if _, ok := step.HostChecks[hostName]; ok || step.CheckScript == "" {
+		return nil
+	}
+	return strings.NewReader(step.CheckScriptBody)
+}
+
+// validateCheck is validateCommand for the step's check, taking per-host
+// overrides into account
+func (o *Orchestrator) validateCheck(env config.Environment, step config.Step) error {
+	for _, hostName := range step.Hosts {
+		host, ok := env.Hosts[hostName]
+		if !ok {
+			continue
+		}
+		if _, err := o.hostCommand(env, step, host, hostCheck(step, hostName)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// validateCommand renders cmd for every host of the step up front, so that
+// template and allow-list errors surface before anything runs, including in
+// dry-run mode
+func (o *Orchestrator) validateCommand(env config.Environment, step config.Step, cmd string) error {
+	for _, hostName := range step.Hosts {
+		host, ok := env.Hosts[hostName]
+		if !ok {
+			// Missing hosts are reported where the command runs
+			continue
+		}
+		if _, err := o.hostCommand(env, step, host, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAllowed verifies cmd against the environment's allow-list. Each entry
+// is a regular expression that must match the whole command; an empty list
+// allows everything.
+func checkAllowed(env config.Environment, cmd string) error {
+	if len(env.AllowedCommands) == 0 {
+		return nil
+	}
+
+	for _, pattern := range env.AllowedCommands {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid allowed_commands pattern %q: %w", pattern, err)
+		}
+		if re.MatchString(cmd) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("command %q is not permitted by the environment's allowed_commands", cmd)
+}
@@ -0,0 +1,1241 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"orchid/internal/audit"
+	"orchid/internal/config"
+	"orchid/internal/ssh"
+)
+
+// stepStatus returns the status of the named step in o's report
+func stepStatus(o *Orchestrator, name string) string {
+	for _, s := range o.Report().Steps {
+		if s.Name == name {
+			return s.Status
+		}
+	}
+	return ""
+}
+
+func TestUpLogsProgress(t *testing.T) {
+	useMockTransport(t, &mockTransport{})
+
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Hosts: map[string]config.Host{
+				"app1": {Hostname: "app1.example.com", Transport: "mock"},
+				"app2": {Hostname: "app2.example.com", Transport: "mock"},
+			},
+			Sequence: []config.Step{
+				{Name: "migrate", Type: "command", Hosts: []string{"app1"}, Run: "migrate"},
+				{Name: "warm", Type: "command", Hosts: []string{"app1", "app2"}, Run: "warm-cache"},
+			},
+		},
+	}}
+	var logs bytes.Buffer
+	o := newTestOrchestrator(t, cfg, Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+
+	if err := o.Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+
+	want := []string{
+		"progress: step 1/2 (50%)",
+		"progress: warm host 1/2",
+		"progress: warm host 2/2",
+		"progress: step 2/2 (100%)",
+	}
+	out := logs.String()
+	last := -1
+	for _, line := range want {
+		i := strings.Index(out, line)
+		if i < 0 {
+			t.Fatalf("logs have no %q:\n%s", line, out)
+		}
+		if i < last {
+			t.Errorf("%q logged out of order:\n%s", line, out)
+		}
+		last = i
+	}
+	if strings.Contains(out, "progress: migrate host") {
+		t.Errorf("logs report host progress for a single-host step:\n%s", out)
+	}
+	if !strings.Contains(out, "elapsed=") {
+		t.Errorf("progress lines have no elapsed time:\n%s", out)
+	}
+}
+
+func TestDownLogsProgress(t *testing.T) {
+	useMockTransport(t, &mockTransport{})
+
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Hosts: map[string]config.Host{"app": {Hostname: "app.example.com", Transport: "mock"}},
+			Sequence: []config.Step{
+				{Name: "migrate", Type: "command", Hosts: []string{"app"}, Run: "migrate"},
+				{Name: "report", Type: "command", Hosts: []string{"app"}, Run: "report"},
+			},
+		},
+	}}
+	var logs bytes.Buffer
+	o := newTestOrchestrator(t, cfg, Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+
+	if err := o.Down(context.Background()); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	for _, line := range []string{"progress: step 1/2 (50%)", "progress: step 2/2 (100%)"} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("logs have no %q:\n%s", line, logs.String())
+		}
+	}
+}
+
+func TestFailedSmokeTestRollsBackEnvironment(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.fail("smoke-test")
+
+	smoke := config.Step{Name: "smoke", Type: "smoke", Hosts: []string{"web1"}, Run: "smoke-test"}
+	cfg := fakeEnvironment(smoke, service("db", "db1"), service("web", "web1", "web2"))
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	err := o.Up(context.Background())
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "smoke" {
+		t.Fatalf("err = %v, want the smoke step to fail", err)
+	}
+
+	// The smoke test runs after the sequence, though it is listed first
+	commands := hosts.commands()
+	smokeAt := slices.Index(commands, "web1: smoke-test")
+	if smokeAt < slices.Index(commands, "web2: start web") || smokeAt < slices.Index(commands, "db1: start db") {
+		t.Errorf("commands = %q, want the smoke test after every service started", commands)
+	}
+	for _, c := range []struct{ host, service string }{{"db1", "db"}, {"web1", "web"}, {"web2", "web"}} {
+		if hosts.isRunning(c.host, c.service) {
+			t.Errorf("%s is still running on %s, want the whole environment rolled back", c.service, c.host)
+		}
+	}
+	if status := stepStatus(o, "web"); status != StepRolledBack {
+		t.Errorf("web status = %q, want %q", status, StepRolledBack)
+	}
+}
+
+func TestSmokeTestNeverRunsOnDown(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.start("web1", "web")
+
+	smoke := config.Step{Name: "smoke", Type: "smoke", Hosts: []string{"web1"}, Run: "smoke-test"}
+	o := newTestOrchestrator(t, fakeEnvironment(service("web", "web1"), smoke), Options{})
+
+	if err := o.Down(context.Background()); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	if hosts.ranCommand("smoke-test") {
+		t.Errorf("commands = %q, want no smoke test on down", hosts.commands())
+	}
+	if hosts.isRunning("web1", "web") {
+		t.Error("web is still running after down")
+	}
+}
+
+func TestDisabledRollbackLeavesServicesStarted(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		name       string
+		rollback   *bool
+		noRollback bool
+		wantLeft   bool
+	}{
+		{name: "default", wantLeft: false},
+		{name: "flag", noRollback: true, wantLeft: true},
+		{name: "environment", rollback: &disabled, wantLeft: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.fail("start web")
+
+			cfg := fakeEnvironment(service("db", "db1"), service("api", "api1"), service("web", "web1"))
+			env := cfg.Environments["test"]
+			env.Rollback = tt.rollback
+			cfg.Environments["test"] = env
+			summaryPath := filepath.Join(t.TempDir(), "summary.json")
+			o := newTestOrchestrator(t, cfg, Options{NoRollback: tt.noRollback, ReportOut: summaryPath})
+
+			err := o.Up(context.Background())
+			var stepErr *StepError
+			if !errors.As(err, &stepErr) {
+				t.Fatalf("err = %v, want a StepError", err)
+			}
+			for _, svc := range []struct{ host, name string }{{"db1", "db"}, {"api1", "api"}} {
+				if got := hosts.isRunning(svc.host, svc.name); got != tt.wantLeft {
+					t.Errorf("%s running = %t, want %t", svc.name, got, tt.wantLeft)
+				}
+			}
+
+			data, readErr := os.ReadFile(summaryPath)
+			if readErr != nil {
+				t.Fatalf("failed to read the summary: %v", readErr)
+			}
+			var summary RunSummary
+			if err := json.Unmarshal(data, &summary); err != nil {
+				t.Fatalf("failed to parse the summary: %v", err)
+			}
+			wantSkipped := ""
+			if tt.wantLeft {
+				wantSkipped = RollbackSkippedDisabled
+			}
+			if stepErr.RolledBack == tt.wantLeft || stepErr.RollbackSkipped != wantSkipped {
+				t.Errorf("RolledBack = %t, RollbackSkipped = %q, want %t, %q", stepErr.RolledBack, stepErr.RollbackSkipped, !tt.wantLeft, wantSkipped)
+			}
+			if summary.RolledBack == tt.wantLeft || summary.RollbackSkipped != wantSkipped {
+				t.Errorf("summary rolled_back = %t, rollback_skipped = %q, want %t, %q", summary.RolledBack, summary.RollbackSkipped, !tt.wantLeft, wantSkipped)
+			}
+		})
+	}
+}
+
+func TestCheckAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		cmd     string
+		wantErr bool
+	}{
+		{name: "no list", cmd: "rm -rf /"},
+		{name: "allowed", allowed: []string{`systemctl (start|stop|is-active) \S+`}, cmd: "systemctl start web"},
+		{name: "blocked", allowed: []string{`systemctl (start|stop|is-active) \S+`}, cmd: "rm -rf /", wantErr: true},
+		{name: "whole command", allowed: []string{`systemctl start \S+`}, cmd: "systemctl start web; rm -rf /", wantErr: true},
+		{name: "invalid pattern", allowed: []string{`(`}, cmd: "true", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAllowed(config.Environment{AllowedCommands: tt.allowed}, tt.cmd)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBlockedCommandIsNeverRun(t *testing.T) {
+	hosts := newFakeHosts(t)
+
+	cfg := fakeEnvironment(
+		service("web", "web1"),
+		config.Step{Name: "cleanup", Type: "command", Hosts: []string{"web1"}, Run: "rm -rf /var/cache"},
+	)
+	env := cfg.Environments["test"]
+	env.AllowedCommands = []string{`(start|stop|check) \S+`}
+	cfg.Environments["test"] = env
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	err := o.Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Fatalf("err = %v, want the cleanup command refused", err)
+	}
+	if !hosts.ranCommand("start web") {
+		t.Errorf("commands = %q, want the allowed start command run", hosts.commands())
+	}
+	if hosts.ranCommand("rm -rf /var/cache") {
+		t.Errorf("commands = %q, want the blocked command never run", hosts.commands())
+	}
+}
+
+func TestRunsAreAudited(t *testing.T) {
+	t.Setenv("GITHUB_ACTIONS", "")
+	t.Setenv("JENKINS_URL", "")
+	t.Setenv("GITLAB_CI", "true")
+	t.Setenv("CI_PIPELINE_ID", "1234")
+
+	hosts := newFakeHosts(t)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	o := newTestOrchestrator(t, fakeEnvironment(service("web", "web1")), Options{Audit: audit.NewWriter(path)})
+
+	hosts.fail("start web")
+	if err := o.Up(context.Background()); err == nil {
+		t.Fatal("Up succeeded, want the failing start to fail it")
+	}
+	if err := o.Down(context.Background()); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+
+	records, err := audit.Read(path, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to read the audit log: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("records = %+v, want one per run", records)
+	}
+	for i, want := range []struct{ action, result string }{{"up", "failure"}, {"down", "success"}} {
+		rec := records[i]
+		if rec.Environment != "test" || rec.Action != want.action || rec.Result != want.result {
+			t.Errorf("record %d = %+v, want %s %s of test", i, rec, want.action, want.result)
+		}
+		if rec.PipelineID != "1234" || rec.User == "" {
+			t.Errorf("record %d = %+v, want the user and pipeline", i, rec)
+		}
+	}
+	if !strings.Contains(records[0].Error, "failed to start service on host web1") {
+		t.Errorf("error = %q, want the failed start", records[0].Error)
+	}
+}
+
+func TestDownStopsReachableHosts(t *testing.T) {
+	hosts := newFakeHosts(t)
+	for _, h := range []string{"web1", "web2", "web3"} {
+		hosts.start(h, "web")
+	}
+	hosts.unreachable("web2")
+
+	cfg := fakeEnvironment(service("web", "web1", "web2", "web3", "web4"))
+	// web4 is listed by the step but missing from the environment
+	delete(cfg.Environments["test"].Hosts, "web4")
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	if err := o.Down(context.Background()); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	for _, h := range []string{"web1", "web3"} {
+		if hosts.isRunning(h, "web") {
+			t.Errorf("web is still running on reachable host %s", h)
+		}
+	}
+
+	report := o.Report().Steps[0]
+	if report.Status != StepFailed {
+		t.Errorf("status = %s, want %s", report.Status, StepFailed)
+	}
+	for _, h := range []string{"web2", "web4"} {
+		if !strings.Contains(report.Error, h) {
+			t.Errorf("error = %q, want %s reported", report.Error, h)
+		}
+	}
+}
+
+func TestDependencyReadyIsPolled(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		wantErr  bool
+	}{
+		{name: "ready after polling", failures: 2},
+		{name: "never ready", failures: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.start("db1", "db")
+			hosts.failTimes(tt.failures, "replication-caught-up")
+
+			db := service("db", "db1")
+			db.Type = "dependency"
+			db.DepReady = "replication-caught-up"
+			o := newTestOrchestrator(t, fakeEnvironment(db, service("web", "web1")), Options{})
+
+			err := o.Up(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "did not become ready") {
+				t.Errorf("err = %v, want the dependency reported not ready", err)
+			}
+
+			var polls int
+			for _, c := range hosts.commands() {
+				if c == "db1: replication-caught-up" {
+					polls++
+				}
+			}
+			if !tt.wantErr && polls != tt.failures+1 {
+				t.Errorf("readiness polled %d times, want %d", polls, tt.failures+1)
+			}
+			if hosts.ranCommand("start db") {
+				t.Error("the dependency was started, want it only verified")
+			}
+			if got := hosts.isRunning("web1", "web"); got == tt.wantErr {
+				t.Errorf("web running = %t, want %t", got, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTagSelection(t *testing.T) {
+	tagged := func(step config.Step, tags ...string) config.Step {
+		step.Tags = tags
+		return step
+	}
+	db := service("db", "db1")
+	db.Type = "dependency"
+	cfg := fakeEnvironment(
+		db,
+		tagged(service("api", "api1"), "backend"),
+		tagged(service("web", "web1"), "frontend"),
+		tagged(service("worker", "worker1"), "backend", "batch"),
+	)
+
+	tests := []struct {
+		name     string
+		tags     []string
+		matchAll bool
+		want     []string
+	}{
+		{name: "single tag", tags: []string{"frontend"}, want: []string{"db", "web"}},
+		{name: "any of several", tags: []string{"frontend", "batch"}, want: []string{"db", "web", "worker"}},
+		{name: "all of several", tags: []string{"backend", "batch"}, matchAll: true, want: []string{"db", "worker"}},
+		{name: "no match", tags: []string{"mobile"}, want: []string{"db"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			o := newTestOrchestrator(t, cfg, Options{Tags: tt.tags, MatchAllTags: tt.matchAll, HandleDeps: true})
+
+			if err := o.Up(context.Background()); err != nil {
+				t.Fatalf("Up: %v", err)
+			}
+			for _, step := range cfg.Environments["test"].Sequence {
+				want := slices.Contains(tt.want, step.Name)
+				if got := hosts.isRunning(step.Hosts[0], step.Name); got != want {
+					t.Errorf("%s running = %t, want %t", step.Name, got, want)
+				}
+				if status := stepStatus(o, step.Name); !want && status != StepSkipped {
+					t.Errorf("%s status = %q, want %q", step.Name, status, StepSkipped)
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackStopsAtCheckpoint(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.fail("start worker")
+
+	stable := service("api", "api1")
+	stable.Checkpoint = true
+	cfg := fakeEnvironment(service("db", "db1"), stable, service("web", "web1"), service("cache", "cache1"), service("worker", "worker1"))
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	err := o.Up(context.Background())
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || !stepErr.RolledBack {
+		t.Fatalf("err = %v, want a rolled back StepError", err)
+	}
+
+	for _, svc := range []struct {
+		host, name  string
+		wantRunning bool
+	}{
+		{"db1", "db", true},
+		{"api1", "api", true},
+		{"web1", "web", false},
+		{"cache1", "cache", false},
+	} {
+		if got := hosts.isRunning(svc.host, svc.name); got != svc.wantRunning {
+			t.Errorf("%s running = %t, want %t", svc.name, got, svc.wantRunning)
+		}
+	}
+	if hosts.ranCommand("stop api") || hosts.ranCommand("stop db") {
+		t.Errorf("commands = %q, want nothing at or before the checkpoint stopped", hosts.commands())
+	}
+}
+
+func TestLenientDeps(t *testing.T) {
+	db := service("db", "db1")
+	db.Type = "dependency"
+	cfg := fakeEnvironment(db, service("api", "api1"))
+
+	tests := []struct {
+		name    string
+		lenient bool
+		wantErr string
+	}{
+		{name: "strict", wantErr: "dependency db is not running"},
+		{name: "lenient", lenient: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			o := newTestOrchestrator(t, cfg, Options{LenientDeps: tt.lenient})
+
+			err := o.Up(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if hosts.ranCommand("start api") {
+					t.Error("api was started after its dependency was found down")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Up: %v", err)
+			}
+			if !hosts.isRunning("api1", "api") {
+				t.Error("api was not started")
+			}
+			if hosts.ranCommand("start db") {
+				t.Error("the dependency was started without HandleDeps")
+			}
+			if w := o.Report().Warnings; len(w) != 1 || w[0].Step != "db" {
+				t.Errorf("warnings = %+v, want one for db", w)
+			}
+		})
+	}
+}
+
+func TestCommandUsers(t *testing.T) {
+	var mu sync.Mutex
+	var running bool
+	users := make(map[string][]string) // Command to the users it ran as
+	transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+		return &mockTransport{host: host.Hostname, run: func(cmd string) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			users[cmd] = append(users[cmd], host.SSHUser)
+			switch cmd {
+			case "start api", "stop api":
+				running = cmd == "start api"
+			case "check api":
+				if !running {
+					return "not running", exitError(1)
+				}
+			}
+			return "ok", nil
+		}}, nil
+	}
+	t.Cleanup(func() { delete(transports, "mock") })
+
+	step := service("api", "api1")
+	step.StartUser = "deploy"
+	step.CheckUser = "monitor"
+	cfg := fakeEnvironment(step)
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	if err := o.Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	if err := o.Down(context.Background()); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+
+	want := map[string]string{"start api": "deploy", "check api": "monitor", "stop api": ""}
+	for cmd, user := range want {
+		ran := users[cmd]
+		if len(ran) == 0 {
+			t.Errorf("%q never ran", cmd)
+		}
+		for _, got := range ran {
+			if got != user {
+				t.Errorf("%q ran as %q, want %q", cmd, got, user)
+			}
+		}
+	}
+}
+
+func TestHealthyExitCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		healthy []int
+		status  int // Exit status of the check once the service is started
+		wantErr error
+	}{
+		{name: "listed status is healthy", healthy: []int{0, 2}, status: 2},
+		{name: "unlisted status fails", healthy: []int{0, 2}, status: 3, wantErr: ErrHealthCheckFailed},
+		{name: "any non-zero status fails by default", status: 2, wantErr: ErrHealthCheckFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var started atomic.Bool
+			useMockTransport(t, &mockTransport{run: func(cmd string) (string, error) {
+				switch {
+				case cmd == "start api":
+					started.Store(true)
+				case cmd == "check api" && !started.Load():
+					return "stopped", exitError(1)
+				case cmd == "check api":
+					return "degraded", exitError(tt.status)
+				}
+				return "ok", nil
+			}})
+
+			step := service("api", "api1")
+			step.HealthyExitCodes = tt.healthy
+			o := newTestOrchestrator(t, fakeEnvironment(step), Options{})
+
+			err := o.Up(context.Background())
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !started.Load() {
+				t.Error("api was not started: a stopped service counted as running")
+			}
+		})
+	}
+}
+
+func TestTimeoutDefaults(t *testing.T) {
+	environment := config.Timeouts{
+		Operation:           time.Hour,
+		HealthCheck:         10 * time.Minute,
+		HealthCheckInterval: time.Minute,
+	}
+	tests := []struct {
+		name     string
+		timeouts config.Timeouts
+		opts     Options
+		want     [3]time.Duration // Operation, health check, health check interval
+	}{
+		{name: "package defaults", want: [3]time.Duration{defaultOperationTimeout, defaultHealthCheckTimeout, defaultHealthCheckInterval}},
+		{name: "environment", timeouts: environment, want: [3]time.Duration{time.Hour, 10 * time.Minute, time.Minute}},
+		{
+			name:     "options win",
+			timeouts: environment,
+			opts:     Options{OperationTimeout: time.Second, HealthCheckTimeout: 2 * time.Second, HealthCheckInterval: 3 * time.Second},
+			want:     [3]time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			name:     "partly set",
+			timeouts: config.Timeouts{HealthCheck: 10 * time.Minute},
+			opts:     Options{OperationTimeout: time.Second},
+			want:     [3]time.Duration{time.Second, 10 * time.Minute, defaultHealthCheckInterval},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Config = &config.Config{Environments: map[string]config.Environment{"test": {Timeouts: tt.timeouts}}}
+			opts.Environment = "test"
+			opts.StateDir = t.TempDir()
+			o, err := New(opts)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			defer o.Close()
+			got := [3]time.Duration{o.options.OperationTimeout, o.options.HealthCheckTimeout, o.options.HealthCheckInterval}
+			if got != tt.want {
+				t.Errorf("timeouts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSerialHostInterval(t *testing.T) {
+	hosts := []config.Host{{Hostname: "app1"}, {Hostname: "app2"}}
+	tests := []struct {
+		name      string
+		interval  time.Duration
+		cancelIn  time.Duration // 0 never cancels
+		wantHosts int
+		wantErr   error
+	}{
+		{name: "honoured", interval: 50 * time.Millisecond, wantHosts: 2},
+		{name: "cancelled mid-interval", interval: time.Hour, cancelIn: 20 * time.Millisecond, wantHosts: 1, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOrchestrator(t, &config.Config{Environments: map[string]config.Environment{"test": {}}}, Options{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelIn > 0 {
+				time.AfterFunc(tt.cancelIn, cancel)
+			}
+
+			var started []time.Time
+			step := config.Step{Name: "api", Serial: true, HostInterval: tt.interval}
+			errs := o.eachHost(ctx, step, hosts, false, func(ctx context.Context, h config.Host) error {
+				started = append(started, time.Now())
+				return nil
+			})
+
+			if len(started) != tt.wantHosts {
+				t.Fatalf("handled %d hosts, want %d", len(started), tt.wantHosts)
+			}
+			if tt.wantHosts == 2 {
+				if gap := started[1].Sub(started[0]); gap < tt.interval {
+					t.Errorf("second host started %s after the first, want at least %s", gap, tt.interval)
+				}
+			}
+			err := errors.Join(errs...)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// batchingTransport is a mockTransport that can also run batches, recording
+// each batch it is given
+type batchingTransport struct {
+	*mockTransport
+	batches [][]string
+}
+
+func (b *batchingTransport) ExecuteBatch(ctx context.Context, cmds []string, opts ssh.ExecOptions) ([]ssh.BatchResult, error) {
+	b.mu.Lock()
+	b.batches = append(b.batches, cmds)
+	b.mu.Unlock()
+
+	var results []ssh.BatchResult
+	for _, cmd := range cmds {
+		output, err := b.ExecuteWith(ctx, cmd, opts)
+		results = append(results, ssh.BatchResult{Command: cmd, Output: output, Err: err})
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+func TestCommandPreAndPostRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		pre, post   string
+		fail        string
+		wantBatches int
+		wantRan     []string
+		wantErr     bool
+	}{
+		{name: "batched in order", pre: "pre", post: "post", wantBatches: 1, wantRan: []string{"pre", "migrate", "post"}},
+		{name: "failing run skips post_run", pre: "pre", post: "post", fail: "migrate", wantBatches: 1, wantRan: []string{"pre", "migrate"}, wantErr: true},
+		{name: "failing pre_run skips run", pre: "pre", post: "post", fail: "pre", wantBatches: 1, wantRan: []string{"pre"}, wantErr: true},
+		{name: "run alone", wantRan: []string{"migrate"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &batchingTransport{mockTransport: &mockTransport{run: func(cmd string) (string, error) {
+				if cmd == tt.fail {
+					return "failed", exitError(1)
+				}
+				return "ok", nil
+			}}}
+			transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+				return transport, nil
+			}
+			t.Cleanup(func() { delete(transports, "mock") })
+
+			step := config.Step{Name: "migrate", Type: "command", Hosts: []string{"app1"}, PreRun: tt.pre, Run: "migrate", PostRun: tt.post}
+			o := newTestOrchestrator(t, fakeEnvironment(step), Options{})
+
+			err := o.Up(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if ran := transport.ran(); !slices.Equal(ran, tt.wantRan) {
+				t.Errorf("ran %q, want %q", ran, tt.wantRan)
+			}
+			if len(transport.batches) != tt.wantBatches {
+				t.Errorf("ran %d batches, want %d", len(transport.batches), tt.wantBatches)
+			}
+		})
+	}
+}
+
+func TestCheckExpect(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string // Printed by the check, which always exits 0
+		expect  string
+		wantErr error
+	}{
+		{name: "matching output", output: `{"status":"green"}`, expect: `"status":"green"`},
+		{name: "mismatch despite exit 0", output: `{"status":"red"}`, expect: `"status":"green"`, wantErr: ErrHealthCheckFailed},
+		{name: "exit status alone", output: `{"status":"red"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMockTransport(t, &mockTransport{run: func(cmd string) (string, error) {
+				if cmd == "check api" {
+					return tt.output, nil
+				}
+				return "ok", nil
+			}})
+
+			step := service("api", "api1")
+			step.CheckExpect = tt.expect
+			cfg := fakeEnvironment(step)
+			o := newTestOrchestrator(t, cfg, Options{})
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+			err := o.performHealthCheck(context.Background(), step, cfg.Environments["test"], logger)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "does not match check_expect") {
+				t.Errorf("err = %v, want it to say the output did not match", err)
+			}
+		})
+	}
+}
+
+func TestMaxFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxFailures string
+		failing     []string
+		wantErr     bool
+	}{
+		{name: "below the threshold", maxFailures: "2", failing: []string{"app3"}},
+		{name: "at the threshold", maxFailures: "2", failing: []string{"app1", "app3"}},
+		{name: "above the threshold", maxFailures: "2", failing: []string{"app1", "app2", "app3"}, wantErr: true},
+		{name: "at a percentage", maxFailures: "50%", failing: []string{"app2", "app4"}},
+		{name: "above a percentage", maxFailures: "25%", failing: []string{"app2", "app4"}, wantErr: true},
+		{name: "none tolerated by default", failing: []string{"app4"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			for _, host := range tt.failing {
+				hosts.fail(host + ": migrate")
+			}
+
+			step := config.Step{Name: "migrate", Type: "command", Hosts: []string{"app1", "app2", "app3", "app4"}, Run: "migrate", MaxFailures: tt.maxFailures}
+			o := newTestOrchestrator(t, fakeEnvironment(step), Options{})
+
+			err := o.Up(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			wantStatus := StepSucceeded
+			if tt.wantErr {
+				wantStatus = StepFailed
+			}
+			if got := stepStatus(o, "migrate"); got != wantStatus {
+				t.Errorf("status = %s, want %s", got, wantStatus)
+			}
+			for _, s := range o.Report().Steps {
+				if s.Name == "migrate" && !slices.Equal(s.FailedHosts, tt.failing) {
+					t.Errorf("report lists failed hosts %q, want %q", s.FailedHosts, tt.failing)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxFailuresSpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    int
+		wantErr bool
+	}{
+		{spec: "", want: 0},
+		{spec: "3", want: 3},
+		{spec: "10%", want: 1},
+		{spec: "19%", want: 1},
+		{spec: "100%", want: 10},
+		{spec: "-1", wantErr: true},
+		{spec: "150%", wantErr: true},
+		{spec: "some", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := maxFailures(tt.spec, 10)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("maxFailures(%q, 10) = %d, %v, want %d, error %t", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestKeepRunningDeps(t *testing.T) {
+	tests := []struct {
+		name    string
+		keep    bool
+		running bool
+		wantRan []string
+	}{
+		{name: "restarted by default", running: true, wantRan: []string{"db1: stop db", "db1: start db"}},
+		{name: "left running", keep: true, running: true},
+		{name: "started when down", keep: true, wantRan: []string{"db1: start db"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			if tt.running {
+				hosts.start("db1", "db")
+			}
+			db := service("db", "db1")
+			db.Type = "dependency"
+			o := newTestOrchestrator(t, fakeEnvironment(db), Options{HandleDeps: true, KeepRunningDeps: tt.keep})
+
+			if err := o.Up(context.Background()); err != nil {
+				t.Fatalf("Up: %v", err)
+			}
+			ran := slices.DeleteFunc(hosts.commands(), func(c string) bool { return strings.HasSuffix(c, "check db") })
+			if !slices.Equal(ran, tt.wantRan) {
+				t.Errorf("ran %q, want %q", ran, tt.wantRan)
+			}
+			if !hosts.isRunning("db1", "db") {
+				t.Error("db is not running")
+			}
+		})
+	}
+}
+
+func TestStopVerifyDelay(t *testing.T) {
+	const exitAfter = 50 * time.Millisecond // The service lingers this long after stop
+	tests := []struct {
+		name        string
+		stepDelay   time.Duration
+		envDelay    time.Duration
+		dryRun      bool
+		wantWarning bool
+		wantChecks  bool
+	}{
+		{name: "checked immediately", wantWarning: true, wantChecks: true},
+		{name: "step delay", stepDelay: 200 * time.Millisecond, wantChecks: true},
+		{name: "environment delay", envDelay: 200 * time.Millisecond, wantChecks: true},
+		{name: "dry run", stepDelay: 200 * time.Millisecond, dryRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var stopped time.Time
+			checks := 0
+			useMockTransport(t, &mockTransport{run: func(cmd string) (string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch cmd {
+				case "stop api":
+					stopped = time.Now()
+				case "check api":
+					checks++
+					if stopped.IsZero() || time.Since(stopped) < exitAfter {
+						return "running", nil
+					}
+					return "stopped", exitError(1)
+				}
+				return "ok", nil
+			}})
+
+			step := service("api", "api1")
+			step.StopVerifyDelay = tt.stepDelay
+			cfg := fakeEnvironment(step)
+			env := cfg.Environments["test"]
+			env.Timeouts.StopVerifyDelay = tt.envDelay
+			cfg.Environments["test"] = env
+			o := newTestOrchestrator(t, cfg, Options{DryRun: tt.dryRun})
+
+			if err := o.Down(context.Background()); err != nil {
+				t.Fatalf("Down: %v", err)
+			}
+			var warned bool
+			for _, w := range o.Report().Warnings {
+				warned = warned || w.Message == "service still appears to be running after stop"
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("warned %t, want %t: %+v", warned, tt.wantWarning, o.Report().Warnings)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if (checks > 0) != tt.wantChecks {
+				t.Errorf("ran the check %d times", checks)
+			}
+		})
+	}
+}
+
+func TestStopVerifyDelayCancelled(t *testing.T) {
+	mock := &mockTransport{}
+	useMockTransport(t, mock)
+	step := service("api", "api1")
+	step.StopVerifyDelay = time.Hour
+	cfg := fakeEnvironment(step)
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	done := make(chan struct{})
+	go func() {
+		o.verifyStopped(ctx, step, cfg.Environments["test"], slog.New(slog.NewTextHandler(io.Discard, nil)))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("verifyStopped ignored its context being cancelled")
+	}
+	if ran := mock.ran(); len(ran) > 0 {
+		t.Errorf("ran %q after being cancelled", ran)
+	}
+}
+
+func TestStoppedCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		stoppedCheck string
+		goneFails    bool
+		wantWarning  bool
+	}{
+		{name: "stopped check confirms shutdown", stoppedCheck: "gone api"},
+		{name: "stopped check fails", stoppedCheck: "gone api", goneFails: true, wantWarning: true},
+		{name: "running check alone", wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The running check keeps passing on a lingering socket
+			mock := &mockTransport{run: func(cmd string) (string, error) {
+				if cmd == "gone api" && tt.goneFails {
+					return "still listening", exitError(1)
+				}
+				return "ok", nil
+			}}
+			useMockTransport(t, mock)
+			step := service("api", "api1")
+			step.StoppedCheck = tt.stoppedCheck
+			o := newTestOrchestrator(t, fakeEnvironment(step), Options{})
+
+			if err := o.Down(context.Background()); err != nil {
+				t.Fatalf("Down: %v", err)
+			}
+			var warned bool
+			for _, w := range o.Report().Warnings {
+				warned = warned || w.Message == "service still appears to be running after stop"
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("warned %t, want %t: %+v", warned, tt.wantWarning, o.Report().Warnings)
+			}
+			if ran := slices.Contains(mock.ran(), "gone api"); ran != (tt.stoppedCheck != "") {
+				t.Errorf("commands = %q, want the stopped check run %t", mock.ran(), tt.stoppedCheck != "")
+			}
+		})
+	}
+}
+
+func TestBackgroundStart(t *testing.T) {
+	tests := []struct {
+		name  string
+		shell string
+		want  string
+	}{
+		{name: "default shell", want: `nohup sh -c 'start api' </dev/null >/dev/null 2>&1 &`},
+		{name: "step shell", shell: "bash", want: `nohup bash -c 'start api' </dev/null >/dev/null 2>&1 &`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backgroundCommand("start api", tt.shell); got != tt.want {
+				t.Errorf("backgroundCommand = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("only start is wrapped", func(t *testing.T) {
+		var mu sync.Mutex
+		running := false
+		mock := &mockTransport{run: func(cmd string) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case strings.Contains(cmd, "start api"):
+				running = true
+			case cmd == "stop api":
+				running = false
+			case cmd == "check api" && !running:
+				return "not running", exitError(1)
+			}
+			return "ok", nil
+		}}
+		useMockTransport(t, mock)
+		step := service("api", "api1")
+		step.Background = true
+		o := newTestOrchestrator(t, fakeEnvironment(step), Options{})
+
+		if err := o.Up(context.Background()); err != nil {
+			t.Fatalf("Up: %v", err)
+		}
+		if err := o.Down(context.Background()); err != nil {
+			t.Fatalf("Down: %v", err)
+		}
+		for _, cmd := range mock.ran() {
+			wrapped := strings.HasPrefix(cmd, "nohup ")
+			if wrapped != strings.Contains(cmd, "start api") {
+				t.Errorf("ran %q, want only start run in the background", cmd)
+			}
+		}
+		if !slices.Contains(mock.ran(), backgroundCommand("start api", "")) {
+			t.Errorf("commands = %q, want start run in the background", mock.ran())
+		}
+	})
+
+	t.Run("returns without waiting", func(t *testing.T) {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("no sh to run the command")
+		}
+		// A foreground process that would otherwise hold the session open
+		start := time.Now()
+		cmd := exec.Command("sh", "-c", backgroundCommand("sleep 30", ""))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("run: %v: %s", err, out)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("returned after %s, want it not to wait for the process", elapsed)
+		}
+	})
+}
+
+func TestHostPriority(t *testing.T) {
+	priorities := map[string]int{"app1": 0, "app2": 10, "app3": 5, "app4": 5}
+	tests := []struct {
+		name   string
+		serial bool
+		canary string
+		action string
+		verb   string
+		want   [][]string // Hosts in order, where hosts in the same group may run in either order
+	}{
+		{name: "serial start", serial: true, action: ActionUp, verb: "start", want: [][]string{{"app2"}, {"app3"}, {"app4"}, {"app1"}}},
+		{name: "concurrent start", action: ActionUp, verb: "start", want: [][]string{{"app2"}, {"app3", "app4"}, {"app1"}}},
+		{name: "canary batches", canary: "2", action: ActionUp, verb: "start", want: [][]string{{"app2", "app3"}, {"app4"}, {"app1"}}},
+		{name: "serial stop", serial: true, action: ActionDown, verb: "stop", want: [][]string{{"app1"}, {"app4"}, {"app3"}, {"app2"}}},
+		{name: "concurrent stop", action: ActionDown, verb: "stop", want: [][]string{{"app1"}, {"app3", "app4"}, {"app2"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			step := service("api", "app1", "app2", "app3", "app4")
+			step.Serial = tt.serial
+			step.Canary = tt.canary
+			cfg := fakeEnvironment(step)
+			for name, priority := range priorities {
+				h := cfg.Environments["test"].Hosts[name]
+				h.Priority = priority
+				cfg.Environments["test"].Hosts[name] = h
+				if tt.action == ActionDown {
+					hosts.start(name, "api")
+				}
+			}
+			o := newTestOrchestrator(t, cfg, Options{})
+
+			run := o.Up
+			if tt.action == ActionDown {
+				run = o.Down
+			}
+			if err := run(context.Background()); err != nil {
+				t.Fatalf("%s: %v", tt.action, err)
+			}
+
+			var got []string
+			for _, cmd := range hosts.commands() {
+				if host, c, _ := strings.Cut(cmd, ": "); c == tt.verb+" api" {
+					got = append(got, host)
+				}
+			}
+			var i int
+			for _, group := range tt.want {
+				if i+len(group) > len(got) {
+					t.Fatalf("%s order = %q, want %q", tt.verb, got, tt.want)
+				}
+				if !sameElements(got[i:i+len(group)], group) {
+					t.Errorf("%s order = %q, want %q", tt.verb, got, tt.want)
+				}
+				i += len(group)
+			}
+		})
+	}
+}
+
+// ctxTransport runs commands through run, which is given the command's
+// context so tests can see when it is cancelled
+type ctxTransport struct {
+	host string
+	run  func(ctx context.Context, host, cmd string) (string, error)
+}
+
+func (c *ctxTransport) Execute(ctx context.Context, cmd string) (string, error) {
+	return c.run(ctx, c.host, cmd)
+}
+
+func (c *ctxTransport) ExecuteWith(ctx context.Context, cmd string, opts ssh.ExecOptions) (string, error) {
+	return c.run(ctx, c.host, cmd)
+}
+
+func (c *ctxTransport) Stream(ctx context.Context, cmd string, opts ssh.ExecOptions, w io.Writer) error {
+	_, err := c.run(ctx, c.host, cmd)
+	return err
+}
+
+func (c *ctxTransport) Close() error { return nil }
+
+func TestFailFast(t *testing.T) {
+	const slowStart = 500 * time.Millisecond
+	tests := []struct {
+		name          string
+		failFast      bool
+		serial        bool
+		wantCancelled bool // Whether app2's start was cancelled
+		wantStarted   bool // Whether app2's start ran at all
+	}{
+		{name: "wait for all", wantStarted: true},
+		{name: "fail fast", failFast: true, wantCancelled: true, wantStarted: true},
+		{name: "fail fast serial", failFast: true, serial: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var started, cancelled bool
+			transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+				return &ctxTransport{host: host.Hostname, run: func(ctx context.Context, host, cmd string) (string, error) {
+					switch {
+					case host == "app1" && cmd == "start api":
+						// Fail once app2 is under way
+						time.Sleep(20 * time.Millisecond)
+						return "failed", exitError(1)
+					case host == "app2" && cmd == "start api":
+						mu.Lock()
+						started = true
+						mu.Unlock()
+						select {
+						case <-ctx.Done():
+							mu.Lock()
+							cancelled = true
+							mu.Unlock()
+							return "", ctx.Err()
+						case <-time.After(slowStart):
+							return "ok", nil
+						}
+					case cmd == "check api":
+						return "not running", exitError(1)
+					}
+					return "ok", nil
+				}}, nil
+			}
+			t.Cleanup(func() { delete(transports, "mock") })
+
+			step := service("api", "app1", "app2")
+			step.FailFast = tt.failFast
+			step.Serial = tt.serial
+			o := newTestOrchestrator(t, fakeEnvironment(step), Options{NoRollback: true})
+
+			begin := time.Now()
+			err := o.Up(context.Background())
+			if err == nil || !strings.Contains(err.Error(), "app1") {
+				t.Fatalf("err = %v, want app1's failure reported", err)
+			}
+			elapsed := time.Since(begin)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if started != tt.wantStarted || cancelled != tt.wantCancelled {
+				t.Errorf("app2 started %t cancelled %t, want started %t cancelled %t", started, cancelled, tt.wantStarted, tt.wantCancelled)
+			}
+			if tt.failFast && elapsed >= slowStart {
+				t.Errorf("Up took %s, want it to return without waiting for app2", elapsed)
+			}
+			if tt.wantCancelled && !strings.Contains(err.Error(), "app2") {
+				t.Errorf("err = %v, want app2's cancellation reported with app1's failure", err)
+			}
+		})
+	}
+}
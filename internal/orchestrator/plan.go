@@ -0,0 +1,86 @@
+package orchestrator
+
+// Planned actions for PlannedStep.Action
+const (
+	PlanStart   = "start"
+	PlanRestart = "restart"
+	PlanStop    = "stop"
+	PlanVerify  = "verify"
+	PlanRun     = "run"
+	PlanFail    = "fail"
+)
+
+// PlannedStep is what Up would do for one step given the services' current
+// state
+type PlannedStep struct {
+	Step    string   `json:"step"`
+	Type    string   `json:"type"`
+	Hosts   []string `json:"hosts"`
+	Action  string   `json:"action"`
+	Running bool     `json:"running"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+// Plan runs the service checks and reports what Up would do for each step,
+// in the order Up would do it. Like Check it never changes anything.
+func (o *Orchestrator) Plan() ([]PlannedStep, error) {
+	env, err := LookupEnvironment(o.cfg, o.env)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := o.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	// A service only counts as running when its check passes on every host
+	running := make(map[string]bool)
+	for _, res := range results {
+		if _, seen := running[res.Step]; !seen {
+			running[res.Step] = true
+		}
+		running[res.Step] = running[res.Step] && res.Healthy
+	}
+
+	var plan []PlannedStep
+	for _, step := range smokeLast(o.selectSteps(env.Sequence)) {
+		p := PlannedStep{
+			Step:    step.Name,
+			Type:    step.Type,
+			Hosts:   step.Hosts,
+			Running: running[step.Name],
+		}
+
+		switch step.Type {
+		case "command", "smoke":
+			p.Action = PlanRun
+		case "application":
+			if p.Running {
+				p.Action, p.Reason = PlanStop, "already running; up stops it and does not start it again"
+			} else {
+				p.Action, p.Reason = PlanStart, "not running"
+			}
+		case "dependency":
+			switch {
+			case o.options.HandleDeps && p.Running && o.options.KeepRunningDeps:
+				p.Action, p.Reason = PlanVerify, "running; left as is"
+			case o.options.HandleDeps && p.Running:
+				p.Action, p.Reason = PlanRestart, "running"
+			case o.options.HandleDeps:
+				p.Action, p.Reason = PlanStart, "not running"
+			case p.Running:
+				p.Action, p.Reason = PlanVerify, "running"
+			case o.options.LenientDeps:
+				p.Action, p.Reason = PlanVerify, "not running; continuing because of lenient deps"
+			default:
+				p.Action, p.Reason = PlanFail, "not running and dependencies are not handled"
+			}
+		default:
+			p.Action, p.Reason = PlanFail, "unknown step type"
+		}
+
+		plan = append(plan, p)
+	}
+	return plan, nil
+}
@@ -0,0 +1,72 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+func TestPlan(t *testing.T) {
+	db := service("db", "db1")
+	db.Type = "dependency"
+	cache := service("cache", "cache1", "cache2")
+	cache.Type = "dependency"
+	smoke := config.Step{Name: "smoke", Type: "smoke", Hosts: []string{"web1"}, Run: "curl"}
+	migrate := config.Step{Name: "migrate", Type: "command", Hosts: []string{"api1"}, Run: "migrate"}
+	cfg := fakeEnvironment(smoke, db, cache, migrate, service("api", "api1"), service("web", "web1"))
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string // "<step> <action>", in the order up would run them
+	}{
+		{
+			name: "verify dependencies",
+			want: []string{"db verify", "cache fail", "migrate run", "api stop", "web start", "smoke run"},
+		},
+		{
+			name: "lenient dependencies",
+			opts: Options{LenientDeps: true},
+			want: []string{"db verify", "cache verify", "migrate run", "api stop", "web start", "smoke run"},
+		},
+		{
+			name: "handle dependencies",
+			opts: Options{HandleDeps: true},
+			want: []string{"db restart", "cache start", "migrate run", "api stop", "web start", "smoke run"},
+		},
+		{
+			name: "keep running dependencies",
+			opts: Options{HandleDeps: true, KeepRunningDeps: true},
+			want: []string{"db verify", "cache start", "migrate run", "api stop", "web start", "smoke run"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.start("db1", "db")
+			hosts.start("cache1", "cache") // But not cache2
+			hosts.start("api1", "api")
+			o := newTestOrchestrator(t, cfg, tt.opts)
+
+			plan, err := o.Plan()
+			if err != nil {
+				t.Fatalf("Plan: %v", err)
+			}
+			var got []string
+			for _, p := range plan {
+				got = append(got, p.Step+" "+p.Action)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("plan = %q, want %q", got, tt.want)
+			}
+
+			for _, cmd := range hosts.commands() {
+				if _, c, _ := strings.Cut(cmd, ": "); !strings.HasPrefix(c, "check ") {
+					t.Errorf("Plan ran %q, want only check commands", cmd)
+				}
+			}
+		})
+	}
+}
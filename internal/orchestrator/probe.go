@@ -0,0 +1,162 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh"
+)
+
+// ErrMissingPrograms is returned by a --dry-run=validate-remote run when a
+// step's command runs a program its host does not have
+var ErrMissingPrograms = errors.New("programs missing on remote hosts")
+
+// probe is a program one of a step's commands runs on a host, as a user
+type probe struct {
+	step    string
+	action  string
+	host    string
+	user    string
+	program string
+}
+
+// stepCommand is one of a step's commands, its per-host overrides and the
+// user it runs as
+type stepCommand struct {
+	action    string
+	cmd       string
+	user      string
+	overrides map[string]string
+}
+
+// upCommands and downCommands list the commands Up and Down may run for step
+func upCommands(step config.Step) []stepCommand {
+	return []stepCommand{
+		{"when", step.When, step.CheckUser, nil},
+		{"start", step.Start, step.StartUser, nil},
+		{"check", step.Check, step.CheckUser, step.HostChecks},
+		{"stop", step.Stop, step.StopUser, nil},
+		{"rollback_command", step.RollbackCommand, step.StopUser, nil},
+		{"dep_ready", step.DepReady, step.CheckUser, nil},
+		{"run", step.Run, "", nil},
+		{"diagnostics", step.Diagnostics, step.CheckUser, nil},
+	}
+}
+
+func downCommands(step config.Step) []stepCommand {
+	return []stepCommand{
+		{"drain", step.Drain, step.CheckUser, nil},
+		{"stop", step.Stop, step.StopUser, nil},
+		{"check", step.Check, step.CheckUser, step.HostChecks},
+		{"stopped_check", step.StoppedCheck, step.CheckUser, nil},
+	}
+}
+
+// probeCommands connects to each host of the sequence and checks, with
+// command -v, that the program each step command starts with exists there.
+// It only runs in --dry-run=validate-remote mode and never runs the commands
+// themselves.
+func (o *Orchestrator) probeCommands(ctx context.Context, env config.Environment, commands func(config.Step) []stepCommand) error {
+	if !o.dryRun || !o.options.ValidateRemote {
+		return nil
+	}
+
+	var probes []probe
+	seen := make(map[probe]bool)
+	for _, step := range env.Sequence {
+		for _, sc := range commands(step) {
+			if sc.cmd == "" {
+				continue
+			}
+			for _, hostName := range step.Hosts {
+				host, ok := env.Hosts[hostName]
+				if !ok {
+					continue
+				}
+				cmd := sc.cmd
+				if override, ok := sc.overrides[hostName]; ok {
+					cmd = override
+				}
+				rendered, err := o.hostCommand(env, step, host, cmd)
+				if err != nil {
+					return err
+				}
+				p := probe{step: step.Name, action: sc.action, host: hostName, user: sc.user, program: programOf(rendered)}
+				if p.program == "" || seen[p] {
+					continue
+				}
+				seen[p] = true
+				probes = append(probes, p)
+			}
+		}
+	}
+
+	o.logger.Info("probing remote hosts for the programs step commands run", slog.Int("probes", len(probes)))
+
+	// Each program is only probed once per host and user
+	type target struct{ host, user, program string }
+	found := make(map[target]bool)
+
+	missing := 0
+	for _, p := range probes {
+		logger := o.logger.With(
+			slog.String("step", p.step),
+			slog.String("action", p.action),
+			slog.String("host", p.host),
+			slog.String("program", p.program),
+		)
+
+		t := target{p.host, p.user, p.program}
+		ok, probed := found[t]
+		if !probed {
+			var err error
+			if ok, err = o.probeProgram(ctx, env, t.host, t.user, t.program); err != nil {
+				return err
+			}
+			found[t] = ok
+		}
+
+		if !ok {
+			logger.Error("program not found on host")
+			missing++
+			continue
+		}
+		logger.Debug("program found on host")
+	}
+
+	if missing > 0 {
+		return fmt.Errorf("%w: %d of %d not found", ErrMissingPrograms, missing, len(probes))
+	}
+	o.logger.Info("every program step commands run was found")
+	return nil
+}
+
+// probeProgram reports whether program exists on the host for user
+func (o *Orchestrator) probeProgram(ctx context.Context, env config.Environment, hostName, user, program string) (bool, error) {
+	client, err := o.connect(ctx, asUser(env.Hosts[hostName], user), env.SSHDefaults)
+	if err != nil {
+		return false, fmt.Errorf("failed to get SSH client for host %s: %w", hostName, err)
+	}
+
+	_, err = client.Execute(ctx, "command -v "+ssh.ShellQuote(program))
+	if _, exited := ssh.ExitStatus(err); err != nil && !exited {
+		return false, fmt.Errorf("failed to probe host %s: %w", hostName, err)
+	}
+	return err == nil, nil
+}
+
+// programOf returns the program a shell command starts with, skipping any
+// leading VAR=value assignments
+func programOf(cmd string) string {
+	for _, field := range strings.Fields(cmd) {
+		if name, _, ok := strings.Cut(field, "="); ok && name != "" && !strings.ContainsAny(name, "/'\"") {
+			continue
+		}
+		return field
+	}
+	return ""
+}
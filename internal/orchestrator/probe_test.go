@@ -0,0 +1,65 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateRemote(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing []string // Probes that exit 1
+		wantErr bool
+	}{
+		{name: "present"},
+		{name: "missing", missing: []string{"app2: command -v '/opt/api/run.sh'"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.fail(tt.missing...)
+			step := service("api", "app1", "app2")
+			step.Start = "PORT=8080 /opt/api/run.sh --daemon"
+			o := newTestOrchestrator(t, fakeEnvironment(step), Options{DryRun: true, ValidateRemote: true})
+
+			err := o.Up(context.Background())
+			if got := errors.Is(err, ErrMissingPrograms); got != tt.wantErr {
+				t.Fatalf("err = %v, want missing programs %t", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "1 of 6 not found") {
+				t.Errorf("err = %v, want one of the six probes reported missing", err)
+			}
+
+			// Only probes run: the commands themselves never do
+			for _, cmd := range hosts.commands() {
+				if _, c, _ := strings.Cut(cmd, ": "); !strings.HasPrefix(c, "command -v ") {
+					t.Errorf("validate-remote ran %q, want only probes", cmd)
+				}
+			}
+			if !hosts.ranCommand("command -v '/opt/api/run.sh'") {
+				t.Errorf("commands = %q, want the start program probed", hosts.commands())
+			}
+		})
+	}
+}
+
+func TestProgramOf(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{cmd: "systemctl start api", want: "systemctl"},
+		{cmd: "  /opt/api/run.sh", want: "/opt/api/run.sh"},
+		{cmd: "PORT=8080 DEBUG=1 ./run.sh --port=8080", want: "./run.sh"},
+		{cmd: "./configure --prefix=/usr", want: "./configure"},
+		{cmd: "A=1", want: ""},
+		{cmd: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := programOf(tt.cmd); got != tt.want {
+			t.Errorf("programOf(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"orchid/internal/audit"
+	"orchid/internal/config"
+	"orchid/internal/redact"
+	"orchid/internal/trace"
+)
+
+func TestSecretsInCommandOutputAreRedacted(t *testing.T) {
+	const secret = "s3cr3t-token"
+
+	mock := &mockTransport{run: func(cmd string) (string, error) {
+		switch cmd {
+		case "migrate":
+			return "migrating with " + secret, errors.New("command exited with status 1")
+		case "dump-state":
+			return "state uses " + secret, nil
+		}
+		return "ok", nil
+	}}
+	transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+		return mock, nil
+	}
+	t.Cleanup(func() { delete(transports, "mock") })
+
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Redact: []string{`s3cr3t-\S+`},
+			Hosts:  map[string]config.Host{"app": {Hostname: "app.example.com", Transport: "mock"}},
+			Sequence: []config.Step{{
+				Name:        "migrate",
+				Type:        "command",
+				Hosts:       []string{"app"},
+				Run:         "migrate",
+				Diagnostics: "dump-state",
+			}},
+			PostUp: &config.RunHook{Run: "echo hook saw " + secret + "; exit 1"},
+		},
+	}}
+
+	dir := t.TempDir()
+	var logs bytes.Buffer
+	var mu sync.Mutex
+	var hookErrs []string
+	o := newTestOrchestrator(t, cfg, Options{
+		Logger:    slog.New(slog.NewTextHandler(&logs, nil)),
+		Audit:     audit.NewWriter(filepath.Join(dir, "audit.jsonl")),
+		Trace:     trace.NewWriter(filepath.Join(dir, "trace.jsonl")),
+		ReportOut: filepath.Join(dir, "summary.json"),
+		Hooks: Hooks{OnStepComplete: func(ev StepEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			if ev.Err != nil {
+				hookErrs = append(hookErrs, ev.Err.Error())
+			}
+		}},
+	})
+
+	err := o.Up(context.Background())
+	if err == nil {
+		t.Fatal("Up succeeded, want the failing command to fail it")
+	}
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) {
+		t.Errorf("err = %v, want a StepError still reachable through the redaction", err)
+	}
+	// The output must have reached the error for the check below to mean
+	// anything
+	if !strings.Contains(err.Error(), "migrating with "+redact.Mask) {
+		t.Errorf("err = %v, want the command's output with the secret masked", err)
+	}
+
+	report, jsonErr := json.Marshal(o.Report())
+	if jsonErr != nil {
+		t.Fatalf("failed to encode the report: %v", jsonErr)
+	}
+	if !bytes.Contains(report, []byte("state uses "+redact.Mask)) {
+		t.Errorf("report = %s, want the diagnostics output with the secret masked", report)
+	}
+	if !bytes.Contains(report, []byte("hook saw "+redact.Mask)) {
+		t.Errorf("report = %s, want the post_up hook warning with the secret masked", report)
+	}
+
+	sinks := map[string]string{
+		"returned error": err.Error(),
+		"logs":           logs.String(),
+		"report":         string(report),
+		"hook events":    strings.Join(hookErrs, "\n"),
+	}
+	for _, name := range []string{"audit.jsonl", "trace.jsonl", "summary.json"} {
+		data, readErr := os.ReadFile(filepath.Join(dir, name))
+		if readErr != nil {
+			t.Fatalf("failed to read %s: %v", name, readErr)
+		}
+		sinks[name] = string(data)
+	}
+	for name, content := range sinks {
+		if content == "" {
+			t.Errorf("%s: nothing was written", name)
+		}
+		if strings.Contains(content, secret) {
+			t.Errorf("%s leaks the secret:\n%s", name, content)
+		}
+	}
+}
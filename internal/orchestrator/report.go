@@ -0,0 +1,315 @@
+package orchestrator
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"orchid/internal/config"
+	"orchid/internal/redact"
+)
+
+// Step statuses recorded in the run report
+const (
+	StepRunning    = "running"
+	StepSucceeded  = "succeeded"
+	StepFailed     = "failed"
+	StepSkipped    = "skipped"
+	StepRolledBack = "rolled_back"
+)
+
+// RunReport records what happened during an Up or Down run
+type RunReport struct {
+	Environment string        `json:"environment"`
+	Action      string        `json:"action"`
+	Start       time.Time     `json:"start"`
+	End         time.Time     `json:"end"`
+	Duration    time.Duration `json:"duration"`
+	Steps       []*StepReport `json:"steps"`
+
+	// Warnings lists conditions that didn't fail the run but may need
+	// attention, in the order they were raised
+	Warnings []Warning `json:"warnings,omitempty"`
+
+	mu       sync.Mutex
+	redactor *redact.Redactor
+}
+
+// StepReport records the outcome and timing of a single step
+type StepReport struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Status   string          `json:"status"`
+	Start    time.Time       `json:"start,omitempty"`
+	End      time.Time       `json:"end,omitempty"`
+	Duration time.Duration   `json:"duration"`
+	Error    string          `json:"error,omitempty"`
+	Commands []CommandTiming `json:"commands,omitempty"`
+
+	// FailedHosts lists hosts a command step failed on, including failures
+	// tolerated by max_failures
+	FailedHosts []string `json:"failed_hosts,omitempty"`
+
+	// Reason says why the step was run or skipped, one of the Reason
+	// constants
+	Reason string `json:"reason,omitempty"`
+
+	// Diagnostics holds the output of the step's diagnostics command on
+	// each host, collected when the step failed
+	Diagnostics []Diagnostics `json:"diagnostics,omitempty"`
+}
+
+// Diagnostics is the output of a failed step's diagnostics command on one
+// host
+type Diagnostics struct {
+	Host   string `json:"host"`
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Warning records a condition that was logged as a warning during a run,
+// such as a service that still appeared to be running after it was stopped
+type Warning struct {
+	Step    string `json:"step,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Message string `json:"message"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (w Warning) String() string {
+	msg := w.Message
+	if w.Host != "" {
+		msg = "host " + w.Host + ": " + msg
+	}
+	if w.Step != "" {
+		msg = "step " + w.Step + ": " + msg
+	}
+	if w.Error != "" {
+		msg += ": " + w.Error
+	}
+	return msg
+}
+
+// CommandTiming records a single command run on a host
+type CommandTiming struct {
+	Host     string        `json:"host"`
+	Action   string        `json:"action"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"error,omitempty"`
+}
+
+// newRunReport returns a report of action against env, with errors, output
+// and warnings masked by redactor as they are recorded
+func newRunReport(env, action string, redactor *redact.Redactor) *RunReport {
+	return &RunReport{
+		Environment: env,
+		Action:      action,
+		Start:       time.Now(),
+		redactor:    redactor,
+	}
+}
+
+// The recording methods below are safe for concurrent use and do nothing
+// on a nil report, so commands outside of Up and Down needn't create one.
+
+func (r *RunReport) startStep(step config.Step) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Steps = append(r.Steps, &StepReport{
+		Name:   step.Name,
+		Type:   step.Type,
+		Status: StepRunning,
+		Start:  time.Now(),
+	})
+}
+
+func (r *RunReport) skipStep(step config.Step) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Steps = append(r.Steps, &StepReport{
+		Name:   step.Name,
+		Type:   step.Type,
+		Status: StepSkipped,
+	})
+}
+
+func (r *RunReport) finishStep(name string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.step(name)
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.Duration = s.End.Sub(s.Start)
+	s.Status = StepSucceeded
+	if err != nil {
+		s.Status = StepFailed
+		s.Error = r.redactor.String(err.Error())
+	}
+}
+
+func (r *RunReport) setStatus(name, status string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s := r.step(name); s != nil {
+		s.Status = status
+	}
+}
+
+// status returns the named step's status, or "" if it has not started
+func (r *RunReport) status(name string) string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s := r.step(name); s != nil {
+		return s.Status
+	}
+	return ""
+}
+
+func (r *RunReport) setFailedHosts(name string, hosts []string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s := r.step(name); s != nil {
+		s.FailedHosts = hosts
+	}
+}
+
+func (r *RunReport) setReason(name, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s := r.step(name); s != nil {
+		s.Reason = reason
+	}
+}
+
+func (r *RunReport) addDiagnostics(name string, d Diagnostics) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d.Output = r.redactor.String(d.Output)
+	d.Error = r.redactor.String(d.Error)
+	if s := r.step(name); s != nil {
+		s.Diagnostics = append(s.Diagnostics, d)
+	}
+}
+
+func (r *RunReport) recordCommand(name string, t CommandTiming) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t.Err = r.redactor.String(t.Err)
+	if s := r.step(name); s != nil {
+		s.Commands = append(s.Commands, t)
+	}
+}
+
+func (r *RunReport) addWarning(w Warning) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w.Message = r.redactor.String(w.Message)
+	w.Error = r.redactor.String(w.Error)
+	r.Warnings = append(r.Warnings, w)
+}
+
+// warnings returns a copy of the warnings raised so far
+func (r *RunReport) warnings() []Warning {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.Warnings)
+}
+
+func (r *RunReport) finish() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.End = time.Now()
+	r.Duration = r.End.Sub(r.Start)
+}
+
+// step returns the most recent report for the named step. Callers must hold
+// the lock.
+func (r *RunReport) step(name string) *StepReport {
+	for i := len(r.Steps) - 1; i >= 0; i-- {
+		if r.Steps[i].Name == name {
+			return r.Steps[i]
+		}
+	}
+	return nil
+}
+
+// log writes a timing line for every step in the report
+func (r *RunReport) log(logger *slog.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.Steps {
+		attrs := []any{
+			slog.String("step", s.Name),
+			slog.String("status", s.Status),
+			slog.Duration("duration", s.Duration.Round(time.Millisecond)),
+			slog.Int("commands", len(s.Commands)),
+		}
+		if len(s.FailedHosts) > 0 {
+			attrs = append(attrs, slog.Any("failed_hosts", s.FailedHosts))
+		}
+		logger.Info("step timing", attrs...)
+	}
+	logger.Info("run timing",
+		slog.String("action", r.Action),
+		slog.Duration("duration", r.Duration.Round(time.Millisecond)))
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
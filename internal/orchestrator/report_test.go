@@ -0,0 +1,57 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestReportTimings(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.fail("start web")
+
+	var logs bytes.Buffer
+	cfg := fakeEnvironment(service("api", "api1", "api2"), service("web", "web1"))
+	o := newTestOrchestrator(t, cfg, Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	if err := o.Up(context.Background()); err == nil {
+		t.Fatal("Up succeeded, want web to fail")
+	}
+
+	report := o.Report()
+	if report.Duration <= 0 || report.End.Before(report.Start) {
+		t.Errorf("run start %v, end %v, duration %s", report.Start, report.End, report.Duration)
+	}
+	if len(report.Steps) != 2 {
+		t.Fatalf("steps = %d, want 2", len(report.Steps))
+	}
+
+	// Timings are kept for failed and rolled back steps alike
+	wantStatus := []string{StepRolledBack, StepFailed}
+	prevEnd := report.Start
+	for i, s := range report.Steps {
+		if s.Status != wantStatus[i] {
+			t.Errorf("%s status = %s, want %s", s.Name, s.Status, wantStatus[i])
+		}
+		if s.Start.Before(prevEnd) || s.End.Before(s.Start) || s.Duration != s.End.Sub(s.Start) {
+			t.Errorf("%s start %v, end %v, duration %s after previous end %v", s.Name, s.Start, s.End, s.Duration, prevEnd)
+		}
+		prevEnd = s.End
+
+		if len(s.Commands) == 0 {
+			t.Errorf("%s recorded no commands", s.Name)
+		}
+		for j, c := range s.Commands {
+			if c.Start.Before(s.Start) || c.Duration < 0 || c.Host == "" || c.Action == "" {
+				t.Errorf("%s command %d = %+v", s.Name, j, c)
+			}
+		}
+	}
+
+	for _, want := range []string{`msg="step timing" step=api`, `msg="step timing" step=web`, `msg="run timing"`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs missing %q", want)
+		}
+	}
+}
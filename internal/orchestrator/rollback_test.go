@@ -0,0 +1,212 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"orchid/internal/config"
+)
+
+// rollbackHosts serves transport "mock" for services that start, stop and
+// check like fakeHosts, but runs stop commands concurrently, holding each for
+// a moment so overlapping stops can be counted
+type rollbackHosts struct {
+	mu       sync.Mutex
+	running  map[string]bool
+	inFlight int
+	maxStops int      // Most stop commands seen running at once
+	stopped  []string // Services in the order their stops finished
+	failStop string
+}
+
+func newRollbackHosts(t *testing.T) *rollbackHosts {
+	h := &rollbackHosts{running: make(map[string]bool)}
+	transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+		return &mockTransport{host: host.Hostname, run: h.run}, nil
+	}
+	t.Cleanup(func() { delete(transports, "mock") })
+	return h
+}
+
+func (h *rollbackHosts) run(cmd string) (string, error) {
+	verb, svc, _ := strings.Cut(cmd, " ")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch verb {
+	case "start":
+		if svc == "bad" {
+			return "failed", exitError(1)
+		}
+		h.running[svc] = true
+	case "check":
+		if !h.running[svc] {
+			return "not running", exitError(1)
+		}
+	case "stop":
+		h.inFlight++
+		h.maxStops = max(h.maxStops, h.inFlight)
+		h.mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		h.mu.Lock()
+		h.inFlight--
+		h.stopped = append(h.stopped, svc)
+		if svc == h.failStop {
+			return "failed", exitError(1)
+		}
+		delete(h.running, svc)
+	}
+	return "ok", nil
+}
+
+func TestParallelRollback(t *testing.T) {
+	db := service("db", "db1")
+	db.Type = "dependency"
+	cfg := fakeEnvironment(db, service("a1", "h1"), service("a2", "h2"), service("a3", "h3"), service("bad", "h4"))
+
+	tests := []struct {
+		name        string
+		concurrency int
+		failStop    string
+		wantMax     int
+	}{
+		{name: "sequential", concurrency: 1, wantMax: 1},
+		{name: "parallel", concurrency: 3, wantMax: 3},
+		{name: "bounded", concurrency: 2, wantMax: 2},
+		{name: "failures aggregated", concurrency: 3, failStop: "a2", wantMax: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newRollbackHosts(t)
+			hosts.failStop = tt.failStop
+			o := newTestOrchestrator(t, cfg, Options{HandleDeps: true, RollbackConcurrency: tt.concurrency})
+
+			err := o.Up(context.Background())
+			var stepErr *StepError
+			if !errors.As(err, &stepErr) || stepErr.Step != "bad" || !stepErr.RolledBack {
+				t.Fatalf("err = %v, want bad to fail and be rolled back", err)
+			}
+
+			hosts.mu.Lock()
+			defer hosts.mu.Unlock()
+			if hosts.maxStops != tt.wantMax {
+				t.Errorf("%d stops ran at once, want %d", hosts.maxStops, tt.wantMax)
+			}
+			// Applications stop before the dependency started ahead of them
+			if i := slices.Index(hosts.stopped, "db"); i != len(hosts.stopped)-1 {
+				t.Errorf("stopped %q, want db stopped last", hosts.stopped)
+			}
+
+			if tt.failStop == "" {
+				if stepErr.RollbackErr != nil {
+					t.Errorf("rollback error = %v", stepErr.RollbackErr)
+				}
+				return
+			}
+			if stepErr.RollbackErr == nil || !strings.Contains(stepErr.RollbackErr.Error(), tt.failStop) {
+				t.Errorf("rollback error = %v, want it to name %s", stepErr.RollbackErr, tt.failStop)
+			}
+			for _, svc := range []string{"a1", "a3", "db"} {
+				if hosts.running[svc] {
+					t.Errorf("%s still running after another service failed to stop", svc)
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    []string
+		wantErr string
+	}{
+		{name: "rollback command"},
+		{name: "rollback command fails", fail: []string{"redeploy db"}, wantErr: "failed to run rollback command on host db1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.fail(append(tt.fail, "start web")...)
+			db := service("db", "db1")
+			db.RollbackCommand = "redeploy db"
+			o := newTestOrchestrator(t, fakeEnvironment(db, service("api", "api1"), service("web", "web1")), Options{})
+
+			err := o.Up(context.Background())
+			var stepErr *StepError
+			if !errors.As(err, &stepErr) || !stepErr.RolledBack {
+				t.Fatalf("err = %v, want web to fail and roll back", err)
+			}
+			if tt.wantErr == "" && stepErr.RollbackErr != nil || tt.wantErr != "" && (stepErr.RollbackErr == nil || !strings.Contains(stepErr.RollbackErr.Error(), tt.wantErr)) {
+				t.Errorf("rollback error = %v, want %q", stepErr.RollbackErr, tt.wantErr)
+			}
+
+			// db runs its rollback command in place of stop, and api, which
+			// has none, falls back to being stopped
+			ran := hosts.commands()
+			if !slices.Contains(ran, "db1: redeploy db") || slices.Contains(ran, "db1: stop db") {
+				t.Errorf("commands = %q, want db rolled back with its rollback command only", ran)
+			}
+			if !slices.Contains(ran, "api1: stop api") || hosts.isRunning("api1", "api") {
+				t.Errorf("commands = %q, want api stopped", ran)
+			}
+			if !hosts.isRunning("db1", "db") {
+				t.Error("db stopped, want it left to its rollback command")
+			}
+		})
+	}
+}
+
+func TestRollbackScope(t *testing.T) {
+	tests := []struct {
+		name        string
+		scope       string
+		wantRunning []string // Services still running after the rollback
+	}{
+		{name: "default", wantRunning: []string{"cache"}},
+		{name: "all", scope: RollbackScopeAll, wantRunning: []string{"cache"}},
+		{name: "apps", scope: RollbackScopeApps, wantRunning: []string{"cache", "db", "queue"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.start("cache1", "cache") // Running before the run, so never rolled back
+			hosts.fail("start web")
+			var deps []config.Step
+			for _, name := range []string{"db", "cache", "queue"} {
+				dep := service(name, name+"1")
+				dep.Type = "dependency"
+				deps = append(deps, dep)
+			}
+			cfg := fakeEnvironment(deps[0], deps[1], service("api", "api1"), deps[2], service("web", "web1"))
+			o := newTestOrchestrator(t, cfg, Options{HandleDeps: true, Ensure: true, RollbackScope: tt.scope})
+
+			var stepErr *StepError
+			if err := o.Up(context.Background()); !errors.As(err, &stepErr) || !stepErr.RolledBack {
+				t.Fatalf("err = %v, want web to fail and roll back", err)
+			}
+
+			var running []string
+			for _, name := range []string{"api", "cache", "db", "queue", "web"} {
+				if hosts.isRunning(name+"1", name) {
+					running = append(running, name)
+				}
+			}
+			if !slices.Equal(running, tt.wantRunning) {
+				t.Errorf("running after rollback = %q, want %q", running, tt.wantRunning)
+			}
+		})
+	}
+
+	t.Run("invalid scope", func(t *testing.T) {
+		_, err := New(Options{RollbackScope: "deps"})
+		if err == nil || !strings.Contains(err.Error(), `invalid rollback scope "deps"`) {
+			t.Errorf("err = %v, want the scope rejected", err)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh"
+)
+
+// withRunHooks runs the environment's pre hook for action, then run, then
+// the post hook with the outcome. A failing pre hook skips run but not the
+// post hook, which sees the pre hook's failure as the run's. A failing post
+// hook is only warned about, so it never changes the outcome of the run.
+//
+// The post hook is not cancelled with ctx, so that like a rollback it still
+// reports a run that was interrupted.
+func (o *Orchestrator) withRunHooks(ctx context.Context, action string, run func() error) error {
+	env, err := LookupEnvironment(o.cfg, o.env)
+	if err != nil {
+		return err
+	}
+	pre, post := env.PreUp, env.PostUp
+	if action == "down" {
+		pre, post = env.PreDown, env.PostDown
+	}
+
+	var runErr error
+	if pre != nil {
+		if err := o.runHook(ctx, env, "pre_"+action, pre, action, nil); err != nil {
+			runErr = fmt.Errorf("pre_%s hook failed: %w", action, err)
+		}
+	}
+	if runErr == nil {
+		runErr = run()
+	}
+
+	if post != nil {
+		if err := o.runHook(context.WithoutCancel(ctx), env, "post_"+action, post, action, runErr); err != nil {
+			o.warn(o.logger, Warning{Message: "post_" + action + " hook failed", Error: err.Error()},
+				slog.String("error", err.Error()))
+		}
+	}
+	return runErr
+}
+
+// runHook runs hook locally or on its host. Pre hooks get the environment
+// and action; post hooks also get the run's result and error, with secrets
+// masked.
+func (o *Orchestrator) runHook(ctx context.Context, env config.Environment, name string, hook *config.RunHook, action string, runErr error) error {
+	vars := []string{
+		"ORCHID_ENVIRONMENT=" + o.env,
+		"ORCHID_ACTION=" + action,
+	}
+	if strings.HasPrefix(name, "post_") {
+		result := "success"
+		if runErr != nil {
+			result = "failure"
+		}
+		vars = append(vars, "ORCHID_RESULT="+result, "ORCHID_ERROR="+errString(o.redactor.Error(runErr)))
+	}
+
+	logger := o.logger.With(slog.String("hook", name))
+	if hook.Host != "" {
+		logger = logger.With(slog.String("host", hook.Host))
+	}
+	if o.dryRun {
+		logger.Info("dry run - would run hook", slog.String("command", hook.Run))
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.options.OperationTimeout)
+	defer cancel()
+
+	logger.Info("running hook", slog.String("command", hook.Run))
+	var output string
+	var err error
+	if hook.Host == "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", hook.Run)
+		cmd.Env = append(os.Environ(), vars...)
+		// Don't wait on children that outlive a cancelled hook for its output
+		cmd.WaitDelay = time.Second
+		var out []byte
+		out, err = cmd.CombinedOutput()
+		output = string(out)
+	} else {
+		output, err = o.runRemoteHook(ctx, env, hook, vars)
+	}
+	if err != nil {
+		return fmt.Errorf("%w. Output: %s", err, output)
+	}
+	logger.Info("hook completed", slog.String("output", output))
+	return nil
+}
+
+// runRemoteHook runs hook on its host, exporting vars to the command
+func (o *Orchestrator) runRemoteHook(ctx context.Context, env config.Environment, hook *config.RunHook, vars []string) (string, error) {
+	if err := checkAllowed(env, hook.Run); err != nil {
+		return "", err
+	}
+	host, ok := env.Hosts[hook.Host]
+	if !ok {
+		return "", fmt.Errorf("host %s not found in environment", hook.Host)
+	}
+	client, err := o.connect(ctx, host, env.SSHDefaults)
+	if err != nil {
+		return "", fmt.Errorf("failed to get SSH client for host %s: %w", host.Hostname, err)
+	}
+
+	exports := make([]string, len(vars))
+	for i, v := range vars {
+		key, value, _ := strings.Cut(v, "=")
+		exports[i] = key + "=" + ssh.ShellQuote(value)
+	}
+	cmd := "export " + strings.Join(exports, " ") + "; " + hook.Run
+	return client.ExecuteWith(ctx, cmd, ssh.ExecOptions{Shell: env.Shell})
+}
@@ -0,0 +1,188 @@
+package orchestrator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"orchid/internal/config"
+)
+
+// hookIndex returns the position in cmds of the remote hook that runs cmd,
+// or -1 when it never ran
+func hookIndex(cmds []string, cmd string) int {
+	for i, c := range cmds {
+		if strings.HasPrefix(c, "ops1: export ") && strings.HasSuffix(c, "; "+cmd) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestRunHookBoundaries(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     string
+		fail       []string
+		pre        string // Run locally when set, in place of the remote pre hook
+		wantErr    string
+		wantResult string // ORCHID_RESULT seen by the post hook
+		wantSteps  bool   // Whether any step commands ran
+	}{
+		{name: "up", action: ActionUp, wantResult: "success", wantSteps: true},
+		{name: "failed up", action: ActionUp, fail: []string{"start web"}, wantErr: "failed to start", wantResult: "failure", wantSteps: true},
+		{name: "pre hook fails", action: ActionUp, pre: "exit 3", wantErr: "pre_up hook failed", wantResult: "failure"},
+		{name: "down", action: ActionDown, wantResult: "success", wantSteps: true},
+		{name: "pre down hook fails", action: ActionDown, pre: "exit 3", wantErr: "pre_down hook failed", wantResult: "failure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.fail(tt.fail...)
+			if tt.action == ActionDown {
+				hosts.start("api1", "api")
+				hosts.start("web1", "web")
+			}
+			cfg := fakeEnvironment(service("api", "api1"), service("web", "web1"))
+			env := cfg.Environments["test"]
+			env.Hosts["ops1"] = config.Host{Hostname: "ops1", Transport: "mock"}
+			pre := &config.RunHook{Run: "notify pre", Host: "ops1"}
+			if tt.pre != "" {
+				pre = &config.RunHook{Run: tt.pre}
+			}
+			post := &config.RunHook{Run: "notify post", Host: "ops1"}
+			if tt.action == ActionUp {
+				env.PreUp, env.PostUp = pre, post
+			} else {
+				env.PreDown, env.PostDown = pre, post
+			}
+			cfg.Environments["test"] = env
+			o := newTestOrchestrator(t, cfg, Options{})
+
+			run := o.Up
+			if tt.action == ActionDown {
+				run = o.Down
+			}
+			err := run(context.Background())
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+
+			// The pre hook runs before any step command and the post hook
+			// after every one, rollback included
+			cmds := hosts.commands()
+			preAt, postAt := hookIndex(cmds, "notify pre"), hookIndex(cmds, "notify post")
+			if tt.pre == "" && preAt != 0 {
+				t.Errorf("commands = %q, want the pre hook first", cmds)
+			}
+			if postAt != len(cmds)-1 {
+				t.Fatalf("commands = %q, want the post hook last", cmds)
+			}
+			var steps int
+			for _, c := range cmds {
+				if !strings.HasPrefix(c, "ops1: ") {
+					steps++
+				}
+			}
+			if (steps > 0) != tt.wantSteps {
+				t.Errorf("commands = %q, want step commands run %t", cmds, tt.wantSteps)
+			}
+
+			for _, v := range []string{"ORCHID_ENVIRONMENT='test'", "ORCHID_ACTION='" + tt.action + "'", "ORCHID_RESULT='" + tt.wantResult + "'"} {
+				if !strings.Contains(cmds[postAt], v) {
+					t.Errorf("post hook = %q, want %s", cmds[postAt], v)
+				}
+			}
+			if tt.wantErr != "" && !strings.Contains(cmds[postAt], tt.wantErr) {
+				t.Errorf("post hook = %q, want ORCHID_ERROR to hold %q", cmds[postAt], tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunHookEnvironment(t *testing.T) {
+	const secret = "s3cr3t-token"
+	useMockTransport(t, &mockTransport{run: func(cmd string) (string, error) {
+		switch cmd {
+		case "start web":
+			return "token " + secret + " rejected", exitError(1)
+		case "check web":
+			return "not running", exitError(1)
+		}
+		return "ok", nil
+	}})
+
+	out := filepath.Join(t.TempDir(), "hook.out")
+	cfg := fakeEnvironment(service("web", "web1"))
+	env := cfg.Environments["test"]
+	env.Redact = []string{`s3cr3t-\S+`}
+	env.PostUp = &config.RunHook{Run: `printf '%s|%s|%s|%s' "$ORCHID_ENVIRONMENT" "$ORCHID_ACTION" "$ORCHID_RESULT" "$ORCHID_ERROR" > ` + out}
+	cfg.Environments["test"] = env
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	if err := o.Up(context.Background()); err == nil {
+		t.Fatal("Up succeeded, want web to fail")
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("post hook did not run: %v", err)
+	}
+	fields := strings.SplitN(string(data), "|", 4)
+	if len(fields) != 4 || fields[0] != "test" || fields[1] != "up" || fields[2] != "failure" {
+		t.Fatalf("post hook saw %q, want test, up and failure", data)
+	}
+	if strings.Contains(fields[3], secret) || !strings.Contains(fields[3], "[REDACTED]") {
+		t.Errorf("ORCHID_ERROR = %q, want the secret masked", fields[3])
+	}
+}
+
+func TestPostHookFailureOnlyWarns(t *testing.T) {
+	newFakeHosts(t)
+	cfg := fakeEnvironment(service("api", "api1"))
+	env := cfg.Environments["test"]
+	env.PostUp = &config.RunHook{Run: "exit 1"}
+	cfg.Environments["test"] = env
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	if err := o.Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	var warned bool
+	for _, w := range o.Report().Warnings {
+		warned = warned || w.Message == "post_up hook failed"
+	}
+	if !warned {
+		t.Errorf("warnings = %+v, want the post hook failure", o.Report().Warnings)
+	}
+}
+
+func TestRunHookUsesRunContext(t *testing.T) {
+	newFakeHosts(t)
+	out := filepath.Join(t.TempDir(), "post.out")
+	cfg := fakeEnvironment(service("api", "api1"))
+	env := cfg.Environments["test"]
+	env.PreUp = &config.RunHook{Run: "sleep 30"}
+	env.PostUp = &config.RunHook{Run: `printf '%s' "$ORCHID_RESULT" > ` + out}
+	cfg.Environments["test"] = env
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	// Interrupting the run stops the pre hook, and the post hook still
+	// reports the interrupted run
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := o.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "pre_up hook failed") {
+		t.Fatalf("err = %v, want the pre hook interrupted", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Up took %s, want the pre hook cancelled with the run", elapsed)
+	}
+	if data, err := os.ReadFile(out); err != nil || string(data) != "failure" {
+		t.Errorf("post hook saw %q, %v, want failure", data, err)
+	}
+}
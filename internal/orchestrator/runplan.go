@@ -0,0 +1,163 @@
+package orchestrator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"orchid/internal/config"
+)
+
+// ErrPlanDrift is returned when an approved plan no longer matches what the
+// current configuration and flags would do
+var ErrPlanDrift = errors.New("plan does not match current configuration")
+
+// RunPlan is a reviewable record of the steps an up would run, written by a
+// dry run and replayed once approved
+type RunPlan struct {
+	Environment string        `json:"environment"`
+	Action      string        `json:"action"`
+	HandleDeps  bool          `json:"handle_deps"`
+	CreatedAt   time.Time     `json:"created_at"`
+	Steps       []RunPlanStep `json:"steps"`
+}
+
+// RunPlanStep summarises a step for reviewers. Digest covers every setting
+// of the step and the definitions of its hosts, so drift in fields not
+// shown is still caught.
+type RunPlanStep struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Hosts  []string `json:"hosts"`
+	Start  string   `json:"start,omitempty"`
+	Check  string   `json:"check,omitempty"`
+	Stop   string   `json:"stop,omitempty"`
+	Run    string   `json:"run,omitempty"`
+	Digest string   `json:"digest"`
+}
+
+// runPlan returns the plan for running env's sequence
+func (o *Orchestrator) runPlan(action string, env config.Environment) (*RunPlan, error) {
+	plan := &RunPlan{
+		Environment: o.env,
+		Action:      action,
+		HandleDeps:  o.options.HandleDeps,
+		CreatedAt:   time.Now().UTC(),
+	}
+	for _, step := range env.Sequence {
+		digest, err := stepDigest(step, env)
+		if err != nil {
+			return nil, err
+		}
+		plan.Steps = append(plan.Steps, RunPlanStep{
+			Name:   step.Name,
+			Type:   step.Type,
+			Hosts:  step.Hosts,
+			Start:  step.Start,
+			Check:  step.Check,
+			Stop:   step.Stop,
+			Run:    step.Run,
+			Digest: digest,
+		})
+	}
+	return plan, nil
+}
+
+// stepDigest hashes step together with the hosts it runs on as env defines
+// them, so pointing a host name at another machine counts as a change
+func stepDigest(step config.Step, env config.Environment) (string, error) {
+	hosts := make(map[string]config.Host, len(step.Hosts))
+	for _, name := range step.Hosts {
+		hosts[name] = env.Hosts[name]
+	}
+	data, err := json.Marshal(struct {
+		Step  config.Step
+		Hosts map[string]config.Host
+	}{step, hosts})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode step %s: %w", step.Name, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writePlan writes the plan for running env's sequence to PlanOut, when it
+// is set
+func (o *Orchestrator) writePlan(action string, env config.Environment) error {
+	if o.options.PlanOut == "" {
+		return nil
+	}
+
+	plan, err := o.runPlan(action, env)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode plan: %w", err)
+	}
+	if err := os.WriteFile(o.options.PlanOut, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write plan '%s': %w", o.options.PlanOut, err)
+	}
+	o.logger.Info("wrote plan", slog.String("path", o.options.PlanOut), slog.Int("steps", len(plan.Steps)))
+	return nil
+}
+
+// plannedSequence returns the steps of the approved plan in PlanIn, in the
+// plan's order, taken from env's sequence. The plan already records which
+// steps were selected, so they replace selection by tags or failures. Any
+// difference between the plan and the current configuration is drift.
+func (o *Orchestrator) plannedSequence(action string, env config.Environment) ([]config.Step, error) {
+	data, err := os.ReadFile(o.options.PlanIn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan '%s': %w", o.options.PlanIn, err)
+	}
+	var approved RunPlan
+	if err := json.Unmarshal(data, &approved); err != nil {
+		return nil, fmt.Errorf("failed to parse plan '%s': %w", o.options.PlanIn, err)
+	}
+
+	sequence, err := o.matchPlan(&approved, action, env)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrPlanDrift, o.options.PlanIn, err)
+	}
+	o.logger.Info("running the approved plan", slog.String("path", o.options.PlanIn), slog.Int("steps", len(sequence)))
+	return sequence, nil
+}
+
+// matchPlan looks up the steps of an approved plan in env, describing the
+// first difference from the current configuration
+func (o *Orchestrator) matchPlan(approved *RunPlan, action string, env config.Environment) ([]config.Step, error) {
+	switch {
+	case approved.Environment != o.env:
+		return nil, fmt.Errorf("plan is for environment %s", approved.Environment)
+	case approved.Action != action:
+		return nil, fmt.Errorf("plan is for %s", approved.Action)
+	case approved.HandleDeps != o.options.HandleDeps:
+		return nil, fmt.Errorf("plan has handle_deps %t", approved.HandleDeps)
+	}
+
+	sequence := make([]config.Step, 0, len(approved.Steps))
+	for _, planned := range approved.Steps {
+		i := slices.IndexFunc(env.Sequence, func(s config.Step) bool { return s.Name == planned.Name })
+		if i < 0 {
+			return nil, fmt.Errorf("planned step %s is no longer configured", planned.Name)
+		}
+		step := env.Sequence[i]
+		digest, err := stepDigest(step, env)
+		if err != nil {
+			return nil, err
+		}
+		if digest != planned.Digest {
+			return nil, fmt.Errorf("step %s has changed", step.Name)
+		}
+		sequence = append(sequence, step)
+	}
+	return sequence, nil
+}
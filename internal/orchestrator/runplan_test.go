@@ -0,0 +1,116 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+// planConfig returns an environment of two services, only api tagged
+// backend, and a command step
+func planConfig() *config.Config {
+	api := service("api", "app1")
+	api.Tags = []string{"backend"}
+	migrate := config.Step{Name: "migrate", Type: "command", Hosts: []string{"app1"}, Run: "migrate", Tags: []string{"backend"}}
+	return fakeEnvironment(api, service("web", "app2"), migrate)
+}
+
+// writeTestPlan writes the plan a dry run with opts makes for cfg
+func writeTestPlan(t *testing.T, cfg *config.Config, opts Options) string {
+	t.Helper()
+	opts.DryRun = true
+	opts.PlanOut = filepath.Join(t.TempDir(), "plan.json")
+	if err := newTestOrchestrator(t, cfg, opts).Up(context.Background()); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	return opts.PlanOut
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	hosts := newFakeHosts(t)
+	cfg := planConfig()
+	path := writeTestPlan(t, cfg, Options{Tags: []string{"backend"}})
+	if ran := hosts.commands(); len(ran) > 0 {
+		t.Fatalf("dry run ran %q", ran)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan RunPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		t.Fatalf("plan is not valid JSON: %v", err)
+	}
+	var names []string
+	for _, s := range plan.Steps {
+		names = append(names, s.Name)
+	}
+	if plan.Environment != "test" || plan.Action != "up" || !slices.Equal(names, []string{"api", "migrate"}) {
+		t.Fatalf("plan = %s %s %q, want the tagged steps of an up of test", plan.Environment, plan.Action, names)
+	}
+
+	// The plan selects the steps, so none are passed again
+	o := newTestOrchestrator(t, cfg, Options{PlanIn: path})
+	if err := o.Up(context.Background()); err != nil {
+		t.Fatalf("Up with the plan: %v", err)
+	}
+	if !hosts.isRunning("app1", "api") || !hosts.ranCommand("migrate") {
+		t.Errorf("the planned steps did not run: %q", hosts.commands())
+	}
+	if hosts.isRunning("app2", "web") {
+		t.Error("web ran although it was not in the plan")
+	}
+}
+
+func TestPlanDrift(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *config.Config, opts *Options)
+	}{
+		{name: "command changed", change: func(cfg *config.Config, opts *Options) {
+			cfg.Environments["test"].Sequence[0].Start = "start api --new"
+		}},
+		{name: "host redefined", change: func(cfg *config.Config, opts *Options) {
+			cfg.Environments["test"].Hosts["app1"] = config.Host{Hostname: "elsewhere", Transport: "mock"}
+		}},
+		{name: "step removed", change: func(cfg *config.Config, opts *Options) {
+			env := cfg.Environments["test"]
+			env.Sequence = env.Sequence[1:]
+			cfg.Environments["test"] = env
+		}},
+		{name: "handle_deps changed", change: func(cfg *config.Config, opts *Options) {
+			opts.HandleDeps = true
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			cfg := planConfig()
+			path := writeTestPlan(t, cfg, Options{})
+
+			opts := Options{PlanIn: path}
+			tt.change(cfg, &opts)
+			err := newTestOrchestrator(t, cfg, opts).Up(context.Background())
+			if !errors.Is(err, ErrPlanDrift) {
+				t.Fatalf("err = %v, want %v", err, ErrPlanDrift)
+			}
+			if ran := hosts.commands(); len(ran) > 0 {
+				t.Errorf("ran %q despite drift", ran)
+			}
+		})
+	}
+}
+
+func TestPlanReplacesSelection(t *testing.T) {
+	_, err := New(Options{PlanIn: "plan.json", Tags: []string{"backend"}})
+	if err == nil {
+		t.Error("New accepted tags alongside a plan")
+	}
+}
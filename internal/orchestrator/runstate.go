@@ -0,0 +1,142 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"orchid/internal/config"
+)
+
+// ErrNoRunState is returned by an OnlyFailed run when no earlier up against
+// the environment left any state behind
+var ErrNoRunState = errors.New("no previous run state")
+
+// RunState is what the last up against an environment left in the state
+// directory, so a later run can re-run just the steps that failed
+type RunState struct {
+	Result      string    `json:"result"` // "success" or "failure"
+	FailedSteps []string  `json:"failed_steps,omitempty"`
+	FinishedAt  time.Time `json:"finished_at"`
+}
+
+func runStatePath(stateDir, env string) string {
+	return filepath.Join(stateDir, env+".last")
+}
+
+// LastRun returns the state of the last up against env, or nil if none has
+// been recorded
+func LastRun(stateDir, env string) (*RunState, error) {
+	state, err := readJSON[RunState](runStatePath(stateDir, env))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run state: %w", err)
+	}
+	return state, nil
+}
+
+// saveRunState records the outcome of an up for OnlyFailed. Runs that failed
+// before any step did, such as on a held lock, leave the previous state in
+// place so its failed steps can still be re-run. Like writeSummary, a
+// failure to write is only logged.
+func (o *Orchestrator) saveRunState(runErr error) {
+	if o.options.StateDir == "" || o.dryRun {
+		return
+	}
+
+	state := RunState{Result: "success", FinishedAt: time.Now().UTC()}
+	if runErr != nil {
+		state.Result = "failure"
+		state.FailedSteps = o.failedSteps(runErr)
+		if len(state.FailedSteps) == 0 {
+			return
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.MkdirAll(o.options.StateDir, 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(runStatePath(o.options.StateDir, o.env), data, 0o644)
+	}
+	if err != nil {
+		o.logger.Error("failed to write run state", slog.String("error", err.Error()))
+	}
+}
+
+// failedSteps lists the steps the report marks failed, along with the step
+// runErr names, since rolling back may have overwritten its status
+func (o *Orchestrator) failedSteps(runErr error) []string {
+	var failed []string
+	var stepErr *StepError
+	if errors.As(runErr, &stepErr) {
+		failed = append(failed, stepErr.Step)
+	}
+
+	o.report.mu.Lock()
+	defer o.report.mu.Unlock()
+	for _, s := range o.report.Steps {
+		if s.Status == StepFailed && !slices.Contains(failed, s.Name) {
+			failed = append(failed, s.Name)
+		}
+	}
+	return failed
+}
+
+// selectFailed narrows the sequence to the steps the last up failed on and
+// the steps they depend on, when Options.OnlyFailed is set
+func (o *Orchestrator) selectFailed(sequence []config.Step) ([]config.Step, error) {
+	if !o.options.OnlyFailed {
+		return sequence, nil
+	}
+
+	state, err := LastRun(o.options.StateDir, o.env)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, fmt.Errorf("%w for environment %s in %s: run up without --only-failed first", ErrNoRunState, o.env, o.options.StateDir)
+	}
+	if len(state.FailedSteps) == 0 {
+		return nil, fmt.Errorf("the last up of environment %s at %s succeeded, so there are no failed steps to re-run",
+			o.env, state.FinishedAt.Format(time.RFC3339))
+	}
+
+	// Walk depends_on from each failed step, so the services they need are
+	// checked or started again too
+	keep := make(map[string]bool)
+	pending := slices.Clone(state.FailedSteps)
+	for len(pending) > 0 {
+		name := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if keep[name] {
+			continue
+		}
+		keep[name] = true
+
+		i := slices.IndexFunc(sequence, func(s config.Step) bool { return s.Name == name })
+		if i < 0 {
+			o.logger.Warn("failed step from the last run is no longer in the sequence", slog.String("step", name))
+			continue
+		}
+		pending = append(pending, sequence[i].DependsOn...)
+	}
+
+	selected := make([]config.Step, 0, len(keep))
+	for _, step := range sequence {
+		if keep[step.Name] {
+			selected = append(selected, step)
+			continue
+		}
+		o.report.skipStep(step)
+		logger := o.logger.With(slog.String("step", step.Name))
+		logger.Info("skipping step that did not fail in the last run")
+		o.explain(logger, step, ReasonSkippedNotFailed)
+	}
+	return selected, nil
+}
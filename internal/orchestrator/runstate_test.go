@@ -0,0 +1,106 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// seedRunState writes state as the last up against the "test" environment
+func seedRunState(t *testing.T, stateDir string, state RunState) {
+	t.Helper()
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, "test.last"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnlyFailed(t *testing.T) {
+	worker := service("worker", "worker1")
+	worker.DependsOn = []string{"api"}
+	cfg := fakeEnvironment(
+		service("db", "db1"),
+		service("api", "api1"),
+		service("web", "web1"),
+		worker,
+	)
+
+	tests := []struct {
+		name    string
+		state   *RunState
+		want    []string
+		wantErr error
+	}{
+		{name: "failed step and its dependencies", state: &RunState{Result: "failure", FailedSteps: []string{"worker"}}, want: []string{"api", "worker"}},
+		{name: "failed step alone", state: &RunState{Result: "failure", FailedSteps: []string{"web"}}, want: []string{"web"}},
+		{name: "no state", wantErr: ErrNoRunState},
+		{name: "last up succeeded", state: &RunState{Result: "success"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			dir := t.TempDir()
+			if tt.state != nil {
+				seedRunState(t, dir, *tt.state)
+			}
+			o := newTestOrchestrator(t, cfg, Options{StateDir: dir, OnlyFailed: true})
+
+			err := o.Up(context.Background())
+			if tt.want == nil {
+				if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				if ran := hosts.commands(); len(ran) > 0 {
+					t.Errorf("ran %q, want nothing run", ran)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Up: %v", err)
+			}
+			for _, step := range cfg.Environments["test"].Sequence {
+				want := slices.Contains(tt.want, step.Name)
+				if got := hosts.isRunning(step.Hosts[0], step.Name); got != want {
+					t.Errorf("%s running = %t, want %t", step.Name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpRecordsRunState(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.failTimes(1, "start web")
+	cfg := fakeEnvironment(service("api", "api1"), service("web", "web1"))
+	dir := t.TempDir()
+
+	o := newTestOrchestrator(t, cfg, Options{StateDir: dir})
+	if err := o.Up(context.Background()); err == nil {
+		t.Fatal("Up succeeded, want web to fail")
+	}
+	state, err := LastRun(dir, "test")
+	if err != nil || state == nil {
+		t.Fatalf("LastRun = %v, %v", state, err)
+	}
+	if state.Result != "failure" || !slices.Equal(state.FailedSteps, []string{"web"}) {
+		t.Errorf("state = %+v, want web failed", state)
+	}
+
+	retry := newTestOrchestrator(t, cfg, Options{StateDir: dir, OnlyFailed: true})
+	if err := retry.Up(context.Background()); err != nil {
+		t.Fatalf("re-running failed steps: %v", err)
+	}
+	if hosts.isRunning("api1", "api") {
+		t.Error("api was started again, want only web re-run")
+	}
+	if state, _ := LastRun(dir, "test"); state == nil || state.Result != "success" || len(state.FailedSteps) > 0 {
+		t.Errorf("state after re-run = %+v, want success", state)
+	}
+}
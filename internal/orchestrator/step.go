@@ -0,0 +1,266 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"orchid/internal/config"
+)
+
+// Step actions accepted by RunStep
+const (
+	ActionUp   = "up"
+	ActionDown = "down"
+)
+
+// RunStep runs a single step of the environment's sequence the way Up or Down
+// would, for tooling built on top of orchid. Only the step itself runs: there
+// is no locking, rollback, audit record, run report or hook callbacks.
+func (o *Orchestrator) RunStep(ctx context.Context, stepName, action string) error {
+	env, err := LookupEnvironment(o.cfg, o.env)
+	if err != nil {
+		return err
+	}
+
+	for i, step := range env.Sequence {
+		if step.Name != stepName {
+			continue
+		}
+		logger := o.logger.With(
+			slog.String("step", step.Name),
+			slog.Int("step_number", i+1),
+			slog.String("type", step.Type),
+		)
+
+		switch action {
+		case ActionUp:
+			_, err := o.upStep(ctx, step, env, logger)
+			return err
+		case ActionDown:
+			_, err := o.downStep(ctx, step, env, logger)
+			return err
+		default:
+			return fmt.Errorf("invalid step action %q: expected %q or %q", action, ActionUp, ActionDown)
+		}
+	}
+	return fmt.Errorf("step %s not found in environment", stepName)
+}
+
+// upStep brings a single step up: starting, restarting or verifying a
+// service and health checking what it started, or running a command step.
+// It reports whether the step was skipped because its when condition failed.
+func (o *Orchestrator) upStep(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) (skipped bool, err error) {
+	met, err := o.conditionMet(ctx, step, env, logger)
+	if err != nil {
+		return false, err
+	}
+	if !met {
+		return true, nil
+	}
+
+	if err := o.checkDependsOn(ctx, step, env, logger); err != nil {
+		return false, err
+	}
+
+	switch step.Type {
+	case "dependency", "application":
+		err = o.handleUp(ctx, step, env, logger)
+	case "command", "smoke":
+		if err = o.handleCommand(ctx, step, env, logger); err == nil {
+			o.explain(logger, step, ReasonRanCommand)
+		}
+	default:
+		err = fmt.Errorf("unknown step type: %s", step.Type)
+	}
+	if err != nil {
+		return false, err
+	}
+	started := time.Now()
+
+	if step.Type == "application" || (step.Type == "dependency" && o.options.HandleDeps) {
+		if !o.dryRun {
+			if err := o.waitForStart(ctx, step, "waiting before health check", logger); err != nil {
+				return false, err
+			}
+			logger.Info("performing health check")
+
+			if err := o.performHealthCheck(ctx, step, env, logger); err != nil {
+				logger.Error("health check failed", slog.String("error", err.Error()))
+				return false, err
+			}
+			if err := o.settle(ctx, step, env, started, logger); err != nil {
+				return false, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// conditionMet runs the step's when command, reporting whether it passed on
+// every host of the step. Steps without one always run, as do all steps in
+// dry-run mode, where the condition is not run.
+func (o *Orchestrator) conditionMet(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) (bool, error) {
+	if step.When == "" {
+		return true, nil
+	}
+	if err := o.validateCommand(env, step, step.When); err != nil {
+		return false, err
+	}
+
+	if o.dryRun {
+		logger.Info("dry run - would run the step only if its condition passes", slog.String("when", step.When))
+		return true, nil
+	}
+
+	met, err := o.succeedsOnAllHosts(ctx, step.When, step, env, logger)
+	if err != nil {
+		return false, fmt.Errorf("failed to check step condition: %w", err)
+	}
+	if !met {
+		logger.Info("step condition did not pass; skipping", slog.String("when", step.When))
+		o.explain(logger, step, ReasonSkippedByCondition)
+	}
+	return met, nil
+}
+
+// downStep brings a single step down, reporting whether it was skipped
+// because down leaves steps of its kind alone
+func (o *Orchestrator) downStep(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) (skipped bool, err error) {
+	switch step.Type {
+	case "dependency", "application":
+		// For dependencies, respect the StopDeps flag
+		if step.Type == "dependency" && !o.options.StopDeps {
+			logger.Info("skipping dependency stop", slog.String("dependency", step.Name))
+			o.explain(logger, step, ReasonSkippedDependencyStop)
+			return true, nil
+		}
+		return false, o.handleDown(ctx, step, env, logger)
+	case "command", "smoke":
+		logger.Info("skipping command in down")
+		o.explain(logger, step, ReasonSkippedCommand)
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown step type: %s", step.Type)
+	}
+}
+
+// checkDependsOn verifies that the services a step depends on pass their
+// checks before it runs. An unhealthy hard dependency fails the step; an
+// unhealthy soft dependency only logs a warning.
+func (o *Orchestrator) checkDependsOn(ctx context.Context, step config.Step, env config.Environment, logger *slog.Logger) error {
+	// Dependencies may have been left out of this run by tags, so look them
+	// up in the full sequence
+	steps := make(map[string]config.Step)
+	for _, s := range o.cfg.Environments[o.env].Sequence {
+		steps[s.Name] = s
+	}
+
+	check := func(name string, soft bool) error {
+		dep, ok := steps[name]
+		healthy := false
+		var err error
+		if ok {
+			healthy, err = o.isServiceRunning(ctx, dep, env, logger)
+		} else {
+			err = fmt.Errorf("step %s not found in environment", name)
+		}
+
+		switch {
+		case healthy:
+			return nil
+		case soft:
+			w := Warning{Step: step.Name, Message: "soft dependency " + name + " is not healthy; continuing"}
+			attrs := []any{slog.String("dependency", name)}
+			if err != nil {
+				w.Error = err.Error()
+				attrs = append(attrs, slog.String("error", err.Error()))
+			}
+			o.warn(logger, w, attrs...)
+			return nil
+		case err != nil:
+			return fmt.Errorf("failed to check dependency %s: %w", name, err)
+		default:
+			return fmt.Errorf("dependency %s is not healthy", name)
+		}
+	}
+
+	for _, name := range step.DependsOn {
+		if err := check(name, false); err != nil {
+			return err
+		}
+	}
+	for _, name := range step.SoftDependsOn {
+		if err := check(name, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settle watches a service that has passed its health check for the step's
+// settle window, re-running the check every health check interval and
+// logging progress, so a service that crashes soon after starting fails
+// the step. Checks that cannot run, for example because of a network blip,
+// are logged and retried rather than counted as failures, as are failed
+// checks within the step's grace period of started.
+func (o *Orchestrator) settle(ctx context.Context, step config.Step, env config.Environment, started time.Time, logger *slog.Logger) error {
+	if step.Settle <= 0 || step.Check == "" {
+		return nil
+	}
+
+	logger.Info("watching service through its settle window", slog.Duration("settle", step.Settle))
+	start := time.Now()
+	ticker := time.NewTicker(o.options.HealthCheckInterval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(step.Settle)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			logger.Info("service stayed healthy through its settle window", slog.Duration("settle", step.Settle))
+			return nil
+		case <-ticker.C:
+		}
+
+		elapsed := time.Since(start).Round(time.Second)
+		healthy, err := o.checkPassesOnAllHosts(ctx, step, env, logger)
+		switch {
+		case err != nil:
+			o.warn(logger, Warning{Step: step.Name, Message: "could not check service during settle window", Error: err.Error()},
+				slog.Duration("elapsed", elapsed),
+				slog.String("error", err.Error()))
+		case !healthy && time.Since(started) < step.Grace:
+			logger.Info("service unhealthy within its grace period; ignoring",
+				slog.Duration("elapsed", elapsed),
+				slog.Duration("grace", step.Grace))
+		case !healthy:
+			logger.Error("service became unhealthy during settle window", slog.Duration("elapsed", elapsed))
+			return fmt.Errorf("%w: %s became unhealthy %s after passing its health check", ErrHealthCheckFailed, step.Name, elapsed)
+		default:
+			logger.Info(fmt.Sprintf("still healthy after %s", elapsed),
+				slog.Duration("elapsed", elapsed),
+				slog.Duration("settle", step.Settle))
+		}
+	}
+}
+
+// waitForStart gives a service that was just started the step's start_wait,
+// or the environment's, before it is health checked
+func (o *Orchestrator) waitForStart(ctx context.Context, step config.Step, msg string, logger *slog.Logger) error {
+	wait := firstDuration(step.StartWait, o.options.StartWait)
+	logger.Info(msg, slog.Duration("duration", wait))
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
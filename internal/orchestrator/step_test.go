@@ -0,0 +1,262 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"orchid/internal/config"
+)
+
+func TestWaitForStart(t *testing.T) {
+	cfg := &config.Config{Environments: map[string]config.Environment{"test": {}}}
+	o := newTestOrchestrator(t, cfg, Options{StartWait: time.Hour})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("step override", func(t *testing.T) {
+		start := time.Now()
+		err := o.waitForStart(context.Background(), config.Step{StartWait: 10 * time.Millisecond}, "waiting", logger)
+		if err != nil {
+			t.Fatalf("waitForStart: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Minute {
+			t.Errorf("waited %s, want the step's start_wait", elapsed)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		err := o.waitForStart(ctx, config.Step{}, "waiting", logger)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, want %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestStartWaitDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts config.Timeouts
+		opts     Options
+		want     time.Duration
+	}{
+		{name: "default", want: defaultStartWait},
+		{name: "environment", timeouts: config.Timeouts{StartWait: time.Second}, want: time.Second},
+		{name: "option wins", timeouts: config.Timeouts{StartWait: time.Second}, opts: Options{StartWait: time.Millisecond}, want: time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Config = &config.Config{Environments: map[string]config.Environment{"test": {Timeouts: tt.timeouts}}}
+			opts.Environment = "test"
+			opts.StateDir = t.TempDir()
+			o, err := New(opts)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			defer o.Close()
+			if o.options.StartWait != tt.want {
+				t.Errorf("StartWait = %s, want %s", o.options.StartWait, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettleGrace(t *testing.T) {
+	tests := []struct {
+		name    string
+		grace   time.Duration
+		started time.Duration // Before the settle window opens
+		wantErr error
+	}{
+		{name: "within grace", grace: time.Hour},
+		{name: "after grace", grace: time.Minute, started: time.Hour, wantErr: ErrHealthCheckFailed},
+		{name: "no grace", wantErr: ErrHealthCheckFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.start("api1", "api")
+			hosts.failTimes(2, "check api")
+
+			step := service("api", "api1")
+			step.Settle = 100 * time.Millisecond
+			step.Grace = tt.grace
+			cfg := fakeEnvironment(step)
+			o := newTestOrchestrator(t, cfg, Options{})
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+			err := o.settle(context.Background(), step, cfg.Environments["test"], time.Now().Add(-tt.started), logger)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunStep(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      string
+		step        string
+		running     bool     // api is already running on api1
+		fail        []string // Commands that exit 1
+		wantRunning bool
+		wantRan     []string
+		wantErr     string
+		wantIs      error
+	}{
+		{name: "up starts and checks", action: ActionUp, step: "api", wantRunning: true, wantRan: []string{"start api", "check api"}},
+		// RunStep never rolls back, so the service is left started
+		{name: "up fails its health check", action: ActionUp, step: "api", fail: []string{"check api"}, wantRunning: true, wantRan: []string{"start api"}, wantIs: ErrHealthCheckFailed},
+		{name: "down stops", action: ActionDown, step: "api", running: true, wantRan: []string{"stop api"}},
+		{name: "unknown step", action: ActionUp, step: "cache", wantErr: "step cache not found"},
+		{name: "invalid action", action: "restart", step: "api", wantErr: `invalid step action "restart"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			if tt.running {
+				hosts.start("api1", "api")
+			}
+			hosts.fail(tt.fail...)
+			o := newTestOrchestrator(t, fakeEnvironment(service("api", "api1"), service("web", "web1")), Options{})
+
+			err := o.RunStep(context.Background(), tt.step, tt.action)
+			switch {
+			case tt.wantIs != nil:
+				if !errors.Is(err, tt.wantIs) {
+					t.Fatalf("err = %v, want %v", err, tt.wantIs)
+				}
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("RunStep: %v", err)
+			}
+
+			if got := hosts.isRunning("api1", "api"); got != tt.wantRunning {
+				t.Errorf("api running = %t, want %t", got, tt.wantRunning)
+			}
+			for _, cmd := range tt.wantRan {
+				if !slices.Contains(hosts.commands(), "api1: "+cmd) {
+					t.Errorf("commands = %q, want %q run", hosts.commands(), cmd)
+				}
+			}
+			for _, cmd := range hosts.commands() {
+				if strings.HasPrefix(cmd, "web1: ") {
+					t.Errorf("RunStep ran %q on another step's host", cmd)
+				}
+			}
+			if r := o.Report(); r != nil {
+				t.Errorf("report = %+v, want RunStep to write none", r)
+			}
+		})
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	tests := []struct {
+		name        string
+		hard, soft  bool
+		dbRunning   bool
+		wantErr     string
+		wantWarning bool
+	}{
+		{name: "healthy hard dependency", hard: true, dbRunning: true},
+		{name: "missing hard dependency blocks", hard: true, wantErr: "dependency db is not healthy"},
+		{name: "healthy soft dependency", soft: true, dbRunning: true},
+		{name: "missing soft dependency warns", soft: true, wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			if tt.dbRunning {
+				hosts.start("db1", "db")
+			}
+			db := service("db", "db1")
+			api := service("api", "api1")
+			if tt.hard {
+				api.DependsOn = []string{"db"}
+			}
+			if tt.soft {
+				api.SoftDependsOn = []string{"db"}
+			}
+			api.Tags = []string{"api"}
+
+			// Only api runs; db is looked up in the full sequence
+			o := newTestOrchestrator(t, fakeEnvironment(db, api), Options{Tags: []string{"api"}})
+			err := o.Up(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if hosts.ranCommand("start api") {
+					t.Error("api started although its hard dependency is not healthy")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Up: %v", err)
+			}
+			if !hosts.isRunning("api1", "api") {
+				t.Error("api not started")
+			}
+
+			var warned bool
+			for _, w := range o.Report().Warnings {
+				warned = warned || w.Message == "soft dependency db is not healthy; continuing"
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("warned %t, want %t: %+v", warned, tt.wantWarning, o.Report().Warnings)
+			}
+		})
+	}
+}
+
+func TestWhenCondition(t *testing.T) {
+	tests := []struct {
+		name       string
+		fail       []string
+		dryRun     bool
+		wantStatus string
+		wantRun    bool // Whether migrate ran
+		wantWhen   bool // Whether the condition ran
+	}{
+		{name: "condition passes", wantStatus: StepSucceeded, wantRun: true, wantWhen: true},
+		{name: "condition fails", fail: []string{"schema-below 5"}, wantStatus: StepSkipped, wantWhen: true},
+		{name: "condition fails on one host", fail: []string{"api2: schema-below 5"}, wantStatus: StepSkipped, wantWhen: true},
+		{name: "dry run", fail: []string{"schema-below 5"}, dryRun: true, wantStatus: StepSucceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.fail(tt.fail...)
+			migrate := config.Step{Name: "migrate", Type: "command", Hosts: []string{"api1", "api2"}, Run: "migrate", When: "schema-below 5"}
+			o := newTestOrchestrator(t, fakeEnvironment(migrate, service("api", "api1")), Options{DryRun: tt.dryRun})
+
+			if err := o.Up(context.Background()); err != nil {
+				t.Fatalf("Up: %v", err)
+			}
+			if got := stepStatus(o, "migrate"); got != tt.wantStatus {
+				t.Errorf("migrate status = %s, want %s", got, tt.wantStatus)
+			}
+			if got := stepStatus(o, "api"); got != StepSucceeded {
+				t.Errorf("api status = %s, want the steps after a skipped one run", got)
+			}
+			if got := hosts.ranCommand("migrate"); got != tt.wantRun {
+				t.Errorf("ran migrate %t, want %t", got, tt.wantRun)
+			}
+			if got := hosts.ranCommand("schema-below 5"); got != tt.wantWhen {
+				t.Errorf("ran the condition %t, want %t", got, tt.wantWhen)
+			}
+		})
+	}
+}
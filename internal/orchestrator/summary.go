@@ -0,0 +1,75 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+
+	"orchid/internal/ci"
+)
+
+// RunSummary is the machine-readable outcome of an Up or Down run written to
+// Options.ReportOut, combining the run report with the CI metadata of the
+// pipeline that ran it
+type RunSummary struct {
+	*RunReport
+
+	Result     string `json:"result"` // "success" or "failure"
+	Error      string `json:"error,omitempty"`
+	FailedStep string `json:"failed_step,omitempty"`
+
+	// RolledBack is set when a failed up stopped the services it started.
+	// RollbackError lists the services that failed to stop, and
+	// RollbackSkipped says why a failed up didn't roll back.
+	RolledBack      bool   `json:"rolled_back"`
+	RollbackError   string `json:"rollback_error,omitempty"`
+	RollbackSkipped string `json:"rollback_skipped,omitempty"`
+
+	CI ci.Metadata `json:"ci"`
+}
+
+func newRunSummary(report *RunReport, runErr error) RunSummary {
+	s := RunSummary{
+		RunReport: report,
+		Result:    "success",
+		CI:        ci.Detect(),
+	}
+	if runErr == nil {
+		return s
+	}
+
+	s.Result = "failure"
+	s.Error = runErr.Error()
+	var stepErr *StepError
+	if errors.As(runErr, &stepErr) {
+		s.FailedStep = stepErr.Step
+		s.RolledBack = stepErr.RolledBack
+		s.RollbackError = errString(stepErr.RollbackErr)
+		s.RollbackSkipped = stepErr.RollbackSkipped
+	}
+	return s
+}
+
+// writeSummary writes the run's summary to Options.ReportOut, if set. A
+// failure to write is logged rather than returned so it never masks the
+// outcome of the run itself.
+func (o *Orchestrator) writeSummary(runErr error) {
+	if o.options.ReportOut == "" {
+		return
+	}
+
+	summary := newRunSummary(o.report, runErr)
+	summary.RollbackError = o.redactor.String(summary.RollbackError)
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err == nil {
+		err = os.WriteFile(o.options.ReportOut, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		o.logger.Error("failed to write run summary",
+			slog.String("path", o.options.ReportOut),
+			slog.String("error", err.Error()))
+		return
+	}
+	o.logger.Info("wrote run summary", slog.String("path", o.options.ReportOut))
+}
@@ -0,0 +1,89 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+func TestRunSummarySchema(t *testing.T) {
+	inPipeline(t, "42")
+	t.Setenv("CI_COMMIT_SHA", "abc123")
+	t.Setenv("CI_PROJECT_PATH", "ops/orchid")
+
+	hosts := newFakeHosts(t)
+	hosts.fail("start web")
+	migrate := config.Step{Name: "migrate", Type: "command", Hosts: []string{"api1"}, Run: "migrate"}
+	cfg := fakeEnvironment(service("api", "api1"), migrate, service("web", "web1"))
+	path := filepath.Join(t.TempDir(), "summary.json")
+	o := newTestOrchestrator(t, cfg, Options{ReportOut: path})
+
+	if err := o.Up(context.Background()); err == nil {
+		t.Fatal("Up succeeded, want web to fail")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the summary: %v", err)
+	}
+	var summary map[string]any
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("failed to parse the summary: %v\n%s", err, data)
+	}
+
+	for key, want := range map[string]any{
+		"environment": "test",
+		"action":      "up",
+		"result":      "failure",
+		"failed_step": "web",
+		"rolled_back": true,
+	} {
+		if summary[key] != want {
+			t.Errorf("%s = %v, want %v", key, summary[key], want)
+		}
+	}
+	for _, key := range []string{"start", "end", "duration", "error"} {
+		if _, ok := summary[key]; !ok {
+			t.Errorf("summary has no %s: %s", key, data)
+		}
+	}
+
+	wantCI := map[string]any{"provider": "gitlab", "pipeline_id": "42", "commit_sha": "abc123", "project": "ops/orchid"}
+	if ci, _ := summary["ci"].(map[string]any); !mapsEqual(ci, wantCI) {
+		t.Errorf("ci = %v, want %v", summary["ci"], wantCI)
+	}
+
+	steps, _ := summary["steps"].([]any)
+	var got [][2]string
+	for _, s := range steps {
+		step, _ := s.(map[string]any)
+		if _, ok := step["duration"].(float64); !ok {
+			t.Errorf("step %v has no duration", step["name"])
+		}
+		name, _ := step["name"].(string)
+		status, _ := step["status"].(string)
+		got = append(got, [2]string{name, status})
+	}
+	want := [][2]string{{"api", StepRolledBack}, {"migrate", StepSucceeded}, {"web", StepFailed}}
+	if !slices.Equal(got, want) {
+		t.Errorf("steps = %v, want %v", got, want)
+	}
+}
+
+// mapsEqual reports whether two decoded JSON objects of scalars are equal
+func mapsEqual(a, b map[string]any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
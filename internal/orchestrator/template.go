@@ -0,0 +1,45 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"orchid/internal/config"
+)
+
+// commandData is the data available to command templates
+type commandData struct {
+	Name string            // Step name
+	Host string            // Hostname the command runs on
+	Vars map[string]string // Environment variables from the config's vars
+}
+
+// renderCommand expands Go template actions in cmd for a single host.
+// Commands without template actions are returned unchanged. Referencing a
+// variable missing from vars is an error.
+func renderCommand(cmd string, step config.Step, host config.Host, vars map[string]string) (string, error) {
+	if !strings.Contains(cmd, "{{") {
+		return cmd, nil
+	}
+
+	tmpl, err := template.New(step.Name).Option("missingkey=error").Parse(cmd)
+	if err != nil {
+		return "", fmt.Errorf("invalid command template in step %s: %w", step.Name, err)
+	}
+
+	var b strings.Builder
+	data := commandData{
+		Name: step.Name,
+		Host: host.Hostname,
+		Vars: vars,
+	}
+	if data.Vars == nil {
+		// missingkey=error only applies to non-nil maps
+		data.Vars = map[string]string{}
+	}
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render command for step %s on host %s: %w", step.Name, host.Hostname, err)
+	}
+	return b.String(), nil
+}
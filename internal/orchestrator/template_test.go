@@ -0,0 +1,68 @@
+package orchestrator
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"orchid/internal/config"
+)
+
+func TestRenderCommand(t *testing.T) {
+	step := config.Step{Name: "api"}
+	host := config.Host{Hostname: "app1.example.com"}
+	vars := map[string]string{"VERSION": "1.2.3"}
+
+	tests := []struct {
+		cmd     string
+		want    string
+		wantErr string
+	}{
+		{cmd: "systemctl start api", want: "systemctl start api"},
+		{cmd: "systemctl start {{.Name}}", want: "systemctl start api"},
+		{cmd: "deploy --host {{.Host}} --version {{.Vars.VERSION}}", want: "deploy --host app1.example.com --version 1.2.3"},
+		{cmd: "deploy {{.Vars.MISSING}}", wantErr: "failed to render command for step api"},
+		{cmd: "deploy {{.Name", wantErr: "invalid command template in step api"},
+	}
+	for _, tt := range tests {
+		got, err := renderCommand(tt.cmd, step, host, vars)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("renderCommand(%q) err = %v, want %q", tt.cmd, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("renderCommand(%q) = %q, %v, want %q", tt.cmd, got, err, tt.want)
+		}
+	}
+}
+
+func TestEnvironmentVarsInCommands(t *testing.T) {
+	hosts := newFakeHosts(t)
+	step := config.Step{Name: "deploy", Type: "command", Hosts: []string{"app1"}, Run: "deploy --region {{.Vars.region}} --host {{.Host}}"}
+	cfg := fakeEnvironment(step)
+	env := cfg.Environments["test"]
+	env.Vars = map[string]string{"region": "us-east"}
+	cfg.Environments["test"] = env
+
+	if err := newTestOrchestrator(t, cfg, Options{}).Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	if ran := hosts.commands(); !slices.Equal(ran, []string{"app1: deploy --region us-east --host app1"}) {
+		t.Errorf("ran %q, want the environment's region rendered", ran)
+	}
+
+	// An undefined variable fails before anything runs
+	env.Vars = nil
+	cfg.Environments["test"] = env
+	hosts = newFakeHosts(t)
+	err := newTestOrchestrator(t, cfg, Options{}).Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "failed to render command for step deploy") {
+		t.Errorf("err = %v, want the undefined variable reported", err)
+	}
+	if ran := hosts.commands(); len(ran) > 0 {
+		t.Errorf("ran %q with an undefined variable", ran)
+	}
+}
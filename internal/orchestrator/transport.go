@@ -0,0 +1,187 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh"
+	"orchid/internal/trace"
+	"orchid/internal/winrm"
+)
+
+// Transport runs commands on a host
+type Transport interface {
+	Execute(ctx context.Context, cmd string) (string, error)
+	ExecuteWith(ctx context.Context, cmd string, opts ssh.ExecOptions) (string, error)
+	Stream(ctx context.Context, cmd string, opts ssh.ExecOptions, w io.Writer) error
+
+	// Close releases the transport's connection. The orchestrator closes the
+	// transports it opened when it is closed.
+	Close() error
+}
+
+// transports opens the transports other than SSH that hosts can select with
+// their transport setting, by name
+var transports = map[string]func(ctx context.Context, host config.Host) (Transport, error){
+	config.TransportWinRM: openWinRM,
+}
+
+// openWinRM returns a WinRM client for host, reading its password from the
+// environment variable its winrm settings name
+func openWinRM(ctx context.Context, host config.Host) (Transport, error) {
+	if host.WinRM == nil {
+		return nil, fmt.Errorf("host %s has transport winrm but no winrm settings", host.Hostname)
+	}
+	password := os.Getenv(host.WinRM.PasswordEnv)
+	if password == "" {
+		return nil, fmt.Errorf("WinRM password for host %s not set: %s is empty", host.Hostname, host.WinRM.PasswordEnv)
+	}
+	return winrm.New(winrm.Options{
+		Hostname: host.Hostname,
+		Port:     host.Port,
+		User:     host.WinRM.User,
+		Password: password,
+		HTTPS:    host.WinRM.HTTPS,
+		Insecure: host.WinRM.Insecure,
+	}), nil
+}
+
+// connect returns the transport for host according to its transport
+// setting, SSH by default
+func (o *Orchestrator) connect(ctx context.Context, host config.Host, defaults config.SSHDefaults) (Transport, error) {
+	var t Transport
+	switch host.Transport {
+	case "", config.TransportSSH:
+		// SSH clients are cached and closed by the ssh.Manager
+		client, err := o.sshManager.GetClient(ctx, host, defaults)
+		if err != nil {
+			return nil, err
+		}
+		t = client
+	default:
+		open, ok := transports[host.Transport]
+		if !ok {
+			return nil, fmt.Errorf("unsupported transport %q for host %s", host.Transport, host.Hostname)
+		}
+		var err error
+		if t, err = open(ctx, host); err != nil {
+			return nil, err
+		}
+		o.transportsMu.Lock()
+		o.transports = append(o.transports, t)
+		o.transportsMu.Unlock()
+	}
+
+	if o.options.Trace != nil {
+		user := host.SSHUser
+		if host.WinRM != nil {
+			user = host.WinRM.User
+		} else if user == "" {
+			user = defaults.User
+		}
+		return &tracedTransport{Transport: t, o: o, host: host.Hostname, user: user}, nil
+	}
+	return t, nil
+}
+
+// closeTransports closes the transports other than SSH that connect opened
+func (o *Orchestrator) closeTransports() {
+	o.transportsMu.Lock()
+	defer o.transportsMu.Unlock()
+
+	for _, t := range o.transports {
+		if err := t.Close(); err != nil {
+			o.logger.Error("failed to close transport", slog.String("error", err.Error()))
+		}
+	}
+	o.transports = nil
+}
+
+// tracedTransport records every command run through it to Options.Trace
+type tracedTransport struct {
+	Transport
+	o    *Orchestrator
+	host string
+	user string
+}
+
+func (t *tracedTransport) Execute(ctx context.Context, cmd string) (string, error) {
+	return t.ExecuteWith(ctx, cmd, ssh.ExecOptions{})
+}
+
+func (t *tracedTransport) ExecuteWith(ctx context.Context, cmd string, opts ssh.ExecOptions) (string, error) {
+	start := time.Now()
+	output, err := t.Transport.ExecuteWith(ctx, cmd, opts)
+	t.record(trace.Entry{Command: cmd, Output: output}, start, err)
+	return output, err
+}
+
+func (t *tracedTransport) Stream(ctx context.Context, cmd string, opts ssh.ExecOptions, w io.Writer) error {
+	start := time.Now()
+	err := t.Transport.Stream(ctx, cmd, opts, w)
+	t.record(trace.Entry{Command: cmd, Streamed: true}, start, err)
+	return err
+}
+
+// record completes e and appends it to the trace. A trace that can't be
+// written is logged rather than failing the command.
+func (t *tracedTransport) record(e trace.Entry, start time.Time, err error) {
+	e.Timestamp = start.UTC()
+	e.Host = t.host
+	e.User = t.user
+	e.Duration = time.Since(start)
+	if err != nil {
+		e.Error = err.Error()
+		if code, ok := ssh.ExitStatus(err); ok {
+			e.ExitCode = &code
+		}
+	} else {
+		code := 0
+		e.ExitCode = &code
+	}
+
+	e.Command = t.o.redactor.String(e.Command)
+	e.Output = t.o.redactor.String(e.Output)
+	e.Error = t.o.redactor.String(e.Error)
+
+	if werr := t.o.options.Trace.Append(e); werr != nil {
+		t.o.logger.Warn("failed to write trace entry", slog.String("error", werr.Error()))
+	}
+}
+
+// checkKeys verifies the SSH key of every host the sequence uses, so a
+// missing or unreadable key fails the run before any host work begins
+func (o *Orchestrator) checkKeys(env config.Environment) error {
+	if o.dryRun && !o.options.ValidateRemote {
+		return nil
+	}
+
+	checked := make(map[string]bool)
+	for _, step := range env.Sequence {
+		for _, name := range step.Hosts {
+			host, ok := env.Hosts[name]
+			if !ok || (host.Transport != "" && host.Transport != config.TransportSSH) {
+				continue
+			}
+
+			key := host.SSHKey
+			if key == "" {
+				key = env.SSHDefaults.Key
+			}
+			if checked[key] {
+				continue
+			}
+			checked[key] = true
+
+			if err := ssh.CheckKey(key); err != nil {
+				return fmt.Errorf("host %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
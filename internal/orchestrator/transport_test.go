@@ -0,0 +1,356 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh"
+	"orchid/internal/trace"
+)
+
+// mockTransport records the commands run through it, answering them with
+// run when it is set and with "ok" otherwise
+type mockTransport struct {
+	run func(cmd string) (string, error)
+
+	mu       sync.Mutex
+	host     string
+	commands []string
+	opts     []ssh.ExecOptions // The options each command ran with
+	closed   bool
+}
+
+func (m *mockTransport) Execute(ctx context.Context, cmd string) (string, error) {
+	return m.ExecuteWith(ctx, cmd, ssh.ExecOptions{})
+}
+
+func (m *mockTransport) ExecuteWith(ctx context.Context, cmd string, opts ssh.ExecOptions) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = append(m.commands, cmd)
+	m.opts = append(m.opts, opts)
+	if m.run != nil {
+		return m.run(cmd)
+	}
+	return "ok", nil
+}
+
+func (m *mockTransport) Stream(ctx context.Context, cmd string, opts ssh.ExecOptions, w io.Writer) error {
+	_, err := m.ExecuteWith(ctx, cmd, opts)
+	return err
+}
+
+func (m *mockTransport) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
+
+// useMockTransport makes mock the transport of hosts with transport "mock"
+// for the rest of the test
+func useMockTransport(t *testing.T, mock *mockTransport) {
+	t.Helper()
+	transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+		return mock, nil
+	}
+	t.Cleanup(func() { delete(transports, "mock") })
+}
+
+// ran returns the commands run through m so far
+func (m *mockTransport) ran() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.commands)
+}
+
+// exitError is a command failure carrying an exit status, as transports
+// report them
+type exitError int
+
+func (e exitError) Error() string   { return fmt.Sprintf("command exited with status %d", int(e)) }
+func (e exitError) ExitStatus() int { return int(e) }
+
+// fakeHosts simulates services on the hosts with transport "mock".
+// "start <service>" and "stop <service>" start and stop the service on the
+// host they run on and "check <service>" exits 1 unless it is running there.
+// Commands made to fail, on every host or on one as "<hostname>: <command>",
+// exit 1, and anything else succeeds.
+type fakeHosts struct {
+	mu       sync.Mutex
+	running  map[string]bool // "<hostname> <service>"
+	failures map[string]int  // Remaining failures, or -1 to always fail
+	down     map[string]bool // Hostnames that can't be connected to
+	log      []string        // "<hostname>: <command>"
+}
+
+// newFakeHosts returns fake hosts serving transport "mock" for the rest of
+// the test
+func newFakeHosts(t *testing.T) *fakeHosts {
+	t.Helper()
+	f := &fakeHosts{running: make(map[string]bool), failures: make(map[string]int), down: make(map[string]bool)}
+	transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+		hostname := host.Hostname
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.down[hostname] {
+			return nil, fmt.Errorf("dial %s: connection refused", hostname)
+		}
+		return &mockTransport{host: hostname, run: func(cmd string) (string, error) {
+			return f.run(hostname, cmd)
+		}}, nil
+	}
+	t.Cleanup(func() { delete(transports, "mock") })
+	return f
+}
+
+func (f *fakeHosts) run(hostname, cmd string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log = append(f.log, hostname+": "+cmd)
+
+	for _, key := range []string{cmd, hostname + ": " + cmd} {
+		if n := f.failures[key]; n != 0 {
+			f.failures[key] = max(n-1, -1)
+			return "failed", exitError(1)
+		}
+	}
+	verb, service, _ := strings.Cut(cmd, " ")
+	switch verb {
+	case "start":
+		f.running[hostname+" "+service] = true
+	case "stop":
+		delete(f.running, hostname+" "+service)
+	case "check":
+		if !f.running[hostname+" "+service] {
+			return "not running", exitError(1)
+		}
+	}
+	return "ok", nil
+}
+
+// fail makes commands exit 1
+func (f *fakeHosts) fail(cmds ...string) {
+	f.failTimes(-1, cmds...)
+}
+
+// failTimes makes the next n runs of commands exit 1, or every run when n
+// is -1
+func (f *fakeHosts) failTimes(n int, cmds ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, cmd := range cmds {
+		f.failures[cmd] = n
+	}
+}
+
+// unreachable makes connections to hostname fail
+func (f *fakeHosts) unreachable(hostname string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down[hostname] = true
+}
+
+// start marks service as already running on hostname
+func (f *fakeHosts) start(hostname, service string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running[hostname+" "+service] = true
+}
+
+func (f *fakeHosts) isRunning(hostname, service string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.running[hostname+" "+service]
+}
+
+// commands returns the commands run so far, as "<hostname>: <command>"
+func (f *fakeHosts) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.log)
+}
+
+// ranCommand reports whether cmd ran on any host
+func (f *fakeHosts) ranCommand(cmd string) bool {
+	return slices.ContainsFunc(f.commands(), func(c string) bool {
+		return strings.HasSuffix(c, ": "+cmd)
+	})
+}
+
+// service returns an application step for service on hosts, driven by
+// fakeHosts' start, stop and check commands
+func service(name string, hosts ...string) config.Step {
+	return config.Step{
+		Name:  name,
+		Type:  "application",
+		Hosts: hosts,
+		Start: "start " + name,
+		Stop:  "stop " + name,
+		Check: "check " + name,
+	}
+}
+
+// fakeEnvironment returns a config whose "test" environment runs sequence
+// on mock hosts named after their hostnames
+func fakeEnvironment(sequence ...config.Step) *config.Config {
+	hosts := make(map[string]config.Host)
+	for _, step := range sequence {
+		for _, name := range step.Hosts {
+			hosts[name] = config.Host{Hostname: name, Transport: "mock"}
+		}
+	}
+	return &config.Config{Environments: map[string]config.Environment{
+		"test": {Hosts: hosts, Sequence: sequence},
+	}}
+}
+
+func TestConnectSelectsTransportByHost(t *testing.T) {
+	var opened []*mockTransport
+	transports["mock"] = func(ctx context.Context, host config.Host) (Transport, error) {
+		m := &mockTransport{host: host.Hostname}
+		opened = append(opened, m)
+		return m, nil
+	}
+	t.Cleanup(func() { delete(transports, "mock") })
+
+	cfg := &config.Config{Environments: map[string]config.Environment{
+		"test": {
+			Hosts: map[string]config.Host{
+				"win": {Hostname: "win.example.com", Transport: "mock"},
+			},
+			Sequence: []config.Step{
+				{Name: "migrate", Type: "command", Hosts: []string{"win"}, Run: "Invoke-Migration"},
+			},
+		},
+	}}
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	if err := o.Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	if len(opened) == 0 {
+		t.Fatal("the host's transport was never opened")
+	}
+	var commands []string
+	for _, m := range opened {
+		if m.host != "win.example.com" {
+			t.Errorf("transport opened for %s, want win.example.com", m.host)
+		}
+		commands = append(commands, m.commands...)
+	}
+	if !slices.Contains(commands, "Invoke-Migration") {
+		t.Errorf("commands = %q, want the step's command run through the mock transport", commands)
+	}
+
+	o.Close()
+	for _, m := range opened {
+		if !m.closed {
+			t.Error("transport was not closed with the orchestrator")
+		}
+	}
+}
+
+func TestOpenWinRM(t *testing.T) {
+	host := config.Host{Hostname: "win1", Transport: config.TransportWinRM, WinRM: &config.WinRM{User: "admin", PasswordEnv: "ORCHID_TEST_WINRM_PASSWORD"}}
+
+	t.Setenv("ORCHID_TEST_WINRM_PASSWORD", "")
+	if _, err := transports[config.TransportWinRM](context.Background(), host); err == nil || !strings.Contains(err.Error(), "ORCHID_TEST_WINRM_PASSWORD") {
+		t.Errorf("err = %v, want the unset password variable named", err)
+	}
+
+	t.Setenv("ORCHID_TEST_WINRM_PASSWORD", "secret")
+	transport, err := transports[config.TransportWinRM](context.Background(), host)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	transport.Close()
+}
+
+func TestMissingKeyFailsBeforeHostWork(t *testing.T) {
+	hosts := newFakeHosts(t)
+	key := filepath.Join(t.TempDir(), "id_missing")
+
+	step := service("api", "api1", "db1")
+	cfg := fakeEnvironment(step)
+	env := cfg.Environments["test"]
+	env.SSHDefaults.Key = key
+	env.Hosts["db1"] = config.Host{Hostname: "db1"} // Over SSH
+	cfg.Environments["test"] = env
+	o := newTestOrchestrator(t, cfg, Options{})
+
+	err := o.Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "host db1: SSH key '"+key+"' does not exist") {
+		t.Fatalf("err = %v, want the missing key named", err)
+	}
+	if ran := hosts.commands(); len(ran) > 0 {
+		t.Errorf("ran %q before checking keys", ran)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	hosts := newFakeHosts(t)
+	hosts.fail("web1: start web")
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	cfg := fakeEnvironment(service("api", "api1", "api2"), service("web", "web1"))
+	o := newTestOrchestrator(t, cfg, Options{Trace: trace.NewWriter(path), NoRollback: true})
+
+	if err := o.Up(context.Background()); err == nil {
+		t.Fatal("Up succeeded, want web to fail")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the trace: %v", err)
+	}
+	var entries []trace.Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e trace.Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line %q is not an entry: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+
+	// Every command run is recorded once, on the host it ran on
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Host+": "+e.Command)
+		if e.Timestamp.IsZero() || e.Duration < 0 {
+			t.Errorf("entry %+v has no timing", e)
+		}
+	}
+	if want := hosts.commands(); !sameElements(got, want) {
+		t.Errorf("traced %q, want %q", got, want)
+	}
+
+	for _, e := range entries {
+		switch e.Host + ": " + e.Command {
+		case "api1: start api", "api2: start api":
+			if e.ExitCode == nil || *e.ExitCode != 0 || e.Output != "ok" || e.Error != "" {
+				t.Errorf("entry = %+v, want a successful start", e)
+			}
+		case "web1: start web":
+			if e.ExitCode == nil || *e.ExitCode != 1 || e.Output != "failed" || e.Error == "" {
+				t.Errorf("entry = %+v, want a start that exited 1", e)
+			}
+		}
+	}
+}
+
+// sameElements reports whether a and b hold the same strings in any order
+func sameElements(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
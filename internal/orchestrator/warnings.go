@@ -0,0 +1,37 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// ErrWarnings is returned by Up and Down when Options.FailOnWarn is set and
+// an otherwise successful run raised warnings
+var ErrWarnings = errors.New("run finished with warnings")
+
+// warn logs w.Message at warning level with attrs and records w in the run
+// report, so conditions that don't fail the run are still visible to CI
+func (o *Orchestrator) warn(logger *slog.Logger, w Warning, attrs ...any) {
+	logger.Warn(w.Message, attrs...)
+	o.report.addWarning(w)
+}
+
+// checkWarnings turns the warnings of a successful run into an error when
+// Options.FailOnWarn is set
+func (o *Orchestrator) checkWarnings(runErr error) error {
+	if runErr != nil || !o.options.FailOnWarn {
+		return runErr
+	}
+
+	warnings := o.report.warnings()
+	if len(warnings) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(warnings))
+	for i, w := range warnings {
+		msgs[i] = w.String()
+	}
+	return fmt.Errorf("%w: %s", ErrWarnings, strings.Join(msgs, "; "))
+}
@@ -0,0 +1,62 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDidNotStopWarning(t *testing.T) {
+	tests := []struct {
+		name       string
+		lingers    bool // Whether the check keeps passing after stop
+		failOnWarn bool
+		wantWarn   bool
+		wantErr    error
+	}{
+		{name: "stopped"},
+		{name: "stopped with fail on warn", failOnWarn: true},
+		{name: "did not stop", lingers: true, wantWarn: true},
+		{name: "did not stop with fail on warn", lingers: true, failOnWarn: true, wantWarn: true, wantErr: ErrWarnings},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := newFakeHosts(t)
+			hosts.start("api1", "api")
+			if tt.lingers {
+				useMockTransport(t, &mockTransport{})
+			}
+			path := filepath.Join(t.TempDir(), "summary.json")
+			o := newTestOrchestrator(t, fakeEnvironment(service("api", "api1")), Options{FailOnWarn: tt.failOnWarn, ReportOut: path})
+
+			err := o.Down(context.Background())
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			want := Warning{Step: "api", Host: "api1", Message: "service still appears to be running after stop"}
+			warnings := o.Report().Warnings
+			if tt.wantWarn && (len(warnings) != 1 || warnings[0] != want) {
+				t.Errorf("warnings = %+v, want %+v", warnings, want)
+			}
+			if !tt.wantWarn && len(warnings) != 0 {
+				t.Errorf("warnings = %+v, want none", warnings)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var summary RunSummary
+			if err := json.Unmarshal(data, &summary); err != nil {
+				t.Fatal(err)
+			}
+			if len(summary.Warnings) != len(warnings) {
+				t.Errorf("summary warnings = %+v, want %+v", summary.Warnings, warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+// Package progress renders a live table of an up or down run's steps on a
+// terminal, driven by the orchestrator's hooks, for operators running orchid
+// by hand.
+package progress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"orchid/internal/orchestrator"
+)
+
+// Row is the state of one step of the run
+type Row struct {
+	Number   int
+	Step     string
+	Type     string
+	Status   string // One of the orchestrator's step statuses
+	Duration time.Duration
+	Err      string
+
+	// Health holds the latest health check result of each host
+	Health map[string]bool
+}
+
+// Model is the state of a run as reported by its hooks, with one row per
+// step in the order the steps started
+type Model struct {
+	Environment string
+	Action      string
+	Rows        []*Row
+}
+
+func NewModel(env, action string) *Model {
+	return &Model{Environment: env, Action: action}
+}
+
+// row returns the row for the named step, adding it when the step hasn't
+// been seen before
+func (m *Model) row(ev orchestrator.StepEvent) *Row {
+	for _, r := range m.Rows {
+		if r.Step == ev.Step {
+			return r
+		}
+	}
+	r := &Row{Number: ev.StepNumber, Step: ev.Step, Type: ev.Type}
+	m.Rows = append(m.Rows, r)
+	return r
+}
+
+func (m *Model) StepStart(ev orchestrator.StepEvent) {
+	r := m.row(ev)
+	r.Status = orchestrator.StepRunning
+	r.Duration = 0
+	r.Err = ""
+}
+
+func (m *Model) StepComplete(ev orchestrator.StepEvent) {
+	r := m.row(ev)
+	r.Status = ev.Status
+	r.Duration = ev.Duration
+	r.Err = errString(ev.Err)
+}
+
+func (m *Model) Rollback(ev orchestrator.StepEvent) {
+	r := m.row(ev)
+	r.Status = ev.Status
+	r.Err = errString(ev.Err)
+}
+
+func (m *Model) HealthCheck(ev orchestrator.HealthCheckEvent) {
+	var r *Row
+	for _, row := range m.Rows {
+		if row.Step == ev.Step {
+			r = row
+		}
+	}
+	if r == nil {
+		return
+	}
+	if r.Health == nil {
+		r.Health = make(map[string]bool)
+	}
+	r.Health[ev.Host] = ev.Healthy
+}
+
+// Render writes the model as a table
+func (m *Model) Render(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "orchid %s %s\n", m.Action, m.Environment)
+	fmt.Fprintln(tw, "#\tSTEP\tTYPE\tSTATUS\tDURATION\tHEALTH")
+	for _, r := range m.Rows {
+		duration := ""
+		if r.Duration > 0 {
+			duration = r.Duration.Round(100 * time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", r.Number, r.Step, r.Type, r.Status, duration, r.health())
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, r := range m.Rows {
+		if r.Err != "" {
+			// Only the first line, so the drawing's height stays predictable
+			msg, _, _ := strings.Cut(r.Err, "\n")
+			if _, err := fmt.Fprintf(w, "%s: %s\n", r.Step, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// health summarises the row's health checks, naming unhealthy hosts
+func (r *Row) health() string {
+	if len(r.Health) == 0 {
+		return ""
+	}
+	var unhealthy []string
+	for host, healthy := range r.Health {
+		if !healthy {
+			unhealthy = append(unhealthy, host)
+		}
+	}
+	summary := fmt.Sprintf("%d/%d healthy", len(r.Health)-len(unhealthy), len(r.Health))
+	if len(unhealthy) > 0 {
+		sort.Strings(unhealthy)
+		summary += " (unhealthy: " + strings.Join(unhealthy, ", ") + ")"
+	}
+	return summary
+}
+
+// View redraws a Model on a terminal in place each time a hook updates it.
+// Hooks are delivered on a single goroutine, so it needs no locking.
+type View struct {
+	w     io.Writer
+	model *Model
+	lines int // Lines drawn last time, to move back over
+}
+
+func NewView(w io.Writer, env, action string) *View {
+	return &View{w: w, model: NewModel(env, action)}
+}
+
+// Hooks returns hooks that update the view's model and redraw it
+func (v *View) Hooks() orchestrator.Hooks {
+	return orchestrator.Hooks{
+		OnStepStart:    func(ev orchestrator.StepEvent) { v.update(func(m *Model) { m.StepStart(ev) }) },
+		OnStepComplete: func(ev orchestrator.StepEvent) { v.update(func(m *Model) { m.StepComplete(ev) }) },
+		OnRollback:     func(ev orchestrator.StepEvent) { v.update(func(m *Model) { m.Rollback(ev) }) },
+		OnHealthCheck:  func(ev orchestrator.HealthCheckEvent) { v.update(func(m *Model) { m.HealthCheck(ev) }) },
+	}
+}
+
+func (v *View) update(fn func(*Model)) {
+	fn(v.model)
+
+	var buf bytes.Buffer
+	if v.lines > 0 {
+		// Move to the start of the previous drawing and clear it
+		fmt.Fprintf(&buf, "\x1b[%dA\x1b[J", v.lines)
+	}
+	var table bytes.Buffer
+	v.model.Render(&table)
+	v.lines = bytes.Count(table.Bytes(), []byte("\n"))
+	buf.Write(table.Bytes())
+	v.w.Write(buf.Bytes())
+}
+
+// IsTerminal reports whether f is a terminal the view can redraw on
+func IsTerminal(f *os.File) bool {
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
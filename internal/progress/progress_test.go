@@ -0,0 +1,124 @@
+package progress
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"orchid/internal/orchestrator"
+)
+
+func TestModelTransitions(t *testing.T) {
+	db := orchestrator.StepEvent{Step: "db", Type: "dependency", StepNumber: 1}
+	api := orchestrator.StepEvent{Step: "api", Type: "application", StepNumber: 2}
+	with := func(ev orchestrator.StepEvent, status string, duration time.Duration, err error) orchestrator.StepEvent {
+		ev.Status, ev.Duration, ev.Err = status, duration, err
+		return ev
+	}
+	unhealthy := errors.New("health check failed")
+	health := func(step, host string, healthy bool) orchestrator.HealthCheckEvent {
+		return orchestrator.HealthCheckEvent{Step: step, Host: host, Healthy: healthy}
+	}
+
+	tests := []struct {
+		name   string
+		events []func(*Model)
+		want   []string // Rows, as "<number> <step> <type> <status> <duration> <health> <err>"
+	}{
+		{
+			name: "step started",
+			events: []func(*Model){
+				func(m *Model) { m.StepStart(db) },
+			},
+			want: []string{"1 db dependency running 0s map[] "},
+		},
+		{
+			name: "steps in start order",
+			events: []func(*Model){
+				func(m *Model) { m.StepStart(db) },
+				func(m *Model) { m.StepComplete(with(db, orchestrator.StepSucceeded, time.Second, nil)) },
+				func(m *Model) { m.StepStart(api) },
+			},
+			want: []string{"1 db dependency succeeded 1s map[] ", "2 api application running 0s map[] "},
+		},
+		{
+			name: "health checks keep the latest result per host",
+			events: []func(*Model){
+				func(m *Model) { m.StepStart(api) },
+				func(m *Model) { m.HealthCheck(health("api", "app1", false)) },
+				func(m *Model) { m.HealthCheck(health("api", "app2", true)) },
+				func(m *Model) { m.HealthCheck(health("api", "app1", true)) },
+			},
+			want: []string{"2 api application running 0s map[app1:true app2:true] "},
+		},
+		{
+			name: "health check of an unknown step",
+			events: []func(*Model){
+				func(m *Model) { m.HealthCheck(health("api", "app1", true)) },
+			},
+		},
+		{
+			name: "failure then rollback",
+			events: []func(*Model){
+				func(m *Model) { m.StepStart(db) },
+				func(m *Model) { m.StepComplete(with(db, orchestrator.StepSucceeded, time.Second, nil)) },
+				func(m *Model) { m.StepStart(api) },
+				func(m *Model) { m.StepComplete(with(api, orchestrator.StepFailed, 2*time.Second, unhealthy)) },
+				func(m *Model) { m.Rollback(with(db, orchestrator.StepRolledBack, 0, nil)) },
+			},
+			want: []string{"1 db dependency rolled_back 1s map[] ", "2 api application failed 2s map[] health check failed"},
+		},
+		{
+			name: "restarted step clears its previous result",
+			events: []func(*Model){
+				func(m *Model) { m.StepStart(api) },
+				func(m *Model) { m.StepComplete(with(api, orchestrator.StepFailed, time.Second, errors.New("exit 1"))) },
+				func(m *Model) { m.StepStart(api) },
+			},
+			want: []string{"2 api application running 0s map[] "},
+		},
+		{
+			name: "rollback of a step that never started here",
+			events: []func(*Model){
+				func(m *Model) { m.Rollback(with(db, orchestrator.StepFailed, 0, errors.New("still running"))) },
+			},
+			want: []string{"1 db dependency failed 0s map[] still running"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewModel("prod", "up")
+			for _, ev := range tt.events {
+				ev(m)
+			}
+			var got []string
+			for _, r := range m.Rows {
+				got = append(got, fmt.Sprintf("%d %s %s %s %s %v %s", r.Number, r.Step, r.Type, r.Status, r.Duration, r.Health, r.Err))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("rows =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestViewRedrawsInPlace(t *testing.T) {
+	var out bytes.Buffer
+	v := NewView(&out, "prod", "up")
+	hooks := v.Hooks()
+
+	hooks.OnStepStart(orchestrator.StepEvent{Step: "api", Type: "application", StepNumber: 1})
+	if strings.Contains(out.String(), "\x1b[") {
+		t.Errorf("first drawing = %q, want nothing to move back over", out.String())
+	}
+
+	// The header, column names and one row
+	out.Reset()
+	hooks.OnStepComplete(orchestrator.StepEvent{Step: "api", Type: "application", StepNumber: 1, Status: orchestrator.StepSucceeded})
+	if !strings.HasPrefix(out.String(), "\x1b[3A\x1b[J") || !strings.Contains(out.String(), orchestrator.StepSucceeded) {
+		t.Errorf("redraw = %q, want the previous 3 lines cleared and the step succeeded", out.String())
+	}
+}
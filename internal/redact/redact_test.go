@@ -0,0 +1,101 @@
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	if r, err := New(nil); r != nil || err != nil {
+		t.Errorf("New(nil) = %v, %v, want a nil Redactor", r, err)
+	}
+	if _, err := New([]string{"ok", "(unclosed"}); err == nil || !strings.Contains(err.Error(), `invalid redact pattern "(unclosed"`) {
+		t.Errorf("err = %v, want the invalid pattern named", err)
+	}
+}
+
+func TestString(t *testing.T) {
+	r, err := New([]string{`token=\S+`, `s3cr3t-\w+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "nothing secret", want: "nothing secret"},
+		{in: "curl -H token=abc123 https://x", want: "curl -H [REDACTED] https://x"},
+		{in: "s3cr3t-one and s3cr3t-two", want: "[REDACTED] and [REDACTED]"},
+		{in: "token=s3cr3t-both", want: "[REDACTED]"},
+	}
+	for _, tt := range tests {
+		if got := r.String(tt.in); got != tt.want {
+			t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	var none *Redactor
+	if got := none.String("token=abc"); got != "token=abc" {
+		t.Errorf("nil Redactor String = %q, want it unchanged", got)
+	}
+}
+
+func TestError(t *testing.T) {
+	r, err := New([]string{`s3cr3t-\w+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cause := fmt.Errorf("open s3cr3t-abc: %w", fs.ErrNotExist)
+
+	got := r.Error(cause)
+	if got.Error() != "open [REDACTED]: file does not exist" {
+		t.Errorf("Error() = %q, want the secret masked", got.Error())
+	}
+	if !errors.Is(got, fs.ErrNotExist) {
+		t.Error("errors.Is lost the wrapped error")
+	}
+	if r.Error(nil) != nil {
+		t.Error("Error(nil) is not nil")
+	}
+
+	var none *Redactor
+	if none.Error(cause) != cause {
+		t.Error("nil Redactor wrapped the error")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r, err := New([]string{`s3cr3t-\w+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	logger := slog.New(r.Handler(slog.NewTextHandler(&out, nil)))
+
+	logger.With(slog.String("with", "s3cr3t-with")).WithGroup("g").Info("saw s3cr3t-message",
+		slog.String("output", "s3cr3t-attr"),
+		slog.Any("error", errors.New("bad s3cr3t-error")),
+		slog.Group("nested", slog.String("cmd", "s3cr3t-nested")),
+		slog.Int("count", 3))
+
+	line := out.String()
+	if strings.Contains(line, "s3cr3t") {
+		t.Errorf("log line = %s, want every secret masked", line)
+	}
+	for _, want := range []string{`msg="saw [REDACTED]"`, "with=[REDACTED]", "g.output=[REDACTED]", `g.error="bad [REDACTED]"`, "g.nested.cmd=[REDACTED]", "g.count=3"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log line = %s, want %s", line, want)
+		}
+	}
+
+	var none *Redactor
+	h := slog.NewTextHandler(&out, nil)
+	if none.Handler(h) != slog.Handler(h) {
+		t.Error("nil Redactor wrapped the handler")
+	}
+}
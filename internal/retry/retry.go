@@ -0,0 +1,82 @@
+// Package retry runs operations repeatedly with exponential backoff.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Policy controls how often and how long an operation is retried
+type Policy struct {
+	Attempts     int           // Maximum number of attempts; 0 retries until the context ends
+	BaseInterval time.Duration // Delay after the first failure
+	MaxInterval  time.Duration // Upper bound on the delay; 0 means no bound
+	Jitter       float64       // Randomise each delay by up to this fraction, e.g. 0.1
+}
+
+// permanentError marks an error that should not be retried
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that Do returns it immediately instead of retrying
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Do calls fn until it succeeds, returns a permanent error, runs out of
+// attempts, or ctx is done. The last error from fn is returned on failure.
+func Do(ctx context.Context, p Policy, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if p.Attempts > 0 && attempt >= p.Attempts {
+			return err
+		}
+
+		timer := time.NewTimer(p.jittered(p.Backoff(attempt)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+// Backoff returns the delay before the attempt following the given one,
+// doubling from BaseInterval and capped at MaxInterval, without jitter
+func (p Policy) Backoff(attempt int) time.Duration {
+	delay := p.BaseInterval
+	for i := 1; i < attempt; i++ {
+		if p.MaxInterval > 0 && delay >= p.MaxInterval {
+			break
+		}
+		delay *= 2
+	}
+	if p.MaxInterval > 0 && delay > p.MaxInterval {
+		delay = p.MaxInterval
+	}
+	return delay
+}
+
+func (p Policy) jittered(delay time.Duration) time.Duration {
+	if p.Jitter <= 0 || delay <= 0 {
+		return delay
+	}
+	spread := float64(delay) * p.Jitter
+	return delay + time.Duration(spread*(2*rand.Float64()-1))
+}
@@ -0,0 +1,123 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errFailed = errors.New("failed")
+
+func TestDoAttempts(t *testing.T) {
+	tests := []struct {
+		name      string
+		attempts  int
+		failures  int // Calls that fail before fn succeeds
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "succeeds first time", attempts: 3, failures: 0, wantCalls: 1},
+		{name: "succeeds on retry", attempts: 3, failures: 2, wantCalls: 3},
+		{name: "runs out of attempts", attempts: 3, failures: 5, wantCalls: 3, wantErr: true},
+		{name: "single attempt", attempts: 1, failures: 1, wantCalls: 1, wantErr: true},
+		{name: "unlimited attempts", attempts: 0, failures: 10, wantCalls: 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := Do(context.Background(), Policy{Attempts: tt.attempts}, func(ctx context.Context) error {
+				calls++
+				if calls <= tt.failures {
+					return errFailed
+				}
+				return nil
+			})
+
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr && !errors.Is(err, errFailed) {
+				t.Errorf("err = %v, want %v", err, errFailed)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestDoPermanent(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), Policy{Attempts: 5}, func(ctx context.Context) error {
+		calls++
+		return Permanent(errFailed)
+	})
+
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+	if err != errFailed {
+		t.Errorf("err = %v, want the unwrapped %v", err, errFailed)
+	}
+}
+
+func TestDoContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	done := make(chan error)
+	go func() {
+		done <- Do(ctx, Policy{BaseInterval: time.Hour}, func(ctx context.Context) error {
+			calls++
+			return errFailed
+		})
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) || !errors.Is(err, errFailed) {
+			t.Errorf("err = %v, want both %v and %v", err, context.Canceled, errFailed)
+		}
+		if calls != 1 {
+			t.Errorf("calls = %d, want 1", calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Do did not return after the context was cancelled")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		attempt int
+		want    time.Duration
+	}{
+		{name: "first failure", policy: Policy{BaseInterval: time.Second}, attempt: 1, want: time.Second},
+		{name: "doubles", policy: Policy{BaseInterval: time.Second}, attempt: 4, want: 8 * time.Second},
+		{name: "capped", policy: Policy{BaseInterval: time.Second, MaxInterval: 5 * time.Second}, attempt: 4, want: 5 * time.Second},
+		{name: "base above cap", policy: Policy{BaseInterval: 10 * time.Second, MaxInterval: 5 * time.Second}, attempt: 1, want: 5 * time.Second},
+		{name: "stays capped without overflow", policy: Policy{BaseInterval: time.Second, MaxInterval: 30 * time.Second}, attempt: 200, want: 30 * time.Second},
+		{name: "no delay", policy: Policy{}, attempt: 3, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Backoff(tt.attempt); got != tt.want {
+				t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJitteredStaysInRange(t *testing.T) {
+	p := Policy{Jitter: 0.1}
+	for i := 0; i < 100; i++ {
+		got := p.jittered(time.Second)
+		if got < 900*time.Millisecond || got > 1100*time.Millisecond {
+			t.Fatalf("jittered(1s) = %v, want within 10%%", got)
+		}
+	}
+}
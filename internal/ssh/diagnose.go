@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Connection phases reported by ConnectError
+const (
+	PhaseProxy     = "proxy"
+	PhaseDNS       = "dns"
+	PhaseDial      = "dial"
+	PhaseHandshake = "handshake"
+	PhaseHostKey   = "host_key"
+	PhaseAuth      = "auth"
+)
+
+// ConnectError reports which phase of connecting to a host failed, to tell
+// network problems apart from credential ones
+type ConnectError struct {
+	Host  string
+	Phase string
+	Err   error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connecting to %s failed during %s: %v", e.Host, e.Phase, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+// hostKeyError marks failures from the host key callback, which the ssh
+// package otherwise reports as a generic handshake failure
+type hostKeyError struct {
+	err error
+}
+
+func (e *hostKeyError) Error() string { return e.err.Error() }
+func (e *hostKeyError) Unwrap() error { return e.err }
+
+// dialPhase classifies an error from dialing a host or proxy
+func dialPhase(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return PhaseDNS
+	}
+	return PhaseDial
+}
+
+// handshakePhase classifies an error from the SSH handshake
+func handshakePhase(err error) string {
+	var keyErr *hostKeyError
+	switch {
+	case errors.As(err, &keyErr):
+		return PhaseHostKey
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return PhaseAuth
+	default:
+		return PhaseHandshake
+	}
+}
+
+// transient reports whether a connection failure may clear up on its own,
+// such as a refused dial while a host reboots, and is worth retrying.
+// Credential, host key and proxy configuration problems never are, nor is a
+// hostname that does not exist.
+func transient(err error) bool {
+	var connErr *ConnectError
+	if !errors.As(err, &connErr) {
+		return false
+	}
+	switch connErr.Phase {
+	case PhaseDNS:
+		var dnsErr *net.DNSError
+		return errors.As(err, &dnsErr) && !dnsErr.IsNotFound
+	case PhaseDial, PhaseHandshake:
+		return true
+	default:
+		return false
+	}
+}
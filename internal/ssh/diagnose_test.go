@@ -0,0 +1,99 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh/sshtest"
+)
+
+func TestConnectErrorPhase(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	_, otherPub := sshtest.ClientKey(t)
+	ok := func(cmd string, stdout, stderr io.Writer) int { return 0 }
+	server := sshtest.NewServer(t, ok, pub)
+	wrongKey := sshtest.NewServer(t, ok, otherPub)
+
+	// A port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host == "missing.test" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []string{host}, nil
+	}
+	t.Cleanup(func() { lookupHost = net.DefaultResolver.LookupHost })
+
+	tests := []struct {
+		name      string
+		hostname  string
+		mode      string
+		wantPhase string
+	}{
+		{name: "dns", hostname: "missing.test:22", wantPhase: PhaseDNS},
+		{name: "dial", hostname: closed, wantPhase: PhaseDial},
+		{name: "auth", hostname: wrongKey.Addr, wantPhase: PhaseAuth},
+		{name: "host key", hostname: server.Addr, mode: HostKeyStrict, wantPhase: PhaseHostKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// An empty known_hosts, so every host is unknown
+			knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+			if err := os.WriteFile(knownHosts, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{
+				HostKeyChecking: tt.mode,
+				KnownHostsPath:  knownHosts,
+				ConnectAttempts: 1,
+			})
+			defer m.CloseAll()
+
+			_, err := m.GetClient(context.Background(), config.Host{Hostname: tt.hostname}, config.SSHDefaults{Key: key})
+			var connErr *ConnectError
+			if !errors.As(err, &connErr) || connErr.Phase != tt.wantPhase {
+				t.Fatalf("err = %v, want a %s failure", err, tt.wantPhase)
+			}
+			if connErr.Host != tt.hostname {
+				t.Errorf("Host = %s, want %s", connErr.Host, tt.hostname)
+			}
+		})
+	}
+}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &ConnectError{Phase: PhaseDial, Err: errors.New("connection refused")}, want: true},
+		{err: &ConnectError{Phase: PhaseHandshake, Err: io.EOF}, want: true},
+		{err: &ConnectError{Phase: PhaseDNS, Err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}, want: true},
+		{err: &ConnectError{Phase: PhaseDNS, Err: &net.DNSError{Err: "no such host", IsNotFound: true}}},
+		{err: &ConnectError{Phase: PhaseAuth, Err: errors.New("unable to authenticate")}},
+		{err: &ConnectError{Phase: PhaseHostKey, Err: errors.New("key mismatch")}},
+		{err: &ConnectError{Phase: PhaseProxy, Err: errors.New("unsupported scheme")}},
+		{err: errors.New("not a connection error")},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.err), func(t *testing.T) {
+			if got := transient(tt.err); got != tt.want {
+				t.Errorf("transient = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key checking modes for ManagerOptions.HostKeyChecking
+const (
+	HostKeyIgnore    = ""           // accept any host key
+	HostKeyStrict    = "strict"     // require the key to be in known_hosts
+	HostKeyAcceptNew = "accept-new" // learn unknown hosts, reject changed keys
+)
+
+// ManagerOptions configures how a Manager connects to hosts
+type ManagerOptions struct {
+	HostKeyChecking string
+
+	// KnownHostsPath defaults to ~/.ssh/known_hosts. An environment's
+	// ssh_defaults.known_hosts takes precedence.
+	KnownHostsPath string
+
+	// ConnectAttempts is how many times connecting to a host is tried when
+	// it fails in a way that may be transient, backing off exponentially
+	// from ConnectBackoff between attempts. Zero values use 3 attempts and a
+	// one second backoff; 1 disables retrying.
+	ConnectAttempts int
+	ConnectBackoff  time.Duration
+
+	// MaxOutput caps the output Execute collects from a command, keeping
+	// its beginning and end. Zero uses 4MB; negative is unlimited.
+	MaxOutput int
+}
+
+// ValidHostKeyChecking reports whether mode is a known host key checking mode
+func ValidHostKeyChecking(mode string) bool {
+	switch mode {
+	case HostKeyIgnore, HostKeyStrict, HostKeyAcceptNew:
+		return true
+	}
+	return false
+}
+
+// knownHostsPath picks the environment's known_hosts, then the manager's,
+// then the user's default
+func (m *Manager) knownHostsPath(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	if m.opts.KnownHostsPath != "" {
+		return m.opts.KnownHostsPath, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate known_hosts: %w", err)
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// hostKeyCallback returns the callback verifying host keys for the
+// configured mode. known_hosts is re-read on every connect so keys learned
+// earlier in the run are honoured.
+func (m *Manager) hostKeyCallback(knownHosts string) (ssh.HostKeyCallback, error) {
+	if m.opts.HostKeyChecking == HostKeyIgnore {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	path, err := m.knownHostsPath(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.opts.HostKeyChecking == HostKeyAcceptNew {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create known_hosts directory: %w", err)
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create known_hosts '%s': %w", path, err)
+		}
+		f.Close()
+	}
+
+	verify, err := knownhosts.New(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("known_hosts file '%s' does not exist: strict host key checking needs it, or use --accept-new-host-keys to create it", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts '%s': %w", path, err)
+	}
+	if m.opts.HostKeyChecking == HostKeyStrict {
+		return verify, nil
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := verify(hostname, remote, key)
+
+		// A KeyError with no wanted keys means the host is unknown; one
+		// with wanted keys means the key changed, which is never accepted
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+
+		if err := appendKnownHost(path, hostname, key); err != nil {
+			return err
+		}
+		m.logger.Warn("learned new host key",
+			slog.String("host", hostname),
+			slog.String("fingerprint", ssh.FingerprintSHA256(key)),
+			slog.String("known_hosts", path))
+		return nil
+	}, nil
+}
+
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return fmt.Errorf("failed to write known_hosts '%s': %w", path, err)
+	}
+	return nil
+}
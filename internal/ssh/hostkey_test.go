@@ -0,0 +1,146 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh/sshtest"
+)
+
+func TestHostKeyChecking(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	ok := func(cmd string, stdout, stderr io.Writer) int { return 0 }
+	server := sshtest.NewServer(t, ok, pub)
+	other := sshtest.NewServer(t, ok, pub)
+
+	connect := func(mode, knownHosts string) error {
+		m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{
+			HostKeyChecking: mode,
+			KnownHostsPath:  knownHosts,
+			ConnectAttempts: 1,
+		})
+		defer m.CloseAll()
+		_, err := m.GetClient(context.Background(), config.Host{Hostname: server.Addr}, config.SSHDefaults{Key: key})
+		return err
+	}
+	writeKnownHosts := func(t *testing.T, lines ...string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "known_hosts")
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	known := knownhosts.Line([]string{knownhosts.Normalize(server.Addr)}, server.HostKey)
+	changed := knownhosts.Line([]string{knownhosts.Normalize(server.Addr)}, other.HostKey)
+
+	t.Run("accept-new learns an unknown host", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+		if err := connect(HostKeyAcceptNew, path); err != nil {
+			t.Fatalf("first connect: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || strings.TrimSpace(string(data)) != known {
+			t.Fatalf("known_hosts = %q, %v, want %q", data, err, known)
+		}
+
+		// Once learned, the key is checked like any other
+		if err := connect(HostKeyStrict, path); err != nil {
+			t.Errorf("strict connect after learning the key: %v", err)
+		}
+		if err := connect(HostKeyAcceptNew, path); err != nil {
+			t.Errorf("second connect: %v", err)
+		}
+		if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 1 {
+			t.Errorf("known_hosts = %q, want the key learned once", data)
+		}
+	})
+
+	tests := []struct {
+		name       string
+		mode       string
+		knownHosts []string // nil leaves the file missing
+		wantErr    string
+	}{
+		{name: "accept-new rejects a changed key", mode: HostKeyAcceptNew, knownHosts: []string{changed}, wantErr: "key mismatch"},
+		{name: "strict accepts a known key", mode: HostKeyStrict, knownHosts: []string{known}},
+		{name: "strict rejects an unknown host", mode: HostKeyStrict, knownHosts: []string{}, wantErr: "key is unknown"},
+		{name: "strict rejects a changed key", mode: HostKeyStrict, knownHosts: []string{changed}, wantErr: "key mismatch"},
+		{name: "strict needs known_hosts", mode: HostKeyStrict, wantErr: "does not exist"},
+		{name: "ignore accepts a changed key", mode: HostKeyIgnore, knownHosts: []string{changed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			if tt.knownHosts != nil {
+				path = writeKnownHosts(t, tt.knownHosts...)
+			}
+			err := connect(tt.mode, path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("connect: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKnownHostsPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	tests := []struct {
+		name       string
+		configured string
+		manager    string
+		want       string
+	}{
+		{name: "default", want: filepath.Join(home, ".ssh", "known_hosts")},
+		{name: "manager", manager: "/ci/known_hosts", want: "/ci/known_hosts"},
+		{name: "environment wins", configured: "/env/known_hosts", manager: "/ci/known_hosts", want: "/env/known_hosts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{KnownHostsPath: tt.manager})
+			got, err := m.knownHostsPath(tt.configured)
+			if err != nil || got != tt.want {
+				t.Errorf("knownHostsPath(%q) = %q, %v, want %q", tt.configured, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomKnownHostsFile(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	server := sshtest.NewServer(t, func(cmd string, stdout, stderr io.Writer) int { return 0 }, pub)
+	t.Setenv("HOME", t.TempDir()) // With no known_hosts
+
+	path := filepath.Join(t.TempDir(), "managed_known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.Addr)}, server.HostKey)
+	if err := os.WriteFile(path, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{HostKeyChecking: HostKeyStrict, ConnectAttempts: 1})
+	defer m.CloseAll()
+	host := config.Host{Hostname: server.Addr}
+	if _, err := m.GetClient(context.Background(), host, config.SSHDefaults{Key: key, KnownHostsPath: path}); err != nil {
+		t.Errorf("GetClient with the managed known_hosts: %v", err)
+	}
+	_, err := m.GetClient(context.Background(), host, config.SSHDefaults{Key: key, User: "other"})
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("err = %v, want the missing default known_hosts reported", err)
+	}
+}
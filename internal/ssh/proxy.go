@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyURL returns the SOCKS5 proxy to dial through, or nil to dial
+// directly. The configured proxy wins; "none" disables the ALL_PROXY
+// fallback, which is only honoured for socks5 URLs.
+func proxyURL(configured string) (*url.URL, error) {
+	if configured == "none" {
+		return nil, nil
+	}
+
+	raw, fromEnv := configured, false
+	if raw == "" {
+		raw, fromEnv = os.Getenv("ALL_PROXY"), true
+		if raw == "" {
+			raw = os.Getenv("all_proxy")
+		}
+	}
+	if raw == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", raw, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		if fromEnv {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unsupported proxy %q: only socks5 is supported", raw)
+	}
+	return u, nil
+}
+
+// dialSOCKS5 connects to addr through the SOCKS5 proxy at u, authenticating
+// with the URL's user info when present. As with curl, a socks5h proxy
+// resolves the hostname itself while socks5 has it resolved locally, which
+// matters when only one side can see the hosts' DNS.
+func dialSOCKS5(ctx context.Context, u *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if u.Scheme == "socks5" {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := lookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ips[0], port)
+	}
+
+	d, err := proxy.FromURL(u, &net.Dialer{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %w", u.Redacted(), err)
+	}
+	// The SOCKS5 dialer bounds its handshake by the context's deadline
+	conn, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+	}
+	return conn, nil
+}
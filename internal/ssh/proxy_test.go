@@ -0,0 +1,223 @@
+package ssh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh/sshtest"
+)
+
+// socksProxy is a SOCKS5 proxy on a loopback address that resolves the
+// hostnames in names itself and records the targets it was asked for
+type socksProxy struct {
+	addr     string
+	user     *[2]string // Username and password required, if set
+	names    map[string]string
+	mu       sync.Mutex
+	requests []string // "domain <host:port>" or "ip <ip:port>"
+}
+
+func newSOCKSProxy(t *testing.T, names map[string]string) *socksProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	p := &socksProxy{addr: l.Addr().String(), names: names}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *socksProxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// Method negotiation, then username and password if required
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if p.user == nil {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		name := make([]byte, buf[1])
+		io.ReadFull(conn, name)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(name) != p.user[0] || string(pass) != p.user[1] {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// Connect request
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var host, kind string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host, kind = net.IP(ip).String(), "ip"
+	case 3:
+		n := make([]byte, 1)
+		io.ReadFull(conn, n)
+		name := make([]byte, n[0])
+		io.ReadFull(conn, name)
+		host, kind = string(name), "domain"
+	default:
+		return
+	}
+	portBuf := make([]byte, 2)
+	io.ReadFull(conn, portBuf)
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(portBuf)))
+
+	p.mu.Lock()
+	p.requests = append(p.requests, kind+" "+net.JoinHostPort(host, port))
+	p.mu.Unlock()
+
+	if ip, ok := p.names[host]; ok {
+		host = ip
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	server := sshtest.NewServer(t, func(cmd string, stdout, stderr io.Writer) int {
+		io.WriteString(stdout, "hello")
+		return 0
+	}, pub)
+	_, port, _ := net.SplitHostPort(server.Addr)
+	portNum, _ := strconv.Atoi(port)
+
+	// Only the proxy knows proxied.test, unless socks5 has it resolved
+	// locally through lookupHost
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host == "local.test" {
+			return []string{"127.0.0.1"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	t.Cleanup(func() { lookupHost = net.DefaultResolver.LookupHost })
+
+	tests := []struct {
+		name        string
+		scheme      string
+		hostname    string
+		user        *[2]string
+		credentials string
+		wantRequest string
+		wantErr     string
+	}{
+		{name: "socks5h resolves on the proxy", scheme: "socks5h", hostname: "proxied.test", wantRequest: "domain proxied.test:" + port},
+		{name: "socks5 resolves locally", scheme: "socks5", hostname: "local.test", wantRequest: "ip 127.0.0.1:" + port},
+		{name: "socks5 cannot resolve proxy-only names", scheme: "socks5", hostname: "proxied.test", wantErr: "no such host"},
+		{name: "authenticated", scheme: "socks5h", hostname: "proxied.test", user: &[2]string{"ops", "secret"}, credentials: "ops:secret@", wantRequest: "domain proxied.test:" + port},
+		{name: "wrong password", scheme: "socks5h", hostname: "proxied.test", user: &[2]string{"ops", "secret"}, credentials: "ops:guess@", wantErr: "username/password authentication failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSOCKSProxy(t, map[string]string{"proxied.test": "127.0.0.1"})
+			p.user = tt.user
+
+			m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{ConnectAttempts: 1})
+			t.Cleanup(m.CloseAll)
+			defaults := config.SSHDefaults{Key: key, Proxy: tt.scheme + "://" + tt.credentials + p.addr}
+			client, err := m.GetClient(context.Background(), config.Host{Hostname: tt.hostname, Port: portNum}, defaults)
+			if tt.wantErr != "" {
+				var connErr *ConnectError
+				if !errors.As(err, &connErr) || connErr.Phase != PhaseProxy || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want a proxy error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetClient: %v", err)
+			}
+
+			if out, err := client.Execute(context.Background(), "echo"); err != nil || out != "hello" {
+				t.Errorf("Execute = %q, %v", out, err)
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if len(p.requests) != 1 || p.requests[0] != tt.wantRequest {
+				t.Errorf("proxy requests = %q, want %q", p.requests, tt.wantRequest)
+			}
+		})
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		env        string
+		want       string
+		wantErr    bool
+	}{
+		{name: "none"},
+		{name: "configured", configured: "socks5://proxy:1080", env: "socks5://other:1080", want: "socks5://proxy:1080"},
+		{name: "from environment", env: "socks5h://proxy:1080", want: "socks5h://proxy:1080"},
+		{name: "disabled", configured: "none", env: "socks5://proxy:1080"},
+		{name: "other schemes in the environment are ignored", env: "http://proxy:3128"},
+		{name: "other schemes configured are an error", configured: "http://proxy:3128", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALL_PROXY", tt.env)
+			t.Setenv("all_proxy", "")
+			u, err := proxyURL(tt.configured)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			var got string
+			if u != nil {
+				got = u.String()
+			}
+			if got != tt.want {
+				t.Errorf("proxyURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,44 +3,78 @@ package ssh
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"orchid/internal/config"
+	"orchid/internal/retry"
 
 	"golang.org/x/crypto/ssh"
 )
 
 type Manager struct {
 	logger  *slog.Logger
+	opts    ManagerOptions
 	clients map[string]*Client
+	dialing map[string]*pendingClient // Connections being made, by client key
 	mu      sync.RWMutex
 }
 
+// pendingClient is a connection being made by one GetClient call, which
+// others asking for the same client wait on rather than dialing again
+type pendingClient struct {
+	done   chan struct{} // Closed once client and err are set
+	client *Client
+	err    error
+}
+
+const (
+	defaultConnectTimeout  = 30 * time.Second
+	defaultConnectAttempts = 3
+	defaultConnectBackoff  = time.Second
+	defaultMaxOutput       = 4 << 20
+	maxConnectBackoff      = 30 * time.Second
+)
+
 type Client struct {
-	client *ssh.Client
-	logger *slog.Logger
+	client    *ssh.Client
+	logger    *slog.Logger
+	timeout   time.Duration
+	maxOutput int // Bytes of output Execute keeps; see ManagerOptions.MaxOutput
 }
 
-func NewManager(logger *slog.Logger) *Manager {
+func NewManager(logger *slog.Logger, opts ManagerOptions) *Manager {
+	if opts.ConnectAttempts <= 0 {
+		opts.ConnectAttempts = defaultConnectAttempts
+	}
+	if opts.ConnectBackoff <= 0 {
+		opts.ConnectBackoff = defaultConnectBackoff
+	}
+	if opts.MaxOutput == 0 {
+		opts.MaxOutput = defaultMaxOutput
+	}
 	return &Manager{
 		logger:  logger,
+		opts:    opts,
 		clients: make(map[string]*Client),
+		dialing: make(map[string]*pendingClient),
 	}
 }
 
-func (m *Manager) GetClient(host config.Host, defaults config.SSHDefaults) (*Client, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	// Use host.Hostname as the key in the clients map
-	clientKey := host.Hostname
-	if client, ok := m.clients[clientKey]; ok {
-		return client, nil
-	}
-
+// GetClient returns a connected client for host, reusing a cached one when
+// possible. Connecting is retried as configured until ctx is done. The
+// manager isn't locked while dialing, so a slow or unreachable host doesn't
+// hold up connections to others.
+func (m *Manager) GetClient(ctx context.Context, host config.Host, defaults config.SSHDefaults) (*Client, error) {
 	// Determine SSH user and key
 	user := host.SSHUser
 	if user == "" {
@@ -52,21 +86,69 @@ func (m *Manager) GetClient(host config.Host, defaults config.SSHDefaults) (*Cli
 		keyPath = defaults.Key
 	}
 
-	// Read private key file
-	keyData, err := ioutil.ReadFile(keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read SSH key '%s': %w", keyPath, err)
+	// Clients are cached per identity, since steps may connect to the same
+	// host as different users
+	addr := address(host.Hostname, host.Port)
+	clientKey := fmt.Sprintf("%s@%s:%s", user, addr, keyPath)
+
+	m.mu.Lock()
+	if client, ok := m.clients[clientKey]; ok {
+		m.mu.Unlock()
+		return client, nil
+	}
+	if pending, ok := m.dialing[clientKey]; ok {
+		m.mu.Unlock()
+		select {
+		case <-pending.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if pending.err != nil && ctx.Err() == nil &&
+			(errors.Is(pending.err, context.Canceled) || errors.Is(pending.err, context.DeadlineExceeded)) {
+			// The caller that was dialing gave up, not the host; try again
+			return m.GetClient(ctx, host, defaults)
+		}
+		return pending.client, pending.err
 	}
+	pending := &pendingClient{done: make(chan struct{})}
+	m.dialing[clientKey] = pending
+	m.mu.Unlock()
 
-	signer, err := ssh.ParsePrivateKey(keyData)
+	pending.client, pending.err = m.connect(ctx, host, defaults, user, keyPath, addr)
+
+	m.mu.Lock()
+	delete(m.dialing, clientKey)
+	if pending.err == nil {
+		m.clients[clientKey] = pending.client
+		go m.forgetOnClose(clientKey, pending.client)
+	}
+	m.mu.Unlock()
+	close(pending.done)
+
+	return pending.client, pending.err
+}
+
+// connect dials addr as user with the key at keyPath, retrying failures
+// that may be transient
+func (m *Manager) connect(ctx context.Context, host config.Host, defaults config.SSHDefaults, user, keyPath, addr string) (*Client, error) {
+	signer, err := loadKey(keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse SSH key '%s': %w", keyPath, err)
+		return nil, err
 	}
 
-	// Set default timeout if not specified
-	timeout := defaults.Timeout
-	if timeout == 0 {
-		timeout = 30 // Default timeout of 30 seconds
+	// The connect timeout only covers dialing and the handshake; command
+	// execution is bounded separately by defaults.Timeout
+	connectTimeout := defaults.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaults.Timeout
+	}
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
+	hostKeyCallback, err := m.hostKeyCallback(defaults.KnownHostsPath)
+	if err != nil {
+		return nil, err
 	}
 
 	config := &ssh.ClientConfig{
@@ -74,22 +156,217 @@ func (m *Manager) GetClient(host config.Host, defaults config.SSHDefaults) (*Cli
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO: Use proper host key verification
-		Timeout:         timeout,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         connectTimeout,
+	}
+
+	// Retry failures that may clear up on their own, such as a host that is
+	// rebooting, so a brief outage doesn't abort the whole run
+	policy := retry.Policy{
+		Attempts:     m.opts.ConnectAttempts,
+		BaseInterval: m.opts.ConnectBackoff,
+		MaxInterval:  maxConnectBackoff,
+		Jitter:       0.1,
+	}
+	var clientConn *ssh.Client
+	attempt := 0
+	err = retry.Do(ctx, policy, func(ctx context.Context) error {
+		attempt++
+		var err error
+		clientConn, err = dial(ctx, host.Hostname, addr, config, defaults.Proxy, m.logger)
+		if err != nil && !transient(err) {
+			return retry.Permanent(err)
+		}
+		if err != nil && attempt < policy.Attempts {
+			m.logger.Warn("SSH connection failed; retrying",
+				slog.String("host", host.Hostname),
+				slog.Int("attempt", attempt),
+				slog.Int("attempts", policy.Attempts),
+				slog.String("error", err.Error()))
+		}
+		return err
+	})
+	if err != nil {
+		var connErr *ConnectError
+		if errors.As(err, &connErr) {
+			m.logger.Error("SSH connection failed",
+				slog.String("host", host.Hostname),
+				slog.String("user", user),
+				slog.String("phase", connErr.Phase),
+				slog.String("error", connErr.Err.Error()))
+		}
+		return nil, err
+	}
+
+	return &Client{
+		client:    clientConn,
+		logger:    m.logger.With(slog.String("host", host.Hostname), slog.String("user", user)),
+		timeout:   defaults.Timeout,
+		maxOutput: m.opts.MaxOutput,
+	}, nil
+}
+
+// forgetOnClose drops a cached client once its connection closes, so that
+// after a network blip the next GetClient reconnects instead of handing out
+// a dead connection
+func (m *Manager) forgetOnClose(key string, c *Client) {
+	err := c.client.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.clients[key] != c {
+		// Closed by CloseAll
+		return
+	}
+	delete(m.clients, key)
+	var attrs []any
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	c.logger.Warn("SSH connection closed; reconnecting on next use", attrs...)
+}
+
+// address returns the host:port to dial for hostname, which may carry its
+// own port, then port when it is set, and otherwise the standard SSH port
+func address(hostname string, port int) string {
+	if _, _, err := net.SplitHostPort(hostname); err == nil {
+		return hostname
+	}
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(port))
+}
+
+// dial connects to addr directly, or through a SOCKS5 proxy when one is
+// configured, classifying any failure by connection phase
+func dial(ctx context.Context, hostname, addr string, config *ssh.ClientConfig, proxy string, logger *slog.Logger) (*ssh.Client, error) {
+	u, err := proxyURL(proxy)
+	if err != nil {
+		return nil, &ConnectError{Host: hostname, Phase: PhaseProxy, Err: err}
+	}
+
+	var conn net.Conn
+	if u == nil {
+		conn, err = dialAddresses(ctx, addr, config.Timeout, logger)
+		if err != nil {
+			return nil, &ConnectError{Host: hostname, Phase: dialPhase(err), Err: err}
+		}
+	} else {
+		conn, err = dialSOCKS5(ctx, u, addr, config.Timeout)
+		if err != nil {
+			return nil, &ConnectError{Host: hostname, Phase: PhaseProxy, Err: err}
+		}
+	}
+
+	// Wrap a copy of the config, which is reused when connecting is retried
+	verify := config.HostKeyCallback
+	cfg := *config
+	cfg.HostKeyCallback = func(host string, remote net.Addr, key ssh.PublicKey) error {
+		if err := verify(host, remote, key); err != nil {
+			return &hostKeyError{err}
+		}
+		return nil
+	}
+
+	// ClientConfig.Timeout only applies to ssh.Dial, so bound the handshake
+	// with a deadline on the connection, and drop it if ctx ends first
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &cfg)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, &ConnectError{Host: hostname, Phase: PhaseHandshake, Err: ctx.Err()}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &ConnectError{Host: hostname, Phase: handshakePhase(err), Err: err}
+	}
+	// Commands are bounded by their own timeout from here on
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// lookupHost resolves hostnames for dialAddresses
+var lookupHost = net.DefaultResolver.LookupHost
+
+// dialAddresses resolves the host of addr and tries each of its addresses in
+// turn, so that one dead address behind round-robin DNS does not fail the
+// connection. The lookup and every attempt share one deadline, timeout from
+// now, so a host with many dead addresses still fails within the connect
+// timeout.
+func dialAddresses(ctx context.Context, addr string, timeout time.Duration, logger *slog.Logger) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
 	}
 
-	clientConn, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", host.Hostname), config)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ips, err := lookupHost(ctx, host)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial SSH on host %s: %w", host.Hostname, err)
+		return nil, err
 	}
 
-	sshClient := &Client{
-		client: clientConn,
-		logger: m.logger.With(slog.String("host", host.Hostname)),
+	var dialer net.Dialer
+	var lastErr error
+	for i, ip := range ips {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+		if err == nil {
+			if len(ips) > 1 {
+				logger.Info("connected to one of several addresses",
+					slog.String("host", host),
+					slog.String("address", ip),
+					slog.Int("addresses", len(ips)))
+			}
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(ips)-1 {
+			logger.Warn("failed to connect to address; trying the next",
+				slog.String("host", host),
+				slog.String("address", ip),
+				slog.String("error", err.Error()))
+		}
+	}
+	if len(ips) > 1 {
+		return nil, fmt.Errorf("none of the %d addresses of %s accepted a connection: %w", len(ips), host, lastErr)
 	}
+	return nil, lastErr
+}
 
-	m.clients[clientKey] = sshClient
-	return sshClient, nil
+// CheckKey verifies that the private key at path exists, is readable and
+// parses, so a bad key is reported before any host is touched
+func CheckKey(path string) error {
+	_, err := loadKey(path)
+	return err
+}
+
+func loadKey(path string) (ssh.Signer, error) {
+	if path == "" {
+		return nil, errors.New("no SSH key configured: set ssh_defaults.key or the host's ssh_key")
+	}
+
+	keyData, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("SSH key '%s' does not exist: check ssh_defaults.key or the host's ssh_key", path)
+	case errors.Is(err, fs.ErrPermission):
+		return nil, fmt.Errorf("SSH key '%s' is not readable by this user: check its permissions", path)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read SSH key '%s': %w", path, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key '%s': %w", path, err)
+	}
+	return signer, nil
 }
 
 func (m *Manager) CloseAll() {
@@ -105,22 +382,82 @@ func (m *Manager) CloseAll() {
 	m.clients = make(map[string]*Client)
 }
 
+// ExecOptions adjusts how a command is run on the remote host
+type ExecOptions struct {
+	// RequestPTY allocates a pseudo-terminal for commands such as sudo that
+	// refuse to run without one
+	RequestPTY bool
+
+	// Shell runs the command as `<Shell> -c '<cmd>'`, for example with
+	// "bash -l", instead of through the remote user's login shell
+	Shell string
+
+	// Stdin is sent to the command's standard input
+	Stdin io.Reader
+}
+
+// command returns cmd as it is sent to the host
+func (opts ExecOptions) command(cmd string) string {
+	if opts.Shell == "" {
+		return cmd
+	}
+	return opts.Shell + " -c " + ShellQuote(cmd)
+}
+
+// ShellQuote quotes s as a single POSIX shell word
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ttyErrors are fragments of the messages printed by tools that need a TTY
+var ttyErrors = []string{
+	"must have a tty",
+	"no tty present",
+	"a terminal is required",
+}
+
+// Close closes the client's connection. A Manager stops handing out a
+// closed client and reconnects on the next GetClient.
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
 func (c *Client) Execute(ctx context.Context, cmd string) (string, error) {
+	return c.ExecuteWith(ctx, cmd, ExecOptions{})
+}
+
+// ExecuteWith runs cmd like Execute, applying opts to the session
+func (c *Client) ExecuteWith(ctx context.Context, cmd string, opts ExecOptions) (string, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
 	session, err := c.client.NewSession()
 	if err != nil {
 		return "", fmt.Errorf("failed to create session: %w", err)
 	}
 	defer session.Close()
 
+	if opts.RequestPTY {
+		modes := ssh.TerminalModes{ssh.ECHO: 0}
+		if err := session.RequestPty("xterm", 80, 200, modes); err != nil {
+			return "", fmt.Errorf("failed to request pty: %w", err)
+		}
+	}
+
 	// Handle context cancellation
 	done := make(chan error, 1)
-	var outputBuf bytes.Buffer
+	outputBuf := syncBuffer{limit: c.maxOutput}
 
+	// The session copies stdout and stderr on separate goroutines
 	session.Stdout = &outputBuf
 	session.Stderr = &outputBuf
+	session.Stdin = opts.Stdin
 
 	go func() {
-		err := session.Run(cmd)
+		err := session.Run(opts.command(cmd))
 		done <- err
 	}()
 
@@ -133,7 +470,12 @@ func (c *Client) Execute(ctx context.Context, cmd string) (string, error) {
 	case err := <-done:
 		output := outputBuf.String()
 		if err != nil {
-			if exitErr, ok := err.(*ssh.ExitError); ok {
+			if !opts.RequestPTY && needsTTY(output) {
+				c.logger.Warn("command appears to require a TTY; set request_pty: true on the step")
+				err = &ttyError{err}
+			}
+			var exitErr *ssh.ExitError
+			if errors.As(err, &exitErr) {
 				// Non-zero exit status
 				return output, fmt.Errorf("command exited with status %d: %w", exitErr.ExitStatus(), err)
 			}
@@ -142,3 +484,164 @@ func (c *Client) Execute(ctx context.Context, cmd string) (string, error) {
 		return output, nil
 	}
 }
+
+// Stream runs cmd, copying its output to w as it arrives instead of
+// collecting it, for long-running commands such as tail -f. The client's
+// command timeout does not apply: it runs until it exits or ctx is done, in
+// which case the remote process is interrupted and ctx.Err() is returned.
+// Stdout and stderr are written from separate goroutines, so w must be safe
+// for concurrent use.
+func (c *Client) Stream(ctx context.Context, cmd string, opts ExecOptions, w io.Writer) error {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	if opts.RequestPTY {
+		modes := ssh.TerminalModes{ssh.ECHO: 0}
+		if err := session.RequestPty("xterm", 80, 200, modes); err != nil {
+			return fmt.Errorf("failed to request pty: %w", err)
+		}
+	}
+
+	session.Stdout = w
+	session.Stderr = w
+	if err := session.Start(opts.command(cmd)); err != nil {
+		return fmt.Errorf("failed to run command: %w", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		if err := session.Signal(ssh.SIGINT); err != nil {
+			c.logger.Warn("failed to send interrupt signal to remote process", slog.String("error", err.Error()))
+		}
+		// Closing the channel ends the session even when the server ignores
+		// signals; waiting for it means nothing is written to w after return
+		session.Close()
+		<-done
+		return ctx.Err()
+	case err := <-done:
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("command exited with status %d: %w", exitErr.ExitStatus(), err)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to run command: %w", err)
+		}
+		return nil
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes. With a positive
+// limit it keeps only the first and last limit/2 bytes written, so a command
+// that floods its output can't exhaust memory, and String marks the gap.
+type syncBuffer struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	limit int
+
+	tail    []byte // Output past the first limit/2 bytes, trimmed lazily
+	written int
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit <= 0 {
+		return b.buf.Write(p)
+	}
+
+	n := len(p)
+	b.written += n
+	if room := b.limit/2 - b.buf.Len(); room > 0 {
+		take := min(room, len(p))
+		b.buf.Write(p[:take])
+		p = p[take:]
+	}
+
+	// Trim only once the tail has doubled so trimming stays cheap
+	b.tail = append(b.tail, p...)
+	if keep := b.limit / 2; len(b.tail) > 2*keep {
+		b.tail = append([]byte(nil), b.tail[len(b.tail)-keep:]...)
+	}
+	return n, nil
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit <= 0 {
+		return b.buf.String()
+	}
+
+	tail := b.tail
+	if keep := b.limit / 2; len(tail) > keep {
+		tail = tail[len(tail)-keep:]
+	}
+	omitted := b.written - b.buf.Len() - len(tail)
+	if omitted == 0 {
+		return b.buf.String() + string(tail)
+	}
+	return fmt.Sprintf("%s\n[... output truncated: %d bytes omitted ...]\n%s", b.buf.String(), omitted, tail)
+}
+
+// BatchResult is the outcome of one command run by ExecuteBatch
+type BatchResult struct {
+	Command string
+	Output  string
+	Err     error
+}
+
+// ExecuteBatch runs cmds in order over the client's connection, stopping at
+// the first failure. It returns a result for every command that ran and the
+// error of the one that failed, if any.
+func (c *Client) ExecuteBatch(ctx context.Context, cmds []string, opts ExecOptions) ([]BatchResult, error) {
+	results := make([]BatchResult, 0, len(cmds))
+	for i, cmd := range cmds {
+		output, err := c.ExecuteWith(ctx, cmd, opts)
+		results = append(results, BatchResult{Command: cmd, Output: output, Err: err})
+		if err != nil {
+			return results, fmt.Errorf("command %d of %d failed: %w", i+1, len(cmds), err)
+		}
+	}
+	return results, nil
+}
+
+// ExitStatus returns the remote exit status carried by an error from
+// Execute, if the command ran and exited non-zero. Transports other than
+// SSH report exit statuses the same way, with an error that has an
+// ExitStatus method.
+func ExitStatus(err error) (int, bool) {
+	var exitErr interface{ ExitStatus() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), true
+	}
+	return 0, false
+}
+
+// ttyError adds a hint to failures from commands that needed a TTY
+type ttyError struct {
+	err error
+}
+
+func (e *ttyError) Error() string {
+	return e.err.Error() + " (hint: the command needs a TTY, set request_pty: true)"
+}
+
+func (e *ttyError) Unwrap() error { return e.err }
+
+func needsTTY(output string) bool {
+	lower := strings.ToLower(output)
+	for _, msg := range ttyErrors {
+		if strings.Contains(lower, msg) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,657 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"orchid/internal/config"
+	"orchid/internal/ssh/sshtest"
+)
+
+// testClient connects to a new test server running handler
+func testClient(t *testing.T, handler sshtest.Handler, defaults config.SSHDefaults) *Client {
+	t.Helper()
+
+	key, pub := sshtest.ClientKey(t)
+	server := sshtest.NewServer(t, handler, pub)
+
+	m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{ConnectAttempts: 1})
+	t.Cleanup(m.CloseAll)
+
+	defaults.Key = key
+	client, err := m.GetClient(context.Background(), config.Host{Hostname: server.Addr}, defaults)
+	if err != nil {
+		t.Fatalf("GetClient: %v", err)
+	}
+	return client
+}
+
+func TestExecuteExitStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantErr    bool
+		wantStatus int
+	}{
+		{name: "success", status: 0},
+		{name: "failure", status: 1, wantErr: true, wantStatus: 1},
+		{name: "other status", status: 42, wantErr: true, wantStatus: 42},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := testClient(t, func(cmd string, stdout, stderr io.Writer) int {
+				fmt.Fprintf(stdout, "ran %s\n", cmd)
+				return tt.status
+			}, config.SSHDefaults{})
+
+			output, err := client.Execute(context.Background(), "deploy")
+			if output != "ran deploy\n" {
+				t.Errorf("output = %q, want %q", output, "ran deploy\n")
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("err = %v, want nil", err)
+				}
+				return
+			}
+			status, ok := ExitStatus(err)
+			if !ok || status != tt.wantStatus {
+				t.Errorf("ExitStatus(%v) = %d, %v, want %d, true", err, status, ok, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestExecuteShell(t *testing.T) {
+	tests := []struct {
+		name  string
+		shell string
+		cmd   string
+		want  string
+	}{
+		{name: "no shell", cmd: "systemctl start api", want: "systemctl start api"},
+		{name: "shell", shell: "bash -l", cmd: "systemctl start api", want: "bash -l -c 'systemctl start api'"},
+		{name: "quotes", shell: "bash -l", cmd: `echo "it's" $HOME`, want: `bash -l -c 'echo "it'\''s" $HOME'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ran []string
+			client := testClient(t, func(cmd string, stdout, stderr io.Writer) int {
+				mu.Lock()
+				defer mu.Unlock()
+				ran = append(ran, cmd)
+				return 0
+			}, config.SSHDefaults{})
+
+			opts := ExecOptions{Shell: tt.shell}
+			if _, err := client.ExecuteWith(context.Background(), tt.cmd, opts); err != nil {
+				t.Fatalf("ExecuteWith: %v", err)
+			}
+			if err := client.Stream(context.Background(), tt.cmd, opts, io.Discard); err != nil {
+				t.Fatalf("Stream: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if want := []string{tt.want, tt.want}; !slices.Equal(ran, want) {
+				t.Errorf("server ran %q, want %q", ran, want)
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	// A quoted word reaches the command unchanged through a real shell
+	for _, s := range []string{"plain", "two words", `it's`, `'`, `$HOME "x" \ ;|&`, ""} {
+		out, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(s)).Output()
+		if err != nil {
+			t.Fatalf("sh: %v", err)
+		}
+		if string(out) != s {
+			t.Errorf("ShellQuote(%q) came through the shell as %q", s, out)
+		}
+	}
+}
+
+func TestExecuteCollectsStderr(t *testing.T) {
+	client := testClient(t, func(cmd string, stdout, stderr io.Writer) int {
+		fmt.Fprint(stderr, "disk full")
+		return 1
+	}, config.SSHDefaults{})
+
+	output, err := client.Execute(context.Background(), "deploy")
+	if err == nil {
+		t.Fatal("err = nil, want the command's failure")
+	}
+	if output != "disk full" {
+		t.Errorf("output = %q, want the command's stderr", output)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	release := make(chan struct{})
+	client := testClient(t, func(cmd string, stdout, stderr io.Writer) int {
+		<-release
+		return 0
+	}, config.SSHDefaults{Timeout: 100 * time.Millisecond})
+	// Registered after the server, so it runs first and lets it shut down
+	t.Cleanup(func() { close(release) })
+
+	start := time.Now()
+	_, err := client.Execute(context.Background(), "sleep 3600")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Execute took %v to time out", elapsed)
+	}
+}
+
+func TestExecuteTruncatesOutput(t *testing.T) {
+	client := testClient(t, func(cmd string, stdout, stderr io.Writer) int {
+		fmt.Fprint(stdout, "start"+strings.Repeat("x", 1<<20)+"end")
+		return 0
+	}, config.SSHDefaults{})
+	client.maxOutput = 1024
+
+	output, err := client.Execute(context.Background(), "deploy")
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if !strings.HasPrefix(output, "start") || !strings.HasSuffix(output, "end") {
+		t.Errorf("output should keep its beginning and end, got %q...%q", output[:10], output[len(output)-10:])
+	}
+	if !strings.Contains(output, "output truncated") || len(output) > 2048 {
+		t.Errorf("output of %d bytes was not truncated", len(output))
+	}
+}
+
+func TestGetClientDoesNotBlockOtherHosts(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	server := sshtest.NewServer(t, func(cmd string, stdout, stderr io.Writer) int { return 0 }, pub)
+
+	// Lookups of the unreachable host hang until their context ends
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host == "unreachable.test" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []string{host}, nil
+	}
+	t.Cleanup(func() { lookupHost = net.DefaultResolver.LookupHost })
+
+	m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{ConnectAttempts: 1})
+	t.Cleanup(m.CloseAll)
+	defaults := config.SSHDefaults{Key: key, ConnectTimeout: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	blocked := make(chan error)
+	go func() {
+		_, err := m.GetClient(ctx, config.Host{Hostname: "unreachable.test"}, defaults)
+		blocked <- err
+	}()
+
+	if _, err := m.GetClient(context.Background(), config.Host{Hostname: server.Addr}, defaults); err != nil {
+		t.Fatalf("GetClient for a reachable host: %v", err)
+	}
+
+	cancel()
+	select {
+	case err := <-blocked:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetClient ignored its context being cancelled")
+	}
+}
+
+func TestGetClientTriesEveryAddress(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	server := sshtest.NewServer(t, func(cmd string, stdout, stderr io.Writer) int { return 0 }, pub)
+	ip, portStr, _ := net.SplitHostPort(server.Addr)
+	port, _ := strconv.Atoi(portStr)
+
+	tests := []struct {
+		name    string
+		lookup  func(ctx context.Context) ([]string, error)
+		wantErr string
+	}{
+		{
+			// Nothing listens on 127.0.0.2, so it refuses the connection
+			name:   "first address refuses",
+			lookup: func(ctx context.Context) ([]string, error) { return []string{"127.0.0.2", ip}, nil },
+		},
+		{
+			name:    "every address refuses",
+			lookup:  func(ctx context.Context) ([]string, error) { return []string{"127.0.0.2", "127.0.0.3"}, nil },
+			wantErr: "none of the 2 addresses of rr.test accepted a connection",
+		},
+		{
+			// A slow lookup leaves no time to dial
+			name: "lookup uses up the connect timeout",
+			lookup: func(ctx context.Context) ([]string, error) {
+				time.Sleep(300 * time.Millisecond)
+				return []string{ip}, nil
+			},
+			wantErr: "dial",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookupHost = func(ctx context.Context, host string) ([]string, error) {
+				if host != "rr.test" {
+					return nil, fmt.Errorf("unexpected lookup of %s", host)
+				}
+				return tt.lookup(ctx)
+			}
+			t.Cleanup(func() { lookupHost = net.DefaultResolver.LookupHost })
+
+			var logs bytes.Buffer
+			m := NewManager(slog.New(slog.NewTextHandler(&logs, nil)), ManagerOptions{HostKeyChecking: HostKeyIgnore, ConnectAttempts: 1})
+			t.Cleanup(m.CloseAll)
+			defaults := config.SSHDefaults{Key: key, ConnectTimeout: 200 * time.Millisecond}
+
+			_, err := m.GetClient(context.Background(), config.Host{Hostname: "rr.test", Port: port}, defaults)
+			if tt.wantErr != "" {
+				var connErr *ConnectError
+				if !errors.As(err, &connErr) || connErr.Phase != PhaseDial || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want a dial failure containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetClient: %v", err)
+			}
+			if !strings.Contains(logs.String(), "address="+ip) || !strings.Contains(logs.String(), "connected to one of several addresses") {
+				t.Errorf("logs = %s, want the address that accepted the connection", logs.String())
+			}
+		})
+	}
+}
+
+func TestGetClientSharesConnection(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	server := sshtest.NewServer(t, func(cmd string, stdout, stderr io.Writer) int { return 0 }, pub)
+
+	m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{ConnectAttempts: 1})
+	t.Cleanup(m.CloseAll)
+	host := config.Host{Hostname: server.Addr}
+	defaults := config.SSHDefaults{Key: key}
+
+	clients := make(chan *Client, 10)
+	for i := 0; i < cap(clients); i++ {
+		go func() {
+			client, err := m.GetClient(context.Background(), host, defaults)
+			if err != nil {
+				t.Errorf("GetClient: %v", err)
+			}
+			clients <- client
+		}()
+	}
+
+	first := <-clients
+	for i := 1; i < cap(clients); i++ {
+		if client := <-clients; client != first {
+			t.Fatal("concurrent GetClient calls for the same host made separate connections")
+		}
+	}
+}
+
+func TestGetClientPerUser(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	server := sshtest.NewServer(t, func(cmd string, stdout, stderr io.Writer) int { return 0 }, pub)
+
+	m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{ConnectAttempts: 1})
+	t.Cleanup(m.CloseAll)
+	defaults := config.SSHDefaults{User: "deploy", Key: key}
+
+	clients := make(map[string]*Client)
+	for _, user := range []string{"", "monitor", ""} {
+		client, err := m.GetClient(context.Background(), config.Host{Hostname: server.Addr, SSHUser: user}, defaults)
+		if err != nil {
+			t.Fatalf("GetClient as %q: %v", user, err)
+		}
+		if prev, ok := clients[user]; ok && prev != client {
+			t.Errorf("GetClient as %q made a second connection", user)
+		}
+		clients[user] = client
+		if _, err := client.Execute(context.Background(), "whoami"); err != nil {
+			t.Fatalf("Execute: %v", err)
+		}
+	}
+	if clients[""] == clients["monitor"] {
+		t.Fatal("different users on the same host shared a connection")
+	}
+
+	var users []string
+	for _, c := range server.Commands() {
+		users = append(users, c.User)
+	}
+	if want := []string{"deploy", "monitor", "deploy"}; !slices.Equal(users, want) {
+		t.Errorf("commands ran as %q, want %q", users, want)
+	}
+}
+
+func TestRequestPTY(t *testing.T) {
+	tests := []struct {
+		name     string
+		pty      bool
+		output   string
+		wantHint bool
+	}{
+		{name: "requested", pty: true},
+		{name: "not requested"},
+		{name: "hint when a tty is needed", output: "sudo: sorry, you must have a tty to run sudo", wantHint: true},
+		{name: "no hint when requested", pty: true, output: "sudo: sorry, you must have a tty to run sudo"},
+		{name: "no hint for other failures", output: "permission denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, pub := sshtest.ClientKey(t)
+			server := sshtest.NewServer(t, func(cmd string, stdout, stderr io.Writer) int {
+				if tt.output == "" {
+					return 0
+				}
+				fmt.Fprintln(stderr, tt.output)
+				return 1
+			}, pub)
+			m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{ConnectAttempts: 1})
+			t.Cleanup(m.CloseAll)
+			client, err := m.GetClient(context.Background(), config.Host{Hostname: server.Addr}, config.SSHDefaults{Key: key})
+			if err != nil {
+				t.Fatalf("GetClient: %v", err)
+			}
+
+			_, err = client.ExecuteWith(context.Background(), "sudo systemctl stop api", ExecOptions{RequestPTY: tt.pty})
+			if (err != nil) != (tt.output != "") {
+				t.Fatalf("err = %v", err)
+			}
+			if hint := err != nil && strings.Contains(err.Error(), "request_pty: true"); hint != tt.wantHint {
+				t.Errorf("err = %v, want hint %t", err, tt.wantHint)
+			}
+			if cmds := server.Commands(); len(cmds) != 1 || cmds[0].PTY != tt.pty {
+				t.Errorf("commands = %+v, want one with PTY %t", cmds, tt.pty)
+			}
+		})
+	}
+}
+
+func TestServersRecordCommandOrder(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	ok := func(cmd string, stdout, stderr io.Writer) int { return 0 }
+	web1 := sshtest.NewServer(t, ok, pub)
+	web2 := sshtest.NewServer(t, ok, pub)
+
+	m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{ConnectAttempts: 1})
+	t.Cleanup(m.CloseAll)
+	defaults := config.SSHDefaults{Key: key}
+
+	run := []struct {
+		server *sshtest.Server
+		cmd    string
+	}{
+		{web1, "start web"},
+		{web2, "start web"},
+		{web1, "check web"},
+		{web2, "check web"},
+	}
+	for _, r := range run {
+		client, err := m.GetClient(context.Background(), config.Host{Hostname: r.server.Addr}, defaults)
+		if err != nil {
+			t.Fatalf("GetClient: %v", err)
+		}
+		if _, err := client.Execute(context.Background(), r.cmd); err != nil {
+			t.Fatalf("Execute %q: %v", r.cmd, err)
+		}
+	}
+
+	for _, server := range []*sshtest.Server{web1, web2} {
+		var got []string
+		for _, c := range server.Commands() {
+			got = append(got, c.Cmd)
+		}
+		if want := []string{"start web", "check web"}; !slices.Equal(got, want) {
+			t.Errorf("%s received %q, want %q", server.Addr, got, want)
+		}
+	}
+
+	interleaved := sshtest.Interleaved(web1, web2)
+	if len(interleaved) != len(run) {
+		t.Fatalf("interleaved = %+v, want %d commands", interleaved, len(run))
+	}
+	for i, c := range interleaved {
+		if c.Addr != run[i].server.Addr || c.Cmd != run[i].cmd {
+			t.Errorf("command %d = %s on %s, want %s on %s", i, c.Cmd, c.Addr, run[i].cmd, run[i].server.Addr)
+		}
+	}
+}
+
+// stalledListener accepts connections and never answers them, like a host
+// whose SSH daemon is hung
+func stalledListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestHandshakeUsesConnectTimeout(t *testing.T) {
+	key, _ := sshtest.ClientKey(t)
+	addr := stalledListener(t)
+
+	m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{ConnectAttempts: 1})
+	t.Cleanup(m.CloseAll)
+
+	// The command timeout is far longer than the test, so only the connect
+	// timeout can end the handshake
+	defaults := config.SSHDefaults{Key: key, ConnectTimeout: 200 * time.Millisecond, Timeout: time.Hour}
+	start := time.Now()
+	_, err := m.GetClient(context.Background(), config.Host{Hostname: addr}, defaults)
+
+	var connErr *ConnectError
+	if !errors.As(err, &connErr) || connErr.Phase != PhaseHandshake {
+		t.Fatalf("err = %v, want a handshake failure", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("handshake gave up after %s, want the 200ms connect timeout", elapsed)
+	}
+}
+
+func TestHandshakeStopsWhenCancelled(t *testing.T) {
+	key, _ := sshtest.ClientKey(t)
+	addr := stalledListener(t)
+
+	m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{ConnectAttempts: 1})
+	t.Cleanup(m.CloseAll)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() {
+		_, err := m.GetClient(ctx, config.Host{Hostname: addr}, config.SSHDefaults{Key: key, ConnectTimeout: time.Hour})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the handshake ignored its context being cancelled")
+	}
+}
+
+func TestExecuteBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmds    []string
+		wantRan []string
+		wantErr string
+	}{
+		{name: "in order", cmds: []string{"pre", "main", "post"}, wantRan: []string{"pre", "main", "post"}},
+		{name: "stops at the first failure", cmds: []string{"pre", "fail", "post"}, wantRan: []string{"pre", "fail"}, wantErr: "command 2 of 3 failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ran []string
+			client := testClient(t, func(cmd string, stdout, stderr io.Writer) int {
+				mu.Lock()
+				ran = append(ran, cmd)
+				mu.Unlock()
+				fmt.Fprintf(stdout, "ran %s", cmd)
+				if cmd == "fail" {
+					return 3
+				}
+				return 0
+			}, config.SSHDefaults{})
+
+			results, err := client.ExecuteBatch(context.Background(), tt.cmds, ExecOptions{})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if err != nil {
+				if status, ok := ExitStatus(err); !ok || status != 3 {
+					t.Errorf("ExitStatus(%v) = %d, %t, want the failed command's status", err, status, ok)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(ran, tt.wantRan) {
+				t.Errorf("ran %q, want %q", ran, tt.wantRan)
+			}
+			if len(results) != len(tt.wantRan) {
+				t.Fatalf("got %d results, want %d", len(results), len(tt.wantRan))
+			}
+			for i, r := range results {
+				if r.Command != tt.wantRan[i] || r.Output != "ran "+r.Command {
+					t.Errorf("result %d = %q, %q", i, r.Command, r.Output)
+				}
+				if (r.Err != nil) != (r.Command == "fail") {
+					t.Errorf("result %d err = %v", i, r.Err)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	valid, _ := sshtest.ClientKey(t)
+	dir := t.TempDir()
+	unreadable := filepath.Join(dir, "unreadable")
+	if err := os.WriteFile(unreadable, []byte("key"), 0o000); err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage")
+	if err := os.WriteFile(garbage, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{name: "valid", path: valid},
+		{name: "missing", path: filepath.Join(dir, "missing"), wantErr: "SSH key '" + filepath.Join(dir, "missing") + "' does not exist"},
+		{name: "unreadable", path: unreadable, wantErr: "SSH key '" + unreadable + "' is not readable by this user"},
+		{name: "not a key", path: garbage, wantErr: "failed to parse SSH key '" + garbage + "'"},
+		{name: "unset", wantErr: "no SSH key configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "unreadable" && os.Geteuid() == 0 {
+				t.Skip("root can read files regardless of their permissions")
+			}
+			err := CheckKey(tt.path)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddress(t *testing.T) {
+	tests := []struct {
+		hostname string
+		port     int
+		want     string
+	}{
+		{hostname: "app1.example.com", want: "app1.example.com:22"},
+		{hostname: "app1.example.com", port: 2222, want: "app1.example.com:2222"},
+		{hostname: "app1.example.com:2200", want: "app1.example.com:2200"},
+		{hostname: "::1", port: 2222, want: "[::1]:2222"},
+	}
+	for _, tt := range tests {
+		if got := address(tt.hostname, tt.port); got != tt.want {
+			t.Errorf("address(%q, %d) = %q, want %q", tt.hostname, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestGetClientCustomPort(t *testing.T) {
+	key, pub := sshtest.ClientKey(t)
+	ok := func(cmd string, stdout, stderr io.Writer) int { return 0 }
+	servers := []*sshtest.Server{sshtest.NewServer(t, ok, pub), sshtest.NewServer(t, ok, pub)}
+
+	m := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), ManagerOptions{HostKeyChecking: HostKeyIgnore, ConnectAttempts: 1})
+	t.Cleanup(m.CloseAll)
+	defaults := config.SSHDefaults{Key: key}
+
+	// The same hostname on different ports gets a connection to each
+	var clients []*Client
+	for i, server := range servers {
+		hostname, portStr, _ := net.SplitHostPort(server.Addr)
+		port, _ := strconv.Atoi(portStr)
+		client, err := m.GetClient(context.Background(), config.Host{Hostname: hostname, Port: port}, defaults)
+		if err != nil {
+			t.Fatalf("GetClient on port %d: %v", port, err)
+		}
+		if _, err := client.Execute(context.Background(), fmt.Sprintf("server %d", i)); err != nil {
+			t.Fatalf("Execute: %v", err)
+		}
+		clients = append(clients, client)
+	}
+	if clients[0] == clients[1] {
+		t.Fatal("hosts on different ports shared a connection")
+	}
+	for i, server := range servers {
+		var cmds []string
+		for _, c := range server.Commands() {
+			cmds = append(cmds, c.Cmd)
+		}
+		if want := []string{fmt.Sprintf("server %d", i)}; !slices.Equal(cmds, want) {
+			t.Errorf("server %d ran %q, want %q", i, cmds, want)
+		}
+	}
+}
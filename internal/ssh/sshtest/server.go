@@ -0,0 +1,264 @@
+// Package sshtest provides an in-process SSH server for exercising the ssh
+// package against real connections, in the spirit of net/http/httptest. It
+// is meant for tests only.
+package sshtest
+
+import (
+	"cmp"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Handler runs a command received by the server, writing its output to
+// stdout and stderr, and returns the command's exit status
+type Handler func(cmd string, stdout, stderr io.Writer) int
+
+// Command is a command a server received. Seq orders commands across every
+// server in the process, so tests can check how hosts interleaved.
+type Command struct {
+	Seq  uint64
+	Addr string // Addr of the server that received the command
+	User string // User the client authenticated as
+	Cmd  string
+	PTY  bool // Whether the session requested a pseudo-terminal
+}
+
+// seq numbers commands in the order servers receive them
+var seq atomic.Uint64
+
+// Server is an SSH server listening on a loopback address. It accepts exec
+// requests only and hands each command to its Handler.
+type Server struct {
+	// Addr is the host:port the server listens on, usable as a hostname
+	Addr string
+
+	// HostKey is the server's public host key, for known_hosts checks
+	HostKey ssh.PublicKey
+
+	handler  Handler
+	config   *ssh.ServerConfig
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
+	commands []Command
+}
+
+// NewServer starts a server that runs commands with handler, failing tb if
+// it cannot start and closing it when tb's test finishes. Clients may
+// authenticate with any of the authorized keys, or with any key at all when
+// none are given.
+func NewServer(tb testing.TB, handler Handler, authorized ...ssh.PublicKey) *Server {
+	tb.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatalf("sshtest: failed to generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		tb.Fatalf("sshtest: failed to create host key signer: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if len(authorized) == 0 {
+				return nil, nil
+			}
+			for _, k := range authorized {
+				if string(k.Marshal()) == string(key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("unauthorized key for %s", ssh.FingerprintSHA256(key))
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("sshtest: failed to listen: %v", err)
+	}
+
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		HostKey:  signer.PublicKey(),
+		handler:  handler,
+		config:   config,
+		listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// ClientKey writes a new private key to a file in tb's temporary directory
+// for clients to authenticate with, returning its path and public key
+func ClientKey(tb testing.TB) (string, ssh.PublicKey) {
+	tb.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatalf("sshtest: failed to generate client key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		tb.Fatalf("sshtest: failed to encode client key: %v", err)
+	}
+	path := filepath.Join(tb.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		tb.Fatalf("sshtest: failed to write client key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		tb.Fatalf("sshtest: failed to encode client public key: %v", err)
+	}
+	return path, key
+}
+
+// Commands returns the commands the server has received, in the order they
+// arrived
+func (s *Server) Commands() []Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.commands)
+}
+
+// Interleaved returns the commands received by all of servers, in the order
+// they arrived
+func Interleaved(servers ...*Server) []Command {
+	var all []Command
+	for _, s := range servers {
+		all = append(all, s.Commands()...)
+	}
+	slices.SortFunc(all, func(a, b Command) int { return cmp.Compare(a.Seq, b.Seq) })
+	return all
+}
+
+// Close stops the server and drops every open connection. It may be called
+// more than once.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	s.listener.Close()
+	s.CloseConnections()
+	s.wg.Wait()
+}
+
+// CloseConnections drops every open connection while leaving the server
+// listening, to simulate a host that restarted or a broken network path
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(sconn.User(), channel, requests)
+	}
+}
+
+func (s *Server) handleSession(user string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	var pty bool
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			pty = true
+			req.Reply(true, nil)
+		case "env":
+			req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			s.mu.Lock()
+			s.commands = append(s.commands, Command{Seq: seq.Add(1), Addr: s.Addr, User: user, Cmd: payload.Command, PTY: pty})
+			s.mu.Unlock()
+
+			status := s.handler(payload.Command, channel, channel.Stderr())
+			exit := make([]byte, 4)
+			binary.BigEndian.PutUint32(exit, uint32(status))
+			channel.SendRequest("exit-status", false, exit)
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Package trace keeps a JSON-lines transcript of every remote command orchid
+// runs, with its output, exit status and timing, for post-mortems.
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// Entry describes a single command run on a host
+type Entry struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Host      string        `json:"host"`
+	User      string        `json:"user,omitempty"`
+	Command   string        `json:"command"`
+	Output    string        `json:"output"` // stdout and stderr, interleaved as received
+	ExitCode  *int          `json:"exit_code,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Duration  time.Duration `json:"duration"`
+
+	// Streamed is set for commands such as those of orchid logs whose output
+	// was copied to the terminal as it arrived and is not recorded
+	Streamed bool `json:"streamed,omitempty"`
+}
+
+// Writer appends entries to a transcript file. It is safe for concurrent use
+// and for use by multiple processes at once.
+type Writer struct {
+	path string
+}
+
+func NewWriter(path string) *Writer {
+	return &Writer{path: path}
+}
+
+// Append writes e as a single JSON line, filling in the timestamp when it is
+// not already set
+func (w *Writer) Append(e Entry) error {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode trace entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	// Lock a separate file, since Windows locks block writes to the locked
+	// file through other handles
+	lock := flock.New(w.path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("failed to lock trace file '%s': %w", w.path, err)
+	}
+	defer lock.Unlock()
+
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open trace file '%s': %w", w.path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to write trace file '%s': %w", w.path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	w := NewWriter(path)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			code := i % 2
+			e := Entry{Host: fmt.Sprintf("app%d", i), Command: "check api", Output: "ok\n", ExitCode: &code, Duration: time.Millisecond}
+			if err := w.Append(e); err != nil {
+				t.Errorf("Append: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	hosts := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %q is not an entry: %v", scanner.Text(), err)
+		}
+		if e.Timestamp.IsZero() {
+			t.Errorf("entry for %s has no timestamp", e.Host)
+		}
+		if e.ExitCode == nil || e.Output != "ok\n" || e.Duration != time.Millisecond {
+			t.Errorf("entry = %+v, want the appended fields", e)
+		}
+		hosts[e.Host] = true
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != n {
+		t.Errorf("read entries for %d hosts, want %d", len(hosts), n)
+	}
+}
+
+func TestAppendKeepsTimestamp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := NewWriter(path).Append(Entry{Timestamp: at, Host: "app1", Command: "true"}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Timestamp.Equal(at) {
+		t.Errorf("timestamp = %s, want %s", e.Timestamp, at)
+	}
+}
@@ -0,0 +1,404 @@
+// Package winrm runs commands on Windows hosts with PowerShell over WinRM.
+// It speaks just enough WS-Management to open a remote shell, run one
+// command in it, collect its output and exit code and remove the shell
+// again, authenticating with HTTP basic auth.
+package winrm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"orchid/internal/ssh"
+)
+
+const (
+	DefaultPort      = 5985
+	DefaultHTTPSPort = 5986
+)
+
+// Client runs commands on one host. Each command gets a shell of its own,
+// so a client holds no remote state between commands.
+type Client struct {
+	endpoint string
+	user     string
+	password string
+	http     *http.Client
+}
+
+// Options configures a Client
+type Options struct {
+	// Hostname may include a port; otherwise Port, or the default port for
+	// HTTPS or HTTP, is used
+	Hostname string
+	Port     int
+	User     string
+	Password string
+	HTTPS    bool
+	Insecure bool // Skip verifying the host's certificate
+}
+
+// New returns a client for the host opts describes. No connection is made
+// until the first command.
+func New(opts Options) *Client {
+	scheme, port := "http", DefaultPort
+	if opts.HTTPS {
+		scheme, port = "https", DefaultHTTPSPort
+	}
+	if opts.Port != 0 {
+		port = opts.Port
+	}
+	addr := opts.Hostname
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(port))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &Client{
+		endpoint: scheme + "://" + addr + "/wsman",
+		user:     opts.User,
+		password: opts.Password,
+		http:     &http.Client{Transport: transport},
+	}
+}
+
+// ExitError is returned when a command exits with a non-zero status
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Status)
+}
+
+// ExitStatus reports the command's exit status, as ssh.ExitStatus expects
+func (e *ExitError) ExitStatus() int { return e.Status }
+
+// Close releases the client's idle connections
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+func (c *Client) Execute(ctx context.Context, cmd string) (string, error) {
+	return c.ExecuteWith(ctx, cmd, ssh.ExecOptions{})
+}
+
+// ExecuteWith runs cmd as a PowerShell script, returning its combined
+// output. Only opts.Stdin applies: commands never get a terminal and always
+// run in PowerShell.
+func (c *Client) ExecuteWith(ctx context.Context, cmd string, opts ssh.ExecOptions) (string, error) {
+	var output bytes.Buffer
+	err := c.run(ctx, cmd, opts.Stdin, &output)
+	return output.String(), err
+}
+
+// Stream runs cmd like ExecuteWith, copying its output to w as it arrives
+func (c *Client) Stream(ctx context.Context, cmd string, opts ssh.ExecOptions, w io.Writer) error {
+	return c.run(ctx, cmd, opts.Stdin, w)
+}
+
+// run opens a shell, runs cmd in it and writes its output to w until it
+// exits or ctx is done, then removes the shell
+func (c *Client) run(ctx context.Context, cmd string, stdin io.Reader, w io.Writer) (err error) {
+	shell, err := c.createShell(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create shell: %w", err)
+	}
+	defer func() {
+		// Clean up even when ctx is done, so shells don't pile up on the
+		// host until WinRM times them out
+		if derr := c.deleteShell(context.WithoutCancel(ctx), shell); derr != nil && err == nil {
+			err = fmt.Errorf("failed to delete shell: %w", derr)
+		}
+	}()
+
+	id, err := c.command(ctx, shell, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to run command: %w", err)
+	}
+	if stdin != nil {
+		if err := c.send(ctx, shell, id, stdin); err != nil {
+			return fmt.Errorf("failed to send input: %w", err)
+		}
+	}
+
+	for {
+		done, status, err := c.receive(ctx, shell, id, w)
+		if err != nil {
+			if ctx.Err() != nil {
+				c.terminate(context.WithoutCancel(ctx), shell, id)
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to receive output: %w", err)
+		}
+		if done {
+			if status != 0 {
+				return &ExitError{Status: status}
+			}
+			return nil
+		}
+	}
+}
+
+const (
+	nsSoap  = "http://www.w3.org/2003/05/soap-envelope"
+	nsAddr  = "http://schemas.xmlsoap.org/ws/2004/08/addressing"
+	nsWSMan = "http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd"
+	nsShell = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell"
+
+	resourceCmd = nsShell + "/cmd"
+
+	actionCreate  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	actionDelete  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	actionCommand = nsShell + "/Command"
+	actionSend    = nsShell + "/Send"
+	actionReceive = nsShell + "/Receive"
+	actionSignal  = nsShell + "/Signal"
+
+	stateDone       = nsShell + "/CommandState/Done"
+	signalTerminate = nsShell + "/signal/terminate"
+
+	// faultTimeout is the WS-Management fault a Receive gets when the
+	// command produced no output within the operation timeout; the command
+	// is still running
+	faultTimeout = "2150858793"
+)
+
+func (c *Client) createShell(ctx context.Context) (string, error) {
+	body := `<rsp:Shell xmlns:rsp="` + nsShell + `"><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>`
+	options := `<w:OptionSet><w:Option Name="WINRS_NOPROFILE">TRUE</w:Option><w:Option Name="WINRS_CODEPAGE">65001</w:Option></w:OptionSet>`
+	resp, err := c.post(ctx, actionCreate, "", options, body)
+	if err != nil {
+		return "", err
+	}
+	if id := resp.Body.Shell.ShellID; id != "" {
+		return id, nil
+	}
+	for _, s := range resp.Body.ResourceCreated.Selectors {
+		if s.Name == "ShellId" {
+			return s.Value, nil
+		}
+	}
+	return "", errors.New("response has no shell id")
+}
+
+func (c *Client) deleteShell(ctx context.Context, shell string) error {
+	_, err := c.post(ctx, actionDelete, shell, "", "")
+	return err
+}
+
+// command starts cmd in shell, returning its command id
+func (c *Client) command(ctx context.Context, shell, cmd string) (string, error) {
+	body := `<rsp:CommandLine xmlns:rsp="` + nsShell + `"><rsp:Command>powershell.exe</rsp:Command>` +
+		`<rsp:Arguments>-NoProfile -NonInteractive -EncodedCommand ` + EncodeCommand(cmd) + `</rsp:Arguments></rsp:CommandLine>`
+	options := `<w:OptionSet><w:Option Name="WINRS_CONSOLEMODE_STDIN">TRUE</w:Option></w:OptionSet>`
+	resp, err := c.post(ctx, actionCommand, shell, options, body)
+	if err != nil {
+		return "", err
+	}
+	if resp.Body.CommandResponse.CommandID == "" {
+		return "", errors.New("response has no command id")
+	}
+	return resp.Body.CommandResponse.CommandID, nil
+}
+
+// send sends all of stdin to the command and closes its input
+func (c *Client) send(ctx context.Context, shell, id string, stdin io.Reader) error {
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	body := `<rsp:Send xmlns:rsp="` + nsShell + `"><rsp:Stream Name="stdin" CommandId="` + escape(id) + `" End="true">` +
+		base64.StdEncoding.EncodeToString(data) + `</rsp:Stream></rsp:Send>`
+	_, err = c.post(ctx, actionSend, shell, "", body)
+	return err
+}
+
+// receive writes the output the command produced since the last receive to
+// w, reporting whether it has exited and with which status
+func (c *Client) receive(ctx context.Context, shell, id string, w io.Writer) (done bool, status int, err error) {
+	body := `<rsp:Receive xmlns:rsp="` + nsShell + `"><rsp:DesiredStream CommandId="` + escape(id) + `">stdout stderr</rsp:DesiredStream></rsp:Receive>`
+	resp, err := c.post(ctx, actionReceive, shell, "", body)
+	var fault *Fault
+	if errors.As(err, &fault) && fault.Code == faultTimeout {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	for _, s := range resp.Body.ReceiveResponse.Streams {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s.Data))
+		if err != nil {
+			return false, 0, fmt.Errorf("invalid %s data: %w", s.Name, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return false, 0, err
+		}
+	}
+
+	state := resp.Body.ReceiveResponse.CommandState
+	if state.State != stateDone {
+		return false, 0, nil
+	}
+	if state.ExitCode != "" {
+		if status, err = strconv.Atoi(state.ExitCode); err != nil {
+			return false, 0, fmt.Errorf("invalid exit code %q", state.ExitCode)
+		}
+	}
+	return true, status, nil
+}
+
+// terminate asks the host to stop a command. It is best effort: the shell is
+// deleted afterwards regardless, which also ends the command.
+func (c *Client) terminate(ctx context.Context, shell, id string) {
+	body := `<rsp:Signal xmlns:rsp="` + nsShell + `" CommandId="` + escape(id) + `"><rsp:Code>` + signalTerminate + `</rsp:Code></rsp:Signal>`
+	c.post(ctx, actionSignal, shell, "", body)
+}
+
+// Fault is a SOAP fault returned by the host
+type Fault struct {
+	Code    string // WS-Management error code, if the host gave one
+	Message string
+}
+
+func (f *Fault) Error() string {
+	if f.Code != "" {
+		return fmt.Sprintf("winrm fault %s: %s", f.Code, f.Message)
+	}
+	return "winrm fault: " + f.Message
+}
+
+// response holds the parts of the SOAP responses the client reads
+type response struct {
+	Body struct {
+		Fault *struct {
+			Reason string `xml:"Reason>Text"`
+			Detail struct {
+				Code    string `xml:"Code,attr"`
+				Message string `xml:"Message"`
+			} `xml:"Detail>WSManFault"`
+		} `xml:"Fault"`
+		Shell struct {
+			ShellID string `xml:"ShellId"`
+		} `xml:"Shell"`
+		ResourceCreated struct {
+			Selectors []struct {
+				Name  string `xml:"Name,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"ReferenceParameters>SelectorSet>Selector"`
+		} `xml:"ResourceCreated"`
+		CommandResponse struct {
+			CommandID string `xml:"CommandId"`
+		} `xml:"CommandResponse"`
+		ReceiveResponse struct {
+			Streams []struct {
+				Name string `xml:"Name,attr"`
+				Data string `xml:",chardata"`
+			} `xml:"Stream"`
+			CommandState struct {
+				State    string `xml:"State,attr"`
+				ExitCode string `xml:"ExitCode"`
+			} `xml:"CommandState"`
+		} `xml:"ReceiveResponse"`
+	} `xml:"Body"`
+}
+
+// post sends a WS-Management request for action on shell, if given, and
+// decodes the response. Faults are returned as a *Fault.
+func (c *Client) post(ctx context.Context, action, shell, options, body string) (*response, error) {
+	var selector string
+	if shell != "" {
+		selector = `<w:SelectorSet><w:Selector Name="ShellId">` + escape(shell) + `</w:Selector></w:SelectorSet>`
+	}
+	envelope := `<s:Envelope xmlns:s="` + nsSoap + `" xmlns:a="` + nsAddr + `" xmlns:w="` + nsWSMan + `">` +
+		`<s:Header>` +
+		`<a:To>` + escape(c.endpoint) + `</a:To>` +
+		`<a:ReplyTo><a:Address s:mustUnderstand="true">` + nsAddr + `/role/anonymous</a:Address></a:ReplyTo>` +
+		`<a:Action s:mustUnderstand="true">` + action + `</a:Action>` +
+		`<a:MessageID>uuid:` + messageID() + `</a:MessageID>` +
+		`<w:ResourceURI s:mustUnderstand="true">` + resourceCmd + `</w:ResourceURI>` +
+		`<w:MaxEnvelopeSize s:mustUnderstand="true">153600</w:MaxEnvelopeSize>` +
+		`<w:OperationTimeout>PT20S</w:OperationTimeout>` +
+		selector + options +
+		`</s:Header>` +
+		`<s:Body>` + body + `</s:Body>` +
+		`</s:Envelope>`
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, strings.NewReader(envelope))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.user, c.password)
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Faults come back with a 500 status
+	var resp response
+	xmlErr := xml.Unmarshal(data, &resp)
+	if f := resp.Body.Fault; xmlErr == nil && f != nil {
+		message := strings.TrimSpace(f.Detail.Message)
+		if message == "" {
+			message = strings.TrimSpace(f.Reason)
+		}
+		return nil, &Fault{Code: f.Detail.Code, Message: message}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", res.Status)
+	}
+	if xmlErr != nil {
+		return nil, fmt.Errorf("invalid response: %w", xmlErr)
+	}
+	return &resp, nil
+}
+
+// EncodeCommand encodes a script for powershell -EncodedCommand, which takes
+// base64 of its UTF-16LE text and so needs no quoting
+func EncodeCommand(script string) string {
+	units := utf16.Encode([]rune(script))
+	buf := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(buf[2*i:], u)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// messageID returns a random UUID for a request's MessageID
+func messageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
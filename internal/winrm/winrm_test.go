@@ -0,0 +1,221 @@
+package winrm
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"orchid/internal/ssh"
+)
+
+// fakeHost is a WinRM endpoint that runs scripts by looking them up in
+// scripts, answering the first receive of each command with the timeout
+// fault a real host sends while a command is still running
+type fakeHost struct {
+	scripts map[string]fakeScript
+
+	mu       sync.Mutex
+	actions  []string          // Actions requested, by last path element
+	commands map[string]string // Scripts started, by command id
+	stdin    string
+	shells   int // Shells open
+	pending  bool
+}
+
+type fakeScript struct {
+	output string
+	status int
+	hang   bool // Never finish
+}
+
+var (
+	actionPattern  = regexp.MustCompile(`<a:Action[^>]*>([^<]+)</a:Action>`)
+	encodedPattern = regexp.MustCompile(`-EncodedCommand (\S+)</rsp:Arguments>`)
+	streamPattern  = regexp.MustCompile(`<rsp:Stream Name="stdin"[^>]*>([^<]*)</rsp:Stream>`)
+)
+
+func newFakeHost(t *testing.T, scripts map[string]fakeScript) (*fakeHost, *httptest.Server) {
+	t.Helper()
+	f := &fakeHost{scripts: scripts, commands: make(map[string]string)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	m := actionPattern.FindSubmatch(body)
+	if m == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	action := string(m[1])
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.actions = append(f.actions, action[strings.LastIndex(action, "/")+1:])
+
+	w.Header().Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	switch action {
+	case actionCreate:
+		f.shells++
+		respond(w, `<rsp:Shell><rsp:ShellId>shell-1</rsp:ShellId></rsp:Shell>`)
+	case actionDelete:
+		f.shells--
+		respond(w, ``)
+	case actionCommand:
+		id := fmt.Sprintf("command-%d", len(f.commands)+1)
+		f.commands[id] = decodeCommand(string(encodedPattern.FindSubmatch(body)[1]))
+		f.pending = true
+		respond(w, `<rsp:CommandResponse><rsp:CommandId>`+id+`</rsp:CommandId></rsp:CommandResponse>`)
+	case actionSend:
+		data, _ := base64.StdEncoding.DecodeString(string(streamPattern.FindSubmatch(body)[1]))
+		f.stdin = string(data)
+		respond(w, `<rsp:SendResponse/>`)
+	case actionSignal:
+		respond(w, `<rsp:SignalResponse/>`)
+	case actionReceive:
+		id := regexp.MustCompile(`CommandId="([^"]*)"`).FindSubmatch(body)[1]
+		script, ok := f.scripts[f.commands[string(id)]]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if f.pending || script.hang {
+			f.pending = false
+			w.WriteHeader(http.StatusInternalServerError)
+			respond(w, `<s:Fault><s:Code><s:Value>s:Receiver</s:Value></s:Code><s:Reason><s:Text>timed out</s:Text></s:Reason>`+
+				`<s:Detail><f:WSManFault xmlns:f="http://schemas.microsoft.com/wbem/wsman/1/wsmanfault" Code="2150858793"><f:Message>The operation timed out</f:Message></f:WSManFault></s:Detail></s:Fault>`)
+			return
+		}
+		respond(w, fmt.Sprintf(`<rsp:ReceiveResponse>`+
+			`<rsp:Stream Name="stdout" CommandId="%[1]s">%[2]s</rsp:Stream>`+
+			`<rsp:CommandState CommandId="%[1]s" State="%[3]s"><rsp:ExitCode>%[4]d</rsp:ExitCode></rsp:CommandState>`+
+			`</rsp:ReceiveResponse>`, id, base64.StdEncoding.EncodeToString([]byte(script.output)), stateDone, script.status))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func respond(w io.Writer, body string) {
+	fmt.Fprintf(w, `<s:Envelope xmlns:s="%s" xmlns:rsp="%s"><s:Body>%s</s:Body></s:Envelope>`, nsSoap, nsShell, body)
+}
+
+// decodeCommand reverses EncodeCommand
+func decodeCommand(encoded string) string {
+	data, _ := base64.StdEncoding.DecodeString(encoded)
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+	}
+	return string(utf16.Decode(units))
+}
+
+func (f *fakeHost) requested() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.actions...)
+}
+
+func testClient(server *httptest.Server, password string) *Client {
+	return New(Options{Hostname: strings.TrimPrefix(server.URL, "http://"), User: "admin", Password: password})
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		password   string
+		wantOutput string
+		wantStatus int
+		wantErr    string
+	}{
+		{name: "success", script: "Write-Output 'héllo'", wantOutput: "héllo\r\n"},
+		{name: "non-zero exit", script: "exit 3", wantOutput: "failing\r\n", wantStatus: 3, wantErr: "command exited with status 3"},
+		{name: "wrong password", script: "exit 0", password: "guess", wantErr: "401 Unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, server := newFakeHost(t, map[string]fakeScript{
+				"Write-Output 'héllo'": {output: "héllo\r\n"},
+				"exit 3":               {output: "failing\r\n", status: 3},
+			})
+			password := tt.password
+			if password == "" {
+				password = "secret"
+			}
+			client := testClient(server, password)
+			defer client.Close()
+
+			output, err := client.Execute(context.Background(), tt.script)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if output != tt.wantOutput {
+				t.Errorf("output = %q, want %q", output, tt.wantOutput)
+			}
+			if status, ok := ssh.ExitStatus(err); tt.wantStatus != 0 && (!ok || status != tt.wantStatus) {
+				t.Errorf("ExitStatus(%v) = %d, %t, want %d", err, status, ok, tt.wantStatus)
+			}
+			if tt.password == "" {
+				want := []string{"Create", "Command", "Receive", "Receive", "Delete"}
+				if got := f.requested(); strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Errorf("requests = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExecuteSendsStdin(t *testing.T) {
+	f, server := newFakeHost(t, map[string]fakeScript{"$input": {}})
+	client := testClient(server, "secret")
+
+	if _, err := client.ExecuteWith(context.Background(), "$input", ssh.ExecOptions{Stdin: strings.NewReader("line one\n")}); err != nil {
+		t.Fatalf("ExecuteWith: %v", err)
+	}
+	if f.stdin != "line one\n" {
+		t.Errorf("stdin = %q, want %q", f.stdin, "line one\n")
+	}
+}
+
+func TestExecuteCancelled(t *testing.T) {
+	f, server := newFakeHost(t, map[string]fakeScript{"Start-Sleep 3600": {hang: true}})
+	client := testClient(server, "secret")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.Execute(ctx, "Start-Sleep 3600")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	got := f.requested()
+	if n := len(got); n < 2 || got[n-2] != "Signal" || got[n-1] != "Delete" {
+		t.Errorf("requests = %q, want the command terminated and its shell deleted", got)
+	}
+	if f.shells != 0 {
+		t.Errorf("%d shells left open", f.shells)
+	}
+}
+
+func TestEncodeCommand(t *testing.T) {
+	// As printed by [Convert]::ToBase64String([Text.Encoding]::Unicode.GetBytes('dir'))
+	if got := EncodeCommand("dir"); got != "ZABpAHIA" {
+		t.Errorf("EncodeCommand(dir) = %q, want %q", got, "ZABpAHIA")
+	}
+}
@@ -2,12 +2,29 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"orchid/internal/audit"
+	"orchid/internal/ci"
 	"orchid/internal/config"
+	"orchid/internal/graph"
+	"orchid/internal/logrotate"
 	"orchid/internal/orchestrator"
+	"orchid/internal/progress"
+	"orchid/internal/redact"
+	"orchid/internal/ssh"
+	"orchid/internal/trace"
 
 	"log/slog"
 
@@ -15,103 +32,992 @@ import (
 )
 
 func main() {
+	rootCmd := newRootCmd()
+	if err := rootCmd.Execute(); err != nil {
+		env, _ := rootCmd.PersistentFlags().GetString("environment")
+		jsonOut, _ := rootCmd.PersistentFlags().GetBool("json")
+		os.Exit(reportError(os.Stdout, os.Stderr, err, env, jsonOut))
+	}
+}
+
+// newRootCmd returns the orchid command with all of its subcommands
+func newRootCmd() *cobra.Command {
 	var (
 		cfgFile          string
 		env              string
 		force            bool
 		dryRun           bool
+		validateRemote   bool
 		handleDeps       bool
 		stopDeps         bool
+		noRollback       bool
+		rollbackParallel int
+		rollbackScope    string
+		connectAttempts  int
+		maxOutput        int
+		lenientDeps      bool
+		keepRunningDeps  bool
+		explain          bool
 		healthCheckWait  time.Duration
 		healthCheckRetry time.Duration
 		operationTimeout time.Duration
 		logLevel         string
 		jsonLog          bool
+		quiet            bool
+		ciFormat         string
+		tui              bool
+		auditFile        string
+		tags             []string
+		allTags          bool
+		execStep         string
+		execAllHosts     bool
+		logsStep         string
+		stateDir         string
+		freezeReason     string
+		abortReason      string
+		graphFormat      string
+		planOut          string
+		reportOut        string
+		failOnWarn       bool
+		traceFile        string
+		planIn           string
+		ensure           bool
+		onlyFailed       bool
+		repeat           bool
+		repeatInterval   time.Duration
+		strictHostKeys   bool
+		acceptNewKeys    bool
+		logFile          string
+		overrides        []string
+		logMaxSize       int
+		logMaxBackups    int
+		since            string
+		hostLock         string
+		waitForLock      time.Duration
 	)
 
 	rootCmd := &cobra.Command{
-		Use: "orchid",
+		Use:           "orchid",
+		SilenceErrors: true,
+		SilenceUsage:  true,
 	}
 
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (required)")
-	rootCmd.PersistentFlags().StringVarP(&env, "environment", "e", "", "environment to deploy (required)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file, or a directory of config files to merge")
+	rootCmd.PersistentFlags().StringVarP(&env, "environment", "e", "", "environment to deploy, defaulting to $ORCHID_ENV or $CI_ENVIRONMENT_NAME; up and down accept a comma-separated list to run several at once")
 	rootCmd.PersistentFlags().BoolVarP(&force, "force", "f", false, "force action")
-	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "dry run mode")
+	rootCmd.PersistentFlags().Var(&dryRunFlag{&dryRun, &validateRemote}, "dry-run", "dry run mode; =validate-remote also checks on each host that the programs commands run exist")
+	rootCmd.PersistentFlags().Lookup("dry-run").NoOptDefVal = "true"
 	rootCmd.PersistentFlags().BoolVar(&handleDeps, "handle-deps", false, "handle dependencies (start/stop)")
 	rootCmd.PersistentFlags().BoolVar(&stopDeps, "stop-deps", false, "stop dependencies in down command")
-	rootCmd.PersistentFlags().DurationVar(&healthCheckWait, "health-check-timeout", 60*time.Second, "Health check timeout")
-	rootCmd.PersistentFlags().DurationVar(&healthCheckRetry, "health-check-interval", 2*time.Second, "Health check retry interval")
-	rootCmd.PersistentFlags().DurationVar(&operationTimeout, "operation-timeout", 5*time.Minute, "Operation timeout")
+	rootCmd.PersistentFlags().BoolVar(&lenientDeps, "lenient-deps", false, "warn instead of failing when a dependency is not running (without --handle-deps)")
+	rootCmd.PersistentFlags().BoolVar(&noRollback, "no-rollback", false, "leave started services in place when up fails")
+	rootCmd.PersistentFlags().IntVar(&rollbackParallel, "rollback-concurrency", 1, "number of services to stop at once during rollback")
+	rootCmd.PersistentFlags().StringVar(&rollbackScope, "rollback-scope", orchestrator.RollbackScopeAll, "what a failed up rolls back: all, or apps to leave the dependencies it started running")
+	rootCmd.PersistentFlags().DurationVar(&healthCheckWait, "health-check-timeout", 60*time.Second, "Health check timeout (overrides the environment's timeouts)")
+	rootCmd.PersistentFlags().DurationVar(&healthCheckRetry, "health-check-interval", 2*time.Second, "Health check retry interval (overrides the environment's timeouts)")
+	rootCmd.PersistentFlags().DurationVar(&operationTimeout, "operation-timeout", 5*time.Minute, "Operation timeout (overrides the environment's timeouts)")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error)")
 	rootCmd.PersistentFlags().BoolVar(&jsonLog, "json", false, "Output logs in JSON format")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "only log warnings and errors, printing a one-line summary of up and down")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Write logs to this file instead of stdout")
+	rootCmd.PersistentFlags().IntVar(&logMaxSize, "log-max-size", 100, "Rotate the log file once it reaches this many megabytes (0 disables)")
+	rootCmd.PersistentFlags().IntVar(&logMaxBackups, "log-max-backups", 3, "Number of rotated log files to keep")
+	rootCmd.PersistentFlags().StringSliceVar(&tags, "tag", nil, "only run steps with any of these tags (dependencies are always included)")
+	rootCmd.PersistentFlags().BoolVar(&allTags, "all-tags", false, "require steps to carry every --tag instead of any")
+	rootCmd.PersistentFlags().StringVar(&stateDir, "state-dir", ".orchid", "directory for orchid state such as maintenance markers")
+	rootCmd.PersistentFlags().StringVar(&hostLock, "host-lock", "", "lock hosts against runs from other environments: fail or wait (default off)")
+	rootCmd.PersistentFlags().DurationVar(&waitForLock, "wait-for-lock", 0, "wait up to this long for host locks held by other runs instead of failing (implies --host-lock wait)")
+	rootCmd.PersistentFlags().BoolVar(&strictHostKeys, "strict-host-keys", false, "verify host keys against known_hosts, rejecting unknown hosts")
+	rootCmd.PersistentFlags().BoolVar(&acceptNewKeys, "accept-new-host-keys", false, "add unknown hosts to known_hosts on first connect but reject changed keys")
+	rootCmd.PersistentFlags().IntVar(&connectAttempts, "connect-attempts", 3, "times to try connecting to a host when it fails in a way that may be transient")
+	rootCmd.PersistentFlags().IntVar(&maxOutput, "max-output", 4, "megabytes of output kept from each remote command, keeping its beginning and end (0 keeps all output)")
+	rootCmd.PersistentFlags().StringVar(&auditFile, "audit-file", "", "append a JSON record of each run to this file")
+	rootCmd.PersistentFlags().BoolVar(&explain, "explain", false, "log a one-line reason for what up and down did with each step")
+	rootCmd.PersistentFlags().StringArrayVar(&overrides, "set", nil, "override a step command for this run of up, down or plan, as step.field=command (repeatable)")
+	rootCmd.PersistentFlags().StringVar(&reportOut, "report-out", "", "write a JSON summary of each up or down run to this file")
+	rootCmd.PersistentFlags().BoolVar(&failOnWarn, "fail-on-warn", false, "fail up and down runs that succeed with warnings, such as a service that did not stop")
+	rootCmd.PersistentFlags().StringVar(&traceFile, "trace", "", "append a JSON-lines transcript of every remote command, its output and exit status to this file")
+	rootCmd.PersistentFlags().BoolVar(&tui, "tui", false, "show a live table of up and down progress instead of logs when stdout is a terminal; logs still go to --log-file")
+	rootCmd.PersistentFlags().StringVar(&ciFormat, "ci-format", "", "fold each step of up and down into a collapsible CI log section: gitlab or github")
+
+	// The progress view redraws stdout in place, so it is only used on a
+	// terminal, and logs that would scroll it away are dropped
+	showTUI := func() bool {
+		return tui && progress.IsTerminal(os.Stdout)
+	}
+
+	newLogger := func() *slog.Logger {
+		var out io.Writer = os.Stdout
+		if logFile != "" {
+			out = logrotate.New(logFile, int64(logMaxSize)*1024*1024, logMaxBackups)
+		} else if showTUI() {
+			out = io.Discard
+		}
+		level := logLevel
+		if quiet {
+			level = "warn"
+		}
+		return setupLogger(level, jsonLog, out)
+	}
 
-	rootCmd.MarkPersistentFlagRequired("config")
-	rootCmd.MarkPersistentFlagRequired("environment")
+	runUp := func(ctx context.Context, cmd *cobra.Command, env string, logger *slog.Logger) error {
+		cfg, err := config.LoadConfig(cfgFile)
+		if err != nil {
+			return &configError{err}
+		}
+		if err := applyOverrides(cfg, env, overrides, logger); err != nil {
+			return &configError{err}
+		}
+
+		opts := orchestrator.Options{
+			Config:       cfg,
+			Environment:  env,
+			Force:        force,
+			DryRun:       dryRun,
+			Logger:       logger,
+			HandleDeps:   handleDeps,
+			LenientDeps:  lenientDeps,
+			NoRollback:   noRollback,
+			Tags:         tags,
+			MatchAllTags: allTags,
+			StateDir:     stateDir,
+			HostLock:     hostLock,
+			LockWait:     waitForLock,
+
+			HostKeyChecking:     hostKeyChecking(strictHostKeys, acceptNewKeys),
+			ConnectAttempts:     connectAttempts,
+			MaxOutput:           maxOutputBytes(maxOutput),
+			Trace:               newTraceWriter(traceFile),
+			OperationTimeout:    flagDuration(cmd, "operation-timeout", operationTimeout),
+			HealthCheckTimeout:  flagDuration(cmd, "health-check-timeout", healthCheckWait),
+			HealthCheckInterval: flagDuration(cmd, "health-check-interval", healthCheckRetry),
+			RollbackConcurrency: rollbackParallel,
+			RollbackScope:       rollbackScope,
+			PlanOut:             planOut,
+			PlanIn:              planIn,
+			Ensure:              ensure,
+			OnlyFailed:          onlyFailed,
+			KeepRunningDeps:     keepRunningDeps,
+			ValidateRemote:      validateRemote,
+			Explain:             explain,
+			ReportOut:           reportOut,
+			FailOnWarn:          failOnWarn,
+		}
+		if auditFile != "" {
+			opts.Audit = audit.NewWriter(auditFile)
+		}
+		if opts.Sections, err = ci.NewSections(os.Stdout, ciFormat); err != nil {
+			return err
+		}
+		if showTUI() {
+			opts.Hooks = progress.NewView(os.Stdout, env, "up").Hooks()
+		}
+		o, err := orchestrator.New(opts)
+		if err != nil {
+			return err
+		}
+		defer o.Close()
+		err = o.Up(ctx)
+		if quiet {
+			printSummary(os.Stdout, o.Report(), err)
+		}
+		return err
+	}
 
 	upCmd := &cobra.Command{
-		Use:   "up",
-		Short: "Start services",
+		Use:     "up",
+		Short:   "Start services",
+		PreRunE: requireFlags("config", "environment"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if reportOut != "" && strings.Contains(env, ",") {
+				return fmt.Errorf("--report-out can only be used with a single environment")
+			}
+			if tui && strings.Contains(env, ",") {
+				return fmt.Errorf("--tui can only be used with a single environment")
+			}
+			if (planOut != "" || planIn != "") && strings.Contains(env, ",") {
+				return fmt.Errorf("--plan-out and --plan-in can only be used with a single environment")
+			}
+			logger := newLogger()
+			if !repeat {
+				return forEachEnvironment(env, logger, func(env string, logger *slog.Logger) error {
+					return runUp(cmd.Context(), cmd, env, logger)
+				})
+			}
+			if !ensure {
+				return fmt.Errorf("--repeat requires --ensure so running services are left alone")
+			}
+			if repeatInterval <= 0 {
+				return fmt.Errorf("--interval must be greater than zero")
+			}
+
+			// Reconcile until signalled, reloading the config each cycle so
+			// changes to the desired state are picked up. A signal during a
+			// cycle stops it before its next step; a second one exits at once.
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				stop()
+			}()
+			for cycle := 1; ; cycle++ {
+				logger.Info("starting reconcile cycle", slog.Int("cycle", cycle))
+				err := forEachEnvironment(env, logger, func(env string, logger *slog.Logger) error {
+					return runUp(ctx, cmd, env, logger)
+				})
+				if err != nil {
+					var cfgErr *configError
+					if errors.As(err, &cfgErr) {
+						return err
+					}
+					logger.Error("reconcile cycle failed", slog.Int("cycle", cycle), slog.String("error", err.Error()))
+				}
+
+				select {
+				case <-ctx.Done():
+					logger.Info("stopping reconciliation")
+					return err
+				case <-time.After(repeatInterval):
+				}
+			}
+		},
+	}
+
+	upCmd.Flags().StringVar(&planOut, "plan-out", "", "write the steps up would run to this file for review (use with --dry-run)")
+	upCmd.Flags().StringVar(&planIn, "plan-in", "", "run the steps of this previously written plan, failing if any has changed since")
+	upCmd.Flags().BoolVar(&onlyFailed, "only-failed", false, "only run the steps that failed in the last up, and the steps they depend on")
+	upCmd.Flags().BoolVar(&ensure, "ensure", false, "only start services that are not running, leaving running ones and command steps alone")
+	upCmd.Flags().BoolVar(&keepRunningDeps, "no-restart-running-deps", false, "leave dependencies that are already running alone instead of restarting them (with --handle-deps)")
+	upCmd.Flags().BoolVar(&repeat, "repeat", false, "keep re-running up every --interval until interrupted")
+	upCmd.Flags().DurationVar(&repeatInterval, "interval", 5*time.Minute, "time between runs with --repeat")
+
+	runDown := func(ctx context.Context, cmd *cobra.Command, env string, logger *slog.Logger) error {
+		cfg, err := config.LoadConfig(cfgFile)
+		if err != nil {
+			return &configError{err}
+		}
+		if err := applyOverrides(cfg, env, overrides, logger); err != nil {
+			return &configError{err}
+		}
+
+		opts := orchestrator.Options{
+			Config:       cfg,
+			Environment:  env,
+			Force:        force,
+			DryRun:       dryRun,
+			Logger:       logger,
+			StopDeps:     stopDeps,
+			Tags:         tags,
+			MatchAllTags: allTags,
+			StateDir:     stateDir,
+			HostLock:     hostLock,
+			LockWait:     waitForLock,
+
+			HostKeyChecking:     hostKeyChecking(strictHostKeys, acceptNewKeys),
+			ConnectAttempts:     connectAttempts,
+			MaxOutput:           maxOutputBytes(maxOutput),
+			Trace:               newTraceWriter(traceFile),
+			OperationTimeout:    flagDuration(cmd, "operation-timeout", operationTimeout),
+			HealthCheckTimeout:  flagDuration(cmd, "health-check-timeout", healthCheckWait),
+			HealthCheckInterval: flagDuration(cmd, "health-check-interval", healthCheckRetry),
+			ValidateRemote:      validateRemote,
+			Explain:             explain,
+			ReportOut:           reportOut,
+			FailOnWarn:          failOnWarn,
+		}
+		if auditFile != "" {
+			opts.Audit = audit.NewWriter(auditFile)
+		}
+		if opts.Sections, err = ci.NewSections(os.Stdout, ciFormat); err != nil {
+			return err
+		}
+		if showTUI() {
+			opts.Hooks = progress.NewView(os.Stdout, env, "down").Hooks()
+		}
+		o, err := orchestrator.New(opts)
+		if err != nil {
+			return err
+		}
+		defer o.Close()
+		err = o.Down(ctx)
+		if quiet {
+			printSummary(os.Stdout, o.Report(), err)
+		}
+		return err
+	}
+
+	downCmd := &cobra.Command{
+		Use:     "down",
+		Short:   "Stop services",
+		PreRunE: requireFlags("config", "environment"),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if reportOut != "" && strings.Contains(env, ",") {
+				return fmt.Errorf("--report-out can only be used with a single environment")
+			}
+			if tui && strings.Contains(env, ",") {
+				return fmt.Errorf("--tui can only be used with a single environment")
+			}
+			return forEachEnvironment(env, newLogger(), func(env string, logger *slog.Logger) error {
+				return runDown(cmd.Context(), cmd, env, logger)
+			})
+		},
+	}
+
+	execCmd := &cobra.Command{
+		Use:     "exec <command>",
+		Short:   "Run an ad-hoc command on a step's hosts",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: requireFlags("config", "environment"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if execStep == "" && !execAllHosts {
+				return fmt.Errorf("one of --step or --all-hosts is required")
+			}
+
 			cfg, err := config.LoadConfig(cfgFile)
 			if err != nil {
-				return err
+				return &configError{err}
 			}
 
-			logger := setupLogger(logLevel, jsonLog)
+			logger := newLogger()
 
-			opts := orchestrator.Options{
+			o, err := orchestrator.New(orchestrator.Options{
 				Config:      cfg,
 				Environment: env,
-				Force:       force,
 				DryRun:      dryRun,
 				Logger:      logger,
-				HandleDeps:  handleDeps,
+
+				HostKeyChecking:     hostKeyChecking(strictHostKeys, acceptNewKeys),
+				ConnectAttempts:     connectAttempts,
+				MaxOutput:           maxOutputBytes(maxOutput),
+				Trace:               newTraceWriter(traceFile),
+				OperationTimeout:    flagDuration(cmd, "operation-timeout", operationTimeout),
+				HealthCheckTimeout:  flagDuration(cmd, "health-check-timeout", healthCheckWait),
+				HealthCheckInterval: flagDuration(cmd, "health-check-interval", healthCheckRetry),
+			})
+			if err != nil {
+				return err
 			}
-			o, err := orchestrator.New(opts)
+
+			results, err := o.Exec(execStep, execAllHosts, args[0])
 			if err != nil {
 				return err
 			}
-			return o.Up()
+
+			failed := 0
+			for _, res := range results {
+				fmt.Fprintf(cmd.OutOrStdout(), "==> %s <==\n%s", res.Host, res.Output)
+				if res.Output != "" && !strings.HasSuffix(res.Output, "\n") {
+					fmt.Fprintln(cmd.OutOrStdout())
+				}
+				if res.Err != nil {
+					failed++
+					fmt.Fprintf(cmd.OutOrStdout(), "error: %v\n", res.Err)
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("command failed on %d of %d hosts", failed, len(results))
+			}
+			return nil
 		},
 	}
-
-	downCmd := &cobra.Command{
-		Use:   "down",
-		Short: "Stop services",
+	logsCmd := &cobra.Command{
+		Use:     "logs",
+		Short:   "Follow a step's logs across its hosts",
+		PreRunE: requireFlags("config", "environment", "step"),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfg, err := config.LoadConfig(cfgFile)
+			if err != nil {
+				return &configError{err}
+			}
+
+			o, err := orchestrator.New(orchestrator.Options{
+				Config:      cfg,
+				Environment: env,
+				DryRun:      dryRun,
+				Logger:      newLogger(),
+
+				HostKeyChecking: hostKeyChecking(strictHostKeys, acceptNewKeys),
+				ConnectAttempts: connectAttempts,
+				MaxOutput:       maxOutputBytes(maxOutput),
+				Trace:           newTraceWriter(traceFile),
+			})
 			if err != nil {
 				return err
 			}
+			defer o.Close()
 
-			logger := setupLogger(logLevel, jsonLog)
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return o.Logs(ctx, logsStep, cmd.OutOrStdout())
+		},
+	}
+	logsCmd.Flags().StringVar(&logsStep, "step", "", "step whose log_command to run")
+
+	execCmd.Flags().StringVar(&execStep, "step", "", "run on the hosts of this step")
+	execCmd.Flags().BoolVar(&execAllHosts, "all-hosts", false, "run on every host in the environment")
 
-			opts := orchestrator.Options{
+	freezeCmd := &cobra.Command{
+		Use:     "freeze",
+		Short:   "Put an environment into maintenance mode, blocking up and down",
+		PreRunE: requireFlags("environment"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return orchestrator.Freeze(stateDir, env, freezeReason)
+		},
+	}
+	freezeCmd.Flags().StringVar(&freezeReason, "reason", "", "why the environment is frozen")
+
+	unfreezeCmd := &cobra.Command{
+		Use:     "unfreeze",
+		Short:   "Take an environment out of maintenance mode",
+		PreRunE: requireFlags("environment"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return orchestrator.Unfreeze(stateDir, env)
+		},
+	}
+
+	abortCmd := &cobra.Command{
+		Use:     "abort",
+		Short:   "Stop a run in progress against an environment and roll it back",
+		PreRunE: requireFlags("environment"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info, err := orchestrator.Abort(stateDir, env, abortReason)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "abort requested for %s %s (pid %d, started by %s at %s); it stops after the current step\n",
+				info.Action, env, info.PID, info.User, info.StartedAt.Format(time.RFC3339))
+			return nil
+		},
+	}
+	abortCmd.Flags().StringVar(&abortReason, "reason", "", "why the run is being aborted")
+
+	auditCmd := &cobra.Command{
+		Use:     "audit",
+		Short:   "Print audit records as JSON lines",
+		PreRunE: requireFlags("audit-file"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			from, err := parseSince(since, time.Now())
+			if err != nil {
+				return err
+			}
+
+			records, err := audit.Read(auditFile, from)
+			if err != nil {
+				return err
+			}
+
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			for _, rec := range records {
+				if env != "" && rec.Environment != env {
+					continue
+				}
+				if err := enc.Encode(rec); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	auditCmd.Flags().StringVar(&since, "since", "", "only show records newer than a duration (1h) or RFC 3339 time")
+
+	checkCmd := &cobra.Command{
+		Use:     "check",
+		Short:   "Run every service's check without starting or stopping anything",
+		PreRunE: requireFlags("config", "environment"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadConfig(cfgFile)
+			if err != nil {
+				return &configError{err}
+			}
+
+			o, err := orchestrator.New(orchestrator.Options{
 				Config:      cfg,
 				Environment: env,
-				Force:       force,
-				DryRun:      dryRun,
-				Logger:      logger,
-				StopDeps:    stopDeps,
+				Logger:      newLogger(),
+
+				HostKeyChecking:     hostKeyChecking(strictHostKeys, acceptNewKeys),
+				ConnectAttempts:     connectAttempts,
+				MaxOutput:           maxOutputBytes(maxOutput),
+				Trace:               newTraceWriter(traceFile),
+				OperationTimeout:    flagDuration(cmd, "operation-timeout", operationTimeout),
+				HealthCheckTimeout:  flagDuration(cmd, "health-check-timeout", healthCheckWait),
+				HealthCheckInterval: flagDuration(cmd, "health-check-interval", healthCheckRetry),
+			})
+			if err != nil {
+				return err
 			}
-			o, err := orchestrator.New(opts)
+
+			results, err := o.Check()
 			if err != nil {
 				return err
 			}
-			return o.Down()
+
+			failed := 0
+			for _, res := range results {
+				if !res.Healthy {
+					failed++
+				}
+			}
+
+			out := cmd.OutOrStdout()
+			if jsonLog {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(results); err != nil {
+					return err
+				}
+			} else {
+				for _, res := range results {
+					status := "PASS"
+					if !res.Healthy {
+						status = "FAIL"
+					}
+					fmt.Fprintf(out, "%s  %-24s %s\n", status, res.Step, res.Host)
+					if res.Error != "" {
+						fmt.Fprintf(out, "      %s\n", res.Error)
+					}
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d of %d checks failed", failed, len(results))
+			}
+			return nil
+		},
+	}
+
+	planCmd := &cobra.Command{
+		Use:     "plan",
+		Short:   "Check each service and show what up would change, without changing anything",
+		PreRunE: requireFlags("config", "environment"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadConfig(cfgFile)
+			if err != nil {
+				return &configError{err}
+			}
+			logger := newLogger()
+			if err := applyOverrides(cfg, env, overrides, logger); err != nil {
+				return &configError{err}
+			}
+
+			o, err := orchestrator.New(orchestrator.Options{
+				Config:       cfg,
+				Environment:  env,
+				Logger:       logger,
+				HandleDeps:   handleDeps,
+				LenientDeps:  lenientDeps,
+				Tags:         tags,
+				MatchAllTags: allTags,
+
+				HostKeyChecking:     hostKeyChecking(strictHostKeys, acceptNewKeys),
+				ConnectAttempts:     connectAttempts,
+				MaxOutput:           maxOutputBytes(maxOutput),
+				Trace:               newTraceWriter(traceFile),
+				OperationTimeout:    flagDuration(cmd, "operation-timeout", operationTimeout),
+				HealthCheckTimeout:  flagDuration(cmd, "health-check-timeout", healthCheckWait),
+				HealthCheckInterval: flagDuration(cmd, "health-check-interval", healthCheckRetry),
+				KeepRunningDeps:     keepRunningDeps,
+			})
+			if err != nil {
+				return err
+			}
+
+			plan, err := o.Plan()
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			if jsonLog {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				return enc.Encode(plan)
+			}
+
+			symbols := map[string]string{
+				orchestrator.PlanStart:   "+",
+				orchestrator.PlanRestart: "~",
+				orchestrator.PlanStop:    "-",
+				orchestrator.PlanVerify:  "=",
+				orchestrator.PlanRun:     ">",
+				orchestrator.PlanFail:    "!",
+			}
+			for _, p := range plan {
+				fmt.Fprintf(out, "%s %-8s %-24s %s\n", symbols[p.Action], p.Action, p.Step, strings.Join(p.Hosts, ","))
+				if p.Reason != "" {
+					fmt.Fprintf(out, "      %s\n", p.Reason)
+				}
+			}
+			return nil
+		},
+	}
+	planCmd.Flags().BoolVar(&keepRunningDeps, "no-restart-running-deps", false, "plan for up run with --no-restart-running-deps")
+
+	graphCmd := &cobra.Command{
+		Use:     "graph",
+		Short:   "Print the environment's step ordering as a Graphviz DOT or Mermaid graph",
+		PreRunE: requireFlags("config", "environment"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadConfig(cfgFile)
+			if err != nil {
+				return &configError{err}
+			}
+
+			e, err := orchestrator.LookupEnvironment(cfg, env)
+			if err != nil {
+				return err
+			}
+
+			switch graphFormat {
+			case "dot":
+				return graph.DOT(cmd.OutOrStdout(), env, e)
+			case "mermaid":
+				return graph.Mermaid(cmd.OutOrStdout(), e)
+			default:
+				return fmt.Errorf("unknown graph format %q: expected dot or mermaid", graphFormat)
+			}
+		},
+	}
+	graphCmd.Flags().StringVar(&graphFormat, "format", "dot", "output format: dot or mermaid")
+
+	schemaCmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema for the configuration file",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(config.Schema())
+		},
+	}
+
+	validateCmd := &cobra.Command{
+		Use:     "validate",
+		Short:   "Check the configuration file without connecting to any host",
+		PreRunE: requireFlags("config"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadConfig(cfgFile)
+			if err != nil {
+				return &configError{err}
+			}
+			if err := cfg.Validate(); err != nil {
+				return &configError{err}
+			}
+
+			for _, w := range cfg.Warnings() {
+				fmt.Fprintf(cmd.OutOrStdout(), "warning: %s\n", w)
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: OK (%d environments)\n", cfgFile, len(cfg.Environments))
+			return nil
 		},
 	}
 
 	rootCmd.AddCommand(upCmd)
 	rootCmd.AddCommand(downCmd)
+	rootCmd.AddCommand(auditCmd)
+	rootCmd.AddCommand(checkCmd)
+	rootCmd.AddCommand(planCmd)
+	rootCmd.AddCommand(execCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(freezeCmd)
+	rootCmd.AddCommand(unfreezeCmd)
+	rootCmd.AddCommand(abortCmd)
+	rootCmd.AddCommand(graphCmd)
+	rootCmd.AddCommand(schemaCmd)
+	rootCmd.AddCommand(validateCmd)
+	return rootCmd
+}
 
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// hostKeyChecking maps the host key flags onto an ssh host key checking mode
+func hostKeyChecking(strict, acceptNew bool) string {
+	switch {
+	case acceptNew:
+		return ssh.HostKeyAcceptNew
+	case strict:
+		return ssh.HostKeyStrict
+	default:
+		return ssh.HostKeyIgnore
+	}
+}
+
+// forEachEnvironment runs fn for each environment in a comma-separated list,
+// concurrently when there are several. Each run logs with its environment's
+// name, and the failures of every run are returned together.
+func forEachEnvironment(envs string, logger *slog.Logger, fn func(env string, logger *slog.Logger) error) error {
+	names := strings.Split(envs, ",")
+	if len(names) == 1 {
+		return fn(envs, logger)
+	}
+
+	seen := make(map[string]bool)
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		if names[i] == "" || seen[names[i]] {
+			return fmt.Errorf("invalid environment list %q: names must be non-empty and distinct", envs)
+		}
+		seen[names[i]] = true
+	}
+
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			envLogger := logger.With(slog.String("environment", name))
+			if err := fn(name, envLogger); err != nil {
+				envLogger.Error("environment failed", slog.String("error", err.Error()))
+				errs[i] = fmt.Errorf("environment %s: %w", name, err)
+			}
+		}(i, name)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// dryRunFlag is --dry-run, which works as a boolean flag but also accepts
+// validate-remote to probe the hosts during the dry run
+type dryRunFlag struct {
+	enabled        *bool
+	validateRemote *bool
+}
+
+func (f *dryRunFlag) String() string {
+	switch {
+	case f.enabled == nil || !*f.enabled:
+		return "false"
+	case *f.validateRemote:
+		return "validate-remote"
+	default:
+		return "true"
+	}
+}
+
+func (f *dryRunFlag) Set(value string) error {
+	if value == "validate-remote" {
+		*f.enabled, *f.validateRemote = true, true
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("expected true, false or validate-remote")
+	}
+	*f.enabled, *f.validateRemote = enabled, false
+	return nil
+}
+
+func (f *dryRunFlag) Type() string { return "mode" }
+
+// flagDuration returns the value of a duration flag only when it was set on
+// the command line, so the environment's configured timeouts and then the
+// orchestrator defaults apply otherwise
+func flagDuration(cmd *cobra.Command, name string, value time.Duration) time.Duration {
+	if !cmd.Flags().Changed(name) {
+		return 0
+	}
+	return value
+}
+
+// newTraceWriter returns a trace writer for path, or nil when tracing is off
+func newTraceWriter(path string) *trace.Writer {
+	if path == "" {
+		return nil
+	}
+	return trace.NewWriter(path)
+}
+
+// applyOverrides applies --set overrides to the environment's steps, warning
+// about each one since the commands run no longer match the reviewed config
+func applyOverrides(cfg *config.Config, env string, overrides []string, logger *slog.Logger) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+	e, err := orchestrator.LookupEnvironment(cfg, env)
+	if err != nil {
+		return err
+	}
+	redactor, err := redact.New(e.Redact)
+	if err != nil {
+		return err
+	}
+	logger = slog.New(redactor.Handler(logger.Handler()))
+
+	for _, override := range overrides {
+		previous, err := cfg.Override(env, override)
+		if err != nil {
+			return err
+		}
+		logger.Warn("overriding step command from the command line",
+			slog.String("override", override),
+			slog.String("previous", previous))
+	}
+	return nil
+}
+
+// maxOutputBytes converts --max-output to Options.MaxOutput, where 0 means
+// unlimited rather than the default
+func maxOutputBytes(mb int) int {
+	if mb <= 0 {
+		return -1
+	}
+	return mb << 20
+}
+
+// flagEnvVars lists, in order of preference, the environment variables that
+// supply a required flag left off the command line
+var flagEnvVars = map[string][]string{
+	"environment": {"ORCHID_ENV", "CI_ENVIRONMENT_NAME"},
+}
+
+// flagFromEnv sets the named flag from the first of its environment
+// variables that is set, reporting whether it found one
+func flagFromEnv(cmd *cobra.Command, name string) (bool, error) {
+	for _, key := range flagEnvVars[name] {
+		if value := os.Getenv(key); value != "" {
+			if err := cmd.Flags().Set(name, value); err != nil {
+				return false, fmt.Errorf("invalid %s from $%s: %w", name, key, err)
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// requireFlags fails unless each named flag was given, either on the
+// command line or, for flags listed in flagEnvVars, by the environment
+func requireFlags(names ...string) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		var missing []string
+		for _, name := range names {
+			if cmd.Flags().Changed(name) {
+				continue
+			}
+			found, err := flagFromEnv(cmd, name)
+			if err != nil {
+				return err
+			}
+			if !found {
+				missing = append(missing, fmt.Sprintf("%q", name))
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("required flag(s) %s not set", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
+
+// parseSince interprets a --since value as either a duration before now or
+// an absolute RFC 3339 time. An empty value means no lower bound.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %q: expected a duration or RFC 3339 time", value)
+	}
+	return t, nil
+}
+
+// Exit codes returned for each category of failure. When an error fits
+// several categories, reportError checks them in the order config, lock,
+// health check, rollback, step, and the first that matches wins.
+const (
+	exitFailure     = 1 // Unclassified failure
+	exitConfig      = 2 // Invalid configuration or unknown environment
+	exitStep        = 3 // A step of the sequence failed and was not rolled back
+	exitLock        = 4 // Another run holds a lock on one of the hosts or the environment
+	exitHealthCheck = 5 // A service never passed its health check
+	exitRolledBack  = 6 // A step failed and the services before it were rolled back
+)
+
+// configError marks errors caused by the configuration file
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string { return e.err.Error() }
+func (e *configError) Unwrap() error { return e.err }
+
+// cliError is the structured form of a failure written with --json
+type cliError struct {
+	Code        int    `json:"code"`
+	Category    string `json:"category"`
+	Message     string `json:"message"`
+	Environment string `json:"environment,omitempty"`
+	Step        string `json:"step,omitempty"`
+	StepNumber  int    `json:"step_number,omitempty"`
+}
+
+// reportError prints err for a human to stderr or, with jsonOut, as a JSON
+// object to stdout, and returns the exit code for its category
+func reportError(stdout, stderr io.Writer, err error, env string, jsonOut bool) int {
+	out := cliError{
+		Code:        exitFailure,
+		Category:    "failure",
+		Message:     err.Error(),
+		Environment: env,
+	}
+
+	var cfgErr *configError
+	var stepErr *orchestrator.StepError
+	if errors.As(err, &stepErr) {
+		out.Step = stepErr.Step
+		out.StepNumber = stepErr.StepNumber
+	}
+
+	switch {
+	case errors.As(err, &cfgErr), errors.Is(err, orchestrator.ErrEnvironmentNotFound):
+		out.Code = exitConfig
+		out.Category = "config"
+	case errors.Is(err, orchestrator.ErrHostLocked), errors.Is(err, orchestrator.ErrRunInProgress):
+		out.Code = exitLock
+		out.Category = "lock"
+	case errors.Is(err, orchestrator.ErrHealthCheckFailed):
+		out.Code = exitHealthCheck
+		out.Category = "health_check"
+	case stepErr != nil && stepErr.RolledBack:
+		out.Code = exitRolledBack
+		out.Category = "rollback"
+	case stepErr != nil:
+		out.Code = exitStep
+		out.Category = "step"
+	}
+
+	if jsonOut {
+		json.NewEncoder(stdout).Encode(out)
+	} else {
+		fmt.Fprintln(stderr, "Error:", out.Message)
+	}
+	return out.Code
+}
+
+// printSummary writes a one-line outcome of an up or down run, which is all
+// --quiet prints apart from warnings and errors
+func printSummary(w io.Writer, report *orchestrator.RunReport, err error) {
+	if report == nil {
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, s := range report.Steps {
+		counts[s.Status]++
+	}
+	outcome := "succeeded"
+	if err != nil {
+		outcome = "failed"
 	}
+	fmt.Fprintf(w, "%s %s %s in %s: %d succeeded, %d skipped, %d failed, %d rolled back\n",
+		report.Action, report.Environment, outcome, report.Duration.Round(time.Millisecond),
+		counts[orchestrator.StepSucceeded], counts[orchestrator.StepSkipped],
+		counts[orchestrator.StepFailed], counts[orchestrator.StepRolledBack])
 }
 
-func setupLogger(logLevel string, jsonLog bool) *slog.Logger {
+func setupLogger(logLevel string, jsonLog bool, out io.Writer) *slog.Logger {
 	var level slog.Level
 	switch logLevel {
 	case "debug":
@@ -133,9 +1039,9 @@ func setupLogger(logLevel string, jsonLog bool) *slog.Logger {
 
 	var handler slog.Handler
 	if jsonLog {
-		handler = slog.NewJSONHandler(os.Stdout, opts)
+		handler = slog.NewJSONHandler(out, opts)
 	} else {
-		handler = slog.NewTextHandler(os.Stdout, opts)
+		handler = slog.NewTextHandler(out, opts)
 	}
 
 	return slog.New(handler)
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"orchid/internal/config"
+	"orchid/internal/logrotate"
+	"orchid/internal/orchestrator"
+)
+
+func TestReportErrorJSON(t *testing.T) {
+	err := &orchestrator.StepError{
+		Environment: "prod",
+		Step:        "web",
+		StepNumber:  3,
+		RolledBack:  true,
+		Err:         errors.New("failed to start service"),
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := reportError(&stdout, &stderr, err, "prod", true)
+	if code != exitRolledBack {
+		t.Errorf("code = %d, want %d", code, exitRolledBack)
+	}
+	if stderr.Len() > 0 {
+		t.Errorf("stderr = %q, want the error only on stdout", stderr.String())
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("stdout is not JSON: %v\n%s", err, stdout.String())
+	}
+	want := map[string]any{
+		"code":        float64(exitRolledBack),
+		"category":    "rollback",
+		"message":     err.Error(),
+		"environment": "prod",
+		"step":        "web",
+		"step_number": float64(3),
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v, want %v", key, got[key], value)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("error = %v, want exactly the fields %v", got, want)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	healthErr := fmt.Errorf("service web: %w", orchestrator.ErrHealthCheckFailed)
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "unclassified", err: errors.New("something broke"), want: exitFailure},
+		{name: "config", err: &configError{errors.New("bad yaml")}, want: exitConfig},
+		{name: "unknown environment", err: fmt.Errorf("prod: %w", orchestrator.ErrEnvironmentNotFound), want: exitConfig},
+		{name: "host locked", err: fmt.Errorf("app1: %w", orchestrator.ErrHostLocked), want: exitLock},
+		{name: "run in progress", err: fmt.Errorf("prod: %w", orchestrator.ErrRunInProgress), want: exitLock},
+		{name: "health check", err: healthErr, want: exitHealthCheck},
+		{name: "rolled back", err: &orchestrator.StepError{Step: "web", RolledBack: true, Err: errors.New("start failed")}, want: exitRolledBack},
+		{name: "step", err: &orchestrator.StepError{Step: "web", Err: errors.New("start failed")}, want: exitStep},
+
+		// An error fitting several categories takes the first in reportError's order
+		{name: "health check wins over rollback", err: &orchestrator.StepError{Step: "web", RolledBack: true, Err: healthErr}, want: exitHealthCheck},
+		{name: "lock wins over step", err: &orchestrator.StepError{Step: "web", Err: orchestrator.ErrHostLocked}, want: exitLock},
+		{name: "config wins over lock", err: &configError{orchestrator.ErrRunInProgress}, want: exitConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if got := reportError(&stdout, &stderr, tt.err, "prod", false); got != tt.want {
+				t.Errorf("exit code = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportErrorHuman(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	reportError(&stdout, &stderr, errors.New("something broke"), "prod", false)
+	if stdout.Len() > 0 {
+		t.Errorf("stdout = %q, want nothing", stdout.String())
+	}
+	if got := strings.TrimSpace(stderr.String()); got != "Error: something broke" {
+		t.Errorf("stderr = %q, want the plain message", got)
+	}
+}
+
+func TestSetupLoggerWritesToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orchid.log")
+	w := logrotate.New(path, 0, 0)
+	defer w.Close()
+
+	setupLogger("info", true, w).Info("deployed", "environment", "prod")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("log file: %v", err)
+	}
+	var entry map[string]any
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("log line %q: %v", data, err)
+	}
+	if entry["msg"] != "deployed" || entry["environment"] != "prod" {
+		t.Errorf("log entry = %v", entry)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "90m", want: now.Add(-90 * time.Minute)},
+		{value: "2024-04-30T08:00:00Z", want: time.Date(2024, 4, 30, 8, 0, 0, 0, time.UTC)},
+		{value: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.value, now)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("parseSince(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestRequiredFlags(t *testing.T) {
+	t.Setenv("ORCHID_ENV", "")
+	t.Setenv("CI_ENVIRONMENT_NAME", "")
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "validate needs only a config", args: []string{"validate", "--config", "orchid.yml"}, want: "orchid.yml: OK"},
+		{name: "validate without a config", args: []string{"validate"}, wantErr: `required flag(s) "config" not set`},
+		{name: "up needs an environment", args: []string{"up", "--config", "orchid.yml"}, wantErr: `required flag(s) "environment" not set`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			cmd := newRootCmd()
+			cmd.SetOut(&out)
+			cmd.SetArgs(tt.args)
+
+			err := cmd.Execute()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute: %v", err)
+			}
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("output = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePrintsWarnings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orchid.yml")
+	err := os.WriteFile(path, []byte(`
+environments:
+  prod:
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - {name: api, type: application, start: run-api, stop: stop-api, check: run-api}
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd := newRootCmd()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"validate", "--config", path})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if want := "warning: environment prod: step api uses the same command for check and start"; !strings.Contains(out.String(), want) {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestFlagDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want time.Duration
+	}{
+		{name: "default left to the environment", want: 0},
+		{name: "set explicitly", args: []string{"--operation-timeout", "1m"}, want: time.Minute},
+		{name: "set to the default", args: []string{"--operation-timeout", "5m"}, want: 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := newRootCmd()
+			if err := cmd.ParseFlags(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			value, err := cmd.Flags().GetDuration("operation-timeout")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := flagDuration(cmd, "operation-timeout", value); got != tt.want {
+				t.Errorf("flagDuration = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForEachEnvironment(t *testing.T) {
+	var logs bytes.Buffer
+	var mu sync.Mutex
+	logger := slog.New(slog.NewJSONHandler(&syncWriter{w: &logs, mu: &mu}, nil))
+
+	errProd := errors.New("prod is broken")
+	var started sync.WaitGroup
+	started.Add(2)
+	err := forEachEnvironment("staging, prod", logger, func(env string, logger *slog.Logger) error {
+		// Neither environment finishes until both have started
+		started.Done()
+		waited := make(chan struct{})
+		go func() { started.Wait(); close(waited) }()
+		select {
+		case <-waited:
+		case <-time.After(5 * time.Second):
+			return errors.New("environments did not run concurrently")
+		}
+
+		logger.Info("deploying", slog.String("ran_as", env))
+		if env == "prod" {
+			return errProd
+		}
+		return nil
+	})
+
+	if !errors.Is(err, errProd) || !strings.Contains(err.Error(), "environment prod: prod is broken") {
+		t.Fatalf("err = %v, want prod's failure attributed to it", err)
+	}
+	if strings.Contains(err.Error(), "staging") {
+		t.Errorf("err = %v, want only the failed environment", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var deployed []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if entry["msg"] == "deploying" {
+			if entry["environment"] != entry["ran_as"] {
+				t.Errorf("log from %v attributed to environment %v", entry["ran_as"], entry["environment"])
+			}
+			deployed = append(deployed, entry["environment"].(string))
+		}
+		if entry["msg"] == "environment failed" && entry["environment"] != "prod" {
+			t.Errorf("failure logged for environment %v, want prod", entry["environment"])
+		}
+	}
+	slices.Sort(deployed)
+	if !slices.Equal(deployed, []string{"prod", "staging"}) {
+		t.Errorf("deployed %q, want both environments", deployed)
+	}
+}
+
+func TestForEachEnvironmentInvalidList(t *testing.T) {
+	for _, envs := range []string{"prod,", "prod,prod", "prod, ,staging"} {
+		called := false
+		err := forEachEnvironment(envs, slog.Default(), func(env string, logger *slog.Logger) error {
+			called = true
+			return nil
+		})
+		if err == nil || called {
+			t.Errorf("forEachEnvironment(%q) = %v, ran %t, want an error before running anything", envs, err, called)
+		}
+	}
+}
+
+// syncWriter serialises writes from concurrent loggers
+type syncWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+func TestApplyOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orchid.yml")
+	err := os.WriteFile(path, []byte(`
+environments:
+  prod:
+    redact: ["token=\\S+"]
+    hosts:
+      app1: {hostname: app1.example.com}
+    sequence:
+      - {name: api, type: application, start: run-api, stop: stop-api, check: check-api}
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	if err := applyOverrides(cfg, "prod", []string{"api.start=run-api token=secret"}, logger); err != nil {
+		t.Fatalf("applyOverrides: %v", err)
+	}
+	if got := cfg.Environments["prod"].Sequence[0].Start; got != "run-api token=secret" {
+		t.Errorf("start = %q, want the override", got)
+	}
+	if !strings.Contains(logs.String(), "level=WARN") || !strings.Contains(logs.String(), "previous=run-api") {
+		t.Errorf("logs = %s, want a warning naming the replaced command", logs.String())
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("logs = %s, want the override redacted", logs.String())
+	}
+
+	if err := applyOverrides(cfg, "prod", []string{"web.start=x"}, logger); err == nil {
+		t.Error("applyOverrides accepted an unknown step")
+	}
+}
+
+func TestEnvironmentFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		vars    map[string]string
+		want    string
+		wantErr string
+	}{
+		{name: "ORCHID_ENV", vars: map[string]string{"ORCHID_ENV": "staging"}, want: "staging"},
+		{name: "CI_ENVIRONMENT_NAME", vars: map[string]string{"CI_ENVIRONMENT_NAME": "review"}, want: "review"},
+		{name: "ORCHID_ENV preferred", vars: map[string]string{"ORCHID_ENV": "staging", "CI_ENVIRONMENT_NAME": "review"}, want: "staging"},
+		{name: "explicit flag wins", args: []string{"--environment", "prod"}, vars: map[string]string{"ORCHID_ENV": "staging", "CI_ENVIRONMENT_NAME": "review"}, want: "prod"},
+		{name: "neither", wantErr: `required flag(s) "environment" not set`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"ORCHID_ENV", "CI_ENVIRONMENT_NAME"} {
+				t.Setenv(key, tt.vars[key])
+			}
+
+			var env string
+			cmd := &cobra.Command{
+				Use:     "up",
+				PreRunE: requireFlags("environment"),
+				RunE:    func(cmd *cobra.Command, args []string) error { return nil },
+			}
+			cmd.Flags().StringVarP(&env, "environment", "e", "", "")
+			cmd.SetArgs(tt.args)
+			cmd.SetOut(io.Discard)
+			cmd.SetErr(io.Discard)
+
+			err := cmd.Execute()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || env != tt.want {
+				t.Errorf("environment = %q, %v, want %q", env, err, tt.want)
+			}
+		})
+	}
+}